@@ -38,14 +38,7 @@ func main() {
 	}
 
 	glog.V(2).Infof("Run cri-containerd grpc server on socket %q", o.SocketPath)
-	service, err := server.NewCRIContainerdService(
-		o.ContainerdEndpoint,
-		o.RootDir,
-		o.NetworkPluginBinDir,
-		o.NetworkPluginConfDir,
-		o.StreamServerAddress,
-		o.StreamServerPort,
-	)
+	service, err := server.NewCRIContainerdService(o.Config)
 	if err != nil {
 		glog.Exitf("Failed to create CRI containerd service %+v: %v", o, err)
 	}
@@ -25,17 +25,32 @@ import (
 
 // CRIContainerdOptions contains cri-containerd command line options.
 type CRIContainerdOptions struct {
+	// Config contains cri-containerd service config.
+	Config
 	// SocketPath is the path to the socket which cri-containerd serves on.
 	SocketPath string
+	// PrintVersion indicates to print version information of cri-containerd.
+	PrintVersion bool
+	// ContainerdConnectionTimeout is the connection timeout for containerd client.
+	ContainerdConnectionTimeout time.Duration
+}
+
+// Config contains cri-containerd service config.
+type Config struct {
 	// RootDir is the root directory path for managing cri-containerd files
 	// (metadata checkpoint etc.)
 	RootDir string
-	// PrintVersion indicates to print version information of cri-containerd.
-	PrintVersion bool
 	// ContainerdEndpoint is the containerd endpoint path.
 	ContainerdEndpoint string
-	// ContainerdConnectionTimeout is the connection timeout for containerd client.
-	ContainerdConnectionTimeout time.Duration
+	// ContainerdRootDir is the root directory path of containerd.
+	ContainerdRootDir string
+	// ContainerdSnapshotter is the containerd snapshotter used to store images
+	// and container rootfs. Empty means the containerd default snapshotter.
+	ContainerdSnapshotter string
+	// ImageFSPath is the backing directory of the snapshotter, which is reported
+	// as the image filesystem. Empty means the snapshotter directory under
+	// ContainerdRootDir.
+	ImageFSPath string
 	// NetworkPluginBinDir is the directory in which the binaries for the plugin is kept.
 	NetworkPluginBinDir string
 	// NetworkPluginConfDir is the directory in which the admin places a CNI conf.
@@ -44,6 +59,99 @@ type CRIContainerdOptions struct {
 	StreamServerAddress string
 	// StreamServerPort is the port streaming server is listening on.
 	StreamServerPort string
+	// StopPodSandboxTimeout is the maximum grace period given to each container
+	// in the sandbox during StopPodSandbox. A container's own termination grace
+	// period is used instead if it is shorter. 0 means containers are killed
+	// immediately.
+	StopPodSandboxTimeout time.Duration
+	// SandboxContainerStopTimeout is the maximum time StopPodSandbox waits for the
+	// sandbox container to exit after it is killed.
+	SandboxContainerStopTimeout time.Duration
+	// NetworkTeardownMaxAttempts is the maximum number of attempts to teardown
+	// sandbox network when StopPodSandbox.
+	NetworkTeardownMaxAttempts int
+	// NetworkReadyTimeout is the maximum time RunPodSandbox waits for the network
+	// plugin to become ready before setting up the network of a non-host-network
+	// sandbox. 0 means RunPodSandbox fails immediately if the network plugin is
+	// not ready.
+	NetworkReadyTimeout time.Duration
+	// PrimaryIPFamily is the ip family, "ipv4" or "ipv6", of the primary ip
+	// address reported for a dual-stack sandbox.
+	PrimaryIPFamily string
+	// AllowedUnsafeSysctls is the list of non-namespaced sysctls (or sysctl patterns
+	// ending with "*") which are allowed to be set for pod sandboxes.
+	AllowedUnsafeSysctls []string
+	// ContainerLogMaxSize is the max size in bytes of a container log file before
+	// it's rotated. 0 disables rotation.
+	ContainerLogMaxSize int64
+	// ContainerLogMaxFiles is the max number of rotated files kept for a container
+	// log file.
+	ContainerLogMaxFiles int
+	// SeccompProfileRoot is the directory relative to which localhost seccomp
+	// profiles are loaded.
+	SeccompProfileRoot string
+	// UserNamespaceUIDMap is the uid mapping "<container id>:<host id>:<size>"
+	// of the user namespace shared by sandboxes and containers. User namespace
+	// is disabled if it's empty.
+	UserNamespaceUIDMap string
+	// UserNamespaceGIDMap is the gid mapping "<container id>:<host id>:<size>"
+	// of the user namespace shared by sandboxes and containers.
+	UserNamespaceGIDMap string
+	// RegistryMirrors are the registry mirrors in the format of
+	// "<registry host>=<endpoint>". Mirrors of a registry are tried in order
+	// before the registry itself when pulling images.
+	RegistryMirrors []string
+	// RegistryCertsDir is the directory containing per-registry tls certificates,
+	// "<dir>/<registry host>/{ca.crt,client.cert,client.key}".
+	RegistryCertsDir string
+	// RegistryTLSSkipVerify is the list of registry hosts whose certificates are
+	// not verified.
+	RegistryTLSSkipVerify []string
+	// InsecureRegistries is the list of registry hosts contacted over plain http.
+	InsecureRegistries []string
+	// RuntimeHandlers are the runtime handlers in the format of
+	// "<handler>=<containerd runtime>". The default runtime is used when a
+	// sandbox doesn't specify a runtime handler.
+	RuntimeHandlers []string
+	// AllowedAnnotations is the list of CRI annotations (or annotation patterns
+	// ending with "*") passed through into the OCI spec annotations of sandbox
+	// and container.
+	AllowedAnnotations []string
+	// SandboxImage is the image used by sandbox container. It's pulled on
+	// startup if it doesn't exist.
+	SandboxImage string
+	// ContentCacheDir is the local content cache directory checked before
+	// fetching image contents from the registry. Cache entries are stored at
+	// <dir>/<algorithm>/<hex>. The cache is disabled if it's empty.
+	ContentCacheDir string
+	// PopulateContentCache enables adding contents fetched from the registry
+	// into the content cache directory.
+	PopulateContentCache bool
+	// ShutdownTimeout is the maximum time to wait for in-flight requests to
+	// finish on shutdown. Requests still running after it are cancelled.
+	ShutdownTimeout time.Duration
+	// DefaultOperationTimeout is the timeout of CRI operations without a
+	// specific timeout. 0 means no timeout.
+	DefaultOperationTimeout time.Duration
+	// OperationTimeouts are the timeouts of specific CRI operations in the
+	// format of "<operation>=<duration>", e.g. "PullImage=1h". 0 means no timeout.
+	OperationTimeouts []string
+	// EnableFSGroupChown enables recursively changing the group of the writable
+	// mounts requested in the chown mounts container annotation to the pod
+	// fsGroup.
+	EnableFSGroupChown bool
+	// CgroupDriver is the cgroup driver, "cgroupfs" or "systemd", used to
+	// create sandbox and container cgroups. It must be the same with kubelet.
+	CgroupDriver string
+	// DefaultPidsLimit is the pids limit of containers not specifying one.
+	// 0 or -1 means unlimited.
+	DefaultPidsLimit int64
+	// DefaultShmSize is the size in bytes of the sandbox shm shared by the
+	// containers of a sandbox not specifying one.
+	DefaultShmSize int64
+	// DefaultRlimits are the rlimits of container processes in the format of
+	// <name>=<soft>:<hard>, which can be overridden by each container.
+	DefaultRlimits []string
 }
 
 // NewCRIContainerdOptions returns a reference to CRIContainerdOptions
@@ -59,18 +167,80 @@ func (c *CRIContainerdOptions) AddFlags(fs *pflag.FlagSet) {
 		"/var/lib/cri-containerd", "Root directory path for cri-containerd managed files (metadata checkpoint etc).")
 	fs.StringVar(&c.ContainerdEndpoint, "containerd-endpoint",
 		"/run/containerd/containerd.sock", "Path to the containerd endpoint.")
+	fs.StringVar(&c.ContainerdRootDir, "containerd-root-dir",
+		"/var/lib/containerd", "Root directory path of containerd.")
+	fs.StringVar(&c.ContainerdSnapshotter, "containerd-snapshotter",
+		"", "The containerd snapshotter used to store images and container rootfs. Empty uses the containerd default snapshotter.")
+	fs.StringVar(&c.ImageFSPath, "image-fs-path",
+		"", "The backing directory of the snapshotter reported as the image filesystem. Empty uses the snapshotter directory under the containerd root directory, assuming overlayfs if no snapshotter is set.")
 	fs.DurationVar(&c.ContainerdConnectionTimeout, "containerd-connection-timeout",
 		2*time.Minute, "Connection timeout for containerd client.")
 	fs.BoolVar(&c.PrintVersion, "version",
 		false, "Print cri-containerd version information and quit.")
 	fs.StringVar(&c.NetworkPluginBinDir, "network-bin-dir",
-		"/etc/cni/net.d", "The directory for putting network binaries.")
+		"/opt/cni/bin", "The directory for putting network binaries.")
 	fs.StringVar(&c.NetworkPluginConfDir, "network-conf-dir",
-		"/opt/cni/bin", "The directory for putting network plugin configuration files.")
+		"/etc/cni/net.d", "The directory for putting network plugin configuration files.")
 	fs.StringVar(&c.StreamServerAddress, "stream-addr",
 		"", "The ip address streaming server is listening on. Default host interface is used if this is empty.")
 	fs.StringVar(&c.StreamServerPort, "stream-port",
 		"10010", "The port streaming server is listening on.")
+	fs.DurationVar(&c.StopPodSandboxTimeout, "stop-pod-sandbox-timeout",
+		0, "The maximum grace period given to each container when stopping a pod sandbox. 0 kills containers immediately.")
+	fs.DurationVar(&c.SandboxContainerStopTimeout, "sandbox-container-stop-timeout",
+		2*time.Minute, "The maximum time to wait for the sandbox container to exit after it is killed when stopping a pod sandbox.")
+	fs.IntVar(&c.NetworkTeardownMaxAttempts, "network-teardown-max-attempts",
+		3, "The maximum number of attempts to teardown pod sandbox network.")
+	fs.DurationVar(&c.NetworkReadyTimeout, "network-ready-timeout",
+		30*time.Second, "The maximum time to wait for the network plugin to become ready when running a non-host-network pod sandbox. 0 fails immediately if the network plugin is not ready.")
+	fs.StringVar(&c.PrimaryIPFamily, "primary-ip-family",
+		"ipv4", "The ip family (ipv4 or ipv6) of the primary ip address reported for a dual-stack pod sandbox. The other addresses are reported as additional ips.")
+	fs.StringSliceVar(&c.AllowedUnsafeSysctls, "allowed-unsafe-sysctls",
+		nil, "Comma-separated list of non-namespaced sysctls or sysctl patterns (ending in \"*\") allowed to be set for pod sandboxes.")
+	fs.Int64Var(&c.ContainerLogMaxSize, "container-log-max-size",
+		0, "The max size in bytes of a container log file before it is rotated. 0 disables log rotation.")
+	fs.IntVar(&c.ContainerLogMaxFiles, "container-log-max-files",
+		5, "The max number of rotated files kept for a container log file.")
+	fs.StringVar(&c.SeccompProfileRoot, "seccomp-profile-root",
+		"/var/lib/kubelet/seccomp", "The directory relative to which localhost seccomp profiles are loaded.")
+	fs.StringVar(&c.UserNamespaceUIDMap, "userns-uid-map",
+		"", "The uid mapping <container id>:<host id>:<size> used to run pods in user namespace. User namespace is disabled if empty.")
+	fs.StringVar(&c.UserNamespaceGIDMap, "userns-gid-map",
+		"", "The gid mapping <container id>:<host id>:<size> used to run pods in user namespace. User namespace is disabled if empty.")
+	fs.StringSliceVar(&c.RegistryMirrors, "registry-mirrors",
+		nil, "Comma-separated list of registry mirrors <registry host>=<endpoint> (e.g. docker.io=https://mirror.gcr.io), tried in order before the registry.")
+	fs.StringVar(&c.RegistryCertsDir, "registry-certs-dir",
+		"/etc/cri-containerd/certs.d", "The directory containing per-registry tls certificates <dir>/<registry host>/{ca.crt,client.cert,client.key}.")
+	fs.StringSliceVar(&c.RegistryTLSSkipVerify, "registry-tls-skip-verify",
+		nil, "Comma-separated list of registry hosts whose tls certificates are not verified.")
+	fs.StringSliceVar(&c.InsecureRegistries, "insecure-registries",
+		nil, "Comma-separated list of registry hosts contacted over plain http.")
+	fs.StringSliceVar(&c.RuntimeHandlers, "runtime-handlers",
+		nil, "Comma-separated list of runtime handlers <handler>=<containerd runtime> (e.g. kata=io.containerd.runtime.v1.kata) selectable by pod sandboxes.")
+	fs.StringSliceVar(&c.AllowedAnnotations, "allowed-annotations",
+		nil, "Comma-separated list of CRI annotations or annotation patterns (ending in \"*\") passed through into the OCI spec annotations.")
+	fs.StringVar(&c.SandboxImage, "sandbox-image",
+		"gcr.io/google_containers/pause:3.0", "The image used by sandbox container, which is pulled on startup if it doesn't exist.")
+	fs.StringVar(&c.ContentCacheDir, "content-cache-dir",
+		"", "Local content cache directory checked before fetching image contents from the registry. Entries are keyed by content digest at <dir>/<algorithm>/<hex>.")
+	fs.BoolVar(&c.PopulateContentCache, "populate-content-cache",
+		false, "Add image contents fetched from the registry into the content cache directory.")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout",
+		30*time.Second, "Maximum time to wait for in-flight requests to finish on shutdown, after which they are cancelled.")
+	fs.DurationVar(&c.DefaultOperationTimeout, "default-operation-timeout",
+		4*time.Minute, "The timeout of CRI operations without a specific timeout. 0 means no timeout.")
+	fs.StringSliceVar(&c.OperationTimeouts, "operation-timeouts",
+		nil, "Comma-separated list of CRI operation timeouts <operation>=<duration> (e.g. PullImage=1h). 0 means no timeout. PullImage defaults to 30m. ExecSync and the operations changing sandboxes or containers default to no timeout.")
+	fs.BoolVar(&c.EnableFSGroupChown, "enable-fs-group-chown",
+		false, "Recursively change the group of writable mounts requested in the chown mounts annotation to the pod fsGroup. Read-only mounts are skipped.")
+	fs.StringVar(&c.CgroupDriver, "cgroup-driver",
+		"cgroupfs", "The cgroup driver used to create sandbox and container cgroups, \"cgroupfs\" or \"systemd\". It must be the same with the kubelet cgroup driver.")
+	fs.Int64Var(&c.DefaultPidsLimit, "default-pids-limit",
+		0, "The maximum number of processes in a container not specifying a pids limit. 0 or -1 means unlimited.")
+	fs.Int64Var(&c.DefaultShmSize, "default-shm-size",
+		64*1024*1024, "The size in bytes of the sandbox /dev/shm shared by the containers of a pod sandbox not specifying one.")
+	fs.StringSliceVar(&c.DefaultRlimits, "default-rlimits",
+		nil, "Comma-separated list of container process rlimits <name>=<soft>:<hard> (e.g. nofile=1024:65536). A single value sets both limits, and \"unlimited\" means no limit. Rlimits not specified are left as the runtime defaults.")
 }
 
 // InitFlags must be called after adding all cli options flags are defined and
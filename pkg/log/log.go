@@ -0,0 +1,148 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package log
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+// Common field keys used across cri-containerd.
+const (
+	// OperationKey is the field key of the CRI operation.
+	OperationKey = "operation"
+	// SandboxIDKey is the field key of the sandbox id.
+	SandboxIDKey = "sandbox"
+	// ContainerIDKey is the field key of the container id.
+	ContainerIDKey = "container"
+	// RequestIDKey is the field key of the request id, which correlates all
+	// logs of a CRI request.
+	RequestIDKey = "request"
+)
+
+// Fields are key/value pairs attached to log messages.
+type Fields map[string]interface{}
+
+// Logger is the logging interface used by cri-containerd. A logger carries
+// fields which are attached to every message it logs.
+type Logger interface {
+	// WithFields returns a logger with the fields added. Existing fields with
+	// the same key are overwritten.
+	WithFields(fields Fields) Logger
+	// V returns a logger logging info messages only when the verbosity level
+	// is enabled, same with glog.V.
+	V(level int) Logger
+	// Infof logs an info message.
+	Infof(format string, args ...interface{})
+	// Warningf logs a warning message.
+	Warningf(format string, args ...interface{})
+	// Errorf logs an error message.
+	Errorf(format string, args ...interface{})
+}
+
+// L is the default logger, which is used when there is no logger in the
+// context. Embedders could replace it to use an alternative logging backend.
+var L Logger = NewGlogLogger()
+
+type loggerKey struct{}
+
+// WithLogger returns a new context with the logger.
+func WithLogger(ctx context.Context, logger Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// WithFields returns a new context with a logger carrying the fields in
+// addition to the fields of the logger in the context.
+func WithFields(ctx context.Context, fields Fields) context.Context {
+	return WithLogger(ctx, G(ctx).WithFields(fields))
+}
+
+// G returns the logger in the context. If there is no logger in the
+// context, the default logger is returned.
+func G(ctx context.Context) Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(Logger); ok {
+		return logger
+	}
+	return L
+}
+
+// glogLogger is a Logger backed by glog.
+type glogLogger struct {
+	fields Fields
+	// verbose indicates whether info messages are enabled.
+	verbose bool
+}
+
+// NewGlogLogger creates a logger backed by glog.
+func NewGlogLogger() Logger {
+	return &glogLogger{verbose: true}
+}
+
+func (g *glogLogger) WithFields(fields Fields) Logger {
+	return &glogLogger{fields: mergeFields(g.fields, fields), verbose: g.verbose}
+}
+
+func (g *glogLogger) V(level int) Logger {
+	return &glogLogger{fields: g.fields, verbose: g.verbose && bool(glog.V(glog.Level(level)))}
+}
+
+func (g *glogLogger) Infof(format string, args ...interface{}) {
+	if !g.verbose {
+		return
+	}
+	glog.InfoDepth(1, FormatMessage(g.fields, format, args...))
+}
+
+func (g *glogLogger) Warningf(format string, args ...interface{}) {
+	glog.WarningDepth(1, FormatMessage(g.fields, format, args...))
+}
+
+func (g *glogLogger) Errorf(format string, args ...interface{}) {
+	glog.ErrorDepth(1, FormatMessage(g.fields, format, args...))
+}
+
+// mergeFields returns a copy of the old fields with the new fields added.
+func mergeFields(old, new Fields) Fields {
+	merged := make(Fields, len(old)+len(new))
+	for k, v := range old {
+		merged[k] = v
+	}
+	for k, v := range new {
+		merged[k] = v
+	}
+	return merged
+}
+
+// FormatMessage formats the message and appends the fields sorted by key,
+// e.g. `message container="id" operation="StartContainer"`.
+func FormatMessage(fields Fields, format string, args ...interface{}) string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, format, args...)
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(&buf, " %s=%q", k, fmt.Sprint(fields[k]))
+	}
+	return buf.String()
+}
@@ -0,0 +1,72 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package log
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestFormatMessage(t *testing.T) {
+	for desc, test := range map[string]struct {
+		fields   Fields
+		format   string
+		args     []interface{}
+		expected string
+	}{
+		"message without fields": {
+			format:   "StartContainer for %q",
+			args:     []interface{}{"test-id"},
+			expected: `StartContainer for "test-id"`,
+		},
+		"fields should be appended sorted by key": {
+			fields: Fields{
+				OperationKey:   "StartContainer",
+				ContainerIDKey: "test-id",
+				SandboxIDKey:   "test-sandbox-id",
+			},
+			format:   "StartContainer returns successfully",
+			expected: `StartContainer returns successfully container="test-id" operation="StartContainer" sandbox="test-sandbox-id"`,
+		},
+		"field values should be quoted": {
+			fields:   Fields{"attempt": 1, "reason": "a b"},
+			format:   "retry",
+			expected: `retry attempt="1" reason="a b"`,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		assert.Equal(t, test.expected, FormatMessage(test.fields, test.format, test.args...))
+	}
+}
+
+func TestLoggerInContext(t *testing.T) {
+	ctx := context.Background()
+	assert.Equal(t, L, G(ctx), "default logger should be returned without logger in context")
+
+	ctx = WithFields(ctx, Fields{OperationKey: "StopContainer"})
+	ctx = WithFields(ctx, Fields{ContainerIDKey: "test-id"})
+	logger, ok := G(ctx).(*glogLogger)
+	assert.True(t, ok)
+	assert.Equal(t, Fields{OperationKey: "StopContainer", ContainerIDKey: "test-id"}, logger.fields)
+
+	// Adding fields to a derived logger should not change the parent logger.
+	child := G(ctx).WithFields(Fields{ContainerIDKey: "other-id"}).(*glogLogger)
+	assert.Equal(t, "other-id", child.fields[ContainerIDKey])
+	assert.Equal(t, "test-id", logger.fields[ContainerIDKey])
+}
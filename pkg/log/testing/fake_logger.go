@@ -0,0 +1,104 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package testing
+
+import (
+	"sync"
+
+	"github.com/kubernetes-incubator/cri-containerd/pkg/log"
+)
+
+// Entry is a message logged by the fake logger.
+type Entry struct {
+	// Level is the severity of the message, "info", "warning" or "error".
+	Level string
+	// Message is the formatted message without fields.
+	Message string
+	// Fields are the fields attached to the message.
+	Fields log.Fields
+}
+
+// fakeLogStore is the entry store shared by a fake logger and all loggers
+// derived from it.
+type fakeLogStore struct {
+	sync.Mutex
+	entries []Entry
+}
+
+// FakeLogger is a fake logger recording all logged messages. All verbosity
+// levels are enabled.
+type FakeLogger struct {
+	store  *fakeLogStore
+	fields log.Fields
+}
+
+var _ log.Logger = &FakeLogger{}
+
+// NewFakeLogger creates a fake logger.
+func NewFakeLogger() *FakeLogger {
+	return &FakeLogger{store: &fakeLogStore{}}
+}
+
+// WithFields returns a fake logger with the fields added, which shares
+// entries with the original logger.
+func (f *FakeLogger) WithFields(fields log.Fields) log.Logger {
+	merged := log.Fields{}
+	for k, v := range f.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return &FakeLogger{store: f.store, fields: merged}
+}
+
+// V returns the fake logger itself.
+func (f *FakeLogger) V(int) log.Logger {
+	return f
+}
+
+// Infof records an info message.
+func (f *FakeLogger) Infof(format string, args ...interface{}) {
+	f.record("info", format, args...)
+}
+
+// Warningf records a warning message.
+func (f *FakeLogger) Warningf(format string, args ...interface{}) {
+	f.record("warning", format, args...)
+}
+
+// Errorf records an error message.
+func (f *FakeLogger) Errorf(format string, args ...interface{}) {
+	f.record("error", format, args...)
+}
+
+// GetEntries returns all recorded entries.
+func (f *FakeLogger) GetEntries() []Entry {
+	f.store.Lock()
+	defer f.store.Unlock()
+	return append([]Entry{}, f.store.entries...)
+}
+
+func (f *FakeLogger) record(level, format string, args ...interface{}) {
+	f.store.Lock()
+	defer f.store.Unlock()
+	f.store.entries = append(f.store.entries, Entry{
+		Level:   level,
+		Message: log.FormatMessage(nil, format, args...),
+		Fields:  f.fields,
+	})
+}
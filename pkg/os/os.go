@@ -17,16 +17,24 @@ limitations under the License.
 package os
 
 import (
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 
+	containerdmount "github.com/containerd/containerd/mount"
 	"github.com/containerd/fifo"
 	"github.com/docker/docker/pkg/mount"
 	"golang.org/x/net/context"
 	"golang.org/x/sys/unix"
 )
 
+// selinuxXattr is the extended attribute storing the selinux label of a file.
+const selinuxXattr = "security.selinux"
+
 // OS collects system level operations that need to be mocked out
 // during tests.
 type OS interface {
@@ -38,6 +46,12 @@ type OS interface {
 	WriteFile(filename string, data []byte, perm os.FileMode) error
 	Mount(source string, target string, fstype string, flags uintptr, data string) error
 	Unmount(target string, flags int) error
+	MountAll(mounts []containerdmount.Mount, target string) error
+	ListMounts(root string) ([]string, error)
+	Relabel(path string, label string) error
+	Chown(path string, uid, gid int) error
+	Statfs(path string) (unix.Statfs_t, error)
+	MountPoint(path string) (string, error)
 }
 
 // RealOS is used to dispatch the real system level operations.
@@ -100,3 +114,90 @@ func (RealOS) Unmount(target string, flags int) error {
 	}
 	return unix.Unmount(target, flags)
 }
+
+// MountAll will call containerd mount.MountAll to mount the snapshot mounts
+// onto the target.
+func (RealOS) MountAll(mounts []containerdmount.Mount, target string) error {
+	return containerdmount.MountAll(mounts, target)
+}
+
+// ListMounts returns all mount points at or under root, deepest first, so
+// that they can be unmounted in order.
+func (RealOS) ListMounts(root string) ([]string, error) {
+	infos, err := mount.GetMounts()
+	if err != nil {
+		return nil, err
+	}
+	root = filepath.Clean(root)
+	var mounts []string
+	for _, info := range infos {
+		if info.Mountpoint == root || strings.HasPrefix(info.Mountpoint, root+"/") {
+			mounts = append(mounts, info.Mountpoint)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(mounts)))
+	return mounts, nil
+}
+
+// Relabel sets the selinux label of path and everything under it. Files on
+// filesystems not supporting selinux labels, e.g. some network filesystems,
+// are skipped.
+func (RealOS) Relabel(path string, label string) error {
+	return filepath.Walk(path, func(p string, _ os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := unix.Lsetxattr(p, selinuxXattr, []byte(label), 0); err != nil {
+			if err == unix.ENOTSUP {
+				return nil
+			}
+			return fmt.Errorf("failed to set label %q on %q: %v", label, p, err)
+		}
+		return nil
+	})
+}
+
+// Chown changes the ownership of path and everything under it. Symlinks
+// themselves are changed instead of their targets. A uid or gid of -1 is
+// left unchanged.
+func (RealOS) Chown(path string, uid, gid int) error {
+	return filepath.Walk(path, func(p string, _ os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := os.Lchown(p, uid, gid); err != nil {
+			return fmt.Errorf("failed to chown %q to %d:%d: %v", p, uid, gid, err)
+		}
+		return nil
+	})
+}
+
+// Statfs will call unix.Statfs to get the filesystem statistics of path.
+func (RealOS) Statfs(path string) (unix.Statfs_t, error) {
+	var buf unix.Statfs_t
+	err := unix.Statfs(path, &buf)
+	return buf, err
+}
+
+// MountPoint returns the mount point of the filesystem path is on.
+func (RealOS) MountPoint(path string) (string, error) {
+	infos, err := mount.GetMounts()
+	if err != nil {
+		return "", err
+	}
+	path = filepath.Clean(path)
+	var mountPoint string
+	for _, info := range infos {
+		mp := info.Mountpoint
+		if path != mp && !strings.HasPrefix(path, strings.TrimSuffix(mp, "/")+"/") {
+			continue
+		}
+		if len(mp) > len(mountPoint) {
+			mountPoint = mp
+		}
+	}
+	if mountPoint == "" {
+		return "", fmt.Errorf("mount point of %q not found", path)
+	}
+	return mountPoint, nil
+}
@@ -21,7 +21,9 @@ import (
 	"os"
 	"sync"
 
+	containerdmount "github.com/containerd/containerd/mount"
 	"golang.org/x/net/context"
+	"golang.org/x/sys/unix"
 
 	osInterface "github.com/kubernetes-incubator/cri-containerd/pkg/os"
 )
@@ -39,16 +41,22 @@ type CalledDetail struct {
 // of the real call.
 type FakeOS struct {
 	sync.Mutex
-	MkdirAllFn  func(string, os.FileMode) error
-	RemoveAllFn func(string) error
-	OpenFifoFn  func(context.Context, string, int, os.FileMode) (io.ReadWriteCloser, error)
-	StatFn      func(string) (os.FileInfo, error)
-	CopyFileFn  func(string, string, os.FileMode) error
-	WriteFileFn func(string, []byte, os.FileMode) error
-	MountFn     func(source string, target string, fstype string, flags uintptr, data string) error
-	UnmountFn   func(target string, flags int) error
-	calls       []CalledDetail
-	errors      map[string]error
+	MkdirAllFn   func(string, os.FileMode) error
+	RemoveAllFn  func(string) error
+	OpenFifoFn   func(context.Context, string, int, os.FileMode) (io.ReadWriteCloser, error)
+	StatFn       func(string) (os.FileInfo, error)
+	CopyFileFn   func(string, string, os.FileMode) error
+	WriteFileFn  func(string, []byte, os.FileMode) error
+	MountFn      func(source string, target string, fstype string, flags uintptr, data string) error
+	UnmountFn    func(target string, flags int) error
+	MountAllFn   func(mounts []containerdmount.Mount, target string) error
+	ListMountsFn func(root string) ([]string, error)
+	RelabelFn    func(path string, label string) error
+	ChownFn      func(path string, uid, gid int) error
+	StatfsFn     func(path string) (unix.Statfs_t, error)
+	MountPointFn func(path string) (string, error)
+	calls        []CalledDetail
+	errors       map[string]error
 }
 
 var _ osInterface.OS = &FakeOS{}
@@ -211,3 +219,81 @@ func (f *FakeOS) Unmount(target string, flags int) error {
 	}
 	return nil
 }
+
+// MountAll is a fake call that invokes MountAllFn or just return nil.
+func (f *FakeOS) MountAll(mounts []containerdmount.Mount, target string) error {
+	f.appendCalls("MountAll", mounts, target)
+	if err := f.getError("MountAll"); err != nil {
+		return err
+	}
+
+	if f.MountAllFn != nil {
+		return f.MountAllFn(mounts, target)
+	}
+	return nil
+}
+
+// ListMounts is a fake call that invokes ListMountsFn or just return nil.
+func (f *FakeOS) ListMounts(root string) ([]string, error) {
+	f.appendCalls("ListMounts", root)
+	if err := f.getError("ListMounts"); err != nil {
+		return nil, err
+	}
+
+	if f.ListMountsFn != nil {
+		return f.ListMountsFn(root)
+	}
+	return nil, nil
+}
+
+// Relabel is a fake call that invokes RelabelFn or just return nil.
+func (f *FakeOS) Relabel(path string, label string) error {
+	f.appendCalls("Relabel", path, label)
+	if err := f.getError("Relabel"); err != nil {
+		return err
+	}
+
+	if f.RelabelFn != nil {
+		return f.RelabelFn(path, label)
+	}
+	return nil
+}
+
+// Chown is a fake call that invokes ChownFn or just return nil.
+func (f *FakeOS) Chown(path string, uid, gid int) error {
+	f.appendCalls("Chown", path, uid, gid)
+	if err := f.getError("Chown"); err != nil {
+		return err
+	}
+
+	if f.ChownFn != nil {
+		return f.ChownFn(path, uid, gid)
+	}
+	return nil
+}
+
+// Statfs is a fake call that invokes StatfsFn or just return empty statistics.
+func (f *FakeOS) Statfs(path string) (unix.Statfs_t, error) {
+	f.appendCalls("Statfs", path)
+	if err := f.getError("Statfs"); err != nil {
+		return unix.Statfs_t{}, err
+	}
+
+	if f.StatfsFn != nil {
+		return f.StatfsFn(path)
+	}
+	return unix.Statfs_t{}, nil
+}
+
+// MountPoint is a fake call that invokes MountPointFn or just return empty path.
+func (f *FakeOS) MountPoint(path string) (string, error) {
+	f.appendCalls("MountPoint", path)
+	if err := f.getError("MountPoint"); err != nil {
+		return "", err
+	}
+
+	if f.MountPointFn != nil {
+		return f.MountPointFn(path)
+	}
+	return "", nil
+}
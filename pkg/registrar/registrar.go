@@ -71,6 +71,15 @@ func (r *Registrar) Reserve(name, key string) error {
 	return nil
 }
 
+// GetKeyByName returns the key reserved for the name.
+func (r *Registrar) GetKeyByName(name string) (string, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	key, exists := r.nameToKey[name]
+	return key, exists
+}
+
 // ReleaseByName releases the reserved name<->key mapping by name.
 // Once released, the name and the key can be reserved again.
 func (r *Registrar) ReleaseByName(name string) {
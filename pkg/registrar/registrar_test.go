@@ -39,6 +39,13 @@ func TestRegistrar(t *testing.T) {
 	assert.Error(r.Reserve("test-name-1", "test-id-conflict"))
 	assert.Error(r.Reserve("test-name-conflict", "test-id-2"))
 
+	t.Logf("should be able to get key by name")
+	key, ok := r.GetKeyByName("test-name-1")
+	assert.True(ok)
+	assert.Equal("test-id-1", key)
+	_, ok = r.GetKeyByName("test-name-unknown")
+	assert.False(ok)
+
 	t.Logf("should be able to release name<->key mapping by key")
 	r.ReleaseByKey("test-id-1")
 
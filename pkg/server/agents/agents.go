@@ -16,7 +16,10 @@ limitations under the License.
 
 package agents
 
-import "io"
+import (
+	"io"
+	"sync"
+)
 
 // StreamType is the type of the stream, stdout/stderr.
 type StreamType string
@@ -43,9 +46,55 @@ type AgentFactory interface {
 	NewContainerLogger(string, StreamType, io.ReadCloser) Agent
 }
 
-type agentFactory struct{}
+type agentFactory struct {
+	// maxLogSize is the max size of a container log file before rotation,
+	// 0 means unlimited.
+	maxLogSize int64
+	// maxLogFiles is the max number of rotated files kept for a container log.
+	maxLogFiles int
+	// lock protects logFiles.
+	lock sync.Mutex
+	// logFiles are the opened container log files indexed by path.
+	logFiles map[string]*logFile
+}
+
+// NewAgentFactory creates a new agent factory. Container log files are rotated
+// once they exceed maxLogSize, and at most maxLogFiles rotated files are kept.
+func NewAgentFactory(maxLogSize int64, maxLogFiles int) AgentFactory {
+	return &agentFactory{
+		maxLogSize:  maxLogSize,
+		maxLogFiles: maxLogFiles,
+		logFiles:    make(map[string]*logFile),
+	}
+}
+
+// acquireLogFile returns the log file at the path, it's opened if not used by
+// any logger yet. The log file should be released with releaseLogFile.
+func (f *agentFactory) acquireLogFile(path string) (*logFile, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if l, ok := f.logFiles[path]; ok {
+		l.refs++
+		return l, nil
+	}
+	l, err := openLogFile(path, f.maxLogSize, f.maxLogFiles)
+	if err != nil {
+		return nil, err
+	}
+	l.refs = 1
+	f.logFiles[path] = l
+	return l, nil
+}
 
-// NewAgentFactory creates a new agent factory.
-func NewAgentFactory() AgentFactory {
-	return &agentFactory{}
+// releaseLogFile releases the log file, and closes it if it's not used by any
+// logger.
+func (f *agentFactory) releaseLogFile(l *logFile) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	l.refs--
+	if l.refs > 0 {
+		return
+	}
+	l.Close() // nolint: errcheck
+	delete(f.logFiles, l.path)
 }
@@ -0,0 +1,145 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agents
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/kubernetes-incubator/cri-containerd/pkg/log"
+)
+
+// logFile is a container log file shared by the loggers of all streams of a
+// container. It rotates the file when it exceeds the max size. All methods are
+// thread-safe, so that log lines are never interleaved or dropped during rotation.
+type logFile struct {
+	mu   sync.Mutex
+	path string
+	// maxSize is the max size of the log file before rotation, 0 means unlimited.
+	maxSize int64
+	// maxFiles is the max number of rotated files kept.
+	maxFiles int
+	file     *os.File
+	size     int64
+	// refs is the number of loggers using the file, it's protected by the
+	// agent factory lock.
+	refs int
+}
+
+// openLogFile opens the log file for append.
+func openLogFile(path string, maxSize int64, maxFiles int) (*logFile, error) {
+	l := &logFile{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// open opens the log file at the path, and sets the current size.
+func (l *logFile) open() error {
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0640)
+	if err != nil {
+		return fmt.Errorf("failed to open log file %q: %v", l.path, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to stat log file %q: %v", l.path, err)
+	}
+	l.file = f
+	l.size = info.Size()
+	return nil
+}
+
+// Write writes one log entry into the log file. The file is rotated before
+// the write if the entry would make it exceed the max size.
+func (l *logFile) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return 0, fmt.Errorf("log file %q is closed", l.path)
+	}
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(p)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			// Keep writing into the current file if rotation fails.
+			log.L.Errorf("Failed to rotate log file %q: %v", l.path, err)
+		}
+	}
+	n, err := l.file.Write(p)
+	l.size += int64(n)
+	return n, err
+}
+
+// rotate renames the current log file to path.1, shifts older rotated files,
+// removes rotated files beyond max files, and opens a fresh log file. Must be
+// called with the lock held.
+func (l *logFile) rotate() error {
+	maxFiles := l.maxFiles
+	if maxFiles < 1 {
+		maxFiles = 1
+	}
+	if err := os.Remove(rotatedLogPath(l.path, maxFiles)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove oldest rotated log file: %v", err)
+	}
+	for i := maxFiles - 1; i > 0; i-- {
+		if err := os.Rename(rotatedLogPath(l.path, i), rotatedLogPath(l.path, i+1)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to shift rotated log file: %v", err)
+		}
+	}
+	if err := os.Rename(l.path, rotatedLogPath(l.path, 1)); err != nil {
+		return fmt.Errorf("failed to rename log file: %v", err)
+	}
+	old := l.file
+	if err := l.open(); err != nil {
+		// Rename the file back, so that the next rotation will retry.
+		os.Rename(rotatedLogPath(l.path, 1), l.path) // nolint: errcheck
+		return err
+	}
+	old.Close()
+	return nil
+}
+
+// Close closes the log file.
+func (l *logFile) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// rotatedLogPath returns the path of the i-th rotated log file.
+func rotatedLogPath(path string, i int) string {
+	return fmt.Sprintf("%s.%d", path, i)
+}
+
+// LogFilePaths returns the paths of the log file and all its rotated files,
+// e.g. for cleanup when the container is removed.
+func LogFilePaths(path string, maxFiles int) []string {
+	if maxFiles < 1 {
+		maxFiles = 1
+	}
+	paths := []string{path}
+	for i := 1; i <= maxFiles; i++ {
+		paths = append(paths, rotatedLogPath(path, i))
+	}
+	return paths
+}
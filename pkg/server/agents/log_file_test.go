@@ -0,0 +1,114 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agents
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogFileRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-log-file")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "container.log")
+
+	l, err := openLogFile(path, 10, 2)
+	require.NoError(t, err)
+	defer l.Close()
+	for _, line := range []string{"line1\n", "line2\n", "line3\n", "line4\n"} {
+		_, err := l.Write([]byte(line))
+		require.NoError(t, err)
+	}
+
+	for file, expected := range map[string]string{
+		path:                    "line4\n",
+		rotatedLogPath(path, 1): "line3\n",
+		rotatedLogPath(path, 2): "line2\n",
+	} {
+		content, err := ioutil.ReadFile(file)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, string(content), file)
+	}
+	_, err = os.Stat(rotatedLogPath(path, 3))
+	assert.True(t, os.IsNotExist(err), "rotated files beyond max files should be removed")
+}
+
+func TestLogFileNoRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-log-file")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "container.log")
+
+	l, err := openLogFile(path, 0, 2)
+	require.NoError(t, err)
+	defer l.Close()
+	for _, line := range []string{"line1\n", "line2\n"} {
+		_, err := l.Write([]byte(line))
+		require.NoError(t, err)
+	}
+	content, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "line1\nline2\n", string(content))
+	_, err = os.Stat(rotatedLogPath(path, 1))
+	assert.True(t, os.IsNotExist(err), "log file should not be rotated without max size")
+}
+
+func TestAgentFactoryShareLogFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-log-file")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "container.log")
+
+	f := NewAgentFactory(0, 0).(*agentFactory)
+	l1, err := f.acquireLogFile(path)
+	require.NoError(t, err)
+	l2, err := f.acquireLogFile(path)
+	require.NoError(t, err)
+	assert.True(t, l1 == l2, "log file should be shared")
+	f.releaseLogFile(l1)
+	_, err = l2.Write([]byte("test"))
+	assert.NoError(t, err, "log file should not be closed while still in use")
+	f.releaseLogFile(l2)
+	assert.Empty(t, f.logFiles)
+	_, err = l2.Write([]byte("test"))
+	assert.Error(t, err, "log file should be closed after released")
+}
+
+func TestLogFilePaths(t *testing.T) {
+	for desc, test := range map[string]struct {
+		maxFiles int
+		expected []string
+	}{
+		"should return log file and rotated files": {
+			maxFiles: 2,
+			expected: []string{"/log", "/log.1", "/log.2"},
+		},
+		"should return at least one rotated file": {
+			maxFiles: 0,
+			expected: []string{"/log", "/log.1"},
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		assert.Equal(t, test.expected, LogFilePaths("/log", test.maxFiles))
+	}
+}
@@ -19,13 +19,11 @@ package agents
 import (
 	"bufio"
 	"bytes"
-	"fmt"
 	"io"
 	"io/ioutil"
-	"os"
 	"time"
 
-	"github.com/golang/glog"
+	"github.com/kubernetes-incubator/cri-containerd/pkg/log"
 )
 
 const (
@@ -39,7 +37,15 @@ const (
 	// POSIX.1 says that write less than PIPE_BUF is atmoic.
 	pipeBufSize = 4096
 	// bufSize is the size of the read buffer.
-	bufSize = pipeBufSize - len(timestampFormat) - len(Stdout) - 2 /*2 delimiter*/ - 1 /*eol*/
+	bufSize = pipeBufSize - len(timestampFormat) - len(Stdout) - len(tagPartial) - 3 /*3 delimiter*/ - 1 /*eol*/
+)
+
+const (
+	// tagPartial is the tag of a partial log line, which is split because it
+	// exceeds the read buffer. The following log line should be appended to it.
+	tagPartial = "P"
+	// tagFull is the tag of a full log line, or the last part of a split line.
+	tagFull = "F"
 )
 
 // sandboxLogger is the log agent used for sandbox.
@@ -63,53 +69,62 @@ func (s *sandboxLogger) Start() error {
 
 // containerLogger is the log agent used for container.
 // It redirect container log into CRI log file, and decorate the log
-// line into CRI defined format.
+// line into CRI defined format: `<timestamp> <stream> <tag> <log>`.
 type containerLogger struct {
-	path   string
-	stream StreamType
-	rc     io.ReadCloser
+	factory *agentFactory
+	path    string
+	stream  StreamType
+	rc      io.ReadCloser
 }
 
-func (*agentFactory) NewContainerLogger(path string, stream StreamType, rc io.ReadCloser) Agent {
+func (f *agentFactory) NewContainerLogger(path string, stream StreamType, rc io.ReadCloser) Agent {
 	return &containerLogger{
-		path:   path,
-		stream: stream,
-		rc:     rc,
+		factory: f,
+		path:    path,
+		stream:  stream,
+		rc:      rc,
 	}
 }
 
 func (c *containerLogger) Start() error {
-	glog.V(4).Infof("Start reading log file %q", c.path)
-	wc, err := os.OpenFile(c.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0640)
+	log.L.V(4).Infof("Start reading log file %q", c.path)
+	// The log file is shared by loggers of all streams of the container.
+	l, err := c.factory.acquireLogFile(c.path)
 	if err != nil {
-		return fmt.Errorf("failed to open log file %q: %v", c.path, err)
+		return err
 	}
-	go c.redirectLogs(wc)
+	go func() {
+		defer c.factory.releaseLogFile(l)
+		c.redirectLogs(l)
+	}()
 	return nil
 }
 
-func (c *containerLogger) redirectLogs(wc io.WriteCloser) {
+func (c *containerLogger) redirectLogs(w io.Writer) {
 	defer c.rc.Close()
-	defer wc.Close()
 	streamBytes := []byte(c.stream)
 	delimiterBytes := []byte{delimiter}
 	r := bufio.NewReaderSize(c.rc, bufSize)
 	for {
 		// TODO(random-liu): Better define CRI log format, and escape newline in log.
-		lineBytes, _, err := r.ReadLine()
+		lineBytes, isPrefix, err := r.ReadLine()
 		if err == io.EOF {
-			glog.V(4).Infof("Finish redirecting log file %q", c.path)
+			log.L.V(4).Infof("Finish redirecting log file %q", c.path)
 			return
 		}
 		if err != nil {
-			glog.Errorf("An error occurred when redirecting log file %q: %v", c.path, err)
+			log.L.Errorf("An error occurred when redirecting log file %q: %v", c.path, err)
 			return
 		}
+		tagBytes := []byte(tagFull)
+		if isPrefix {
+			tagBytes = []byte(tagPartial)
+		}
 		timestampBytes := time.Now().AppendFormat(nil, time.RFC3339Nano)
-		data := bytes.Join([][]byte{timestampBytes, streamBytes, lineBytes}, delimiterBytes)
+		data := bytes.Join([][]byte{timestampBytes, streamBytes, tagBytes, lineBytes}, delimiterBytes)
 		data = append(data, eol)
-		if _, err := wc.Write(data); err != nil {
-			glog.Errorf("Fail to write log line %q: %v", data, err)
+		if _, err := w.Write(data); err != nil {
+			log.L.Errorf("Fail to write log line %q: %v", data, err)
 		}
 		// Continue on write error to drain the input.
 	}
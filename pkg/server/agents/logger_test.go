@@ -27,22 +27,14 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
-// writeCloserBuffer is a writecloser wrapper for bytes.Buffer
-// with a nop closer.
-type writeCloserBuffer struct {
-	*bytes.Buffer
-}
-
-// nop close
-func (*writeCloserBuffer) Close() error { return nil }
-
 func TestRedirectLogs(t *testing.T) {
-	f := NewAgentFactory()
-	// f.NewContainerLogger(
+	f := NewAgentFactory(0, 0)
 	for desc, test := range map[string]struct {
 		input   string
 		stream  StreamType
 		content []string
+		// tags are the expected tags, all log lines should be full if not set.
+		tags []string
 	}{
 		"stdout log": {
 			input:  "test stdout log 1\ntest stdout log 2",
@@ -67,24 +59,51 @@ func TestRedirectLogs(t *testing.T) {
 				strings.Repeat("a", bufSize),
 				strings.Repeat("a", 10),
 			},
+			tags: []string{tagPartial, tagFull},
+		},
+		"very long log": {
+			input:  strings.Repeat("a", 2*bufSize+10) + "\nshort log\n",
+			stream: Stdout,
+			content: []string{
+				strings.Repeat("a", bufSize),
+				strings.Repeat("a", bufSize),
+				strings.Repeat("a", 10),
+				"short log",
+			},
+			tags: []string{tagPartial, tagPartial, tagFull, tagFull},
 		},
 	} {
 		t.Logf("TestCase %q", desc)
 		rc := ioutil.NopCloser(strings.NewReader(test.input))
 		c := f.NewContainerLogger("test-path", test.stream, rc).(*containerLogger)
-		wc := &writeCloserBuffer{bytes.NewBuffer(nil)}
+		wc := bytes.NewBuffer(nil)
 		c.redirectLogs(wc)
 		output := wc.String()
 		lines := strings.Split(output, "\n")
 		lines = lines[:len(lines)-1] // Discard empty string after last \n
 		assert.Len(t, lines, len(test.content))
+		var reassembled []string
+		partial := ""
 		for i := range lines {
-			fields := strings.SplitN(lines[i], string([]byte{delimiter}), 3)
-			require.Len(t, fields, 3)
+			fields := strings.SplitN(lines[i], string([]byte{delimiter}), 4)
+			require.Len(t, fields, 4)
 			_, err := time.Parse(timestampFormat, fields[0])
 			assert.NoError(t, err)
 			assert.EqualValues(t, test.stream, fields[1])
-			assert.Equal(t, test.content[i], fields[2])
+			expectedTag := tagFull
+			if test.tags != nil {
+				expectedTag = test.tags[i]
+			}
+			assert.Equal(t, expectedTag, fields[2])
+			assert.Equal(t, test.content[i], fields[3])
+			assert.True(t, len(lines[i]) < pipeBufSize, "log line should be shorter than PIPE_BUF")
+			// Reassemble log lines like a CRI log reader.
+			partial += fields[3]
+			if fields[2] == tagFull {
+				reassembled = append(reassembled, partial)
+				partial = ""
+			}
 		}
+		assert.Equal(t, strings.Split(strings.TrimSuffix(test.input, "\n"), "\n"), reassembled)
 	}
 }
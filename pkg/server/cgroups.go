@@ -0,0 +1,71 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+const (
+	// cgroupDriverCgroupfs is the cgroup driver managing cgroups directly
+	// through the cgroup filesystem.
+	cgroupDriverCgroupfs = "cgroupfs"
+	// cgroupDriverSystemd is the cgroup driver managing cgroups through systemd.
+	cgroupDriverSystemd = "systemd"
+	// systemdCgroupPrefix is the prefix of the systemd scope units created for
+	// sandboxes and containers.
+	systemdCgroupPrefix = "cri-containerd"
+	// systemdSliceSuffix is the suffix of systemd slice units.
+	systemdSliceSuffix = ".slice"
+)
+
+// validateCgroupDriver returns error if the cgroup driver is not supported.
+func validateCgroupDriver(driver string) error {
+	if driver != cgroupDriverCgroupfs && driver != cgroupDriverSystemd {
+		return fmt.Errorf("unsupported cgroup driver %q, must be %q or %q", driver, cgroupDriverCgroupfs, cgroupDriverSystemd)
+	}
+	return nil
+}
+
+// getCgroupsPath generates the cgroups path of a sandbox or container under
+// the cgroup parent in the format of the cgroup driver, i.e. a cgroup
+// directory for cgroupfs, or "slice:prefix:name" for systemd. It returns
+// error if the cgroup parent is in the format of the other driver, which
+// means kubelet and cri-containerd are configured with different cgroup
+// drivers.
+func getCgroupsPath(cgroupsParent, id, driver string) (string, error) {
+	isSlice := !strings.Contains(cgroupsParent, "/") && strings.HasSuffix(cgroupsParent, systemdSliceSuffix)
+	switch driver {
+	case cgroupDriverSystemd:
+		if !isSlice {
+			return "", grpc.Errorf(codes.InvalidArgument, "cgroup parent %q is not a systemd slice, "+
+				"the kubelet cgroup driver may not be %q", cgroupsParent, driver)
+		}
+		return strings.Join([]string{cgroupsParent, systemdCgroupPrefix, id}, ":"), nil
+	default:
+		if isSlice {
+			return "", grpc.Errorf(codes.InvalidArgument, "cgroup parent %q is a systemd slice, "+
+				"the kubelet cgroup driver may not be %q", cgroupsParent, cgroupDriverCgroupfs)
+		}
+		return filepath.Join(cgroupsParent, id), nil
+	}
+}
@@ -0,0 +1,82 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+func TestGetCgroupsPath(t *testing.T) {
+	testID := "test-id"
+	for desc, test := range map[string]struct {
+		cgroupsParent string
+		driver        string
+		expected      string
+		expectErr     bool
+	}{
+		"should join cgroup parent and id for cgroupfs": {
+			cgroupsParent: "/kubepods/burstable/pod123",
+			driver:        cgroupDriverCgroupfs,
+			expected:      "/kubepods/burstable/pod123/test-id",
+		},
+		"should use cgroupfs if driver is not specified": {
+			cgroupsParent: "/kubepods",
+			expected:      "/kubepods/test-id",
+		},
+		"should allow slice directory in cgroupfs path": {
+			cgroupsParent: "/system.slice",
+			driver:        cgroupDriverCgroupfs,
+			expected:      "/system.slice/test-id",
+		},
+		"should return error for systemd slice with cgroupfs driver": {
+			cgroupsParent: "kubepods-burstable-pod123.slice",
+			driver:        cgroupDriverCgroupfs,
+			expectErr:     true,
+		},
+		"should generate slice:prefix:name for systemd": {
+			cgroupsParent: "kubepods-burstable-pod123.slice",
+			driver:        cgroupDriverSystemd,
+			expected:      "kubepods-burstable-pod123.slice:cri-containerd:test-id",
+		},
+		"should return error for cgroupfs path with systemd driver": {
+			cgroupsParent: "/kubepods/burstable/pod123",
+			driver:        cgroupDriverSystemd,
+			expectErr:     true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		path, err := getCgroupsPath(test.cgroupsParent, testID, test.driver)
+		if test.expectErr {
+			assert.Error(t, err)
+			assert.Equal(t, codes.InvalidArgument, grpc.Code(err))
+			continue
+		}
+		assert.NoError(t, err)
+		assert.Equal(t, test.expected, path)
+	}
+}
+
+func TestValidateCgroupDriver(t *testing.T) {
+	assert.NoError(t, validateCgroupDriver(cgroupDriverCgroupfs))
+	assert.NoError(t, validateCgroupDriver(cgroupDriverSystemd))
+	assert.Error(t, validateCgroupDriver(""))
+	assert.Error(t, validateCgroupDriver("invalid"))
+}
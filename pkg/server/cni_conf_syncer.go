@@ -0,0 +1,200 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/containernetworking/cni/libcni"
+	"github.com/fsnotify/fsnotify"
+	"github.com/kubernetes-incubator/cri-o/pkg/ocicni"
+
+	"github.com/kubernetes-incubator/cri-containerd/pkg/log"
+)
+
+// initCNI creates an ocicni plugin. Note that ocicni.InitCNI takes the cni config
+// directory first, and then the cni plugin binary directories.
+var initCNI = ocicni.InitCNI
+
+// newCNIPluginFunc returns a function which creates a cni plugin loading configs
+// from confDir and plugin binaries from binDir.
+func newCNIPluginFunc(confDir, binDir string) func() (ocicni.CNIPlugin, error) {
+	return func() (ocicni.CNIPlugin, error) {
+		return initCNI(confDir, binDir)
+	}
+}
+
+// cniNetConfSyncer is a cni plugin which watches the cni config directory and
+// reloads the underlying plugin when the config changes. If the new config is
+// invalid, the last good plugin is kept for pod network operations, but Status
+// returns the load error so that NetworkReady is reported false.
+type cniNetConfSyncer struct {
+	sync.RWMutex
+	// plugin is the last successfully loaded cni plugin.
+	plugin ocicni.CNIPlugin
+	// lastSyncErr is the error of the last config reload, nil if it succeeded.
+	lastSyncErr error
+	// confDir is the cni config directory being watched.
+	confDir string
+	// newPlugin creates a cni plugin from the config directory.
+	newPlugin func() (ocicni.CNIPlugin, error)
+	// watcher watches the cni config directory.
+	watcher *fsnotify.Watcher
+}
+
+var _ ocicni.CNIPlugin = &cniNetConfSyncer{}
+
+// newCNINetConfSyncer creates a cni plugin with newPlugin and starts watching the
+// cni config directory. The directory is created if it doesn't exist.
+func newCNINetConfSyncer(confDir string, newPlugin func() (ocicni.CNIPlugin, error)) (*cniNetConfSyncer, error) {
+	plugin, err := newPlugin()
+	if err != nil {
+		return nil, err
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create fsnotify watcher: %v", err)
+	}
+	if err := os.MkdirAll(confDir, 0755); err != nil {
+		watcher.Close() // nolint: errcheck
+		return nil, fmt.Errorf("failed to create cni conf dir %q: %v", confDir, err)
+	}
+	if err := watcher.Add(confDir); err != nil {
+		watcher.Close() // nolint: errcheck
+		return nil, fmt.Errorf("failed to watch cni conf dir %q: %v", confDir, err)
+	}
+	return &cniNetConfSyncer{
+		plugin:    plugin,
+		confDir:   confDir,
+		newPlugin: newPlugin,
+		watcher:   watcher,
+	}, nil
+}
+
+// syncLoop reloads the cni plugin on every change in the cni config directory.
+// It returns when the watcher is closed.
+func (s *cniNetConfSyncer) syncLoop() {
+	for {
+		select {
+		case event, ok := <-s.watcher.Events:
+			if !ok {
+				log.L.Infof("CNI config watcher is closed")
+				return
+			}
+			// Only reload on changes of the directory content. Chmod is ignored.
+			if event.Op&(fsnotify.Create|fsnotify.Write|fsnotify.Remove|fsnotify.Rename) == 0 {
+				continue
+			}
+			log.L.V(4).Infof("Receive cni config event %v", event)
+			if err := s.sync(); err != nil {
+				log.L.Errorf("Failed to reload cni config, keep using the last good config: %v", err)
+			}
+		case err, ok := <-s.watcher.Errors:
+			if !ok {
+				log.L.Infof("CNI config watcher is closed")
+				return
+			}
+			log.L.Errorf("CNI config watcher error: %v", err)
+		}
+	}
+}
+
+// sync validates the cni config and reloads the cni plugin. The current plugin
+// is kept if the config is invalid.
+func (s *cniNetConfSyncer) sync() error {
+	err := validateCNIConfig(s.confDir)
+	var plugin ocicni.CNIPlugin
+	if err == nil {
+		plugin, err = s.newPlugin()
+	}
+	s.Lock()
+	defer s.Unlock()
+	if err != nil {
+		s.lastSyncErr = err
+		return err
+	}
+	s.plugin = plugin
+	s.lastSyncErr = nil
+	return nil
+}
+
+// stop stops watching the cni config directory.
+func (s *cniNetConfSyncer) stop() error {
+	return s.watcher.Close()
+}
+
+// getPlugin returns the current cni plugin.
+func (s *cniNetConfSyncer) getPlugin() ocicni.CNIPlugin {
+	s.RLock()
+	defer s.RUnlock()
+	return s.plugin
+}
+
+// Name returns the name of the current cni plugin.
+func (s *cniNetConfSyncer) Name() string {
+	return s.getPlugin().Name()
+}
+
+// SetUpPod sets up pod network with the current cni plugin.
+func (s *cniNetConfSyncer) SetUpPod(netnsPath string, namespace string, name string, containerID string) error {
+	return s.getPlugin().SetUpPod(netnsPath, namespace, name, containerID)
+}
+
+// TearDownPod tears down pod network with the current cni plugin.
+func (s *cniNetConfSyncer) TearDownPod(netnsPath string, namespace string, name string, containerID string) error {
+	return s.getPlugin().TearDownPod(netnsPath, namespace, name, containerID)
+}
+
+// GetContainerNetworkStatus gets the pod ip with the current cni plugin.
+func (s *cniNetConfSyncer) GetContainerNetworkStatus(netnsPath string, namespace string, name string, containerID string) (string, error) {
+	return s.getPlugin().GetContainerNetworkStatus(netnsPath, namespace, name, containerID)
+}
+
+// Status returns the error of the last config reload if it failed, otherwise
+// the status of the current cni plugin.
+func (s *cniNetConfSyncer) Status() error {
+	s.RLock()
+	plugin, err := s.plugin, s.lastSyncErr
+	s.RUnlock()
+	if err != nil {
+		return fmt.Errorf("failed to load cni config: %v", err)
+	}
+	return plugin.Status()
+}
+
+// validateCNIConfig checks whether a default network can be loaded from the cni
+// config directory. Same with the cni plugin, config files are tried in name
+// order and the first valid one is the default network.
+func validateCNIConfig(confDir string) error {
+	files, err := libcni.ConfFiles(confDir)
+	if err != nil {
+		return fmt.Errorf("failed to list cni config files in %q: %v", confDir, err)
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("no cni config found in %q", confDir)
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		if _, err = libcni.ConfFromFile(file); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("no valid cni config found in %q: %v", confDir, err)
+}
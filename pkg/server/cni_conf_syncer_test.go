@@ -0,0 +1,183 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kubernetes-incubator/cri-o/pkg/ocicni"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	servertesting "github.com/kubernetes-incubator/cri-containerd/pkg/server/testing"
+)
+
+const testCNIConfig = `{"cniVersion": "0.3.1", "name": "test-net", "type": "bridge"}`
+
+func TestValidateCNIConfig(t *testing.T) {
+	for desc, test := range map[string]struct {
+		files     map[string]string
+		expectErr bool
+	}{
+		"should return error if no config is found": {
+			files:     map[string]string{"ignored.txt": testCNIConfig},
+			expectErr: true,
+		},
+		"should return error if all configs are invalid": {
+			files:     map[string]string{"10-invalid.conf": "invalid"},
+			expectErr: true,
+		},
+		"should not return error if any config is valid": {
+			files: map[string]string{
+				"10-invalid.conf": "invalid",
+				"20-valid.conf":   testCNIConfig,
+			},
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		dir, err := ioutil.TempDir("", "cni-conf-test")
+		require.NoError(t, err)
+		for name, content := range test.files {
+			require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+		}
+		err = validateCNIConfig(dir)
+		assert.Equal(t, test.expectErr, err != nil)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestNewCNIPluginFunc(t *testing.T) {
+	original := initCNI
+	defer func() { initCNI = original }()
+	var pluginDir string
+	var cniDirs []string
+	initCNI = func(dir string, dirs ...string) (ocicni.CNIPlugin, error) {
+		pluginDir, cniDirs = dir, dirs
+		return servertesting.NewFakeCNIPlugin(), nil
+	}
+	_, err := newCNIPluginFunc("/test/cni/conf", "/test/cni/bin")()
+	require.NoError(t, err)
+	assert.Equal(t, "/test/cni/conf", pluginDir, "cni config directory should be passed first")
+	assert.Equal(t, []string{"/test/cni/bin"}, cniDirs)
+}
+
+func TestCNINetConfSyncerSync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cni-conf-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	confFile := filepath.Join(dir, "10-test.conf")
+	require.NoError(t, ioutil.WriteFile(confFile, []byte(testCNIConfig), 0644))
+
+	var plugins []*servertesting.FakeCNIPlugin
+	var newPluginErr error
+	s, err := newCNINetConfSyncer(dir, func() (ocicni.CNIPlugin, error) {
+		if newPluginErr != nil {
+			return nil, newPluginErr
+		}
+		plugin := servertesting.NewFakeCNIPlugin()
+		plugins = append(plugins, plugin.(*servertesting.FakeCNIPlugin))
+		return plugin, nil
+	})
+	require.NoError(t, err)
+	defer s.stop() // nolint: errcheck
+	require.Len(t, plugins, 1)
+	assert.NoError(t, s.Status())
+
+	t.Logf("should reload plugin when config is valid")
+	assert.NoError(t, s.sync())
+	require.Len(t, plugins, 2)
+	assert.Equal(t, plugins[1], s.getPlugin().(*servertesting.FakeCNIPlugin))
+	assert.NoError(t, s.Status())
+
+	t.Logf("should keep the last good plugin and report error when config is invalid")
+	require.NoError(t, ioutil.WriteFile(confFile, []byte("invalid"), 0644))
+	assert.Error(t, s.sync())
+	assert.Len(t, plugins, 2)
+	assert.Equal(t, plugins[1], s.getPlugin().(*servertesting.FakeCNIPlugin))
+	assert.Error(t, s.Status())
+	assert.NoError(t, s.SetUpPod("test-netns", "test-ns", "test-name", "test-id"))
+	assert.Contains(t, plugins[1].GetCalledNames(), "SetUpPod", "last good plugin should be used")
+
+	t.Logf("should keep the last good plugin and report error when plugin creation fails")
+	require.NoError(t, ioutil.WriteFile(confFile, []byte(testCNIConfig), 0644))
+	newPluginErr = errors.New("random error")
+	assert.Error(t, s.sync())
+	assert.Equal(t, plugins[1], s.getPlugin().(*servertesting.FakeCNIPlugin))
+	assert.Error(t, s.Status())
+
+	t.Logf("should recover when config becomes valid again")
+	newPluginErr = nil
+	assert.NoError(t, s.sync())
+	require.Len(t, plugins, 3)
+	assert.Equal(t, plugins[2], s.getPlugin().(*servertesting.FakeCNIPlugin))
+	assert.NoError(t, s.Status())
+}
+
+func TestCNINetConfSyncerSyncLoop(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cni-conf-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	reloaded := make(chan struct{}, 10)
+	s, err := newCNINetConfSyncer(dir, func() (ocicni.CNIPlugin, error) {
+		reloaded <- struct{}{}
+		return servertesting.NewFakeCNIPlugin(), nil
+	})
+	require.NoError(t, err)
+	<-reloaded
+	done := make(chan struct{})
+	go func() {
+		s.syncLoop()
+		close(done)
+	}()
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "10-test.conf"), []byte(testCNIConfig), 0644))
+	select {
+	case <-reloaded:
+	case <-time.After(10 * time.Second):
+		t.Fatal("cni plugin should be reloaded on config change")
+	}
+
+	require.NoError(t, s.stop())
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("sync loop should return after watcher is closed")
+	}
+}
+
+func TestNewCNINetConfSyncerCreatesConfDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cni-conf-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	confDir := filepath.Join(dir, "net.d")
+	s, err := newCNINetConfSyncer(confDir, func() (ocicni.CNIPlugin, error) {
+		return servertesting.NewFakeCNIPlugin(), nil
+	})
+	require.NoError(t, err)
+	defer s.stop() // nolint: errcheck
+	info, err := os.Stat(confDir)
+	require.NoError(t, err)
+	assert.True(t, info.IsDir())
+	assert.Equal(t, os.FileMode(0755), info.Mode().Perm(), "cni conf dir should be world readable")
+}
@@ -18,13 +18,78 @@ package server
 
 import (
 	"errors"
+	"fmt"
+	"io"
 
+	"github.com/containerd/containerd/api/services/tasks/v1"
 	"golang.org/x/net/context"
-
+	"k8s.io/client-go/tools/remotecommand"
 	"k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+
+	"github.com/kubernetes-incubator/cri-containerd/pkg/log"
+	cio "github.com/kubernetes-incubator/cri-containerd/pkg/server/io"
 )
 
 // Attach prepares a streaming endpoint to attach to a running container, and returns the address.
-func (c *criContainerdService) Attach(ctx context.Context, r *runtime.AttachRequest) (*runtime.AttachResponse, error) {
-	return nil, errors.New("not implemented")
+func (c *criContainerdService) Attach(ctx context.Context, r *runtime.AttachRequest) (retRes *runtime.AttachResponse, retErr error) {
+	log.G(ctx).V(2).Infof("Attach for %q with tty %v and stdin %v", r.GetContainerId(), r.GetTty(), r.GetStdin())
+	defer func() {
+		if retErr == nil {
+			log.G(ctx).V(2).Infof("Attach for %q returns URL %q", r.GetContainerId(), retRes.Url)
+		}
+	}()
+
+	cntr, err := c.containerStore.Get(r.GetContainerId())
+	if err != nil {
+		return nil, wrapGRPCError(err, "failed to find container in store")
+	}
+	state := cntr.Status.Get().State()
+	if state != runtime.ContainerState_CONTAINER_RUNNING {
+		return nil, fmt.Errorf("container is in %s state", criContainerStateToString(state))
+	}
+	if r.GetStdin() && !cntr.Config.GetStdin() {
+		return nil, errors.New("stdin is not enabled for the container, the container should be created with stdin")
+	}
+	return c.streamServer.GetAttach(r)
+}
+
+// attachContainer attaches to the stdio of the container main process, and
+// handles tty resize.
+func (c *criContainerdService) attachContainer(ctx context.Context, id string, stdin io.Reader, stdout, stderr io.WriteCloser,
+	tty bool, resize <-chan remotecommand.TerminalSize) error {
+	// Get container from our container store.
+	cntr, err := c.containerStore.Get(id)
+	if err != nil {
+		return wrapGRPCError(err, "failed to find container in store")
+	}
+	id = cntr.ID
+
+	state := cntr.Status.Get().State()
+	if state != runtime.ContainerState_CONTAINER_RUNNING {
+		return fmt.Errorf("container is in %s state", criContainerStateToString(state))
+	}
+	if cntr.IO == nil {
+		return fmt.Errorf("container %q io is not available", id)
+	}
+	if stdin != nil && !cntr.Config.GetStdin() {
+		return errors.New("stdin is not enabled for the container")
+	}
+
+	handleResizing(resize, func(size remotecommand.TerminalSize) {
+		if _, err := c.taskService.ResizePty(ctx, &tasks.ResizePtyRequest{
+			ContainerID: id,
+			Width:       uint32(size.Width),
+			Height:      uint32(size.Height),
+		}); err != nil {
+			log.G(ctx).Errorf("Failed to resize task %q console: %v", id, err)
+		}
+	})
+
+	return cntr.IO.Attach(cio.AttachOptions{
+		Stdin:     stdin,
+		Stdout:    stdout,
+		Stderr:    stderr,
+		Tty:       tty,
+		StdinOnce: cntr.Config.GetStdinOnce(),
+	})
 }
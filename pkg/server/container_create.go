@@ -19,30 +19,201 @@ package server
 import (
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/containerd/containerd"
 	"github.com/containerd/containerd/containers"
+	"github.com/docker/docker/pkg/signal"
+	"github.com/gogo/protobuf/proto"
 	prototypes "github.com/gogo/protobuf/types"
-	"github.com/golang/glog"
 	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/opencontainers/runc/libcontainer/devices"
 	runtimespec "github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/opencontainers/runtime-tools/generate"
+	"github.com/opencontainers/runtime-tools/generate/seccomp"
+	"github.com/opencontainers/runtime-tools/validate"
+	"github.com/syndtr/gocapability/capability"
 	"golang.org/x/net/context"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
 
+	"github.com/kubernetes-incubator/cri-containerd/pkg/log"
+	cio "github.com/kubernetes-incubator/cri-containerd/pkg/server/io"
 	containerstore "github.com/kubernetes-incubator/cri-containerd/pkg/store/container"
 )
 
+const (
+	// defaultDevicePermissions is the cgroup permissions of a device if not
+	// specified, which allows read, write and mknod.
+	defaultDevicePermissions = "rwm"
+	// minOOMScoreAdj is the minimum valid oom score adj.
+	minOOMScoreAdj = -1000
+	// maxOOMScoreAdj is the maximum valid oom score adj.
+	maxOOMScoreAdj = 1000
+)
+
+const (
+	// seccompPodAnnotationKey is the sandbox annotation key of the seccomp profile
+	// for all containers in the sandbox.
+	seccompPodAnnotationKey = "seccomp.security.alpha.kubernetes.io/pod"
+	// seccompContainerAnnotationKeyPrefix is the sandbox annotation key prefix of
+	// the seccomp profile for a specific container, which overrides the pod one.
+	seccompContainerAnnotationKeyPrefix = "container.seccomp.security.alpha.kubernetes.io/"
+	// seccompRuntimeDefault is the seccomp profile using the runtime default profile.
+	seccompRuntimeDefault = "runtime/default"
+	// seccompUnconfined is the seccomp profile applying no seccomp filter.
+	seccompUnconfined = "unconfined"
+	// seccompLocalhostPrefix is the prefix of seccomp profiles loaded from file.
+	seccompLocalhostPrefix = "localhost/"
+)
+
+const (
+	// tmpfsMountsAnnotationKey is the container annotation key of memory-backed
+	// mounts. The value is a json map from container path to tmpfsMountOptions.
+	// CRI has no way to specify the medium of a mount, so memory-backed emptyDir
+	// volumes are requested through this annotation.
+	tmpfsMountsAnnotationKey = "io.kubernetes.cri-containerd.tmpfs-mounts"
+	// defaultTmpfsMode is the default permission mode of a tmpfs mount.
+	defaultTmpfsMode = "1777"
+)
+
+const (
+	// chownMountsAnnotationKey is the container annotation key of the mounts
+	// whose host paths should be recursively chowned to the container run-as
+	// user. The value is a json list of container paths. Chown is opt-in per
+	// mount because it walks the whole volume.
+	chownMountsAnnotationKey = "io.kubernetes.cri-containerd.chown-mounts"
+)
+
+const (
+	// cpusetCPUsAnnotationKey is the container annotation key of the initial
+	// cpus the container is pinned to, in the cpuset list format.
+	// TODO: Switch to the CRI cpuset resource fields once the CRI api is bumped.
+	cpusetCPUsAnnotationKey = "io.kubernetes.cri-containerd.cpuset-cpus"
+	// cpusetMemsAnnotationKey is the container annotation key of the initial
+	// memory nodes the container is pinned to, in the cpuset list format.
+	cpusetMemsAnnotationKey = "io.kubernetes.cri-containerd.cpuset-mems"
+)
+
+const (
+	// pidNamespaceModeAnnotationKey is the sandbox annotation key of the pid
+	// namespace mode of the containers in the sandbox, one of the modes below.
+	// TODO: Switch to the CRI namespace mode field once the CRI api is bumped.
+	pidNamespaceModeAnnotationKey = "io.kubernetes.cri-containerd.pid-namespace-mode"
+	// pidNamespaceModePod means all containers share the pid namespace of the
+	// sandbox container, in which the sandbox container is pid 1 and reaps the
+	// orphaned processes of all containers.
+	pidNamespaceModePod = "POD"
+	// pidNamespaceModeContainer means each container has its own pid namespace,
+	// in which the container process is pid 1.
+	pidNamespaceModeContainer = "CONTAINER"
+)
+
+const (
+	// pidsLimitAnnotationKey is the container annotation key of the maximum
+	// number of processes in the container. 0 or -1 means unlimited, which
+	// overrides the node default.
+	// TODO: Switch to the CRI pids limit field once the CRI api is bumped.
+	pidsLimitAnnotationKey = "io.kubernetes.cri-containerd.pids-limit"
+)
+
+const (
+	// mountPropagationAnnotationKey is the container annotation key of mount
+	// propagation modes. The value is a json map from container path to one of
+	// the propagation modes below. Mounts not in the map are private.
+	// TODO: Switch to the CRI mount propagation field once the CRI
+	// api is bumped.
+	mountPropagationAnnotationKey = "io.kubernetes.cri-containerd.mount-propagation"
+	// propagationPrivate means no mount events are propagated.
+	propagationPrivate = "rprivate"
+	// propagationHostToContainer means mount events on the host are propagated
+	// into the container.
+	propagationHostToContainer = "rslave"
+	// propagationBidirectional means mount events are propagated both from the
+	// host into the container and from the container to the host.
+	propagationBidirectional = "rshared"
+)
+
+const (
+	// maskedPathsAnnotationKey is the container annotation key overriding the
+	// default masked paths. The value is a json list of container paths. An
+	// empty list unmasks all paths.
+	// TODO: Switch to the CRI masked paths field once the CRI api is bumped.
+	maskedPathsAnnotationKey = "io.kubernetes.cri-containerd.masked-paths"
+	// readonlyPathsAnnotationKey is the container annotation key overriding the
+	// default readonly paths. The value is a json list of container paths. An
+	// empty list makes all paths writable.
+	readonlyPathsAnnotationKey = "io.kubernetes.cri-containerd.readonly-paths"
+)
+
+var (
+	// defaultMaskedPaths are the paths masked in non-privileged containers by
+	// default, same with the runtime default expected by kubelet.
+	defaultMaskedPaths = []string{
+		"/proc/acpi",
+		"/proc/kcore",
+		"/proc/keys",
+		"/proc/latency_stats",
+		"/proc/timer_list",
+		"/proc/timer_stats",
+		"/proc/sched_debug",
+		"/proc/scsi",
+		"/sys/firmware",
+	}
+	// defaultReadonlyPaths are the paths mounted readonly in non-privileged
+	// containers by default, same with the runtime default expected by kubelet.
+	defaultReadonlyPaths = []string{
+		"/proc/asound",
+		"/proc/bus",
+		"/proc/fs",
+		"/proc/irq",
+		"/proc/sys",
+		"/proc/sysrq-trigger",
+	}
+)
+
+// tmpfsMountOptions is the options of a memory-backed mount.
+type tmpfsMountOptions struct {
+	// Size is the size limit of the tmpfs, e.g. "64Mi". The container memory
+	// limit is used as the size cap if it is specified.
+	Size string `json:"size,omitempty"`
+	// Mode is the octal permission mode of the tmpfs root, e.g. "1777".
+	Mode string `json:"mode,omitempty"`
+}
+
+const (
+	// apparmorContainerAnnotationKeyPrefix is the sandbox annotation key prefix of
+	// the apparmor profile for a specific container.
+	apparmorContainerAnnotationKeyPrefix = "container.apparmor.security.beta.kubernetes.io/"
+	// apparmorRuntimeDefault is the apparmor profile using the runtime default profile.
+	apparmorRuntimeDefault = "runtime/default"
+	// apparmorUnconfined is the apparmor profile applying no apparmor confinement.
+	apparmorUnconfined = "unconfined"
+	// apparmorLocalhostPrefix is the prefix of apparmor profiles loaded on the host.
+	apparmorLocalhostPrefix = "localhost/"
+	// defaultApparmorProfile is the name of the runtime default apparmor profile,
+	// which should be loaded on the host.
+	defaultApparmorProfile = "cri-containerd-default"
+	// apparmorEnabledFile is the file indicating whether apparmor is enabled.
+	apparmorEnabledFile = "/sys/module/apparmor/parameters/enabled"
+)
+
 // CreateContainer creates a new container in the given PodSandbox.
 func (c *criContainerdService) CreateContainer(ctx context.Context, r *runtime.CreateContainerRequest) (retRes *runtime.CreateContainerResponse, retErr error) {
-	glog.V(2).Infof("CreateContainer within sandbox %q with container config %+v and sandbox config %+v",
+	log.G(ctx).V(2).Infof("CreateContainer within sandbox %q with container config %+v and sandbox config %+v",
 		r.GetPodSandboxId(), r.GetConfig(), r.GetSandboxConfig())
 	defer func() {
 		if retErr == nil {
-			glog.V(2).Infof("CreateContainer returns container id %q", retRes.GetContainerId())
+			log.G(ctx).V(2).Infof("CreateContainer returns container id %q", retRes.GetContainerId())
 		}
 	}()
 
@@ -50,9 +221,13 @@ func (c *criContainerdService) CreateContainer(ctx context.Context, r *runtime.C
 	sandboxConfig := r.GetSandboxConfig()
 	sandbox, err := c.sandboxStore.Get(r.GetPodSandboxId())
 	if err != nil {
-		return nil, fmt.Errorf("failed to find sandbox id %q: %v", r.GetPodSandboxId(), err)
+		return nil, wrapGRPCError(err, "failed to find sandbox id %q", r.GetPodSandboxId())
 	}
 	sandboxID := sandbox.ID
+	runtimeInfo, err := c.getContainerRuntime(sandbox, config)
+	if err != nil {
+		return nil, wrapGRPCError(err, "failed to get container runtime")
+	}
 
 	// Generate unique id and name for the container and reserve the name.
 	// Reserve the container name to avoid concurrent `CreateContainer` request creating
@@ -60,7 +235,19 @@ func (c *criContainerdService) CreateContainer(ctx context.Context, r *runtime.C
 	id := generateID()
 	name := makeContainerName(config.GetMetadata(), sandboxConfig.GetMetadata())
 	if err = c.containerNameIndex.Reserve(name, id); err != nil {
-		return nil, fmt.Errorf("failed to reserve container name %q: %v", name, err)
+		// The name contains the attempt, so a conflict with a created container
+		// in the same sandbox and of the same config means the request is a
+		// retry, e.g. after a timeout. Return the existing container instead of
+		// failing the retry, otherwise the container would be orphaned.
+		if existingID, ok := c.containerNameIndex.GetKeyByName(name); ok {
+			if existing, err := c.containerStore.Get(existingID); err == nil &&
+				c.isRetriedCreateRequest(ctx, existing, sandboxID, config) {
+				log.G(ctx).Warningf("Container %q already exists for name %q, return it for the retried request",
+					existingID, name)
+				return &runtime.CreateContainerResponse{ContainerId: existingID}, nil
+			}
+		}
+		return nil, grpc.Errorf(codes.AlreadyExists, "failed to reserve container name %q: %v", name, err)
 	}
 	defer func() {
 		// Release the name if the function returns with an error.
@@ -71,10 +258,15 @@ func (c *criContainerdService) CreateContainer(ctx context.Context, r *runtime.C
 
 	// Create initial internal container metadata.
 	meta := containerstore.Metadata{
-		ID:        id,
-		Name:      name,
-		SandboxID: sandboxID,
-		Config:    config,
+		ID:           id,
+		Name:         name,
+		SandboxID:    sandboxID,
+		Config:       config,
+		RestartCount: c.getContainerRestartCount(sandboxID, config.GetMetadata()),
+	}
+	// Only generate container log path when it is specified.
+	if config.GetLogPath() != "" {
+		meta.LogPath = filepath.Join(sandbox.Config.GetLogDirectory(), config.GetLogPath())
 	}
 
 	// Prepare container image snapshot. For container, the image should have
@@ -88,36 +280,80 @@ func (c *criContainerdService) CreateContainer(ctx context.Context, r *runtime.C
 		return nil, fmt.Errorf("image %q not found", imageRef)
 	}
 
-	// Generate container runtime spec.
-	mounts := c.generateContainerMounts(getSandboxRootDir(c.rootDir, sandboxID), config)
-	spec, err := c.generateContainerSpec(id, sandbox.Pid, config, sandboxConfig, image.Config, mounts)
+	// Generate container selinux labels.
+	processLabel, mountLabel, err := c.getContainerSelinuxLabels(sandbox.ProcessLabel, sandbox.MountLabel,
+		config.GetLinux().GetSecurityContext().GetSelinuxOptions())
 	if err != nil {
-		return nil, fmt.Errorf("failed to generate container %q spec: %v", id, err)
+		return nil, fmt.Errorf("failed to get container selinux labels: %v", err)
 	}
-	rawSpec, err := json.Marshal(spec)
+
+	// Generate container runtime spec.
+	mounts := c.generateContainerMounts(getSandboxRootDir(c.rootDir, sandboxID), sandboxConfig, config)
+	spec, err := c.generateContainerSpec(id, sandbox.Pid, config, sandboxConfig, image.Config, mounts,
+		processLabel, mountLabel)
 	if err != nil {
-		return nil, fmt.Errorf("failed to marshal oci spec %+v: %v", spec, err)
+		return nil, wrapGRPCError(err, "failed to generate container %q spec", id)
 	}
-	glog.V(4).Infof("Container spec: %+v", spec)
 
 	// Prepare container rootfs.
-	if config.GetLinux().GetSecurityContext().GetReadonlyRootfs() {
-		if _, err := c.snapshotService.View(ctx, id, image.ChainID); err != nil {
-			return nil, fmt.Errorf("failed to view container rootfs %q: %v", image.ChainID, err)
-		}
-	} else {
-		if _, err := c.snapshotService.Prepare(ctx, id, image.ChainID); err != nil {
-			return nil, fmt.Errorf("failed to prepare container rootfs %q: %v", image.ChainID, err)
-		}
+	rootfsParent, err := c.getRootfsParent(ctx, image.ChainID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get container rootfs parent of %q: %v", image.ChainID, err)
 	}
+	// Register the cleanup before preparing the snapshot, because the snapshot
+	// may have been created even if the prepare returns error, e.g. timeout.
 	defer func() {
 		if retErr != nil {
-			if err := c.snapshotService.Remove(ctx, id); err != nil {
-				glog.Errorf("Failed to remove container snapshot %q: %v", id, err)
+			if err := c.snapshotService.Remove(ctx, id); err != nil && !isContainerdGRPCNotFoundError(err) {
+				log.G(ctx).Errorf("Failed to remove container snapshot %q: %v", id, err)
 			}
 		}
 	}()
+	if config.GetLinux().GetSecurityContext().GetReadonlyRootfs() {
+		if _, err := c.snapshotService.View(ctx, id, rootfsParent); err != nil {
+			return nil, fmt.Errorf("failed to view container rootfs %q: %v", rootfsParent, err)
+		}
+	} else {
+		if _, err := c.snapshotService.Prepare(ctx, id, rootfsParent); err != nil {
+			return nil, fmt.Errorf("failed to prepare container rootfs %q: %v", rootfsParent, err)
+		}
+	}
+
+	// Resolve the process user after the rootfs is prepared, because user and
+	// group names are looked up in the image.
+	user, err := c.getContainerUser(ctx, id, config, image.Config)
+	if err != nil {
+		return nil, wrapGRPCError(err, "failed to resolve container %q user", id)
+	}
+	if err := validateRunAsNonRoot(config, user.UID); err != nil {
+		return nil, err
+	}
+	// Relabel and chown mounts only after the spec is generated and the user is
+	// resolved, so that an invalid request doesn't modify host paths, and the
+	// mounts are owned by the user the container actually runs as.
+	if err := c.relabelMounts(config.GetMounts(), mountLabel); err != nil {
+		return nil, err
+	}
+	if err := c.chownMounts(sandboxConfig, config, user.UID); err != nil {
+		return nil, err
+	}
+	spec.Process.User.UID = user.UID
+	spec.Process.User.GID = user.GID
+	spec.Process.User.AdditionalGids = mergeGids(spec.Process.User.AdditionalGids, user.AdditionalGids)
+	rawSpec, err := json.Marshal(spec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal oci spec %+v: %v", spec, err)
+	}
+	log.G(ctx).V(4).Infof("Container spec: %+v", spec)
 	meta.ImageRef = image.ID
+	// Validate the stop signal in image config, so that invalid stop signal fails
+	// the container creation instead of the container stop.
+	if stopSignal := image.Config.StopSignal; stopSignal != "" {
+		if _, err := signal.ParseSignal(stopSignal); err != nil {
+			return nil, fmt.Errorf("failed to parse stop signal %q: %v", stopSignal, err)
+		}
+		meta.StopSignal = stopSignal
+	}
 
 	// Create container root directory.
 	containerRootDir := getContainerRootDir(c.rootDir, id)
@@ -129,18 +365,26 @@ func (c *criContainerdService) CreateContainer(ctx context.Context, r *runtime.C
 		if retErr != nil {
 			// Cleanup the container root directory.
 			if err = c.os.RemoveAll(containerRootDir); err != nil {
-				glog.Errorf("Failed to remove container root directory %q: %v",
+				log.G(ctx).Errorf("Failed to remove container root directory %q: %v",
 					containerRootDir, err)
 			}
 		}
 	}()
 
+	// Checkpoint metadata into container labels.
+	data, err := meta.Encode()
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode container metadata: %v", err)
+	}
 	// Create containerd container.
 	if _, err = c.containerService.Create(ctx, containers.Container{
 		ID: id,
-		// TODO(random-liu): Checkpoint metadata into container labels.
+		Labels: map[string]string{
+			containerKindLabel:     containerKindContainer,
+			containerMetadataLabel: string(data),
+		},
 		Image:   image.ID,
-		Runtime: containers.RuntimeInfo{Name: defaultRuntime},
+		Runtime: runtimeInfo,
 		Spec: &prototypes.Any{
 			TypeUrl: runtimespec.Version,
 			Value:   rawSpec,
@@ -152,12 +396,16 @@ func (c *criContainerdService) CreateContainer(ctx context.Context, r *runtime.C
 	defer func() {
 		if retErr != nil {
 			if err := c.containerService.Delete(ctx, id); err != nil {
-				glog.Errorf("Failed to delete containerd container %q: %v", id, err)
+				log.G(ctx).Errorf("Failed to delete containerd container %q: %v", id, err)
 			}
 		}
 	}()
 
-	container, err := containerstore.NewContainer(meta, containerstore.Status{CreatedAt: time.Now().UnixNano()})
+	container, err := containerstore.NewContainer(meta,
+		containerstore.Status{CreatedAt: time.Now().UnixNano()},
+		containerstore.WithContainerIO(cio.NewContainerIO(id)),
+		containerstore.WithStatusCheckpoint(containerRootDir),
+	)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create internal container object for %q: %v",
 			id, err)
@@ -166,7 +414,7 @@ func (c *criContainerdService) CreateContainer(ctx context.Context, r *runtime.C
 		if retErr != nil {
 			// Cleanup container checkpoint on error.
 			if err := container.Delete(); err != nil {
-				glog.Errorf("Failed to cleanup container checkpoint for %q: %v", id, err)
+				log.G(ctx).Errorf("Failed to cleanup container checkpoint for %q: %v", id, err)
 			}
 		}
 	}()
@@ -179,8 +427,26 @@ func (c *criContainerdService) CreateContainer(ctx context.Context, r *runtime.C
 	return &runtime.CreateContainerResponse{ContainerId: id}, nil
 }
 
+// getContainerRestartCount returns the restart count of a new container, which is one
+// more than the largest restart count of the containers with the same name in the
+// sandbox. The attempt in the container metadata is used if it's larger, e.g. when
+// the previous containers have been removed.
+func (c *criContainerdService) getContainerRestartCount(sandboxID string, metadata *runtime.ContainerMetadata) uint32 {
+	count := metadata.GetAttempt()
+	for _, cntr := range c.containerStore.List() {
+		if cntr.SandboxID != sandboxID || cntr.Config.GetMetadata().GetName() != metadata.GetName() {
+			continue
+		}
+		if cntr.RestartCount+1 > count {
+			count = cntr.RestartCount + 1
+		}
+	}
+	return count
+}
+
 func (c *criContainerdService) generateContainerSpec(id string, sandboxPid uint32, config *runtime.ContainerConfig,
-	sandboxConfig *runtime.PodSandboxConfig, imageConfig *imagespec.ImageConfig, extraMounts []*runtime.Mount) (*runtimespec.Spec, error) {
+	sandboxConfig *runtime.PodSandboxConfig, imageConfig *imagespec.ImageConfig, extraMounts []*runtime.Mount,
+	processLabel, mountLabel string) (*runtimespec.Spec, error) {
 	// Creates a spec Generator with the default spec.
 	spec, err := containerd.GenerateSpec()
 	if err != nil {
@@ -208,30 +474,77 @@ func (c *criContainerdService) generateContainerSpec(id string, sandboxPid uint3
 	}
 
 	// Apply envs from image config first, so that envs from container config
-	// can override them.
+	// can override them. Envs not overridden, e.g. the image PATH, are kept. The
+	// last value wins if a key is duplicated.
 	if err := addImageEnvs(&g, imageConfig.Env); err != nil {
 		return nil, err
 	}
 	for _, e := range config.GetEnvs() {
+		if e.GetKey() == "" {
+			return nil, grpc.Errorf(codes.InvalidArgument, "invalid environment variable with empty key and value %q",
+				e.GetValue())
+		}
 		g.AddProcessEnv(e.GetKey(), e.GetValue())
 	}
 
-	// TODO: add setOCIPrivileged group all privileged logic together
 	securityContext := config.GetLinux().GetSecurityContext()
+	// A privileged container gets all host devices and capabilities, and is not
+	// confined by default masked paths, apparmor or seccomp. It's only allowed
+	// in a privileged sandbox.
+	if securityContext.GetPrivileged() && !sandboxConfig.GetLinux().GetSecurityContext().GetPrivileged() {
+		return nil, grpc.Errorf(codes.InvalidArgument, "no privileged container allowed in non-privileged sandbox")
+	}
+
+	tmpfsMounts, err := getTmpfsMounts(config.GetAnnotations(), config.GetLinux().GetResources().GetMemoryLimitInBytes())
+	if err != nil {
+		return nil, err
+	}
+
+	propagations, err := getMountPropagations(config.GetAnnotations())
+	if err != nil {
+		return nil, err
+	}
 
 	// Add extra mounts first so that CRI specified mounts can override.
-	addOCIBindMounts(&g, append(extraMounts, config.GetMounts()...), securityContext.GetPrivileged())
+	bindMounts := filterTmpfsMounts(append(extraMounts, config.GetMounts()...), tmpfsMounts)
+	addOCIBindMounts(&g, bindMounts, propagations, securityContext.GetPrivileged())
+	addOCITmpfsMounts(&g, tmpfsMounts)
 
 	g.SetRootReadonly(securityContext.GetReadonlyRootfs())
 
+	if err := setOCIMaskedReadonlyPaths(&g, config.GetAnnotations(), securityContext.GetPrivileged()); err != nil {
+		return nil, err
+	}
+
 	if err := addOCIDevices(&g, config.GetDevices(), securityContext.GetPrivileged()); err != nil {
-		return nil, fmt.Errorf("failed to set devices mapping %+v: %v", config.GetDevices(), err)
+		return nil, wrapGRPCError(err, "failed to set devices mapping %+v", config.GetDevices())
 	}
 
 	setOCILinuxResource(&g, config.GetLinux().GetResources())
+	pidsLimit, err := getPidsLimit(config.GetAnnotations(), c.config.DefaultPidsLimit)
+	if err != nil {
+		return nil, err
+	}
+	setOCIPidsLimit(&g, pidsLimit)
+	rlimits, err := getRlimits(config.GetAnnotations(), c.defaultRlimits)
+	if err != nil {
+		return nil, err
+	}
+	setOCIRlimits(&g, rlimits)
+	if err := setOCICPUSet(&g, getContainerCPUSet(config.GetAnnotations())); err != nil {
+		return nil, err
+	}
+	hugepageLimits, err := getHugepageLimits(config.GetAnnotations())
+	if err != nil {
+		return nil, err
+	}
+	setOCIHugepageLimits(&g, hugepageLimits)
 
 	if sandboxConfig.GetLinux().GetCgroupParent() != "" {
-		cgroupsPath := getCgroupsPath(sandboxConfig.GetLinux().GetCgroupParent(), id)
+		cgroupsPath, err := getCgroupsPath(sandboxConfig.GetLinux().GetCgroupParent(), id, c.config.CgroupDriver)
+		if err != nil {
+			return nil, err
+		}
 		g.SetLinuxCgroupsPath(cgroupsPath)
 	}
 
@@ -240,28 +553,76 @@ func (c *criContainerdService) generateContainerSpec(id string, sandboxPid uint3
 			securityContext.GetCapabilities(), err)
 	}
 
+	// Privileged containers are allowed to gain privileges, e.g. through setuid
+	// binaries.
+	// TODO: Apply NoNewPrivs in the security context after the CRI api is updated.
+	g.SetProcessNoNewPrivileges(!securityContext.GetPrivileged())
+
 	// Set namespaces, share namespace with sandbox container.
-	setOCINamespaces(&g, securityContext.GetNamespaceOptions(), sandboxPid)
+	pidMode, err := getPIDNamespaceMode(sandboxConfig)
+	if err != nil {
+		return nil, err
+	}
+	setOCINamespaces(&g, sandboxConfig.GetLinux().GetSecurityContext().GetNamespaceOptions(), pidMode, sandboxPid)
+	c.setOCIUserNamespace(&g, getUserNamespace(sandboxPid))
 
-	// TODO(random-liu): [P1] Set selinux options.
+	g.SetProcessSelinuxLabel(processLabel)
+	g.SetLinuxMountLabel(mountLabel)
 
-	// TODO(random-liu): [P1] Set user/username.
+	// The process uid and gid are resolved against the image rootfs in
+	// CreateContainer, see getContainerUser.
 
-	supplementalGroups := securityContext.GetSupplementalGroups()
+	supplementalGroups, err := getSupplementalGroups(sandboxConfig, config)
+	if err != nil {
+		return nil, err
+	}
 	for _, group := range supplementalGroups {
-		g.AddProcessAdditionalGid(uint32(group))
+		// The generator skips duplicated groups.
+		g.AddProcessAdditionalGid(group)
+	}
+
+	// Privileged containers are always unconfined.
+	if !securityContext.GetPrivileged() {
+		containerName := config.GetMetadata().GetName()
+		apparmorProfile := getApparmorProfile(securityContext, sandboxConfig.GetAnnotations(), containerName)
+		if err := c.setOCIApparmor(&g, apparmorProfile); err != nil {
+			return nil, fmt.Errorf("failed to set apparmor profile %q: %v", apparmorProfile, err)
+		}
+		seccompProfile := getSeccompProfile(sandboxConfig.GetAnnotations(), containerName)
+		if err := c.setOCISeccomp(&g, seccompProfile); err != nil {
+			return nil, fmt.Errorf("failed to set seccomp profile %q: %v", seccompProfile, err)
+		}
 	}
 
-	// TODO(random-liu): [P2] Add apparmor and seccomp.
+	// Add sandbox annotations first so that container annotations can override.
+	addOCIAnnotations(&g, sandboxConfig.GetAnnotations(), c.config.AllowedAnnotations)
+	addOCIAnnotations(&g, config.GetAnnotations(), c.config.AllowedAnnotations)
 
 	return g.Spec(), nil
 }
 
-// generateContainerMounts sets up necessary container mounts including /dev/shm, /etc/hosts
-// and /etc/resolv.conf.
-func (c *criContainerdService) generateContainerMounts(sandboxRootDir string, config *runtime.ContainerConfig) []*runtime.Mount {
+// addOCIAnnotations adds the CRI annotations matching the allowed patterns into
+// the spec, so that the runtime and the shim can act on them. Other annotations
+// are not passed through.
+func addOCIAnnotations(g *generate.Generator, annotations map[string]string, allowed []string) {
+	for k, v := range annotations {
+		if matchPatterns(k, allowed) {
+			g.AddAnnotation(k, v)
+		}
+	}
+}
+
+// generateContainerMounts sets up necessary container mounts including /dev/shm, /etc/hostname,
+// /etc/hosts and /etc/resolv.conf.
+func (c *criContainerdService) generateContainerMounts(sandboxRootDir string, sandboxConfig *runtime.PodSandboxConfig,
+	config *runtime.ContainerConfig) []*runtime.Mount {
 	var mounts []*runtime.Mount
 	securityContext := config.GetLinux().GetSecurityContext()
+	mounts = append(mounts, &runtime.Mount{
+		ContainerPath: etcHostname,
+		HostPath:      getSandboxHostnamePath(sandboxRootDir),
+		Readonly:      securityContext.GetReadonlyRootfs(),
+	})
 	mounts = append(mounts, &runtime.Mount{
 		ContainerPath: etcHosts,
 		HostPath:      getSandboxHosts(sandboxRootDir),
@@ -276,8 +637,10 @@ func (c *criContainerdService) generateContainerMounts(sandboxRootDir string, co
 		Readonly:      securityContext.GetReadonlyRootfs(),
 	})
 
+	// The container uses the host /dev/shm if the sandbox uses the host ipc
+	// namespace, same with the ipc namespace itself.
 	sandboxDevShm := getSandboxDevShm(sandboxRootDir)
-	if securityContext.GetNamespaceOptions().GetHostIpc() {
+	if sandboxConfig.GetLinux().GetSecurityContext().GetNamespaceOptions().GetHostIpc() {
 		sandboxDevShm = devShm
 	}
 	mounts = append(mounts, &runtime.Mount{
@@ -288,33 +651,54 @@ func (c *criContainerdService) generateContainerMounts(sandboxRootDir string, co
 	return mounts
 }
 
-// setOCIProcessArgs sets process args. It returns error if the final arg list
-// is empty.
+// setOCIProcessArgs sets process args. Container command overrides image
+// entrypoint, and container args override image cmd. Image cmd is ignored if
+// container command is specified. It returns error if the final arg list is
+// empty.
 func setOCIProcessArgs(g *generate.Generator, config *runtime.ContainerConfig, imageConfig *imagespec.ImageConfig) error {
 	command, args := config.GetCommand(), config.GetArgs()
 	// The following logic is migrated from https://github.com/moby/moby/blob/master/daemon/commit.go
 	// TODO(random-liu): Clearly define the commands overwrite behavior.
 	if len(command) == 0 {
 		if len(args) == 0 {
-			args = imageConfig.Cmd
+			args = normalizeImageCommand(imageConfig.Cmd)
 		}
 		if command == nil {
-			command = imageConfig.Entrypoint
+			command = normalizeImageCommand(imageConfig.Entrypoint)
 		}
 	}
 	if len(command) == 0 && len(args) == 0 {
-		return fmt.Errorf("no command specified")
+		return grpc.Errorf(codes.InvalidArgument, "no command specified: neither container command/args nor image entrypoint/cmd is set")
+	}
+	// Copy into a new slice, so that the image config is never modified.
+	processArgs := make([]string, 0, len(command)+len(args))
+	processArgs = append(append(processArgs, command...), args...)
+	if processArgs[0] == "" {
+		return grpc.Errorf(codes.InvalidArgument, "empty executable in process args %q", processArgs)
 	}
-	g.SetProcessArgs(append(command, args...))
+	g.SetProcessArgs(processArgs)
 	return nil
 }
 
+// normalizeImageCommand normalizes image entrypoint or cmd. Shell form is
+// already converted into exec form, e.g. ["/bin/sh", "-c", "cmd"], when the
+// image is built. Exec form with a single empty string, e.g. `ENTRYPOINT [""]`,
+// resets the entrypoint or cmd inherited from the base image, and is treated
+// the same as not specified, the same with docker.
+func normalizeImageCommand(cmd []string) []string {
+	if len(cmd) == 1 && cmd[0] == "" {
+		return nil
+	}
+	return cmd
+}
+
 // addImageEnvs adds environment variables from image config. It returns error if
 // an invalid environment variable is encountered.
 func addImageEnvs(g *generate.Generator, imageEnvs []string) error {
 	for _, e := range imageEnvs {
-		kv := strings.Split(e, "=")
-		if len(kv) != 2 {
+		// The value may contain "=" as well.
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
 			return fmt.Errorf("invalid environment variable %q", e)
 		}
 		g.AddProcessEnv(kv[0], kv[1])
@@ -332,7 +716,9 @@ func clearReadOnly(m *runtimespec.Mount) {
 	m.Options = opt
 }
 
-// addDevices set device mapping.
+// addOCIDevices adds the host devices to the container at the requested container
+// paths, and allows them in the device cgroup with the requested permissions. All
+// host devices are added if the container is privileged.
 func addOCIDevices(g *generate.Generator, devs []*runtime.Device, privileged bool) error {
 	spec := g.Spec()
 	if privileged {
@@ -341,18 +727,17 @@ func addOCIDevices(g *generate.Generator, devs []*runtime.Device, privileged boo
 			return err
 		}
 		for _, hostDevice := range hostDevices {
-			rd := runtimespec.LinuxDevice{
-				Path:  hostDevice.Path,
-				Type:  string(hostDevice.Type),
-				Major: hostDevice.Major,
-				Minor: hostDevice.Minor,
-				UID:   &hostDevice.Uid,
-				GID:   &hostDevice.Gid,
-			}
 			if hostDevice.Major == 0 && hostDevice.Minor == 0 {
 				// Invalid device, most likely a symbolic link, skip it.
 				continue
 			}
+			// Get the device again, because the listed device type is wrong for
+			// character devices.
+			rd, err := getHostDevice(hostDevice.Path)
+			if err != nil {
+				log.L.Warningf("Skip host device %q: %v", hostDevice.Path, err)
+				continue
+			}
 			g.AddDevice(rd)
 		}
 		spec.Linux.Resources.Devices = []runtimespec.LinuxDeviceCgroup{
@@ -364,38 +749,203 @@ func addOCIDevices(g *generate.Generator, devs []*runtime.Device, privileged boo
 		return nil
 	}
 	for _, device := range devs {
-		path, err := resolveSymbolicLink(device.HostPath)
-		if err != nil {
-			return err
+		permissions := device.GetPermissions()
+		if permissions == "" {
+			permissions = defaultDevicePermissions
 		}
-		dev, err := devices.DeviceFromPath(path, device.Permissions)
+		if strings.Trim(permissions, defaultDevicePermissions) != "" {
+			return grpc.Errorf(codes.InvalidArgument, "invalid permissions %q of device %q", permissions, device.GetHostPath())
+		}
+		path, err := resolveSymbolicLink(device.GetHostPath())
 		if err != nil {
-			return err
+			if os.IsNotExist(err) {
+				return grpc.Errorf(codes.NotFound, "host device %q not found", device.GetHostPath())
+			}
+			return fmt.Errorf("failed to resolve host device %q: %v", device.GetHostPath(), err)
 		}
-		rd := runtimespec.LinuxDevice{
-			Path:  device.ContainerPath,
-			Type:  string(dev.Type),
-			Major: dev.Major,
-			Minor: dev.Minor,
-			UID:   &dev.Uid,
-			GID:   &dev.Gid,
+		rd, err := getHostDevice(path)
+		if err != nil {
+			return fmt.Errorf("failed to get host device %q: %v", device.GetHostPath(), err)
 		}
+		rd.Path = device.GetContainerPath()
 		g.AddDevice(rd)
 		spec.Linux.Resources.Devices = append(spec.Linux.Resources.Devices, runtimespec.LinuxDeviceCgroup{
 			Allow:  true,
-			Type:   string(dev.Type),
-			Major:  &dev.Major,
-			Minor:  &dev.Minor,
-			Access: dev.Permissions,
+			Type:   rd.Type,
+			Major:  &rd.Major,
+			Minor:  &rd.Minor,
+			Access: permissions,
 		})
 	}
 	return nil
 }
 
-// addOCIBindMounts adds bind mounts.
-// TODO(random-liu): Figure out whether we need to change all CRI mounts to readonly when
-// rootfs is readonly. (https://github.com/moby/moby/blob/master/daemon/oci_linux.go)
-func addOCIBindMounts(g *generate.Generator, mounts []*runtime.Mount, privileged bool) {
+// getHostDevice returns the type, number and owner of a host device. The device
+// type is checked against the whole file type bits, because the block device bits
+// include the character device bit.
+func getHostDevice(path string) (runtimespec.LinuxDevice, error) {
+	var stat unix.Stat_t
+	if err := unix.Lstat(path, &stat); err != nil {
+		return runtimespec.LinuxDevice{}, err
+	}
+	var devType string
+	switch stat.Mode & unix.S_IFMT {
+	case unix.S_IFBLK:
+		devType = "b"
+	case unix.S_IFCHR:
+		devType = "c"
+	default:
+		return runtimespec.LinuxDevice{}, devices.ErrNotADevice
+	}
+	uid, gid := stat.Uid, stat.Gid
+	return runtimespec.LinuxDevice{
+		Path:  path,
+		Type:  devType,
+		Major: devices.Major(int(stat.Rdev)),
+		Minor: devices.Minor(int(stat.Rdev)),
+		UID:   &uid,
+		GID:   &gid,
+	}, nil
+}
+
+// isRetriedCreateRequest checks whether the create request is a retry of the
+// request which created the existing container, i.e. it's in the same sandbox,
+// has the same config and the image still resolves to the same image.
+func (c *criContainerdService) isRetriedCreateRequest(ctx context.Context, existing containerstore.Container,
+	sandboxID string, config *runtime.ContainerConfig) bool {
+	if existing.SandboxID != sandboxID || !proto.Equal(existing.Config, config) {
+		return false
+	}
+	image, err := c.localResolve(ctx, config.GetImage().GetImage())
+	if err != nil || image == nil {
+		return false
+	}
+	return image.ID == existing.ImageRef
+}
+
+// relabelExcludedPaths are the host system paths which are never relabeled,
+// because relabeling them breaks the host. This follows docker.
+var relabelExcludedPaths = map[string]bool{
+	"/":      true,
+	"/bin":   true,
+	"/boot":  true,
+	"/dev":   true,
+	"/etc":   true,
+	"/home":  true,
+	"/lib":   true,
+	"/lib64": true,
+	"/opt":   true,
+	"/proc":  true,
+	"/root":  true,
+	"/run":   true,
+	"/sbin":  true,
+	"/sys":   true,
+	"/tmp":   true,
+	"/usr":   true,
+	"/var":   true,
+}
+
+// relabelMounts relabels the host paths of mounts requiring selinux relabel
+// with the container mount label. Relabeling host system paths is refused.
+func (c *criContainerdService) relabelMounts(mounts []*runtime.Mount, mountLabel string) error {
+	if mountLabel == "" {
+		return nil
+	}
+	for _, mount := range mounts {
+		if !mount.GetSelinuxRelabel() {
+			continue
+		}
+		if relabelExcludedPaths[filepath.Clean(mount.GetHostPath())] {
+			return grpc.Errorf(codes.InvalidArgument, "selinux relabel of host path %q is not allowed", mount.GetHostPath())
+		}
+		if err := c.os.Relabel(mount.GetHostPath(), mountLabel); err != nil {
+			return fmt.Errorf("failed to relabel mount %q with %q: %v", mount.GetHostPath(), mountLabel, err)
+		}
+	}
+	return nil
+}
+
+// chownMounts recursively changes the owner of the host paths of mounts requested
+// in the container annotations to the resolved container user uid, which may come
+// from the run-as user or the image user. The uid is shifted by the uid mapping
+// when user namespace is enabled.
+// If fsGroup chown is enabled, the group of the requested writable mounts is
+// also changed to the sandbox fsGroup, shifted by the gid mapping. Read-only
+// mounts are never chgrp'd, because the container can't write them anyway and
+// walking a large read-only volume, e.g. a dataset, would delay the container
+// startup.
+func (c *criContainerdService) chownMounts(sandboxConfig *runtime.PodSandboxConfig, config *runtime.ContainerConfig, uid uint32) error {
+	value, ok := config.GetAnnotations()[chownMountsAnnotationKey]
+	if !ok {
+		return nil
+	}
+	var paths []string
+	if err := json.Unmarshal([]byte(value), &paths); err != nil {
+		return grpc.Errorf(codes.InvalidArgument, "failed to unmarshal chown mounts %q: %v", value, err)
+	}
+	hostUID, gid := int(uid), -1
+	if c.userNamespaceEnabled() {
+		hostUID += int(c.uidMapping.HostID) - int(c.uidMapping.ContainerID)
+	}
+	if c.config.EnableFSGroupChown {
+		fsGroup, err := getFSGroup(sandboxConfig)
+		if err != nil {
+			return err
+		}
+		if fsGroup != nil {
+			gid = int(*fsGroup)
+			if c.userNamespaceEnabled() {
+				gid += int(c.gidMapping.HostID) - int(c.gidMapping.ContainerID)
+			}
+		}
+	}
+	chown := make(map[string]bool)
+	for _, p := range paths {
+		chown[filepath.Clean(p)] = true
+	}
+	for _, mount := range config.GetMounts() {
+		if !chown[filepath.Clean(mount.GetContainerPath())] {
+			continue
+		}
+		mountGID := gid
+		if mount.GetReadonly() {
+			mountGID = -1
+		}
+		if err := c.os.Chown(mount.GetHostPath(), hostUID, mountGID); err != nil {
+			return fmt.Errorf("failed to chown mount %q to %d:%d: %v", mount.GetHostPath(), hostUID, mountGID, err)
+		}
+	}
+	return nil
+}
+
+// getMountPropagations returns the mount propagation modes keyed by container
+// path, which are requested in the container annotations.
+func getMountPropagations(annotations map[string]string) (map[string]string, error) {
+	value, ok := annotations[mountPropagationAnnotationKey]
+	if !ok {
+		return nil, nil
+	}
+	var requests map[string]string
+	if err := json.Unmarshal([]byte(value), &requests); err != nil {
+		return nil, grpc.Errorf(codes.InvalidArgument, "failed to unmarshal mount propagations %q: %v", value, err)
+	}
+	propagations := make(map[string]string)
+	for dst, p := range requests {
+		switch p {
+		case propagationPrivate, propagationHostToContainer, propagationBidirectional:
+		default:
+			return nil, grpc.Errorf(codes.InvalidArgument, "unsupported propagation %q of mount %q", p, dst)
+		}
+		propagations[filepath.Clean(dst)] = p
+	}
+	return propagations, nil
+}
+
+// addOCIBindMounts adds bind mounts. CRI mounts keep their own readonly setting
+// even when the rootfs is readonly, so that volumes remain writable. The rootfs
+// propagation is changed if any mount needs to receive or propagate mount events,
+// because a mount can't be more shared than its parent.
+func addOCIBindMounts(g *generate.Generator, mounts []*runtime.Mount, propagations map[string]string, privileged bool) {
 	// Mount cgroup into the container as readonly, which inherits docker's behavior.
 	g.AddCgroupsMount("ro") // nolint: errcheck
 	for _, mount := range mounts {
@@ -405,7 +955,19 @@ func addOCIBindMounts(g *generate.Generator, mounts []*runtime.Mount, privileged
 		if mount.GetReadonly() {
 			options = []string{"ro"}
 		}
-		// TODO(random-liu): [P1] Apply selinux label
+		propagation, ok := propagations[filepath.Clean(dst)]
+		if !ok {
+			propagation = propagationPrivate
+		}
+		switch propagation {
+		case propagationBidirectional:
+			g.SetLinuxRootPropagation(propagationBidirectional) // nolint: errcheck
+		case propagationHostToContainer:
+			if g.Spec().Linux.RootfsPropagation != propagationBidirectional {
+				g.SetLinuxRootPropagation(propagationHostToContainer) // nolint: errcheck
+			}
+		}
+		options = append(options, propagation)
 		g.AddBindMount(src, dst, options)
 	}
 	if !privileged {
@@ -421,8 +983,125 @@ func addOCIBindMounts(g *generate.Generator, mounts []*runtime.Mount, privileged
 			clearReadOnly(&spec.Mounts[i])
 		}
 	}
-	spec.Linux.ReadonlyPaths = nil
+}
+
+// setOCIMaskedReadonlyPaths sets the masked and readonly paths of the container.
+// The paths in the container annotations override the default ones. Privileged
+// containers have no masked or readonly paths.
+func setOCIMaskedReadonlyPaths(g *generate.Generator, annotations map[string]string, privileged bool) error {
+	spec := g.Spec()
 	spec.Linux.MaskedPaths = nil
+	spec.Linux.ReadonlyPaths = nil
+	if privileged {
+		return nil
+	}
+	maskedPaths, err := getContainerPaths(annotations, maskedPathsAnnotationKey, defaultMaskedPaths)
+	if err != nil {
+		return err
+	}
+	readonlyPaths, err := getContainerPaths(annotations, readonlyPathsAnnotationKey, defaultReadonlyPaths)
+	if err != nil {
+		return err
+	}
+	for _, p := range maskedPaths {
+		g.AddLinuxMaskedPaths(p)
+	}
+	for _, p := range readonlyPaths {
+		g.AddLinuxReadonlyPaths(p)
+	}
+	return nil
+}
+
+// getContainerPaths returns the container paths in the annotation, or the
+// default paths if the annotation is not set. All paths must be absolute.
+func getContainerPaths(annotations map[string]string, key string, defaults []string) ([]string, error) {
+	value, ok := annotations[key]
+	if !ok {
+		return defaults, nil
+	}
+	var paths []string
+	if err := json.Unmarshal([]byte(value), &paths); err != nil {
+		return nil, grpc.Errorf(codes.InvalidArgument, "failed to unmarshal paths %q in annotation %q: %v", value, key, err)
+	}
+	for _, p := range paths {
+		if !filepath.IsAbs(p) {
+			return nil, grpc.Errorf(codes.InvalidArgument, "path %q in annotation %q is not absolute", p, key)
+		}
+	}
+	return paths, nil
+}
+
+// getTmpfsMounts returns the tmpfs mount options keyed by container path, which
+// are requested in the container annotations. The tmpfs size is capped by the
+// memory limit if the memory limit is specified.
+func getTmpfsMounts(annotations map[string]string, memoryLimit int64) (map[string][]string, error) {
+	value, ok := annotations[tmpfsMountsAnnotationKey]
+	if !ok {
+		return nil, nil
+	}
+	var requests map[string]tmpfsMountOptions
+	if err := json.Unmarshal([]byte(value), &requests); err != nil {
+		return nil, grpc.Errorf(codes.InvalidArgument, "failed to unmarshal tmpfs mounts %q: %v", value, err)
+	}
+	mounts := make(map[string][]string)
+	for dst, opts := range requests {
+		if !filepath.IsAbs(dst) {
+			return nil, grpc.Errorf(codes.InvalidArgument, "tmpfs mount path %q is not absolute", dst)
+		}
+		size := memoryLimit
+		if opts.Size != "" {
+			q, err := resource.ParseQuantity(opts.Size)
+			if err != nil {
+				return nil, grpc.Errorf(codes.InvalidArgument, "failed to parse size %q of tmpfs mount %q: %v", opts.Size, dst, err)
+			}
+			if s := q.Value(); s > 0 && (size <= 0 || s < size) {
+				size = s
+			}
+		}
+		mode := opts.Mode
+		if mode == "" {
+			mode = defaultTmpfsMode
+		}
+		if _, err := strconv.ParseUint(mode, 8, 32); err != nil {
+			return nil, grpc.Errorf(codes.InvalidArgument, "invalid mode %q of tmpfs mount %q: %v", mode, dst, err)
+		}
+		options := []string{"nosuid", "nodev", "mode=" + mode}
+		if size > 0 {
+			options = append(options, fmt.Sprintf("size=%d", size))
+		}
+		mounts[filepath.Clean(dst)] = options
+	}
+	return mounts, nil
+}
+
+// filterTmpfsMounts removes the mounts which are replaced by tmpfs mounts.
+func filterTmpfsMounts(mounts []*runtime.Mount, tmpfsMounts map[string][]string) []*runtime.Mount {
+	if len(tmpfsMounts) == 0 {
+		return mounts
+	}
+	var filtered []*runtime.Mount
+	for _, m := range mounts {
+		if _, ok := tmpfsMounts[filepath.Clean(m.GetContainerPath())]; ok {
+			continue
+		}
+		filtered = append(filtered, m)
+	}
+	return filtered
+}
+
+// addOCITmpfsMounts adds tmpfs mounts. The tmpfs mounts are created in the
+// container mount namespace, so they are released together with the container
+// and don't need to be unmounted on the host.
+func addOCITmpfsMounts(g *generate.Generator, tmpfsMounts map[string][]string) {
+	var dsts []string
+	for dst := range tmpfsMounts {
+		dsts = append(dsts, dst)
+	}
+	// Sort the mounts so that the generated spec is deterministic.
+	sort.Strings(dsts)
+	for _, dst := range dsts {
+		g.AddTmpfsMount(dst, tmpfsMounts[dst])
+	}
 }
 
 // setOCILinuxResource set container resource limit.
@@ -434,7 +1113,103 @@ func setOCILinuxResource(g *generate.Generator, resources *runtime.LinuxContaine
 	g.SetLinuxResourcesCPUQuota(resources.GetCpuQuota())
 	g.SetLinuxResourcesCPUShares(uint64(resources.GetCpuShares()))
 	g.SetLinuxResourcesMemoryLimit(resources.GetMemoryLimitInBytes())
-	g.SetProcessOOMScoreAdj(int(resources.GetOomScoreAdj()))
+	// Leave the spec default if oom score adj is not specified.
+	if resources.GetOomScoreAdj() != 0 {
+		g.SetProcessOOMScoreAdj(clampOOMScoreAdj(resources.GetOomScoreAdj()))
+	}
+}
+
+// getPidsLimit returns the pids limit of a container, which is specified in the
+// container annotations, or the node default if it's not specified. 0 or -1
+// means unlimited, same with kubernetes.
+func getPidsLimit(annotations map[string]string, defaultLimit int64) (int64, error) {
+	value, ok := annotations[pidsLimitAnnotationKey]
+	if !ok {
+		return defaultLimit, nil
+	}
+	limit, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || limit < -1 {
+		return 0, grpc.Errorf(codes.InvalidArgument, "invalid pids limit %q", value)
+	}
+	return limit, nil
+}
+
+// setOCIPidsLimit sets the pids cgroup limit. The pids cgroup is left
+// unlimited if the limit is not positive.
+func setOCIPidsLimit(g *generate.Generator, limit int64) {
+	if limit <= 0 {
+		return
+	}
+	g.SetLinuxResourcesPidsLimit(limit)
+}
+
+// linuxCPUSet is the cpu and memory node pinning of a container in the cpuset
+// list format, e.g. "0-3,7". An empty field means no pinning.
+type linuxCPUSet struct {
+	// CPUs are the cpus the container is allowed to run on.
+	CPUs string
+	// Mems are the memory nodes the container is allowed to allocate from.
+	Mems string
+}
+
+// getContainerCPUSet returns the initial cpuset of a container specified in the
+// container annotations.
+func getContainerCPUSet(annotations map[string]string) linuxCPUSet {
+	return linuxCPUSet{
+		CPUs: annotations[cpusetCPUsAnnotationKey],
+		Mems: annotations[cpusetMemsAnnotationKey],
+	}
+}
+
+// setOCICPUSet sets the container cpuset. It returns error if the cpuset list
+// is invalid.
+func setOCICPUSet(g *generate.Generator, cpuset linuxCPUSet) error {
+	if err := validateCPUSetList(cpuset.CPUs); err != nil {
+		return grpc.Errorf(codes.InvalidArgument, "invalid cpuset cpus %q: %v", cpuset.CPUs, err)
+	}
+	if err := validateCPUSetList(cpuset.Mems); err != nil {
+		return grpc.Errorf(codes.InvalidArgument, "invalid cpuset mems %q: %v", cpuset.Mems, err)
+	}
+	g.SetLinuxResourcesCPUCpus(cpuset.CPUs)
+	g.SetLinuxResourcesCPUMems(cpuset.Mems)
+	return nil
+}
+
+// validateCPUSetList validates a cpuset list, which is a comma separated list
+// of ids or inclusive id ranges, e.g. "0-3,7". An empty list is valid.
+func validateCPUSetList(list string) error {
+	if list == "" {
+		return nil
+	}
+	for _, item := range strings.Split(list, ",") {
+		bounds := strings.SplitN(item, "-", 2)
+		start, err := strconv.ParseUint(bounds[0], 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid id %q", bounds[0])
+		}
+		if len(bounds) == 1 {
+			continue
+		}
+		end, err := strconv.ParseUint(bounds[1], 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid id %q", bounds[1])
+		}
+		if end < start {
+			return fmt.Errorf("invalid range %q", item)
+		}
+	}
+	return nil
+}
+
+// clampOOMScoreAdj clamps the oom score adj into the valid range.
+func clampOOMScoreAdj(oomScoreAdj int64) int {
+	if oomScoreAdj < minOOMScoreAdj {
+		return minOOMScoreAdj
+	}
+	if oomScoreAdj > maxOOMScoreAdj {
+		return maxOOMScoreAdj
+	}
+	return int(oomScoreAdj)
 }
 
 // setOCICapabilities adds/drops process capabilities.
@@ -448,25 +1223,214 @@ func setOCICapabilities(g *generate.Generator, capabilities *runtime.Capability,
 		return nil
 	}
 
-	// Capabilities in CRI doesn't have `CAP_` prefix, so add it.
-	for _, c := range capabilities.GetAddCapabilities() {
-		if err := g.AddProcessCapability("CAP_" + c); err != nil {
-			return err
+	drops, err := getOCICapabilitiesList(capabilities.GetDropCapabilities())
+	if err != nil {
+		return fmt.Errorf("failed to get drop capabilities: %v", err)
+	}
+	adds, err := getOCICapabilitiesList(capabilities.GetAddCapabilities())
+	if err != nil {
+		return fmt.Errorf("failed to get add capabilities: %v", err)
+	}
+
+	// Start from the default capabilities, drop capabilities first and then
+	// add capabilities, so that "drop ALL" with an add list only keeps the
+	// added capabilities.
+	spec := g.Spec()
+	if spec.Process.Capabilities == nil {
+		spec.Process.Capabilities = &runtimespec.LinuxCapabilities{}
+	}
+	caps := spec.Process.Capabilities
+	for _, set := range []*[]string{&caps.Bounding, &caps.Effective, &caps.Permitted, &caps.Inheritable, &caps.Ambient} {
+		*set = addCapabilities(removeCapabilities(*set, drops), adds)
+	}
+	return nil
+}
+
+// getOCICapabilitiesList converts CRI capabilities into OCI capabilities and
+// expands "ALL" into all capabilities.
+func getOCICapabilitiesList(capabilities []string) ([]string, error) {
+	var caps []string
+	for _, c := range capabilities {
+		c = strings.ToUpper(c)
+		if c == "ALL" {
+			return getAllCapabilities(), nil
+		}
+		// Capabilities in CRI doesn't have `CAP_` prefix, so add it.
+		if !strings.HasPrefix(c, "CAP_") {
+			c = "CAP_" + c
 		}
+		if err := validate.CapValid(c, false); err != nil {
+			return nil, fmt.Errorf("invalid capability %q: %v", c, err)
+		}
+		caps = append(caps, c)
 	}
+	return caps, nil
+}
 
-	for _, c := range capabilities.GetDropCapabilities() {
-		if err := g.DropProcessCapability("CAP_" + c); err != nil {
-			return err
+// getAllCapabilities returns all capabilities supported on the host.
+func getAllCapabilities() []string {
+	var caps []string
+	for _, c := range capability.List() {
+		if c > validate.LastCap() {
+			continue
+		}
+		caps = append(caps, "CAP_"+strings.ToUpper(c.String()))
+	}
+	return caps
+}
+
+// addCapabilities adds capabilities which are not in the capability set yet.
+func addCapabilities(set, caps []string) []string {
+	for _, c := range caps {
+		if !containsCapability(set, c) {
+			set = append(set, c)
+		}
+	}
+	return set
+}
+
+// removeCapabilities removes capabilities from the capability set.
+func removeCapabilities(set, caps []string) []string {
+	result := []string{}
+	for _, c := range set {
+		if !containsCapability(caps, c) {
+			result = append(result, c)
+		}
+	}
+	return result
+}
+
+// containsCapability checks whether a capability is in the capability set.
+func containsCapability(set []string, c string) bool {
+	for _, s := range set {
+		if strings.ToUpper(s) == c {
+			return true
+		}
+	}
+	return false
+}
+
+// getSeccompProfile returns the seccomp profile of a container from the sandbox
+// annotations. The container profile overrides the pod profile.
+func getSeccompProfile(annotations map[string]string, containerName string) string {
+	if profile, ok := annotations[seccompContainerAnnotationKeyPrefix+containerName]; ok {
+		return profile
+	}
+	return annotations[seccompPodAnnotationKey]
+}
+
+// setOCISeccomp sets seccomp filter based on the seccomp profile.
+func (c *criContainerdService) setOCISeccomp(g *generate.Generator, profile string) error {
+	switch {
+	case profile == "" || profile == seccompUnconfined:
+		// Kubernetes defaults to unconfined when no profile is specified.
+		g.Spec().Linux.Seccomp = nil
+	case profile == seccompRuntimeDefault:
+		g.Spec().Linux.Seccomp = seccomp.DefaultProfile(g.Spec())
+	case strings.HasPrefix(profile, seccompLocalhostPrefix):
+		path := strings.TrimPrefix(profile, seccompLocalhostPrefix)
+		if path == "" {
+			return fmt.Errorf("localhost seccomp profile path is not specified")
+		}
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(c.config.SeccompProfileRoot, path)
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read seccomp profile %q: %v", path, err)
+		}
+		var s runtimespec.LinuxSeccomp
+		if err := json.Unmarshal(data, &s); err != nil {
+			return fmt.Errorf("failed to parse seccomp profile %q: %v", path, err)
 		}
+		g.Spec().Linux.Seccomp = &s
+	default:
+		return fmt.Errorf("unsupported seccomp profile")
 	}
 	return nil
 }
 
-// setOCINamespaces sets namespaces.
-func setOCINamespaces(g *generate.Generator, namespaces *runtime.NamespaceOption, sandboxPid uint32) {
-	g.AddOrReplaceLinuxNamespace(string(runtimespec.NetworkNamespace), getNetworkNamespace(sandboxPid)) // nolint: errcheck
-	g.AddOrReplaceLinuxNamespace(string(runtimespec.IPCNamespace), getIPCNamespace(sandboxPid))         // nolint: errcheck
-	g.AddOrReplaceLinuxNamespace(string(runtimespec.UTSNamespace), getUTSNamespace(sandboxPid))         // nolint: errcheck
-	g.AddOrReplaceLinuxNamespace(string(runtimespec.PIDNamespace), getPIDNamespace(sandboxPid))         // nolint: errcheck
+// getApparmorProfile returns the apparmor profile of a container. The profile
+// in the security context takes precedence over the sandbox annotation.
+func getApparmorProfile(securityContext *runtime.LinuxContainerSecurityContext, annotations map[string]string,
+	containerName string) string {
+	if profile := securityContext.GetApparmorProfile(); profile != "" {
+		return profile
+	}
+	return annotations[apparmorContainerAnnotationKeyPrefix+containerName]
+}
+
+// setOCIApparmor sets apparmor profile based on the profile.
+func (c *criContainerdService) setOCIApparmor(g *generate.Generator, profile string) error {
+	if profile == "" || profile == apparmorUnconfined {
+		g.SetProcessApparmorProfile("")
+		return nil
+	}
+	if !c.apparmorEnabled {
+		return fmt.Errorf("apparmor is not enabled on the host")
+	}
+	switch {
+	case profile == apparmorRuntimeDefault:
+		g.SetProcessApparmorProfile(defaultApparmorProfile)
+	case strings.HasPrefix(profile, apparmorLocalhostPrefix):
+		name := strings.TrimPrefix(profile, apparmorLocalhostPrefix)
+		if name == "" {
+			return fmt.Errorf("localhost apparmor profile name is not specified")
+		}
+		g.SetProcessApparmorProfile(name)
+	default:
+		return fmt.Errorf("unsupported apparmor profile")
+	}
+	return nil
+}
+
+// isApparmorEnabled returns whether apparmor is enabled on the host.
+func isApparmorEnabled() bool {
+	data, err := ioutil.ReadFile(apparmorEnabledFile)
+	return err == nil && len(data) > 0 && data[0] == 'Y'
+}
+
+// getPIDNamespaceMode returns the pid namespace mode of the containers in
+// the sandbox, which defaults to the pod mode.
+func getPIDNamespaceMode(sandboxConfig *runtime.PodSandboxConfig) (string, error) {
+	mode, ok := sandboxConfig.GetAnnotations()[pidNamespaceModeAnnotationKey]
+	if !ok {
+		return pidNamespaceModePod, nil
+	}
+	if mode != pidNamespaceModePod && mode != pidNamespaceModeContainer {
+		return "", grpc.Errorf(codes.InvalidArgument, "unsupported pid namespace mode %q, must be %q or %q",
+			mode, pidNamespaceModePod, pidNamespaceModeContainer)
+	}
+	return mode, nil
+}
+
+// setOCINamespaces sets namespaces. The namespaces are always decided by the
+// sandbox namespace options, and the namespace options in the container
+// security context are ignored, because namespaces are shared at the pod
+// level. E.g. a container asking for host pid in a sandbox without host pid
+// still runs in the pid namespace of the sandbox or its own one.
+// A host namespace is removed from the spec, so that the container inherits
+// the host namespace of the runtime, same with the sandbox container.
+func setOCINamespaces(g *generate.Generator, namespaces *runtime.NamespaceOption, pidMode string, sandboxPid uint32) {
+	if namespaces.GetHostNetwork() {
+		g.RemoveLinuxNamespace(string(runtimespec.NetworkNamespace)) // nolint: errcheck
+	} else {
+		g.AddOrReplaceLinuxNamespace(string(runtimespec.NetworkNamespace), getNetworkNamespace(sandboxPid)) // nolint: errcheck
+	}
+	if namespaces.GetHostIpc() {
+		g.RemoveLinuxNamespace(string(runtimespec.IPCNamespace)) // nolint: errcheck
+	} else {
+		g.AddOrReplaceLinuxNamespace(string(runtimespec.IPCNamespace), getIPCNamespace(sandboxPid)) // nolint: errcheck
+	}
+	// The sandbox container always has its own uts namespace.
+	g.AddOrReplaceLinuxNamespace(string(runtimespec.UTSNamespace), getUTSNamespace(sandboxPid)) // nolint: errcheck
+	switch {
+	case namespaces.GetHostPid():
+		g.RemoveLinuxNamespace(string(runtimespec.PIDNamespace)) // nolint: errcheck
+	case pidMode == pidNamespaceModeContainer:
+		// An empty path makes runc create a new pid namespace.
+		g.AddOrReplaceLinuxNamespace(string(runtimespec.PIDNamespace), "") // nolint: errcheck
+	default:
+		g.AddOrReplaceLinuxNamespace(string(runtimespec.PIDNamespace), getPIDNamespace(sandboxPid)) // nolint: errcheck
+	}
 }
@@ -17,14 +17,27 @@ limitations under the License.
 package server
 
 import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/containerd/containerd"
 	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
 	runtimespec "github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/opencontainers/runtime-tools/generate"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+
+	ostesting "github.com/kubernetes-incubator/cri-containerd/pkg/os/testing"
+	containerstore "github.com/kubernetes-incubator/cri-containerd/pkg/store/container"
+	imagestore "github.com/kubernetes-incubator/cri-containerd/pkg/store/image"
+	sandboxstore "github.com/kubernetes-incubator/cri-containerd/pkg/store/sandbox"
 )
 
 func checkMount(t *testing.T, mounts []runtimespec.Mount, src, dest, typ string,
@@ -147,7 +160,7 @@ func getCreateContainerTestData() (*runtime.ContainerConfig, *runtime.PodSandbox
 		assert.Contains(t, spec.Process.User.AdditionalGids, uint32(2222))
 
 		t.Logf("Check cgroup path")
-		assert.Equal(t, getCgroupsPath("/test/cgroup/parent", id), spec.Linux.CgroupsPath)
+		assert.Equal(t, "/test/cgroup/parent/"+id, spec.Linux.CgroupsPath)
 
 		t.Logf("Check namespaces")
 		assert.Contains(t, spec.Linux.Namespaces, runtimespec.LinuxNamespace{
@@ -175,11 +188,33 @@ func TestGeneralContainerSpec(t *testing.T) {
 	testPid := uint32(1234)
 	config, sandboxConfig, imageConfig, specCheck := getCreateContainerTestData()
 	c := newTestCRIContainerdService()
-	spec, err := c.generateContainerSpec(testID, testPid, config, sandboxConfig, imageConfig, nil)
+	spec, err := c.generateContainerSpec(testID, testPid, config, sandboxConfig, imageConfig, nil, "", "")
 	assert.NoError(t, err)
 	specCheck(t, testID, testPid, spec)
 }
 
+func TestContainerSpecNotChangeImageConfig(t *testing.T) {
+	testID := "test-id"
+	testPid := uint32(1234)
+	config, sandboxConfig, imageConfig, _ := getCreateContainerTestData()
+	c := newTestCRIContainerdService()
+	imageConfig.User = "1234:5678"
+	imageConfig.StopSignal = "SIGQUIT"
+	imageConfig.Entrypoint = make([]string, 1, 10)
+	imageConfig.Entrypoint[0] = "/entrypoint"
+	config.Command = nil
+	config.Args = nil
+	expected, err := json.Marshal(imageConfig)
+	require.NoError(t, err)
+	spec, err := c.generateContainerSpec(testID, testPid, config, sandboxConfig, imageConfig, nil, "", "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/entrypoint", "cmd"}, spec.Process.Args)
+	actual, err := json.Marshal(imageConfig)
+	require.NoError(t, err)
+	assert.JSONEq(t, string(expected), string(actual), "image config shared by containers should not be changed")
+	assert.Empty(t, imageConfig.Entrypoint[:2][1], "spare capacity of image entrypoint should not be written")
+}
+
 func TestContainerSpecTty(t *testing.T) {
 	testID := "test-id"
 	testPid := uint32(1234)
@@ -187,7 +222,7 @@ func TestContainerSpecTty(t *testing.T) {
 	c := newTestCRIContainerdService()
 	for _, tty := range []bool{true, false} {
 		config.Tty = tty
-		spec, err := c.generateContainerSpec(testID, testPid, config, sandboxConfig, imageConfig, nil)
+		spec, err := c.generateContainerSpec(testID, testPid, config, sandboxConfig, imageConfig, nil, "", "")
 		assert.NoError(t, err)
 		specCheck(t, testID, testPid, spec)
 		assert.Equal(t, tty, spec.Process.Terminal)
@@ -206,13 +241,299 @@ func TestContainerSpecReadonlyRootfs(t *testing.T) {
 	c := newTestCRIContainerdService()
 	for _, readonly := range []bool{true, false} {
 		config.Linux.SecurityContext.ReadonlyRootfs = readonly
-		spec, err := c.generateContainerSpec(testID, testPid, config, sandboxConfig, imageConfig, nil)
+		spec, err := c.generateContainerSpec(testID, testPid, config, sandboxConfig, imageConfig, nil, "", "")
 		assert.NoError(t, err)
 		specCheck(t, testID, testPid, spec)
 		assert.Equal(t, readonly, spec.Root.Readonly)
 	}
 }
 
+func TestContainerSpecReadonlyRootfsWritableMounts(t *testing.T) {
+	testID := "test-id"
+	testPid := uint32(1234)
+	config, sandboxConfig, imageConfig, specCheck := getCreateContainerTestData()
+	config.Linux.SecurityContext.ReadonlyRootfs = true
+	c := newTestCRIContainerdService()
+	mounts := c.generateContainerMounts(getSandboxRootDir(c.rootDir, "test-sandbox-id"), sandboxConfig, config)
+	spec, err := c.generateContainerSpec(testID, testPid, config, sandboxConfig, imageConfig, mounts, "", "")
+	require.NoError(t, err)
+	specCheck(t, testID, testPid, spec)
+	assert.True(t, spec.Root.Readonly)
+
+	t.Logf("volumes should keep their own writability")
+	checkMount(t, spec.Mounts, "host-path-1", "container-path-1", "bind", []string{"rw"}, []string{"ro"})
+	checkMount(t, spec.Mounts, "host-path-2", "container-path-2", "bind", []string{"ro"}, nil)
+
+	t.Logf("/dev/shm and the runtime tmpfs should remain writable")
+	checkMount(t, spec.Mounts, getSandboxDevShm(getSandboxRootDir(c.rootDir, "test-sandbox-id")), devShm,
+		"bind", []string{"rw"}, []string{"ro"})
+	checkMount(t, spec.Mounts, "tmpfs", "/run", "tmpfs", nil, []string{"ro"})
+
+	t.Logf("sandbox managed files should be readonly")
+	checkMount(t, spec.Mounts, getSandboxHosts(getSandboxRootDir(c.rootDir, "test-sandbox-id")), etcHosts,
+		"bind", []string{"ro"}, nil)
+}
+
+func TestContainerSpecNoNewPrivileges(t *testing.T) {
+	testID := "test-id"
+	testPid := uint32(1234)
+	config, sandboxConfig, imageConfig, _ := getCreateContainerTestData()
+	c := newTestCRIContainerdService()
+	for _, privileged := range []bool{true, false} {
+		config.Linux.SecurityContext.Privileged = privileged
+		sandboxConfig.Linux.SecurityContext = &runtime.LinuxSandboxSecurityContext{Privileged: privileged}
+		spec, err := c.generateContainerSpec(testID, testPid, config, sandboxConfig, imageConfig, nil, "", "")
+		require.NoError(t, err)
+		assert.Equal(t, !privileged, spec.Process.NoNewPrivileges)
+	}
+}
+
+func TestSetOCICapabilities(t *testing.T) {
+	for desc, test := range map[string]struct {
+		capabilities *runtime.Capability
+		expectErr    bool
+		included     []string
+		excluded     []string
+		onlyIncluded bool
+	}{
+		"should keep default capabilities if not specified": {
+			included: []string{"CAP_CHOWN"},
+		},
+		"should add and drop capabilities": {
+			capabilities: &runtime.Capability{
+				AddCapabilities:  []string{"SYS_ADMIN"},
+				DropCapabilities: []string{"CHOWN"},
+			},
+			included: []string{"CAP_SYS_ADMIN"},
+			excluded: []string{"CAP_CHOWN"},
+		},
+		"should drop all capabilities before adding": {
+			capabilities: &runtime.Capability{
+				AddCapabilities:  []string{"NET_ADMIN"},
+				DropCapabilities: []string{"ALL"},
+			},
+			included:     []string{"CAP_NET_ADMIN"},
+			onlyIncluded: true,
+		},
+		"should add all capabilities": {
+			capabilities: &runtime.Capability{
+				AddCapabilities: []string{"all"},
+			},
+			included: []string{"CAP_SYS_ADMIN", "CAP_NET_ADMIN", "CAP_CHOWN"},
+		},
+		"should return error for invalid add capability": {
+			capabilities: &runtime.Capability{
+				AddCapabilities: []string{"INVALID"},
+			},
+			expectErr: true,
+		},
+		"should return error for invalid drop capability": {
+			capabilities: &runtime.Capability{
+				DropCapabilities: []string{"INVALID"},
+			},
+			expectErr: true,
+		},
+	} {
+		spec, err := containerd.GenerateSpec()
+		require.NoError(t, err, desc)
+		g := generate.NewFromSpec(spec)
+		err = setOCICapabilities(&g, test.capabilities, false)
+		if test.expectErr {
+			assert.Error(t, err, desc)
+			continue
+		}
+		require.NoError(t, err, desc)
+		caps := spec.Process.Capabilities
+		for _, set := range [][]string{caps.Bounding, caps.Effective, caps.Permitted, caps.Inheritable} {
+			if test.onlyIncluded {
+				assert.Equal(t, test.included, set, desc)
+				continue
+			}
+			for _, c := range test.included {
+				assert.Contains(t, set, c, desc)
+			}
+			for _, c := range test.excluded {
+				assert.NotContains(t, set, c, desc)
+			}
+		}
+	}
+}
+
+func TestContainerSpecOOMScoreAdj(t *testing.T) {
+	testID := "test-id"
+	testPid := uint32(1234)
+	for desc, test := range map[string]struct {
+		oomScoreAdj int64
+		expected    *int
+	}{
+		"should leave spec default if oom score adj is not set": {},
+		"should set oom score adj": {
+			oomScoreAdj: -500,
+			expected:    intPtr(-500),
+		},
+		"should clamp oom score adj to max": {
+			oomScoreAdj: 2000,
+			expected:    intPtr(maxOOMScoreAdj),
+		},
+		"should clamp oom score adj to min": {
+			oomScoreAdj: -2000,
+			expected:    intPtr(minOOMScoreAdj),
+		},
+	} {
+		config, sandboxConfig, imageConfig, _ := getCreateContainerTestData()
+		config.Linux.Resources.OomScoreAdj = test.oomScoreAdj
+		c := newTestCRIContainerdService()
+		spec, err := c.generateContainerSpec(testID, testPid, config, sandboxConfig, imageConfig, nil, "", "")
+		require.NoError(t, err, desc)
+		assert.Equal(t, test.expected, spec.Process.OOMScoreAdj, desc)
+	}
+}
+
+func intPtr(i int) *int { return &i }
+
+func TestContainerSpecSeccomp(t *testing.T) {
+	testID := "test-id"
+	testPid := uint32(1234)
+	profileRoot, err := ioutil.TempDir("", "seccomp-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(profileRoot)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(profileRoot, "valid.json"),
+		[]byte(`{"defaultAction":"SCMP_ACT_ERRNO","syscalls":[{"names":["read"],"action":"SCMP_ACT_ALLOW"}]}`), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(profileRoot, "invalid.json"),
+		[]byte("invalid"), 0644))
+	for desc, test := range map[string]struct {
+		annotations   map[string]string
+		privileged    bool
+		expectErr     bool
+		expectAction  runtimespec.LinuxSeccompAction
+		expectSeccomp bool
+	}{
+		"should not set seccomp if profile is not specified": {},
+		"should not set seccomp for unconfined profile": {
+			annotations: map[string]string{seccompPodAnnotationKey: seccompUnconfined},
+		},
+		"should set default seccomp for runtime/default profile": {
+			annotations:   map[string]string{seccompPodAnnotationKey: seccompRuntimeDefault},
+			expectSeccomp: true,
+			expectAction:  runtimespec.ActErrno,
+		},
+		"should let container profile override pod profile": {
+			annotations: map[string]string{
+				seccompPodAnnotationKey:                           seccompRuntimeDefault,
+				seccompContainerAnnotationKeyPrefix + "test-name": seccompUnconfined,
+			},
+		},
+		"should not set seccomp for privileged container": {
+			annotations: map[string]string{seccompPodAnnotationKey: seccompRuntimeDefault},
+			privileged:  true,
+		},
+		"should load localhost profile relative to profile root": {
+			annotations:   map[string]string{seccompPodAnnotationKey: seccompLocalhostPrefix + "valid.json"},
+			expectSeccomp: true,
+			expectAction:  runtimespec.ActErrno,
+		},
+		"should load localhost profile with absolute path": {
+			annotations:   map[string]string{seccompPodAnnotationKey: seccompLocalhostPrefix + filepath.Join(profileRoot, "valid.json")},
+			expectSeccomp: true,
+			expectAction:  runtimespec.ActErrno,
+		},
+		"should return error if localhost profile doesn't exist": {
+			annotations: map[string]string{seccompPodAnnotationKey: seccompLocalhostPrefix + "missing.json"},
+			expectErr:   true,
+		},
+		"should return error if localhost profile fails to parse": {
+			annotations: map[string]string{seccompPodAnnotationKey: seccompLocalhostPrefix + "invalid.json"},
+			expectErr:   true,
+		},
+		"should return error for unsupported profile": {
+			annotations: map[string]string{seccompPodAnnotationKey: "unknown"},
+			expectErr:   true,
+		},
+	} {
+		config, sandboxConfig, imageConfig, _ := getCreateContainerTestData()
+		sandboxConfig.Annotations = test.annotations
+		config.Linux.SecurityContext.Privileged = test.privileged
+		sandboxConfig.Linux.SecurityContext = &runtime.LinuxSandboxSecurityContext{Privileged: test.privileged}
+		c := newTestCRIContainerdService()
+		c.config.SeccompProfileRoot = profileRoot
+		spec, err := c.generateContainerSpec(testID, testPid, config, sandboxConfig, imageConfig, nil, "", "")
+		if test.expectErr {
+			assert.Error(t, err, desc)
+			continue
+		}
+		require.NoError(t, err, desc)
+		if !test.expectSeccomp {
+			assert.Nil(t, spec.Linux.Seccomp, desc)
+			continue
+		}
+		require.NotNil(t, spec.Linux.Seccomp, desc)
+		assert.Equal(t, test.expectAction, spec.Linux.Seccomp.DefaultAction, desc)
+		assert.NotEmpty(t, spec.Linux.Seccomp.Syscalls, desc)
+	}
+}
+
+func TestContainerSpecApparmor(t *testing.T) {
+	testID := "test-id"
+	testPid := uint32(1234)
+	for desc, test := range map[string]struct {
+		profile         string
+		annotations     map[string]string
+		privileged      bool
+		disabled        bool
+		expectErr       bool
+		expectedProfile string
+	}{
+		"should not set apparmor if profile is not specified": {},
+		"should not set apparmor for unconfined profile": {
+			profile: apparmorUnconfined,
+		},
+		"should not require apparmor for unconfined profile": {
+			profile:  apparmorUnconfined,
+			disabled: true,
+		},
+		"should set default apparmor for runtime/default profile": {
+			profile:         apparmorRuntimeDefault,
+			expectedProfile: defaultApparmorProfile,
+		},
+		"should set localhost apparmor profile": {
+			profile:         apparmorLocalhostPrefix + "test-profile",
+			expectedProfile: "test-profile",
+		},
+		"should set apparmor profile from sandbox annotation": {
+			annotations:     map[string]string{apparmorContainerAnnotationKeyPrefix + "test-name": apparmorLocalhostPrefix + "test-profile"},
+			expectedProfile: "test-profile",
+		},
+		"should not set apparmor for privileged container": {
+			profile:    apparmorRuntimeDefault,
+			privileged: true,
+		},
+		"should return error if apparmor is not enabled": {
+			profile:   apparmorRuntimeDefault,
+			disabled:  true,
+			expectErr: true,
+		},
+		"should return error for unsupported profile": {
+			profile:   "unknown",
+			expectErr: true,
+		},
+	} {
+		config, sandboxConfig, imageConfig, _ := getCreateContainerTestData()
+		config.Linux.SecurityContext.ApparmorProfile = test.profile
+		config.Linux.SecurityContext.Privileged = test.privileged
+		sandboxConfig.Linux.SecurityContext = &runtime.LinuxSandboxSecurityContext{Privileged: test.privileged}
+		sandboxConfig.Annotations = test.annotations
+		c := newTestCRIContainerdService()
+		c.apparmorEnabled = !test.disabled
+		spec, err := c.generateContainerSpec(testID, testPid, config, sandboxConfig, imageConfig, nil, "", "")
+		if test.expectErr {
+			assert.Error(t, err, desc)
+			continue
+		}
+		require.NoError(t, err, desc)
+		assert.Equal(t, test.expectedProfile, spec.Process.ApparmorProfile, desc)
+	}
+}
+
 func TestContainerSpecWithExtraMounts(t *testing.T) {
 	testID := "test-id"
 	testPid := uint32(1234)
@@ -229,7 +550,7 @@ func TestContainerSpecWithExtraMounts(t *testing.T) {
 		HostPath:      "test-host-path-extra",
 		Readonly:      true,
 	}
-	spec, err := c.generateContainerSpec(testID, testPid, config, sandboxConfig, imageConfig, []*runtime.Mount{extraMount})
+	spec, err := c.generateContainerSpec(testID, testPid, config, sandboxConfig, imageConfig, []*runtime.Mount{extraMount}, "", "")
 	assert.NoError(t, err)
 	specCheck(t, testID, testPid, spec)
 	var mounts []runtimespec.Mount
@@ -246,6 +567,472 @@ func TestContainerSpecWithExtraMounts(t *testing.T) {
 	assert.Contains(t, mounts[1].Options, "rw")
 }
 
+func TestAddOCIDevices(t *testing.T) {
+	dir, err := ioutil.TempDir("", "devices-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	regularFile := filepath.Join(dir, "regular-file")
+	require.NoError(t, ioutil.WriteFile(regularFile, []byte{}, 0644))
+	symlink := filepath.Join(dir, "null-link")
+	require.NoError(t, os.Symlink("/dev/null", symlink))
+
+	for desc, test := range map[string]struct {
+		device         *runtime.Device
+		expectedAccess string
+		expectErr      bool
+	}{
+		"should add device with requested permissions": {
+			device:         &runtime.Device{ContainerPath: "/dev/test", HostPath: "/dev/null", Permissions: "r"},
+			expectedAccess: "r",
+		},
+		"should add device with default permissions": {
+			device:         &runtime.Device{ContainerPath: "/dev/test", HostPath: "/dev/null"},
+			expectedAccess: "rwm",
+		},
+		"should resolve symlink of host device": {
+			device:         &runtime.Device{ContainerPath: "/dev/test", HostPath: symlink, Permissions: "rw"},
+			expectedAccess: "rw",
+		},
+		"should return error if host device is not found": {
+			device:    &runtime.Device{ContainerPath: "/dev/test", HostPath: filepath.Join(dir, "not-exist")},
+			expectErr: true,
+		},
+		"should return error if host path is not a device": {
+			device:    &runtime.Device{ContainerPath: "/dev/test", HostPath: regularFile},
+			expectErr: true,
+		},
+		"should return error for invalid permissions": {
+			device:    &runtime.Device{ContainerPath: "/dev/test", HostPath: "/dev/null", Permissions: "rwx"},
+			expectErr: true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		g := generate.New()
+		err := addOCIDevices(&g, []*runtime.Device{test.device}, false)
+		if test.expectErr {
+			assert.Error(t, err)
+			continue
+		}
+		require.NoError(t, err)
+		spec := g.Spec()
+		require.Len(t, spec.Linux.Devices, 1)
+		assert.Equal(t, "/dev/test", spec.Linux.Devices[0].Path)
+		assert.Equal(t, "c", spec.Linux.Devices[0].Type)
+		assert.EqualValues(t, 1, spec.Linux.Devices[0].Major)
+		assert.EqualValues(t, 3, spec.Linux.Devices[0].Minor)
+		rule := spec.Linux.Resources.Devices[len(spec.Linux.Resources.Devices)-1]
+		assert.True(t, rule.Allow)
+		assert.Equal(t, "c", rule.Type)
+		assert.EqualValues(t, 1, *rule.Major)
+		assert.EqualValues(t, 3, *rule.Minor)
+		assert.Equal(t, test.expectedAccess, rule.Access)
+	}
+}
+
+func TestValidateCPUSetList(t *testing.T) {
+	for list, expectErr := range map[string]bool{
+		"":          false,
+		"0":         false,
+		"0-3,7":     false,
+		"1,3-3,5-8": false,
+		"a":         true,
+		"0-":        true,
+		"-1":        true,
+		"3-0":       true,
+		"0,,1":      true,
+		"0-1-2":     true,
+	} {
+		t.Logf("TestCase %q", list)
+		assert.Equal(t, expectErr, validateCPUSetList(list) != nil)
+	}
+}
+
+func TestContainerSpecCPUSet(t *testing.T) {
+	testID := "test-id"
+	testPid := uint32(1234)
+	for desc, test := range map[string]struct {
+		annotations  map[string]string
+		expectedCPUs string
+		expectedMems string
+		expectErr    bool
+	}{
+		"should not pin if cpuset is not specified": {},
+		"should not pin if cpuset is empty": {
+			annotations: map[string]string{cpusetCPUsAnnotationKey: "", cpusetMemsAnnotationKey: ""},
+		},
+		"should pin to specified cpuset": {
+			annotations:  map[string]string{cpusetCPUsAnnotationKey: "0-3", cpusetMemsAnnotationKey: "0,1"},
+			expectedCPUs: "0-3",
+			expectedMems: "0,1",
+		},
+		"should return error for invalid cpuset": {
+			annotations: map[string]string{cpusetCPUsAnnotationKey: "invalid"},
+			expectErr:   true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		config, sandboxConfig, imageConfig, _ := getCreateContainerTestData()
+		config.Annotations = test.annotations
+		c := newTestCRIContainerdService()
+		spec, err := c.generateContainerSpec(testID, testPid, config, sandboxConfig, imageConfig, nil, "", "")
+		if test.expectErr {
+			assert.Error(t, err)
+			continue
+		}
+		require.NoError(t, err)
+		assert.Equal(t, test.expectedCPUs, spec.Linux.Resources.CPU.Cpus)
+		assert.Equal(t, test.expectedMems, spec.Linux.Resources.CPU.Mems)
+	}
+}
+
+func TestContainerSpecPIDNamespace(t *testing.T) {
+	testID := "test-id"
+	testPid := uint32(1234)
+	for desc, test := range map[string]struct {
+		annotations      map[string]string
+		sandboxHostPid   bool
+		containerHostPid bool
+		expected         *runtimespec.LinuxNamespace
+		expectErr        bool
+	}{
+		"should share sandbox pid namespace by default": {
+			expected: &runtimespec.LinuxNamespace{Type: runtimespec.PIDNamespace, Path: getPIDNamespace(testPid)},
+		},
+		"should share sandbox pid namespace in pod mode": {
+			annotations: map[string]string{pidNamespaceModeAnnotationKey: pidNamespaceModePod},
+			expected:    &runtimespec.LinuxNamespace{Type: runtimespec.PIDNamespace, Path: getPIDNamespace(testPid)},
+		},
+		"should create new pid namespace in container mode": {
+			annotations: map[string]string{pidNamespaceModeAnnotationKey: pidNamespaceModeContainer},
+			expected:    &runtimespec.LinuxNamespace{Type: runtimespec.PIDNamespace},
+		},
+		"should use host pid namespace if sandbox uses host pid": {
+			annotations:    map[string]string{pidNamespaceModeAnnotationKey: pidNamespaceModeContainer},
+			sandboxHostPid: true,
+		},
+		"should ignore host pid of a single container": {
+			containerHostPid: true,
+			expected:         &runtimespec.LinuxNamespace{Type: runtimespec.PIDNamespace, Path: getPIDNamespace(testPid)},
+		},
+		"should return error for unsupported mode": {
+			annotations: map[string]string{pidNamespaceModeAnnotationKey: "NODE"},
+			expectErr:   true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		config, sandboxConfig, imageConfig, _ := getCreateContainerTestData()
+		sandboxConfig.Annotations = test.annotations
+		sandboxConfig.Linux.SecurityContext = &runtime.LinuxSandboxSecurityContext{
+			NamespaceOptions: &runtime.NamespaceOption{HostPid: test.sandboxHostPid},
+		}
+		config.Linux.SecurityContext.NamespaceOptions = &runtime.NamespaceOption{HostPid: test.containerHostPid}
+		c := newTestCRIContainerdService()
+		spec, err := c.generateContainerSpec(testID, testPid, config, sandboxConfig, imageConfig, nil, "", "")
+		if test.expectErr {
+			assert.Error(t, err)
+			assert.Equal(t, codes.InvalidArgument, grpc.Code(err))
+			continue
+		}
+		require.NoError(t, err)
+		var pidNS *runtimespec.LinuxNamespace
+		for i, ns := range spec.Linux.Namespaces {
+			if ns.Type == runtimespec.PIDNamespace {
+				pidNS = &spec.Linux.Namespaces[i]
+			}
+		}
+		assert.Equal(t, test.expected, pidNS)
+	}
+}
+
+func TestContainerSpecHostNamespaces(t *testing.T) {
+	testID := "test-id"
+	testPid := uint32(1234)
+	for _, hostNetwork := range []bool{false, true} {
+		for _, hostPid := range []bool{false, true} {
+			for _, hostIpc := range []bool{false, true} {
+				t.Logf("TestCase host network %v, host pid %v, host ipc %v", hostNetwork, hostPid, hostIpc)
+				config, sandboxConfig, imageConfig, _ := getCreateContainerTestData()
+				sandboxConfig.Linux.SecurityContext = &runtime.LinuxSandboxSecurityContext{
+					NamespaceOptions: &runtime.NamespaceOption{
+						HostNetwork: hostNetwork,
+						HostPid:     hostPid,
+						HostIpc:     hostIpc,
+					},
+				}
+				c := newTestCRIContainerdService()
+				spec, err := c.generateContainerSpec(testID, testPid, config, sandboxConfig, imageConfig, nil, "", "")
+				require.NoError(t, err)
+				namespaces := make(map[runtimespec.LinuxNamespaceType]string)
+				for _, ns := range spec.Linux.Namespaces {
+					namespaces[ns.Type] = ns.Path
+				}
+				for nsType, test := range map[runtimespec.LinuxNamespaceType]struct {
+					host bool
+					path string
+				}{
+					runtimespec.NetworkNamespace: {host: hostNetwork, path: getNetworkNamespace(testPid)},
+					runtimespec.PIDNamespace:     {host: hostPid, path: getPIDNamespace(testPid)},
+					runtimespec.IPCNamespace:     {host: hostIpc, path: getIPCNamespace(testPid)},
+					runtimespec.UTSNamespace:     {path: getUTSNamespace(testPid)},
+				} {
+					path, ok := namespaces[nsType]
+					if test.host {
+						assert.False(t, ok, "%s namespace should be removed", nsType)
+						continue
+					}
+					assert.True(t, ok, "%s namespace should be set", nsType)
+					assert.Equal(t, test.path, path, "%s namespace should join sandbox", nsType)
+				}
+			}
+		}
+	}
+}
+
+func TestContainerSpecPidsLimit(t *testing.T) {
+	testID := "test-id"
+	testPid := uint32(1234)
+	for desc, test := range map[string]struct {
+		annotations  map[string]string
+		defaultLimit int64
+		expected     *runtimespec.LinuxPids
+		expectErr    bool
+	}{
+		"should not limit pids by default": {},
+		"should use node default if not specified": {
+			defaultLimit: 1024,
+			expected:     &runtimespec.LinuxPids{Limit: 1024},
+		},
+		"should prefer container limit over node default": {
+			annotations:  map[string]string{pidsLimitAnnotationKey: "100"},
+			defaultLimit: 1024,
+			expected:     &runtimespec.LinuxPids{Limit: 100},
+		},
+		"should not limit pids if container limit is 0": {
+			annotations:  map[string]string{pidsLimitAnnotationKey: "0"},
+			defaultLimit: 1024,
+		},
+		"should not limit pids if container limit is -1": {
+			annotations:  map[string]string{pidsLimitAnnotationKey: "-1"},
+			defaultLimit: 1024,
+		},
+		"should not limit pids if node default is -1": {
+			defaultLimit: -1,
+		},
+		"should return error for invalid limit": {
+			annotations: map[string]string{pidsLimitAnnotationKey: "invalid"},
+			expectErr:   true,
+		},
+		"should return error for limit less than -1": {
+			annotations: map[string]string{pidsLimitAnnotationKey: "-2"},
+			expectErr:   true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		config, sandboxConfig, imageConfig, _ := getCreateContainerTestData()
+		config.Annotations = test.annotations
+		c := newTestCRIContainerdService()
+		c.config.DefaultPidsLimit = test.defaultLimit
+		spec, err := c.generateContainerSpec(testID, testPid, config, sandboxConfig, imageConfig, nil, "", "")
+		if test.expectErr {
+			assert.Error(t, err)
+			assert.Equal(t, codes.InvalidArgument, grpc.Code(err))
+			continue
+		}
+		require.NoError(t, err)
+		assert.Equal(t, test.expected, spec.Linux.Resources.Pids)
+	}
+}
+
+func TestContainerSpecRlimits(t *testing.T) {
+	testID := "test-id"
+	testPid := uint32(1234)
+	config, sandboxConfig, imageConfig, specCheck := getCreateContainerTestData()
+	c := newTestCRIContainerdService()
+	c.defaultRlimits = map[string]rlimit{
+		"RLIMIT_NOFILE": {soft: 1024, hard: 4096},
+		"RLIMIT_CORE":   {soft: 0, hard: 0},
+	}
+	config.Annotations = map[string]string{rlimitsAnnotationKey: "nofile=65536:65536"}
+	spec, err := c.generateContainerSpec(testID, testPid, config, sandboxConfig, imageConfig, nil, "", "")
+	require.NoError(t, err)
+	specCheck(t, testID, testPid, spec)
+	assert.Contains(t, spec.Process.Rlimits, runtimespec.POSIXRlimit{Type: "RLIMIT_NOFILE", Soft: 65536, Hard: 65536})
+	assert.Contains(t, spec.Process.Rlimits, runtimespec.POSIXRlimit{Type: "RLIMIT_CORE", Soft: 0, Hard: 0})
+
+	t.Logf("Invalid rlimits should be rejected")
+	config.Annotations = map[string]string{rlimitsAnnotationKey: "nofile=2:1"}
+	_, err = c.generateContainerSpec(testID, testPid, config, sandboxConfig, imageConfig, nil, "", "")
+	assert.Error(t, err)
+}
+
+func TestGetTmpfsMounts(t *testing.T) {
+	for desc, test := range map[string]struct {
+		annotations map[string]string
+		memoryLimit int64
+		expected    map[string][]string
+		expectErr   bool
+	}{
+		"should return nil if no tmpfs mount is requested": {},
+		"should use default mode and no size without memory limit": {
+			annotations: map[string]string{tmpfsMountsAnnotationKey: `{"/cache":{}}`},
+			expected:    map[string][]string{"/cache": {"nosuid", "nodev", "mode=1777"}},
+		},
+		"should use memory limit as size if size is not specified": {
+			annotations: map[string]string{tmpfsMountsAnnotationKey: `{"/cache/":{"mode":"0755"}}`},
+			memoryLimit: 1024,
+			expected:    map[string][]string{"/cache": {"nosuid", "nodev", "mode=0755", "size=1024"}},
+		},
+		"should use size if it is smaller than memory limit": {
+			annotations: map[string]string{tmpfsMountsAnnotationKey: `{"/cache":{"size":"1Ki"}}`},
+			memoryLimit: 4096,
+			expected:    map[string][]string{"/cache": {"nosuid", "nodev", "mode=1777", "size=1024"}},
+		},
+		"should cap size by memory limit": {
+			annotations: map[string]string{tmpfsMountsAnnotationKey: `{"/cache":{"size":"1Mi"}}`},
+			memoryLimit: 4096,
+			expected:    map[string][]string{"/cache": {"nosuid", "nodev", "mode=1777", "size=4096"}},
+		},
+		"should return error for invalid json": {
+			annotations: map[string]string{tmpfsMountsAnnotationKey: "invalid"},
+			expectErr:   true,
+		},
+		"should return error for relative path": {
+			annotations: map[string]string{tmpfsMountsAnnotationKey: `{"cache":{}}`},
+			expectErr:   true,
+		},
+		"should return error for invalid size": {
+			annotations: map[string]string{tmpfsMountsAnnotationKey: `{"/cache":{"size":"invalid"}}`},
+			expectErr:   true,
+		},
+		"should return error for invalid mode": {
+			annotations: map[string]string{tmpfsMountsAnnotationKey: `{"/cache":{"mode":"999"}}`},
+			expectErr:   true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		mounts, err := getTmpfsMounts(test.annotations, test.memoryLimit)
+		if test.expectErr {
+			assert.Error(t, err)
+			continue
+		}
+		assert.NoError(t, err)
+		assert.Equal(t, test.expected, mounts)
+	}
+}
+
+func TestContainerSpecWithTmpfsMounts(t *testing.T) {
+	testID := "test-id"
+	testPid := uint32(1234)
+	config, sandboxConfig, imageConfig, specCheck := getCreateContainerTestData()
+	c := newTestCRIContainerdService()
+	config.Annotations = map[string]string{tmpfsMountsAnnotationKey: `{"/test-tmpfs":{"size":"64Mi"}}`}
+	config.Mounts = append(config.Mounts, &runtime.Mount{
+		ContainerPath: "/test-tmpfs",
+		HostPath:      "test-host-path",
+	})
+	spec, err := c.generateContainerSpec(testID, testPid, config, sandboxConfig, imageConfig, nil, "", "")
+	require.NoError(t, err)
+	specCheck(t, testID, testPid, spec)
+	var mounts []runtimespec.Mount
+	for _, m := range spec.Mounts {
+		if m.Destination == "/test-tmpfs" {
+			mounts = append(mounts, m)
+		}
+	}
+	t.Logf("Tmpfs mount should replace the bind mount")
+	require.Len(t, mounts, 1)
+	assert.Equal(t, "tmpfs", mounts[0].Type)
+	t.Logf("Tmpfs size should be capped by the memory limit")
+	assert.Contains(t, mounts[0].Options, "size=400")
+}
+
+func TestContainerSpecAnnotations(t *testing.T) {
+	testID := "test-id"
+	testPid := uint32(1234)
+	config, sandboxConfig, imageConfig, specCheck := getCreateContainerTestData()
+	c := newTestCRIContainerdService()
+	c.config.AllowedAnnotations = []string{"io.katacontainers.*", "gpu.allowed"}
+	sandboxConfig.Annotations = map[string]string{
+		"io.katacontainers.sandbox": "sandbox-value",
+		"io.katacontainers.shared":  "sandbox-value",
+		"sandbox.not-allowed":       "sandbox-value",
+	}
+	config.Annotations = map[string]string{
+		"io.katacontainers.shared": "container-value",
+		"gpu.allowed":              "container-value",
+		"container.not-allowed":    "container-value",
+	}
+	spec, err := c.generateContainerSpec(testID, testPid, config, sandboxConfig, imageConfig, nil, "", "")
+	require.NoError(t, err)
+	specCheck(t, testID, testPid, spec)
+	t.Logf("Only allowed annotations should be passed through, and container annotations should override")
+	assert.Equal(t, map[string]string{
+		"io.katacontainers.sandbox": "sandbox-value",
+		"io.katacontainers.shared":  "container-value",
+		"gpu.allowed":               "container-value",
+	}, spec.Annotations)
+}
+
+func TestContainerSpecEnvs(t *testing.T) {
+	testID := "test-id"
+	testPid := uint32(1234)
+	for desc, test := range map[string]struct {
+		imageEnvs []string
+		envs      []*runtime.KeyValue
+		expected  []string
+		expectErr bool
+	}{
+		"image envs should be kept if not overridden": {
+			imageEnvs: []string{"PATH=/usr/local/bin:/usr/bin", "ik1=iv1"},
+			envs:      []*runtime.KeyValue{{Key: "k1", Value: "v1"}},
+			expected:  []string{"PATH=/usr/local/bin:/usr/bin", "ik1=iv1", "k1=v1"},
+		},
+		"container envs should override image envs": {
+			imageEnvs: []string{"PATH=/usr/bin", "k1=iv1"},
+			envs:      []*runtime.KeyValue{{Key: "k1", Value: "v1"}},
+			expected:  []string{"PATH=/usr/bin", "k1=v1"},
+		},
+		"the last value of duplicated container envs should win": {
+			imageEnvs: []string{"PATH=/usr/bin"},
+			envs: []*runtime.KeyValue{
+				{Key: "k1", Value: "v1"},
+				{Key: "k1", Value: "v2"},
+			},
+			expected: []string{"PATH=/usr/bin", "k1=v2"},
+		},
+		"env values containing '=' should be kept": {
+			imageEnvs: []string{"PATH=/usr/bin", "ik1=a=b"},
+			envs:      []*runtime.KeyValue{{Key: "k1", Value: "c=d"}},
+			expected:  []string{"PATH=/usr/bin", "ik1=a=b", "k1=c=d"},
+		},
+		"should return error for invalid image env": {
+			imageEnvs: []string{"PATH"},
+			expectErr: true,
+		},
+		"should return error for image env with empty key": {
+			imageEnvs: []string{"=value"},
+			expectErr: true,
+		},
+		"should return error for container env with empty key": {
+			envs:      []*runtime.KeyValue{{Key: "", Value: "value"}},
+			expectErr: true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		config, sandboxConfig, imageConfig, _ := getCreateContainerTestData()
+		c := newTestCRIContainerdService()
+		imageConfig.Env = test.imageEnvs
+		config.Envs = test.envs
+		spec, err := c.generateContainerSpec(testID, testPid, config, sandboxConfig, imageConfig, nil, "", "")
+		if test.expectErr {
+			assert.Error(t, err)
+			continue
+		}
+		require.NoError(t, err)
+		assert.Equal(t, test.expected, spec.Process.Env)
+	}
+}
+
 func TestContainerSpecCommand(t *testing.T) {
 	for desc, test := range map[string]struct {
 		criEntrypoint   []string
@@ -289,8 +1076,37 @@ func TestContainerSpecCommand(t *testing.T) {
 		"should return error if both entrypoint and args are empty": {
 			expectErr: true,
 		},
+		"should use image cmd if image entrypoint is reset": {
+			imageEntrypoint: []string{""},
+			imageArgs:       []string{"a", "b"},
+			expected:        []string{"a", "b"},
+		},
+		"should use image entrypoint if image cmd is reset": {
+			imageEntrypoint: []string{"a", "b"},
+			imageArgs:       []string{""},
+			expected:        []string{"a", "b"},
+		},
+		"should use image shell form cmd": {
+			imageArgs: []string{"/bin/sh", "-c", "echo hello"},
+			expected:  []string{"/bin/sh", "-c", "echo hello"},
+		},
+		"should override image shell form entrypoint with cri entrypoint": {
+			criEntrypoint:   []string{"a"},
+			imageEntrypoint: []string{"/bin/sh", "-c", "echo hello"},
+			imageArgs:       []string{"b"},
+			expected:        []string{"a"},
+		},
+		"should return error if both image entrypoint and cmd are reset": {
+			imageEntrypoint: []string{""},
+			imageArgs:       []string{""},
+			expectErr:       true,
+		},
+		"should return error if the executable is empty": {
+			criEntrypoint: []string{"", "a"},
+			expectErr:     true,
+		},
 	} {
-
+		t.Logf("TestCase %q", desc)
 		config, _, imageConfig, _ := getCreateContainerTestData()
 		g := generate.New()
 		config.Command = test.criEntrypoint
@@ -311,13 +1127,46 @@ func TestGenerateContainerMounts(t *testing.T) {
 	testSandboxRootDir := "test-sandbox-root"
 	for desc, test := range map[string]struct {
 		securityContext *runtime.LinuxContainerSecurityContext
+		sandboxHostIpc  bool
 		expectedMounts  []*runtime.Mount
 	}{
+		"should use sandbox /dev/shm when only container host ipc is set": {
+			securityContext: &runtime.LinuxContainerSecurityContext{
+				NamespaceOptions: &runtime.NamespaceOption{HostIpc: true},
+			},
+			expectedMounts: []*runtime.Mount{
+				{
+					ContainerPath: "/etc/hostname",
+					HostPath:      testSandboxRootDir + "/hostname",
+					Readonly:      false,
+				},
+				{
+					ContainerPath: "/etc/hosts",
+					HostPath:      testSandboxRootDir + "/hosts",
+					Readonly:      false,
+				},
+				{
+					ContainerPath: resolvConfPath,
+					HostPath:      testSandboxRootDir + "/resolv.conf",
+					Readonly:      false,
+				},
+				{
+					ContainerPath: "/dev/shm",
+					HostPath:      testSandboxRootDir + "/shm",
+					Readonly:      false,
+				},
+			},
+		},
 		"should setup ro mount when rootfs is read-only": {
 			securityContext: &runtime.LinuxContainerSecurityContext{
 				ReadonlyRootfs: true,
 			},
 			expectedMounts: []*runtime.Mount{
+				{
+					ContainerPath: "/etc/hostname",
+					HostPath:      testSandboxRootDir + "/hostname",
+					Readonly:      true,
+				},
 				{
 					ContainerPath: "/etc/hosts",
 					HostPath:      testSandboxRootDir + "/hosts",
@@ -338,6 +1187,11 @@ func TestGenerateContainerMounts(t *testing.T) {
 		"should setup rw mount when rootfs is read-write": {
 			securityContext: &runtime.LinuxContainerSecurityContext{},
 			expectedMounts: []*runtime.Mount{
+				{
+					ContainerPath: "/etc/hostname",
+					HostPath:      testSandboxRootDir + "/hostname",
+					Readonly:      false,
+				},
 				{
 					ContainerPath: "/etc/hosts",
 					HostPath:      testSandboxRootDir + "/hosts",
@@ -355,11 +1209,14 @@ func TestGenerateContainerMounts(t *testing.T) {
 				},
 			},
 		},
-		"should use host /dev/shm when host ipc is set": {
-			securityContext: &runtime.LinuxContainerSecurityContext{
-				NamespaceOptions: &runtime.NamespaceOption{HostIpc: true},
-			},
+		"should use host /dev/shm when sandbox host ipc is set": {
+			sandboxHostIpc: true,
 			expectedMounts: []*runtime.Mount{
+				{
+					ContainerPath: "/etc/hostname",
+					HostPath:      testSandboxRootDir + "/hostname",
+					Readonly:      false,
+				},
 				{
 					ContainerPath: "/etc/hosts",
 					HostPath:      testSandboxRootDir + "/hosts",
@@ -388,11 +1245,99 @@ func TestGenerateContainerMounts(t *testing.T) {
 			},
 		}
 		c := newTestCRIContainerdService()
-		mounts := c.generateContainerMounts(testSandboxRootDir, config)
+		sandboxConfig := &runtime.PodSandboxConfig{
+			Linux: &runtime.LinuxPodSandboxConfig{
+				SecurityContext: &runtime.LinuxSandboxSecurityContext{
+					NamespaceOptions: &runtime.NamespaceOption{HostIpc: test.sandboxHostIpc},
+				},
+			},
+		}
+		mounts := c.generateContainerMounts(testSandboxRootDir, sandboxConfig, config)
 		assert.Equal(t, test.expectedMounts, mounts, desc)
 	}
 }
 
+func TestContainerSpecPrivilegedInNonPrivilegedSandbox(t *testing.T) {
+	testID := "test-id"
+	testPid := uint32(1234)
+	config, sandboxConfig, imageConfig, _ := getCreateContainerTestData()
+	config.Linux.SecurityContext.Privileged = true
+	c := newTestCRIContainerdService()
+	_, err := c.generateContainerSpec(testID, testPid, config, sandboxConfig, imageConfig, nil, "", "")
+	assert.Error(t, err)
+	assert.Equal(t, codes.InvalidArgument, grpc.Code(err))
+
+	sandboxConfig.Linux.SecurityContext = &runtime.LinuxSandboxSecurityContext{Privileged: true}
+	spec, err := c.generateContainerSpec(testID, testPid, config, sandboxConfig, imageConfig, nil, "", "")
+	require.NoError(t, err)
+	assert.Nil(t, spec.Linux.MaskedPaths)
+	assert.Nil(t, spec.Linux.ReadonlyPaths)
+	assert.Equal(t, []runtimespec.LinuxDeviceCgroup{{Allow: true, Access: "rwm"}}, spec.Linux.Resources.Devices)
+	assert.Contains(t, spec.Process.Capabilities.Effective, "CAP_SYS_ADMIN")
+	assert.Empty(t, spec.Process.ApparmorProfile)
+	assert.Nil(t, spec.Linux.Seccomp)
+}
+
+func TestSetOCIMaskedReadonlyPaths(t *testing.T) {
+	for desc, test := range map[string]struct {
+		annotations           map[string]string
+		privileged            bool
+		expectedMaskedPaths   []string
+		expectedReadonlyPaths []string
+		expectErr             bool
+	}{
+		"should set default masked and readonly paths": {
+			expectedMaskedPaths:   defaultMaskedPaths,
+			expectedReadonlyPaths: defaultReadonlyPaths,
+		},
+		"should override masked and readonly paths with annotations": {
+			annotations: map[string]string{
+				maskedPathsAnnotationKey:   `["/proc/kcore", "/custom/masked"]`,
+				readonlyPathsAnnotationKey: `["/proc/sys"]`,
+			},
+			expectedMaskedPaths:   []string{"/proc/kcore", "/custom/masked"},
+			expectedReadonlyPaths: []string{"/proc/sys"},
+		},
+		"should unmask all paths with empty list": {
+			annotations: map[string]string{
+				maskedPathsAnnotationKey:   `[]`,
+				readonlyPathsAnnotationKey: `[]`,
+			},
+		},
+		"should keep default readonly paths if only masked paths are overridden": {
+			annotations:           map[string]string{maskedPathsAnnotationKey: `["/proc/kcore"]`},
+			expectedMaskedPaths:   []string{"/proc/kcore"},
+			expectedReadonlyPaths: defaultReadonlyPaths,
+		},
+		"should clear masked and readonly paths for privileged container": {
+			annotations: map[string]string{maskedPathsAnnotationKey: `["/proc/kcore"]`},
+			privileged:  true,
+		},
+		"should return error for malformed annotation": {
+			annotations: map[string]string{maskedPathsAnnotationKey: `"/proc/kcore"`},
+			expectErr:   true,
+		},
+		"should return error for relative path": {
+			annotations: map[string]string{readonlyPathsAnnotationKey: `["proc/sys"]`},
+			expectErr:   true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		spec, err := containerd.GenerateSpec()
+		require.NoError(t, err)
+		g := generate.NewFromSpec(spec)
+		err = setOCIMaskedReadonlyPaths(&g, test.annotations, test.privileged)
+		if test.expectErr {
+			assert.Error(t, err)
+			assert.Equal(t, codes.InvalidArgument, grpc.Code(err))
+			continue
+		}
+		require.NoError(t, err)
+		assert.Equal(t, test.expectedMaskedPaths, g.Spec().Linux.MaskedPaths)
+		assert.Equal(t, test.expectedReadonlyPaths, g.Spec().Linux.ReadonlyPaths)
+	}
+}
+
 func TestPrivilegedBindMount(t *testing.T) {
 	for desc, test := range map[string]struct {
 		privileged         bool
@@ -419,7 +1364,7 @@ func TestPrivilegedBindMount(t *testing.T) {
 		t.Logf("TestCase %q", desc)
 		g := generate.New()
 		g.SetRootReadonly(test.readonlyRootFS)
-		addOCIBindMounts(&g, nil, test.privileged)
+		addOCIBindMounts(&g, nil, nil, test.privileged)
 		spec := g.Spec()
 		if test.expectedSysFSRO {
 			checkMount(t, spec.Mounts, "sysfs", "/sys", "sysfs", []string{"ro"}, nil)
@@ -433,3 +1378,367 @@ func TestPrivilegedBindMount(t *testing.T) {
 		}
 	}
 }
+
+func TestMountPropagation(t *testing.T) {
+	for desc, test := range map[string]struct {
+		propagations            map[string]string
+		expectedOption          string
+		expectedRootPropagation string
+	}{
+		"should mount as private by default": {
+			expectedOption: "rprivate",
+		},
+		"should mount as private if private propagation is requested": {
+			propagations:   map[string]string{"/test-container-path": propagationPrivate},
+			expectedOption: "rprivate",
+		},
+		"should mount as rslave and set rootfs rslave if host to container propagation is requested": {
+			propagations:            map[string]string{"/test-container-path": propagationHostToContainer},
+			expectedOption:          "rslave",
+			expectedRootPropagation: "rslave",
+		},
+		"should mount as rshared and set rootfs rshared if bidirectional propagation is requested": {
+			propagations:            map[string]string{"/test-container-path": propagationBidirectional},
+			expectedOption:          "rshared",
+			expectedRootPropagation: "rshared",
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		g := generate.New()
+		addOCIBindMounts(&g, []*runtime.Mount{
+			{
+				ContainerPath: "/test-container-path",
+				HostPath:      "test-host-path",
+			},
+		}, test.propagations, false)
+		spec := g.Spec()
+		checkMount(t, spec.Mounts, "test-host-path", "/test-container-path", "bind",
+			[]string{test.expectedOption}, nil)
+		assert.Equal(t, test.expectedRootPropagation, spec.Linux.RootfsPropagation)
+	}
+}
+
+func TestMountPropagationRootfsSharedPrecedence(t *testing.T) {
+	g := generate.New()
+	addOCIBindMounts(&g, []*runtime.Mount{
+		{ContainerPath: "/shared", HostPath: "test-host-path-1"},
+		{ContainerPath: "/slave", HostPath: "test-host-path-2"},
+	}, map[string]string{
+		"/shared": propagationBidirectional,
+		"/slave":  propagationHostToContainer,
+	}, false)
+	assert.Equal(t, "rshared", g.Spec().Linux.RootfsPropagation)
+}
+
+func TestChownMounts(t *testing.T) {
+	mounts := []*runtime.Mount{
+		{ContainerPath: "/test-chown", HostPath: "/test-host-chown"},
+		{ContainerPath: "/test-no-chown", HostPath: "/test-host-no-chown"},
+		{ContainerPath: "/test-chown-ro", HostPath: "/test-host-chown-ro", Readonly: true},
+	}
+	for desc, test := range map[string]struct {
+		annotations        map[string]string
+		sandboxAnnotations map[string]string
+		enableFSGroupChown bool
+		uid                uint32
+		uidMapping         *runtimespec.LinuxIDMapping
+		expectedCalls      []ostesting.CalledDetail
+		expectErr          bool
+	}{
+		"should not chown if not requested": {
+			uid:           1000,
+			expectedCalls: []ostesting.CalledDetail{},
+		},
+		"should chown to root if the resolved user is root": {
+			annotations: map[string]string{chownMountsAnnotationKey: `["/test-chown"]`},
+			expectedCalls: []ostesting.CalledDetail{{
+				Name:      "Chown",
+				Arguments: []interface{}{"/test-host-chown", 0, -1},
+			}},
+		},
+		"should only chown requested mounts": {
+			annotations: map[string]string{chownMountsAnnotationKey: `["/test-chown/"]`},
+			uid:         1000,
+			expectedCalls: []ostesting.CalledDetail{{
+				Name:      "Chown",
+				Arguments: []interface{}{"/test-host-chown", 1000, -1},
+			}},
+		},
+		"should shift uid with user namespace": {
+			annotations: map[string]string{chownMountsAnnotationKey: `["/test-chown"]`},
+			uid:         1000,
+			uidMapping:  &runtimespec.LinuxIDMapping{ContainerID: 0, HostID: 100000, Size: 65536},
+			expectedCalls: []ostesting.CalledDetail{{
+				Name:      "Chown",
+				Arguments: []interface{}{"/test-host-chown", 101000, -1},
+			}},
+		},
+		"should return error for invalid json": {
+			annotations:   map[string]string{chownMountsAnnotationKey: "invalid"},
+			uid:           1000,
+			expectedCalls: []ostesting.CalledDetail{},
+			expectErr:     true,
+		},
+		"should not chgrp to fs group if not enabled": {
+			annotations:        map[string]string{chownMountsAnnotationKey: `["/test-chown"]`},
+			sandboxAnnotations: map[string]string{fsGroupAnnotationKey: "2000"},
+			uid:                1000,
+			expectedCalls: []ostesting.CalledDetail{{
+				Name:      "Chown",
+				Arguments: []interface{}{"/test-host-chown", 1000, -1},
+			}},
+		},
+		"should chgrp writable mounts to fs group if enabled": {
+			annotations:        map[string]string{chownMountsAnnotationKey: `["/test-chown", "/test-chown-ro"]`},
+			sandboxAnnotations: map[string]string{fsGroupAnnotationKey: "2000"},
+			enableFSGroupChown: true,
+			expectedCalls: []ostesting.CalledDetail{
+				{
+					Name:      "Chown",
+					Arguments: []interface{}{"/test-host-chown", 0, 2000},
+				},
+				{
+					Name:      "Chown",
+					Arguments: []interface{}{"/test-host-chown-ro", 0, -1},
+				},
+			},
+		},
+		"should chown read-only mounts without chgrp": {
+			annotations:        map[string]string{chownMountsAnnotationKey: `["/test-chown", "/test-chown-ro"]`},
+			sandboxAnnotations: map[string]string{fsGroupAnnotationKey: "2000"},
+			enableFSGroupChown: true,
+			uid:                1000,
+			expectedCalls: []ostesting.CalledDetail{
+				{
+					Name:      "Chown",
+					Arguments: []interface{}{"/test-host-chown", 1000, 2000},
+				},
+				{
+					Name:      "Chown",
+					Arguments: []interface{}{"/test-host-chown-ro", 1000, -1},
+				},
+			},
+		},
+		"should shift fs group with user namespace": {
+			annotations:        map[string]string{chownMountsAnnotationKey: `["/test-chown"]`},
+			sandboxAnnotations: map[string]string{fsGroupAnnotationKey: "2000"},
+			enableFSGroupChown: true,
+			uidMapping:         &runtimespec.LinuxIDMapping{ContainerID: 0, HostID: 100000, Size: 65536},
+			expectedCalls: []ostesting.CalledDetail{{
+				Name:      "Chown",
+				Arguments: []interface{}{"/test-host-chown", 100000, 102000},
+			}},
+		},
+		"should return error for invalid fs group": {
+			annotations:        map[string]string{chownMountsAnnotationKey: `["/test-chown"]`},
+			sandboxAnnotations: map[string]string{fsGroupAnnotationKey: "invalid"},
+			enableFSGroupChown: true,
+			expectedCalls:      []ostesting.CalledDetail{},
+			expectErr:          true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		c := newTestCRIContainerdService()
+		c.config.EnableFSGroupChown = test.enableFSGroupChown
+		if test.uidMapping != nil {
+			c.uidMapping = test.uidMapping
+			c.gidMapping = test.uidMapping
+		}
+		fakeOS := c.os.(*ostesting.FakeOS)
+		config := &runtime.ContainerConfig{
+			Annotations: test.annotations,
+			Mounts:      mounts,
+		}
+		err := c.chownMounts(&runtime.PodSandboxConfig{Annotations: test.sandboxAnnotations}, config, test.uid)
+		assert.Equal(t, test.expectErr, err != nil)
+		assert.Equal(t, test.expectedCalls, fakeOS.GetCalls())
+	}
+}
+
+func TestGetMountPropagations(t *testing.T) {
+	for desc, test := range map[string]struct {
+		annotations map[string]string
+		expected    map[string]string
+		expectErr   bool
+	}{
+		"should return nil if no propagation is requested": {},
+		"should return cleaned propagations": {
+			annotations: map[string]string{mountPropagationAnnotationKey: `{"/test/":"rshared"}`},
+			expected:    map[string]string{"/test": "rshared"},
+		},
+		"should return error for invalid json": {
+			annotations: map[string]string{mountPropagationAnnotationKey: "invalid"},
+			expectErr:   true,
+		},
+		"should return error for unsupported propagation": {
+			annotations: map[string]string{mountPropagationAnnotationKey: `{"/test":"shared"}`},
+			expectErr:   true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		propagations, err := getMountPropagations(test.annotations)
+		if test.expectErr {
+			assert.Error(t, err)
+			continue
+		}
+		assert.NoError(t, err)
+		assert.Equal(t, test.expected, propagations)
+	}
+}
+
+func TestGetContainerRestartCount(t *testing.T) {
+	for desc, test := range map[string]struct {
+		existing []containerstore.Metadata
+		attempt  uint32
+		expected uint32
+	}{
+		"should return attempt if there is no previous container": {
+			attempt:  2,
+			expected: 2,
+		},
+		"should increase restart count of previous container with the same name": {
+			existing: []containerstore.Metadata{
+				{ID: "id-1", SandboxID: "test-sandbox-id", RestartCount: 0},
+				{ID: "id-2", SandboxID: "test-sandbox-id", RestartCount: 1},
+			},
+			expected: 2,
+		},
+		"should return attempt if it is larger than the restart count": {
+			existing: []containerstore.Metadata{
+				{ID: "id-1", SandboxID: "test-sandbox-id", RestartCount: 1},
+			},
+			attempt:  5,
+			expected: 5,
+		},
+		"should ignore containers in other sandboxes": {
+			existing: []containerstore.Metadata{
+				{ID: "id-1", SandboxID: "other-sandbox-id", RestartCount: 3},
+			},
+			expected: 0,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		c := newTestCRIContainerdService()
+		for _, meta := range test.existing {
+			meta.Config = &runtime.ContainerConfig{
+				Metadata: &runtime.ContainerMetadata{Name: "test-name"},
+			}
+			container, err := containerstore.NewContainer(meta, containerstore.Status{})
+			require.NoError(t, err)
+			require.NoError(t, c.containerStore.Add(container))
+		}
+		// Containers with other names should be ignored.
+		other, err := containerstore.NewContainer(containerstore.Metadata{
+			ID:           "other-id",
+			SandboxID:    "test-sandbox-id",
+			Config:       &runtime.ContainerConfig{Metadata: &runtime.ContainerMetadata{Name: "other-name"}},
+			RestartCount: 10,
+		}, containerstore.Status{})
+		require.NoError(t, err)
+		require.NoError(t, c.containerStore.Add(other))
+		count := c.getContainerRestartCount("test-sandbox-id", &runtime.ContainerMetadata{
+			Name:    "test-name",
+			Attempt: test.attempt,
+		})
+		assert.Equal(t, test.expected, count)
+	}
+}
+
+func TestCreateContainerRetry(t *testing.T) {
+	sandboxConfig := &runtime.PodSandboxConfig{
+		Metadata: &runtime.PodSandboxMetadata{
+			Name:      "test-sandbox-name",
+			Namespace: "test-sandbox-ns",
+			Uid:       "test-sandbox-uid",
+		},
+	}
+	const imageID = "sha256:c75bebcdd211f41b3a460c7bf82970ed6c75acaab9cd4c9a4e125b03ca113799"
+	config := &runtime.ContainerConfig{
+		Metadata: &runtime.ContainerMetadata{Name: "test-name", Attempt: 1},
+		Image:    &runtime.ImageSpec{Image: imageID},
+	}
+	otherConfig := &runtime.ContainerConfig{
+		Metadata: &runtime.ContainerMetadata{Name: "test-name", Attempt: 1},
+		Image:    &runtime.ImageSpec{Image: imageID},
+		Command:  []string{"other-command"},
+	}
+	name := makeContainerName(config.GetMetadata(), sandboxConfig.GetMetadata())
+	for desc, test := range map[string]struct {
+		existingSandboxID string
+		existingConfig    *runtime.ContainerConfig
+		existingImageRef  string
+		created           bool
+		expectID          string
+		expectCode        codes.Code
+	}{
+		"should return existing container for a retried request": {
+			existingSandboxID: "test-sandbox-id",
+			existingConfig:    config,
+			existingImageRef:  imageID,
+			created:           true,
+			expectID:          "existing-id",
+		},
+		"should return already exists if the existing container is still being created": {
+			existingSandboxID: "test-sandbox-id",
+			expectCode:        codes.AlreadyExists,
+		},
+		"should return already exists if the existing container is in another sandbox": {
+			existingSandboxID: "other-sandbox-id",
+			existingConfig:    config,
+			existingImageRef:  imageID,
+			created:           true,
+			expectCode:        codes.AlreadyExists,
+		},
+		"should return already exists if the existing container has a different config": {
+			existingSandboxID: "test-sandbox-id",
+			existingConfig:    otherConfig,
+			existingImageRef:  imageID,
+			created:           true,
+			expectCode:        codes.AlreadyExists,
+		},
+		"should return already exists if the existing container has a different image": {
+			existingSandboxID: "test-sandbox-id",
+			existingConfig:    config,
+			existingImageRef:  "sha256:0000000000000000000000000000000000000000000000000000000000000000",
+			created:           true,
+			expectCode:        codes.AlreadyExists,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		c := newTestCRIContainerdService()
+		require.NoError(t, c.sandboxStore.Add(sandboxstore.Sandbox{
+			Metadata: sandboxstore.Metadata{
+				ID:     "test-sandbox-id",
+				Config: sandboxConfig,
+			},
+		}))
+		c.imageStore.Add(imagestore.Image{ID: imageID})
+		require.NoError(t, c.containerNameIndex.Reserve(name, "existing-id"))
+		if test.created {
+			container, err := containerstore.NewContainer(containerstore.Metadata{
+				ID:        "existing-id",
+				Name:      name,
+				SandboxID: test.existingSandboxID,
+				Config:    test.existingConfig,
+				ImageRef:  test.existingImageRef,
+			}, containerstore.Status{})
+			require.NoError(t, err)
+			require.NoError(t, c.containerStore.Add(container))
+		}
+		resp, err := c.CreateContainer(context.Background(), &runtime.CreateContainerRequest{
+			PodSandboxId:  "test-sandbox-id",
+			Config:        config,
+			SandboxConfig: sandboxConfig,
+		})
+		if test.expectCode != codes.OK {
+			require.Error(t, err)
+			assert.Equal(t, test.expectCode, grpc.Code(err))
+			continue
+		}
+		require.NoError(t, err)
+		assert.Equal(t, test.expectID, resp.GetContainerId())
+		key, ok := c.containerNameIndex.GetKeyByName(name)
+		assert.True(t, ok, "name reservation should be kept")
+		assert.Equal(t, "existing-id", key)
+	}
+}
@@ -20,25 +20,46 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"sync"
 	"time"
 
 	"github.com/containerd/containerd"
 	"github.com/containerd/containerd/api/services/events/v1"
 	"github.com/containerd/containerd/typeurl"
-	"github.com/golang/glog"
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/any"
 	"golang.org/x/net/context"
+	"golang.org/x/sys/unix"
+	rpcstatus "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"k8s.io/client-go/tools/remotecommand"
 	"k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+
+	"github.com/kubernetes-incubator/cri-containerd/pkg/log"
 )
 
+// execTimeoutExitCode is the exit code returned by ExecSync if the timeout is
+// exceeded. It's distinct from the exit code of any process.
+const execTimeoutExitCode = -1
+
+// typeURLPrefix is the prefix of the type url of protobuf messages in grpc
+// status details.
+const typeURLPrefix = "type.googleapis.com/"
+
 // ExecSync executes a command in the container, and returns the stdout output.
-// If command exits with a non-zero exit code, an error is returned.
+// If the timeout is exceeded, the command is killed, and a DeadlineExceeded error
+// is returned together with the output collected so far and execTimeoutExitCode.
+// grpc drops the response if an error is returned, so the partial response is
+// also attached to the error status details.
 func (c *criContainerdService) ExecSync(ctx context.Context, r *runtime.ExecSyncRequest) (retRes *runtime.ExecSyncResponse, retErr error) {
-	glog.V(2).Infof("ExecSync for %q with command %+v and timeout %d (s)", r.GetContainerId(), r.GetCmd(), r.GetTimeout())
+	log.G(ctx).V(2).Infof("ExecSync for %q with command %+v and timeout %d (s)", r.GetContainerId(), r.GetCmd(), r.GetTimeout())
 	defer func() {
 		if retErr == nil {
-			glog.V(2).Infof("ExecSync for %q returns with exit code %d", r.GetContainerId(), retRes.GetExitCode())
-			glog.V(4).Infof("ExecSync for %q outputs - stdout: %q, stderr: %q", r.GetContainerId(),
+			log.G(ctx).V(2).Infof("ExecSync for %q returns with exit code %d", r.GetContainerId(), retRes.GetExitCode())
+			log.G(ctx).V(4).Infof("ExecSync for %q outputs - stdout: %q, stderr: %q", r.GetContainerId(),
 				retRes.GetStdout(), retRes.GetStderr())
 		}
 	}()
@@ -50,17 +71,50 @@ func (c *criContainerdService) ExecSync(ctx context.Context, r *runtime.ExecSync
 		stderr:  &stderr,
 		timeout: time.Duration(r.GetTimeout()) * time.Second,
 	})
+	return toExecSyncResponse(ctx, exitCode, err, stdout.Bytes(), stderr.Bytes())
+}
+
+// toExecSyncResponse converts the result of execInContainer into the ExecSync
+// response. On timeout, the partial response is returned with a DeadlineExceeded
+// error carrying the response in its status details.
+func toExecSyncResponse(ctx context.Context, exitCode *uint32, err error, stdout, stderr []byte) (*runtime.ExecSyncResponse, error) {
 	if err != nil {
+		if _, ok := err.(*execTimeoutError); ok {
+			log.G(ctx).V(2).Infof("ExecSync is killed: %v", err)
+			// Return the partial output with a distinct exit code.
+			resp := &runtime.ExecSyncResponse{
+				Stdout:   stdout,
+				Stderr:   stderr,
+				ExitCode: execTimeoutExitCode,
+			}
+			return resp, newExecSyncTimeoutError(resp, err)
+		}
 		return nil, fmt.Errorf("failed to exec in container: %v", err)
 	}
-
 	return &runtime.ExecSyncResponse{
-		Stdout:   stdout.Bytes(),
-		Stderr:   stderr.Bytes(),
+		Stdout:   stdout,
+		Stderr:   stderr,
 		ExitCode: int32(*exitCode),
 	}, nil
 }
 
+// newExecSyncTimeoutError returns a DeadlineExceeded grpc error with the partial
+// ExecSync response in the status details.
+func newExecSyncTimeoutError(resp *runtime.ExecSyncResponse, err error) error {
+	data, marshalErr := proto.Marshal(resp)
+	if marshalErr != nil {
+		return grpc.Errorf(codes.DeadlineExceeded, "%v", err)
+	}
+	return status.ErrorProto(&rpcstatus.Status{
+		Code:    int32(codes.DeadlineExceeded),
+		Message: err.Error(),
+		Details: []*any.Any{{
+			TypeUrl: typeURLPrefix + proto.MessageName(resp),
+			Value:   data,
+		}},
+	})
+}
+
 // execOptions specifies how to execute command in container.
 type execOptions struct {
 	cmd     []string
@@ -73,13 +127,14 @@ type execOptions struct {
 }
 
 // execInContainer executes a command inside the container synchronously, and
-// redirects stdio stream properly.
-// TODO(random-liu): Support timeout.
+// redirects stdio stream properly. If the timeout is exceeded, the exec process
+// is killed and an execTimeoutError is returned, the output collected so far is
+// still written to the stdio streams.
 func (c *criContainerdService) execInContainer(ctx context.Context, id string, opts execOptions) (*uint32, error) {
 	// Get container from our container store.
 	cntr, err := c.containerStore.Get(id)
 	if err != nil {
-		return nil, fmt.Errorf("failed to find container in store: %v", err)
+		return nil, wrapGRPCError(err, "failed to find container in store")
 	}
 	id = cntr.ID
 
@@ -109,11 +164,28 @@ func (c *criContainerdService) execInContainer(ctx context.Context, id string, o
 		// Create empty buffer if stdin is nil.
 		opts.stdin = new(bytes.Buffer)
 	}
+	// Discard output streams not requested by the client, stdout and stderr are
+	// copied separately when tty is not enabled.
+	if opts.stdout == nil {
+		opts.stdout = ioutil.Discard
+	}
+	if opts.stderr == nil {
+		opts.stderr = ioutil.Discard
+	}
+	// The io copy may still be running if the exec process doesn't exit after
+	// being killed. Stop writing into the output streams once this function
+	// returns, so that the caller can read them safely.
+	stdout, stderr := newSyncWriter(opts.stdout), newSyncWriter(opts.stderr)
+	defer stdout.Close()
+	defer stderr.Close()
+	// Notify when the client closes stdin, so that it could be propagated to the
+	// exec process.
+	stdin := newCloseNotifyReader(opts.stdin)
 	execID := generateID()
 	process, err := task.Exec(ctx, execID, pspec, containerd.NewIOWithTerminal(
-		opts.stdin,
-		opts.stdout,
-		opts.stderr,
+		stdin,
+		stdout,
+		stderr,
 		opts.tty,
 	))
 	if err != nil {
@@ -121,16 +193,10 @@ func (c *criContainerdService) execInContainer(ctx context.Context, id string, o
 	}
 	defer func() {
 		if _, err := process.Delete(ctx); err != nil {
-			glog.Errorf("Failed to delete exec process %q for container %q: %v", execID, id, err)
+			log.G(ctx).Errorf("Failed to delete exec process %q for container %q: %v", execID, id, err)
 		}
 	}()
 
-	handleResizing(opts.resize, func(size remotecommand.TerminalSize) {
-		if err := process.Resize(ctx, uint32(size.Width), uint32(size.Height)); err != nil {
-			glog.Errorf("Failed to resize process %q console for container %q: %v", execID, id, err)
-		}
-	})
-
 	// Get containerd event client first, so that we won't miss any events.
 	// TODO(random-liu): Add filter to only subscribe events of the exec process.
 	// TODO(random-liu): Use `Wait` after is fixed. (containerd#1279, containerd#1287)
@@ -145,9 +211,60 @@ func (c *criContainerdService) execInContainer(ctx context.Context, id string, o
 		return nil, fmt.Errorf("failed to start exec %q: %v", execID, err)
 	}
 
-	exitCode, err := c.waitContainerExec(eventstream, id, execID)
-	if err != nil {
-		return nil, fmt.Errorf("failed to wait for exec in container %q to finish: %v", id, err)
+	handleResizing(opts.resize, func(size remotecommand.TerminalSize) {
+		if err := process.Resize(ctx, uint32(size.Width), uint32(size.Height)); err != nil {
+			log.G(ctx).Errorf("Failed to resize process %q console for container %q: %v", execID, id, err)
+		}
+	})
+
+	go func() {
+		select {
+		case <-stdin.closed:
+			if err := process.CloseIO(ctx, containerd.WithStdinCloser); err != nil {
+				log.G(ctx).Errorf("Failed to close stdin of exec %q in container %q: %v", execID, id, err)
+			}
+		case <-cancellable.Done():
+		}
+	}()
+
+	type exitResult struct {
+		exitCode *uint32
+		err      error
+	}
+	exitCh := make(chan exitResult, 1)
+	go func() {
+		exitCode, err := c.waitContainerExec(eventstream, id, execID)
+		exitCh <- exitResult{exitCode: exitCode, err: err}
+	}()
+
+	var timeoutCh <-chan time.Time
+	if opts.timeout > 0 {
+		timer := time.NewTimer(opts.timeout)
+		defer timer.Stop()
+		timeoutCh = timer.C
+	}
+
+	var exitCode *uint32
+	select {
+	case res := <-exitCh:
+		if res.err != nil {
+			return nil, fmt.Errorf("failed to wait for exec in container %q to finish: %v", id, res.err)
+		}
+		exitCode = res.exitCode
+	case <-timeoutCh:
+		// Kill the exec process, and wait for it to exit so that the output
+		// collected so far is drained.
+		if err := process.Kill(ctx, unix.SIGKILL); err != nil && !isContainerdGRPCNotFoundError(err) &&
+			!isRuncProcessAlreadyFinishedError(err) {
+			log.G(ctx).Errorf("Failed to kill exec %q in container %q after timeout: %v", execID, id, err)
+		}
+		select {
+		case <-exitCh:
+			process.IO().Wait()
+		case <-time.After(killContainerTimeout):
+			log.G(ctx).Errorf("Exec %q in container %q is still running after kill", execID, id)
+		}
+		return nil, &execTimeoutError{timeout: opts.timeout}
 	}
 
 	// Wait for the io to be drained.
@@ -156,6 +273,64 @@ func (c *criContainerdService) execInContainer(ctx context.Context, id string, o
 	return exitCode, nil
 }
 
+// closeNotifyReader wraps a reader, and closes the closed channel once the
+// underlying reader returns an error, e.g. io.EOF when the client closes stdin.
+type closeNotifyReader struct {
+	r      io.Reader
+	once   sync.Once
+	closed chan struct{}
+}
+
+func newCloseNotifyReader(r io.Reader) *closeNotifyReader {
+	return &closeNotifyReader{r: r, closed: make(chan struct{})}
+}
+
+func (c *closeNotifyReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if err != nil {
+		c.once.Do(func() { close(c.closed) })
+	}
+	return n, err
+}
+
+// syncWriter wraps a writer, serializes writes into it, and drops writes after
+// it's closed.
+type syncWriter struct {
+	mu     sync.Mutex
+	w      io.Writer
+	closed bool
+}
+
+func newSyncWriter(w io.Writer) *syncWriter {
+	return &syncWriter{w: w}
+}
+
+func (s *syncWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return len(p), nil
+	}
+	return s.w.Write(p)
+}
+
+// Close stops writing into the underlying writer. It waits for the ongoing
+// write to finish. The underlying writer is not closed.
+func (s *syncWriter) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+}
+
+// execTimeoutError is returned when an exec process doesn't finish before timeout.
+type execTimeoutError struct {
+	timeout time.Duration
+}
+
+func (e *execTimeoutError) Error() string {
+	return fmt.Sprintf("timeout %v exceeded", e.timeout)
+}
+
 // waitContainerExec waits for container exec to finish and returns the exit code.
 func (c *criContainerdService) waitContainerExec(eventstream events.Events_SubscribeClient, id string,
 	execID string) (*uint32, error) {
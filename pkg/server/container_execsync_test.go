@@ -0,0 +1,151 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+)
+
+func TestCloseNotifyReader(t *testing.T) {
+	r := newCloseNotifyReader(bytes.NewBufferString("test-stdin"))
+	select {
+	case <-r.closed:
+		t.Fatal("should not notify before the reader is drained")
+	default:
+	}
+	data, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "test-stdin", string(data))
+	select {
+	case <-r.closed:
+	default:
+		t.Fatal("should notify after the reader returns EOF")
+	}
+	// Reading again should not panic.
+	_, err = r.Read(make([]byte, 1))
+	assert.Error(t, err)
+}
+
+func TestToExecSyncResponse(t *testing.T) {
+	exitCode := uint32(1)
+	for desc, test := range map[string]struct {
+		exitCode   *uint32
+		err        error
+		expected   *runtime.ExecSyncResponse
+		expectErr  bool
+		expectCode codes.Code
+	}{
+		"should return output and exit code": {
+			exitCode: &exitCode,
+			expected: &runtime.ExecSyncResponse{Stdout: []byte("stdout"), Stderr: []byte("stderr"), ExitCode: 1},
+		},
+		"should return partial output with deadline exceeded error on timeout": {
+			err:        &execTimeoutError{timeout: time.Second},
+			expected:   &runtime.ExecSyncResponse{Stdout: []byte("stdout"), Stderr: []byte("stderr"), ExitCode: execTimeoutExitCode},
+			expectErr:  true,
+			expectCode: codes.DeadlineExceeded,
+		},
+		"should return error on other errors": {
+			err:        errors.New("random error"),
+			expectErr:  true,
+			expectCode: codes.Unknown,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		resp, err := toExecSyncResponse(context.Background(), test.exitCode, test.err, []byte("stdout"), []byte("stderr"))
+		assert.Equal(t, test.expectErr, err != nil)
+		assert.Equal(t, test.expectCode, grpc.Code(err))
+		assert.Equal(t, test.expected, resp)
+	}
+}
+
+// getExecSyncResponseFromError gets the partial ExecSync response from the
+// status details of the error.
+func getExecSyncResponseFromError(t *testing.T, err error) *runtime.ExecSyncResponse {
+	st, ok := status.FromError(err)
+	require.True(t, ok)
+	details := st.Proto().GetDetails()
+	require.Len(t, details, 1)
+	assert.Equal(t, typeURLPrefix+"runtime.ExecSyncResponse", details[0].GetTypeUrl())
+	var resp runtime.ExecSyncResponse
+	require.NoError(t, proto.Unmarshal(details[0].GetValue(), &resp))
+	return &resp
+}
+
+// execSyncTimeoutService is a runtime service whose ExecSync always times out.
+type execSyncTimeoutService struct {
+	runtime.RuntimeServiceServer
+}
+
+func (execSyncTimeoutService) ExecSync(ctx context.Context, r *runtime.ExecSyncRequest) (*runtime.ExecSyncResponse, error) {
+	return toExecSyncResponse(ctx, nil, &execTimeoutError{timeout: time.Second}, []byte("partial"), nil)
+}
+
+func TestExecSyncTimeoutOutputOverGRPC(t *testing.T) {
+	dir, err := ioutil.TempDir("", "execsync-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	addr := filepath.Join(dir, "test.sock")
+	l, err := net.Listen(unixProtocol, addr)
+	require.NoError(t, err)
+	s := grpc.NewServer()
+	runtime.RegisterRuntimeServiceServer(s, execSyncTimeoutService{})
+	go s.Serve(l) // nolint: errcheck
+	defer s.Stop()
+
+	conn, err := grpc.Dial(addr, grpc.WithInsecure(), grpc.WithBlock(), grpc.WithTimeout(10*time.Second),
+		grpc.WithDialer(func(addr string, timeout time.Duration) (net.Conn, error) {
+			return net.DialTimeout(unixProtocol, addr, timeout)
+		}))
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = runtime.NewRuntimeServiceClient(conn).ExecSync(context.Background(), &runtime.ExecSyncRequest{})
+	require.Error(t, err)
+	assert.Equal(t, codes.DeadlineExceeded, grpc.Code(err))
+	resp := getExecSyncResponseFromError(t, err)
+	assert.Equal(t, "partial", string(resp.Stdout), "partial output should reach the client")
+	assert.EqualValues(t, execTimeoutExitCode, resp.ExitCode)
+}
+
+func TestSyncWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := newSyncWriter(&buf)
+	n, err := w.Write([]byte("before"))
+	assert.NoError(t, err)
+	assert.Equal(t, 6, n)
+	w.Close()
+	n, err = w.Write([]byte("after"))
+	assert.NoError(t, err)
+	assert.Equal(t, 5, n, "writes after close should be dropped silently")
+	assert.Equal(t, "before", buf.String())
+}
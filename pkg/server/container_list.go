@@ -17,20 +17,20 @@ limitations under the License.
 package server
 
 import (
-	"github.com/golang/glog"
 	"golang.org/x/net/context"
 
 	"k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
 
+	"github.com/kubernetes-incubator/cri-containerd/pkg/log"
 	containerstore "github.com/kubernetes-incubator/cri-containerd/pkg/store/container"
 )
 
 // ListContainers lists all containers matching the filter.
 func (c *criContainerdService) ListContainers(ctx context.Context, r *runtime.ListContainersRequest) (retRes *runtime.ListContainersResponse, retErr error) {
-	glog.V(4).Infof("ListContainers with filter %+v", r.GetFilter())
+	log.G(ctx).V(4).Infof("ListContainers with filter %+v", r.GetFilter())
 	defer func() {
 		if retErr == nil {
-			glog.V(4).Infof("ListContainers returns containers %+v", retRes.GetContainers())
+			log.G(ctx).V(4).Infof("ListContainers returns containers %+v", retRes.GetContainers())
 		}
 	}()
 
@@ -52,7 +52,7 @@ func toCRIContainer(container containerstore.Container) *runtime.Container {
 	return &runtime.Container{
 		Id:           container.ID,
 		PodSandboxId: container.SandboxID,
-		Metadata:     container.Config.GetMetadata(),
+		Metadata:     toCRIContainerMetadata(container.Metadata),
 		Image:        container.Config.GetImage(),
 		ImageRef:     container.ImageRef,
 		State:        status.State(),
@@ -79,18 +79,8 @@ func (c *criContainerdService) filterCRIContainers(containers []*runtime.Contain
 		if filter.GetState() != nil && filter.GetState().GetState() != cntr.State {
 			continue
 		}
-		if filter.GetLabelSelector() != nil {
-			match := true
-			for k, v := range filter.GetLabelSelector() {
-				got, ok := cntr.Labels[k]
-				if !ok || got != v {
-					match = false
-					break
-				}
-			}
-			if !match {
-				continue
-			}
+		if !matchLabelSelector(filter.GetLabelSelector(), cntr.Labels) {
+			continue
 		}
 		filtered = append(filtered, cntr)
 	}
@@ -97,6 +97,14 @@ func TestFilterContainers(t *testing.T) {
 			State:        runtime.ContainerState_CONTAINER_CREATED,
 			Labels:       map[string]string{"c": "d"},
 		},
+		{
+			Id:           "4",
+			PodSandboxId: "s-3",
+			Metadata:     &runtime.ContainerMetadata{Name: "name-4", Attempt: 1},
+			State:        runtime.ContainerState_CONTAINER_EXITED,
+			Labels:       map[string]string{"a": "b", "c": "d"},
+			Annotations:  map[string]string{"e": "f"},
+		},
 	}
 	for desc, test := range map[string]struct {
 		filter *runtime.ContainerFilter
@@ -115,13 +123,40 @@ func TestFilterContainers(t *testing.T) {
 					State: runtime.ContainerState_CONTAINER_EXITED,
 				},
 			},
-			expect: []*runtime.Container{testContainers[1]},
+			expect: []*runtime.Container{testContainers[1], testContainers[3]},
 		},
 		"label filter": {
 			filter: &runtime.ContainerFilter{
 				LabelSelector: map[string]string{"a": "b"},
 			},
-			expect: []*runtime.Container{testContainers[1]},
+			expect: []*runtime.Container{testContainers[1], testContainers[3]},
+		},
+		"multi-label filter matched": {
+			filter: &runtime.ContainerFilter{
+				LabelSelector: map[string]string{"a": "b", "c": "d"},
+			},
+			expect: []*runtime.Container{testContainers[3]},
+		},
+		"multi-label filter not matched": {
+			filter: &runtime.ContainerFilter{
+				LabelSelector: map[string]string{"a": "b", "c": "x"},
+			},
+			expect: []*runtime.Container{},
+		},
+		"annotation should not be used as label": {
+			filter: &runtime.ContainerFilter{
+				LabelSelector: map[string]string{"e": "f"},
+			},
+			expect: []*runtime.Container{},
+		},
+		"state and multi-label filter matched": {
+			filter: &runtime.ContainerFilter{
+				State: &runtime.ContainerStateValue{
+					State: runtime.ContainerState_CONTAINER_EXITED,
+				},
+				LabelSelector: map[string]string{"a": "b", "c": "d"},
+			},
+			expect: []*runtime.Container{testContainers[3]},
 		},
 		"sandbox id filter": {
 			filter: &runtime.ContainerFilter{PodSandboxId: "s-2"},
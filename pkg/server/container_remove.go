@@ -19,31 +19,31 @@ package server
 import (
 	"fmt"
 
-	"github.com/containerd/containerd/errdefs"
-	"github.com/golang/glog"
 	"golang.org/x/net/context"
 	"k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
 
+	"github.com/kubernetes-incubator/cri-containerd/pkg/log"
+	"github.com/kubernetes-incubator/cri-containerd/pkg/server/agents"
 	"github.com/kubernetes-incubator/cri-containerd/pkg/store"
 	containerstore "github.com/kubernetes-incubator/cri-containerd/pkg/store/container"
 )
 
 // RemoveContainer removes the container.
 func (c *criContainerdService) RemoveContainer(ctx context.Context, r *runtime.RemoveContainerRequest) (retRes *runtime.RemoveContainerResponse, retErr error) {
-	glog.V(2).Infof("RemoveContainer for %q", r.GetContainerId())
+	log.G(ctx).V(2).Infof("RemoveContainer for %q", r.GetContainerId())
 	defer func() {
 		if retErr == nil {
-			glog.V(2).Infof("RemoveContainer %q returns successfully", r.GetContainerId())
+			log.G(ctx).V(2).Infof("RemoveContainer %q returns successfully", r.GetContainerId())
 		}
 	}()
 
 	container, err := c.containerStore.Get(r.GetContainerId())
 	if err != nil {
 		if err != store.ErrNotExist {
-			return nil, fmt.Errorf("an error occurred when try to find container %q: %v", r.GetContainerId(), err)
+			return nil, wrapGRPCError(err, "an error occurred when try to find container %q", r.GetContainerId())
 		}
 		// Do not return error if container metadata doesn't exist.
-		glog.V(5).Infof("RemoveContainer called for container %q that does not exist", r.GetContainerId())
+		log.G(ctx).V(5).Infof("RemoveContainer called for container %q that does not exist", r.GetContainerId())
 		return &runtime.RemoveContainerResponse{}, nil
 	}
 	id := container.ID
@@ -58,7 +58,7 @@ func (c *criContainerdService) RemoveContainer(ctx context.Context, r *runtime.R
 			// Reset removing if remove failed.
 			if err := resetContainerRemoving(container); err != nil {
 				// TODO(random-liu): Do not checkpoint `Removing` state.
-				glog.Errorf("failed to reset removing state for container %q: %v", id, err)
+				log.G(ctx).Errorf("failed to reset removing state for container %q: %v", id, err)
 			}
 		}
 	}()
@@ -68,13 +68,18 @@ func (c *criContainerdService) RemoveContainer(ctx context.Context, r *runtime.R
 	// kubelet implementation, we'll never start a container once we decide to remove it,
 	// so we don't need the "Dead" state for now.
 
+	// NOTE: The containerd container is deleted after all other resources, so
+	// that an interrupted removal leaves the container recoverable on restart,
+	// and a retry cleans up the remaining resources.
+
 	// Remove container snapshot.
 	if err := c.snapshotService.Remove(ctx, id); err != nil {
-		if !errdefs.IsNotFound(err) {
+		if !isContainerdGRPCNotFoundError(err) {
 			return nil, fmt.Errorf("failed to remove container snapshot %q: %v", id, err)
 		}
-		glog.V(5).Infof("Remove called for snapshot %q that does not exist", id)
+		log.G(ctx).V(5).Infof("Remove called for snapshot %q that does not exist", id)
 	}
+	c.snapshotUsageCache.remove(id)
 
 	containerRootDir := getContainerRootDir(c.rootDir, id)
 	if err := c.os.RemoveAll(containerRootDir); err != nil {
@@ -87,12 +92,21 @@ func (c *criContainerdService) RemoveContainer(ctx context.Context, r *runtime.R
 		return nil, fmt.Errorf("failed to delete container checkpoint for %q: %v", id, err)
 	}
 
+	// Remove container log file and its rotated files.
+	if logPath := container.LogPath; logPath != "" {
+		for _, path := range agents.LogFilePaths(logPath, c.config.ContainerLogMaxFiles) {
+			if err := c.os.RemoveAll(path); err != nil {
+				return nil, fmt.Errorf("failed to remove container log file %q: %v", path, err)
+			}
+		}
+	}
+
 	// Delete containerd container.
 	if err := c.containerService.Delete(ctx, id); err != nil {
 		if !isContainerdGRPCNotFoundError(err) {
 			return nil, fmt.Errorf("failed to delete containerd container %q: %v", id, err)
 		}
-		glog.V(5).Infof("Remove called for containerd container %q that does not exist", id, err)
+		log.G(ctx).V(5).Infof("Remove called for containerd container %q that does not exist", id)
 	}
 
 	c.containerStore.Delete(id)
@@ -17,11 +17,19 @@ limitations under the License.
 package server
 
 import (
+	"errors"
 	"testing"
 	"time"
 
+	"github.com/containerd/containerd/containers"
+	"github.com/containerd/containerd/snapshot"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
 
+	ostesting "github.com/kubernetes-incubator/cri-containerd/pkg/os/testing"
+	servertesting "github.com/kubernetes-incubator/cri-containerd/pkg/server/testing"
 	containerstore "github.com/kubernetes-incubator/cri-containerd/pkg/store/container"
 )
 
@@ -74,3 +82,118 @@ func TestSetContainerRemoving(t *testing.T) {
 		}
 	}
 }
+
+func TestRemoveContainer(t *testing.T) {
+	testID := "test-id"
+	testLogPath := "/test/log/dir/container.log"
+	for desc, test := range map[string]struct {
+		injectErr func(c *criContainerdService)
+		expectErr bool
+	}{
+		"should remove all container resources": {},
+		"should keep containerd container if snapshot removal fails": {
+			injectErr: func(c *criContainerdService) {
+				c.snapshotService.(*servertesting.FakeSnapshotter).InjectError("remove", errors.New("random error"))
+			},
+			expectErr: true,
+		},
+		"should keep containerd container if log removal fails": {
+			injectErr: func(c *criContainerdService) {
+				c.os.(*ostesting.FakeOS).RemoveAllFn = func(path string) error {
+					if path == testLogPath {
+						return errors.New("random error")
+					}
+					return nil
+				}
+			},
+			expectErr: true,
+		},
+		"should keep container in store if containerd container deletion fails": {
+			injectErr: func(c *criContainerdService) {
+				c.containerService.(*servertesting.FakeContainerService).InjectError("delete", errors.New("random error"))
+			},
+			expectErr: true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		c := newTestCRIContainerdService()
+		c.config.ContainerLogMaxFiles = 1
+		fakeOS := c.os.(*ostesting.FakeOS)
+		fakeSnapshotter := c.snapshotService.(*servertesting.FakeSnapshotter)
+		fakeContainerService := c.containerService.(*servertesting.FakeContainerService)
+		container, err := containerstore.NewContainer(
+			containerstore.Metadata{
+				ID:      testID,
+				Name:    "test-name",
+				Config:  &runtime.ContainerConfig{},
+				LogPath: testLogPath,
+			},
+			containerstore.Status{
+				CreatedAt:  time.Now().UnixNano(),
+				StartedAt:  time.Now().UnixNano(),
+				FinishedAt: time.Now().UnixNano(),
+			},
+		)
+		require.NoError(t, err)
+		require.NoError(t, c.containerStore.Add(container))
+		require.NoError(t, c.containerNameIndex.Reserve("test-name", testID))
+		fakeSnapshotter.SetFakeSnapshots([]snapshot.Info{{Name: testID, Kind: snapshot.KindActive}})
+		fakeContainerService.SetFakeContainers([]containers.Container{{ID: testID}})
+		if test.injectErr != nil {
+			test.injectErr(c)
+		}
+
+		_, err = c.RemoveContainer(context.Background(), &runtime.RemoveContainerRequest{ContainerId: testID})
+		if test.expectErr {
+			assert.Error(t, err)
+			// The containerd container and the metadata should be kept for retry.
+			_, err = fakeContainerService.Get(context.Background(), testID)
+			assert.NoError(t, err)
+			got, err := c.containerStore.Get(testID)
+			require.NoError(t, err)
+			assert.False(t, got.Status.Get().Removing, "removing state should be reset")
+			continue
+		}
+		assert.NoError(t, err)
+		var removed []string
+		for _, call := range fakeOS.GetCalls() {
+			if call.Name == "RemoveAll" {
+				removed = append(removed, call.Arguments[0].(string))
+			}
+		}
+		assert.Equal(t, []string{
+			getContainerRootDir(c.rootDir, testID),
+			testLogPath,
+			testLogPath + ".1",
+		}, removed)
+		_, err = fakeSnapshotter.Stat(context.Background(), testID)
+		assert.Error(t, err, "snapshot should be removed")
+		_, err = fakeContainerService.Get(context.Background(), testID)
+		assert.True(t, isContainerdGRPCNotFoundError(err), "containerd container should be deleted")
+		_, err = c.containerStore.Get(testID)
+		assert.Error(t, err, "container should be removed from store")
+		assert.NoError(t, c.containerNameIndex.Reserve("test-name", "another-id"), "name should be released")
+
+		// Remove again should succeed.
+		_, err = c.RemoveContainer(context.Background(), &runtime.RemoveContainerRequest{ContainerId: testID})
+		assert.NoError(t, err)
+	}
+}
+
+func TestRemoveContainerRetryAfterPartialRemoval(t *testing.T) {
+	testID := "test-id"
+	c := newTestCRIContainerdService()
+	fakeContainerService := c.containerService.(*servertesting.FakeContainerService)
+	container, err := containerstore.NewContainer(
+		containerstore.Metadata{ID: testID, Config: &runtime.ContainerConfig{}},
+		containerstore.Status{CreatedAt: time.Now().UnixNano()},
+	)
+	require.NoError(t, err)
+	require.NoError(t, c.containerStore.Add(container))
+	// The snapshot is already removed by the interrupted removal.
+	fakeContainerService.SetFakeContainers([]containers.Container{{ID: testID}})
+	_, err = c.RemoveContainer(context.Background(), &runtime.RemoveContainerRequest{ContainerId: testID})
+	assert.NoError(t, err)
+	_, err = fakeContainerService.Get(context.Background(), testID)
+	assert.True(t, isContainerdGRPCNotFoundError(err), "containerd container should be deleted")
+}
@@ -19,33 +19,35 @@ package server
 import (
 	"fmt"
 	"io"
-	"os"
-	"path/filepath"
 	"time"
 
 	"github.com/containerd/containerd/api/services/tasks/v1"
 	"github.com/containerd/containerd/api/types"
 	"github.com/containerd/containerd/api/types/task"
-	"github.com/golang/glog"
 	"golang.org/x/net/context"
 	"k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
 
+	"github.com/kubernetes-incubator/cri-containerd/pkg/log"
 	"github.com/kubernetes-incubator/cri-containerd/pkg/server/agents"
+	cio "github.com/kubernetes-incubator/cri-containerd/pkg/server/io"
 	containerstore "github.com/kubernetes-incubator/cri-containerd/pkg/store/container"
 )
 
+// containerLogOutput is the name of the container logger output in container io.
+const containerLogOutput = "log"
+
 // StartContainer starts the container.
 func (c *criContainerdService) StartContainer(ctx context.Context, r *runtime.StartContainerRequest) (retRes *runtime.StartContainerResponse, retErr error) {
-	glog.V(2).Infof("StartContainer for %q", r.GetContainerId())
+	log.G(ctx).V(2).Infof("StartContainer for %q", r.GetContainerId())
 	defer func() {
 		if retErr == nil {
-			glog.V(2).Infof("StartContainer %q returns successfully", r.GetContainerId())
+			log.G(ctx).V(2).Infof("StartContainer %q returns successfully", r.GetContainerId())
 		}
 	}()
 
 	container, err := c.containerStore.Get(r.GetContainerId())
 	if err != nil {
-		return nil, fmt.Errorf("an error occurred when try to find container %q: %v", r.GetContainerId(), err)
+		return nil, wrapGRPCError(err, "an error occurred when try to find container %q", r.GetContainerId())
 	}
 	id := container.ID
 
@@ -54,7 +56,7 @@ func (c *criContainerdService) StartContainer(ctx context.Context, r *runtime.St
 	if err := container.Status.Update(func(status containerstore.Status) (containerstore.Status, error) {
 		// Always apply status change no matter startContainer fails or not. Because startContainer
 		// may change container state no matter it fails or succeeds.
-		startErr = c.startContainer(ctx, id, container.Metadata, &status)
+		startErr = c.startContainer(ctx, id, container.Metadata, container.IO, &status)
 		return status, nil
 	}); startErr != nil {
 		return nil, startErr
@@ -66,7 +68,8 @@ func (c *criContainerdService) StartContainer(ctx context.Context, r *runtime.St
 
 // startContainer actually starts the container. The function needs to be run in one transaction. Any updates
 // to the status passed in will be applied no matter the function returns error or not.
-func (c *criContainerdService) startContainer(ctx context.Context, id string, meta containerstore.Metadata, status *containerstore.Status) (retErr error) {
+func (c *criContainerdService) startContainer(ctx context.Context, id string, meta containerstore.Metadata,
+	containerIO *cio.ContainerIO, status *containerstore.Status) (retErr error) {
 	config := meta.Config
 	// Return error if container is not in created state.
 	if status.State() != runtime.ContainerState_CONTAINER_CREATED {
@@ -89,12 +92,10 @@ func (c *criContainerdService) startContainer(ctx context.Context, id string, me
 		}
 	}()
 
-	// Get sandbox config from sandbox store.
-	sandbox, err := c.sandboxStore.Get(meta.SandboxID)
-	if err != nil {
+	// Make sure sandbox exists in sandbox store.
+	if _, err := c.sandboxStore.Get(meta.SandboxID); err != nil {
 		return fmt.Errorf("sandbox %q not found: %v", meta.SandboxID, err)
 	}
-	sandboxConfig := sandbox.Config
 	sandboxID := meta.SandboxID
 	// Make sure sandbox is running.
 	sandboxInfo, err := c.taskService.Get(ctx, &tasks.GetTaskRequest{ContainerID: sandboxID})
@@ -107,46 +108,18 @@ func (c *criContainerdService) startContainer(ctx context.Context, id string, me
 		return fmt.Errorf("sandbox container %q is not running", sandboxID)
 	}
 
-	containerRootDir := getContainerRootDir(c.rootDir, id)
-	stdin, stdout, stderr := getStreamingPipes(containerRootDir)
-	// Set stdin to empty if Stdin == false.
-	if !config.GetStdin() {
-		stdin = ""
+	if containerIO == nil {
+		return fmt.Errorf("container %q io is not available", id)
 	}
-	stdinPipe, stdoutPipe, stderrPipe, err := c.prepareStreamingPipes(ctx, stdin, stdout, stderr)
+	stdin, stdout, stderr, closePipes, err := c.pipeContainerIO(ctx, meta, containerIO)
 	if err != nil {
-		return fmt.Errorf("failed to prepare streaming pipes: %v", err)
+		return err
 	}
 	defer func() {
 		if retErr != nil {
-			if stdinPipe != nil {
-				stdinPipe.Close()
-			}
-			stdoutPipe.Close()
-			stderrPipe.Close()
+			closePipes()
 		}
 	}()
-	// Redirect the stream to std for now.
-	// TODO(random-liu): [P1] Support StdinOnce after container logging is added.
-	if stdinPipe != nil {
-		go func(w io.WriteCloser) {
-			io.Copy(w, os.Stdin) // nolint: errcheck
-			w.Close()
-		}(stdinPipe)
-	}
-	if config.GetLogPath() != "" {
-		// Only generate container log when log path is specified.
-		logPath := filepath.Join(sandboxConfig.GetLogDirectory(), config.GetLogPath())
-		if err = c.agentFactory.NewContainerLogger(logPath, agents.Stdout, stdoutPipe).Start(); err != nil {
-			return fmt.Errorf("failed to start container stdout logger: %v", err)
-		}
-		// Only redirect stderr when there is no tty.
-		if !config.GetTty() {
-			if err = c.agentFactory.NewContainerLogger(logPath, agents.Stderr, stderrPipe).Start(); err != nil {
-				return fmt.Errorf("failed to start container stderr logger: %v", err)
-			}
-		}
-	}
 
 	// Get rootfs mounts.
 	rootfsMounts, err := c.snapshotService.Mounts(ctx, id)
@@ -171,7 +144,7 @@ func (c *criContainerdService) startContainer(ctx context.Context, id string, me
 		Stderr:      stderr,
 		Terminal:    config.GetTty(),
 	}
-	glog.V(5).Infof("Create containerd task (id=%q, name=%q) with options %+v.",
+	log.G(ctx).V(5).Infof("Create containerd task (id=%q, name=%q) with options %+v.",
 		id, meta.Name, createOpts)
 	createResp, err := c.taskService.Create(ctx, createOpts)
 	if err != nil {
@@ -181,7 +154,7 @@ func (c *criContainerdService) startContainer(ctx context.Context, id string, me
 		if retErr != nil {
 			// Cleanup the containerd task if an error is returned.
 			if _, err := c.taskService.Delete(ctx, &tasks.DeleteTaskRequest{ContainerID: id}); err != nil {
-				glog.Errorf("Failed to delete containerd task %q: %v", id, err)
+				log.G(ctx).Errorf("Failed to delete containerd task %q: %v", id, err)
 			}
 		}
 	}()
@@ -196,3 +169,61 @@ func (c *criContainerdService) startContainer(ctx context.Context, id string, me
 	status.StartedAt = time.Now().UnixNano()
 	return nil
 }
+
+// pipeContainerIO opens the streaming pipes in the container root directory,
+// starts the container loggers if the log path is specified, and redirects the
+// pipes into the container io. It returns the paths of the pipes, and a function
+// to close the pipes if the container fails to start. It's used both to start a
+// container and to reconnect the io of a running container on recovery.
+func (c *criContainerdService) pipeContainerIO(ctx context.Context, meta containerstore.Metadata,
+	containerIO *cio.ContainerIO) (stdin, stdout, stderr string, closePipes func(), retErr error) {
+	config := meta.Config
+	stdin, stdout, stderr = getStreamingPipes(getContainerRootDir(c.rootDir, meta.ID))
+	// Set stdin to empty if Stdin == false.
+	if !config.GetStdin() {
+		stdin = ""
+	}
+	stdinPipe, stdoutPipe, stderrPipe, err := c.prepareStreamingPipes(ctx, stdin, stdout, stderr)
+	if err != nil {
+		return "", "", "", nil, fmt.Errorf("failed to prepare streaming pipes: %v", err)
+	}
+	closePipes = func() {
+		if stdinPipe != nil {
+			stdinPipe.Close()
+		}
+		if stdoutPipe != nil {
+			stdoutPipe.Close()
+		}
+		if stderrPipe != nil {
+			stderrPipe.Close()
+		}
+	}
+	defer func() {
+		if retErr != nil {
+			closePipes()
+		}
+	}()
+	if logPath := meta.LogPath; logPath != "" {
+		// Only generate container log when log path is specified.
+		stdoutLog, stdoutLogWriter := io.Pipe()
+		if err := c.agentFactory.NewContainerLogger(logPath, agents.Stdout, stdoutLog).Start(); err != nil {
+			return "", "", "", nil, fmt.Errorf("failed to start container stdout logger: %v", err)
+		}
+		containerIO.AddOutput(containerLogOutput, stdoutLogWriter, nil)
+		// Only redirect stderr when there is no tty.
+		if !config.GetTty() {
+			stderrLog, stderrLogWriter := io.Pipe()
+			if err := c.agentFactory.NewContainerLogger(logPath, agents.Stderr, stderrLog).Start(); err != nil {
+				return "", "", "", nil, fmt.Errorf("failed to start container stderr logger: %v", err)
+			}
+			containerIO.AddOutput(containerLogOutput, nil, stderrLogWriter)
+		}
+	}
+	// Stderr is merged into stdout when tty is enabled.
+	if config.GetTty() {
+		containerIO.Pipe(stdinPipe, stdoutPipe, nil)
+	} else {
+		containerIO.Pipe(stdinPipe, stdoutPipe, stderrPipe)
+	}
+	return stdin, stdout, stderr, closePipes, nil
+}
@@ -17,15 +17,191 @@ limitations under the License.
 package server
 
 import (
-	"errors"
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"golang.org/x/net/context"
-
 	"k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+
+	"github.com/kubernetes-incubator/cri-containerd/pkg/log"
+	containerstore "github.com/kubernetes-incubator/cri-containerd/pkg/store/container"
+)
+
+const (
+	// cgroupRoot is the root directory of the cgroup hierarchies.
+	cgroupRoot = "/sys/fs/cgroup"
+	// procCgroupFormat is the format of the cgroup file of a process.
+	procCgroupFormat = "/proc/%d/cgroup"
+	// cpuacctUsageFile is the cpuacct cgroup file of total cpu time in nanoseconds.
+	cpuacctUsageFile = "cpuacct.usage"
+	// memoryUsageFile is the memory cgroup file of current memory usage in bytes.
+	memoryUsageFile = "memory.usage_in_bytes"
+	// memoryStatFile is the memory cgroup file of memory statistics.
+	memoryStatFile = "memory.stat"
+	// memoryInactiveFileKey is the memory.stat key of inactive file cache,
+	// which is excluded from the working set.
+	memoryInactiveFileKey = "total_inactive_file"
 )
 
 // ContainerStats returns stats of the container. If the container does not
 // exist, the call returns an error.
-func (c *criContainerdService) ContainerStats(ctx context.Context, in *runtime.ContainerStatsRequest) (*runtime.ContainerStatsResponse, error) {
-	return nil, errors.New("not implemented")
+func (c *criContainerdService) ContainerStats(ctx context.Context, r *runtime.ContainerStatsRequest) (retRes *runtime.ContainerStatsResponse, retErr error) {
+	log.G(ctx).V(4).Infof("ContainerStats for container %q", r.GetContainerId())
+	defer func() {
+		if retErr == nil {
+			log.G(ctx).V(4).Infof("ContainerStats for %q returns stats %+v", r.GetContainerId(), retRes.GetStats())
+		}
+	}()
+
+	container, err := c.containerStore.Get(r.GetContainerId())
+	if err != nil {
+		return nil, wrapGRPCError(err, "failed to find container %q", r.GetContainerId())
+	}
+	stats, err := c.getContainerStats(ctx, container)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get stats of container %q: %v", container.ID, err)
+	}
+	return &runtime.ContainerStatsResponse{Stats: stats}, nil
+}
+
+// getContainerStats gets the stats of the container. Cpu and memory usage are
+// zero if the container is not running.
+func (c *criContainerdService) getContainerStats(ctx context.Context, container containerstore.Container) (*runtime.ContainerStats, error) {
+	meta := container.Metadata
+	status := container.Status.Get()
+	timestamp := time.Now().UnixNano()
+	stats := &runtime.ContainerStats{
+		Attributes: &runtime.ContainerAttributes{
+			Id:          meta.ID,
+			Metadata:    toCRIContainerMetadata(meta),
+			Labels:      meta.Config.GetLabels(),
+			Annotations: meta.Config.GetAnnotations(),
+		},
+		Cpu: &runtime.CpuUsage{
+			Timestamp:            timestamp,
+			UsageCoreNanoSeconds: &runtime.UInt64Value{},
+		},
+		Memory: &runtime.MemoryUsage{
+			Timestamp:       timestamp,
+			WorkingSetBytes: &runtime.UInt64Value{},
+		},
+	}
+
+	writableLayer, err := c.getWritableLayerUsage(ctx, meta.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get usage of writable layer: %v", err)
+	}
+	stats.WritableLayer = writableLayer
+
+	if status.State() != runtime.ContainerState_CONTAINER_RUNNING {
+		return stats, nil
+	}
+	cpu, memory, err := getCgroupStats(fmt.Sprintf(procCgroupFormat, status.Pid), cgroupRoot)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get cgroup stats: %v", err)
+	}
+	stats.Cpu.UsageCoreNanoSeconds.Value = cpu
+	stats.Memory.WorkingSetBytes.Value = memory
+	return stats, nil
+}
+
+// getCgroupStats returns the cpu usage in nanoseconds and the memory working set
+// in bytes of the cgroups in the process cgroup file.
+func getCgroupStats(procCgroupFile, root string) (uint64, uint64, error) {
+	paths, err := getCgroupPaths(procCgroupFile)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to get cgroup paths from %q: %v", procCgroupFile, err)
+	}
+	cpuacct, ok := paths["cpuacct"]
+	if !ok {
+		return 0, 0, fmt.Errorf("cpuacct cgroup not found")
+	}
+	memory, ok := paths["memory"]
+	if !ok {
+		return 0, 0, fmt.Errorf("memory cgroup not found")
+	}
+	cpu, err := readCgroupUint(filepath.Join(root, cpuacct, cpuacctUsageFile))
+	if err != nil {
+		return 0, 0, err
+	}
+	usage, err := readCgroupUint(filepath.Join(root, memory, memoryUsageFile))
+	if err != nil {
+		return 0, 0, err
+	}
+	inactive, err := readCgroupStat(filepath.Join(root, memory, memoryStatFile), memoryInactiveFileKey)
+	if err != nil {
+		return 0, 0, err
+	}
+	workingSet := uint64(0)
+	if usage > inactive {
+		workingSet = usage - inactive
+	}
+	return cpu, workingSet, nil
+}
+
+// getCgroupPaths parses the process cgroup file and returns the cgroup
+// directory of each subsystem relative to the cgroup root, e.g.
+// "cpu,cpuacct/kubepods/test-id".
+func getCgroupPaths(procCgroupFile string) (map[string]string, error) {
+	f, err := os.Open(procCgroupFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	paths := make(map[string]string)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		// Each line is in the format of "<hierarchy id>:<subsystems>:<path>".
+		fields := strings.SplitN(s.Text(), ":", 3)
+		if len(fields) != 3 || fields[1] == "" {
+			continue
+		}
+		for _, subsystem := range strings.Split(fields[1], ",") {
+			paths[subsystem] = filepath.Join(fields[1], fields[2])
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return paths, nil
+}
+
+// readCgroupUint reads a cgroup file containing a single unsigned integer.
+func readCgroupUint(path string) (uint64, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read %q: %v", path, err)
+	}
+	v, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse %q: %v", path, err)
+	}
+	return v, nil
+}
+
+// readCgroupStat reads the value of a key from a cgroup stat file in the format
+// of "<key> <value>" per line. 0 is returned if the key doesn't exist.
+func readCgroupStat(path, key string) (uint64, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read %q: %v", path, err)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || fields[0] != key {
+			continue
+		}
+		v, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("failed to parse %q in %q: %v", key, path, err)
+		}
+		return v, nil
+	}
+	return 0, nil
 }
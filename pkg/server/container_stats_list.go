@@ -17,14 +17,77 @@ limitations under the License.
 package server
 
 import (
-	"errors"
+	"fmt"
 
 	"golang.org/x/net/context"
-
+	"golang.org/x/sync/errgroup"
 	"k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+
+	"github.com/kubernetes-incubator/cri-containerd/pkg/log"
+	containerstore "github.com/kubernetes-incubator/cri-containerd/pkg/store/container"
 )
 
 // ListContainerStats returns stats of all running containers.
-func (c *criContainerdService) ListContainerStats(ctx context.Context, in *runtime.ListContainerStatsRequest) (*runtime.ListContainerStatsResponse, error) {
-	return nil, errors.New("not implemented")
+func (c *criContainerdService) ListContainerStats(ctx context.Context, r *runtime.ListContainerStatsRequest) (retRes *runtime.ListContainerStatsResponse, retErr error) {
+	log.G(ctx).V(4).Infof("ListContainerStats with filter %+v", r.GetFilter())
+	defer func() {
+		if retErr == nil {
+			log.G(ctx).V(4).Infof("ListContainerStats returns stats %+v", retRes.GetStats())
+		}
+	}()
+
+	containers := c.filterContainersForStats(c.containerStore.List(), r.GetFilter())
+	// Get stats of all containers concurrently, each container only writes its
+	// own slot in the result.
+	results := make([]*runtime.ContainerStats, len(containers))
+	g, gctx := errgroup.WithContext(ctx)
+	for i := range containers {
+		i, container := i, containers[i]
+		g.Go(func() error {
+			stats, err := c.getContainerStats(gctx, container)
+			if err != nil {
+				// Skip the container if it's stopped in the meantime.
+				if container.Status.Get().State() != runtime.ContainerState_CONTAINER_RUNNING {
+					log.G(ctx).V(4).Infof("Skip stats of container %q which is not running: %v", container.ID, err)
+					return nil
+				}
+				return fmt.Errorf("failed to get stats of container %q: %v", container.ID, err)
+			}
+			results[i] = stats
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	stats := []*runtime.ContainerStats{}
+	for _, s := range results {
+		if s != nil {
+			stats = append(stats, s)
+		}
+	}
+	return &runtime.ListContainerStatsResponse{Stats: stats}, nil
+}
+
+// filterContainersForStats returns running containers matching the filter.
+func (c *criContainerdService) filterContainersForStats(containers []containerstore.Container,
+	filter *runtime.ContainerStatsFilter) []containerstore.Container {
+	var filtered []containerstore.Container
+	for _, cntr := range containers {
+		if cntr.Status.Get().State() != runtime.ContainerState_CONTAINER_RUNNING {
+			continue
+		}
+		if filter.GetId() != "" && filter.GetId() != cntr.ID {
+			continue
+		}
+		if filter.GetPodSandboxId() != "" && filter.GetPodSandboxId() != cntr.SandboxID {
+			continue
+		}
+		if !matchLabelSelector(filter.GetLabelSelector(), cntr.Config.GetLabels()) {
+			continue
+		}
+		filtered = append(filtered, cntr)
+	}
+	return filtered
 }
@@ -0,0 +1,114 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+
+	containerstore "github.com/kubernetes-incubator/cri-containerd/pkg/store/container"
+)
+
+func TestFilterContainersForStats(t *testing.T) {
+	c := newTestCRIContainerdService()
+	var containers []containerstore.Container
+	for _, test := range []struct {
+		id        string
+		sandboxID string
+		labels    map[string]string
+		running   bool
+	}{
+		{id: "1", sandboxID: "s-1", labels: map[string]string{"a": "b"}, running: true},
+		{id: "2", sandboxID: "s-1", labels: map[string]string{"a": "b", "c": "d"}, running: true},
+		{id: "3", sandboxID: "s-2", labels: map[string]string{"c": "d"}, running: true},
+		{id: "4", sandboxID: "s-2", labels: map[string]string{"a": "b"}},
+	} {
+		status := containerstore.Status{CreatedAt: time.Now().UnixNano(), StartedAt: time.Now().UnixNano()}
+		if !test.running {
+			status.FinishedAt = time.Now().UnixNano()
+		}
+		container, err := containerstore.NewContainer(
+			containerstore.Metadata{
+				ID:        test.id,
+				SandboxID: test.sandboxID,
+				Config:    &runtime.ContainerConfig{Labels: test.labels},
+			},
+			status,
+		)
+		require.NoError(t, err)
+		containers = append(containers, container)
+	}
+
+	for desc, test := range map[string]struct {
+		filter   *runtime.ContainerStatsFilter
+		expected []string
+	}{
+		"should return all running containers without filter": {
+			expected: []string{"1", "2", "3"},
+		},
+		"should filter by id": {
+			filter:   &runtime.ContainerStatsFilter{Id: "2"},
+			expected: []string{"2"},
+		},
+		"should filter by sandbox id": {
+			filter:   &runtime.ContainerStatsFilter{PodSandboxId: "s-2"},
+			expected: []string{"3"},
+		},
+		"should filter by label selector": {
+			filter:   &runtime.ContainerStatsFilter{LabelSelector: map[string]string{"a": "b"}},
+			expected: []string{"1", "2"},
+		},
+		"should combine filters": {
+			filter: &runtime.ContainerStatsFilter{
+				PodSandboxId:  "s-1",
+				LabelSelector: map[string]string{"c": "d"},
+			},
+			expected: []string{"2"},
+		},
+		"should skip stopped containers": {
+			filter: &runtime.ContainerStatsFilter{Id: "4"},
+		},
+	} {
+		var ids []string
+		for _, cntr := range c.filterContainersForStats(containers, test.filter) {
+			ids = append(ids, cntr.ID)
+		}
+		assert.Equal(t, test.expected, ids, desc)
+	}
+}
+
+func TestListContainerStatsSkipStoppedContainers(t *testing.T) {
+	c := newTestCRIContainerdService()
+	container, err := containerstore.NewContainer(
+		containerstore.Metadata{ID: "test-id", Config: &runtime.ContainerConfig{}},
+		containerstore.Status{
+			CreatedAt:  time.Now().UnixNano(),
+			StartedAt:  time.Now().UnixNano(),
+			FinishedAt: time.Now().UnixNano(),
+		},
+	)
+	require.NoError(t, err)
+	require.NoError(t, c.containerStore.Add(container))
+	resp, err := c.ListContainerStats(context.Background(), &runtime.ListContainerStatsRequest{})
+	require.NoError(t, err)
+	assert.Empty(t, resp.GetStats())
+}
@@ -0,0 +1,107 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/snapshot"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+
+	servertesting "github.com/kubernetes-incubator/cri-containerd/pkg/server/testing"
+	containerstore "github.com/kubernetes-incubator/cri-containerd/pkg/store/container"
+)
+
+func TestGetCgroupStats(t *testing.T) {
+	root, err := ioutil.TempDir("", "cgroup-stats-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+	procCgroupFile := filepath.Join(root, "cgroup")
+	require.NoError(t, ioutil.WriteFile(procCgroupFile, []byte(`11:memory:/kubepods/test-id
+4:cpu,cpuacct:/kubepods/test-id
+1:name=systemd:/kubepods/test-id
+`), 0644))
+	cpuacctDir := filepath.Join(root, "cpu,cpuacct", "kubepods", "test-id")
+	memoryDir := filepath.Join(root, "memory", "kubepods", "test-id")
+	require.NoError(t, os.MkdirAll(cpuacctDir, 0755))
+	require.NoError(t, os.MkdirAll(memoryDir, 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(cpuacctDir, cpuacctUsageFile), []byte("12345\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(memoryDir, memoryUsageFile), []byte("4096\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(memoryDir, memoryStatFile),
+		[]byte("cache 2048\ntotal_inactive_file 1024\n"), 0644))
+
+	cpu, memory, err := getCgroupStats(procCgroupFile, root)
+	require.NoError(t, err)
+	assert.EqualValues(t, 12345, cpu)
+	assert.EqualValues(t, 4096-1024, memory)
+
+	t.Logf("should return error if cgroup files don't exist")
+	require.NoError(t, os.RemoveAll(memoryDir))
+	_, _, err = getCgroupStats(procCgroupFile, root)
+	assert.Error(t, err)
+}
+
+func TestContainerStats(t *testing.T) {
+	testID := "test-id"
+	c := newTestCRIContainerdService()
+	fakeSnapshotter := c.snapshotService.(*servertesting.FakeSnapshotter)
+	config := &runtime.ContainerConfig{
+		Metadata:    &runtime.ContainerMetadata{Name: "test-name"},
+		Labels:      map[string]string{"a": "b"},
+		Annotations: map[string]string{"c": "d"},
+	}
+	container, err := containerstore.NewContainer(
+		containerstore.Metadata{ID: testID, Config: config},
+		containerstore.Status{
+			Pid:        1234,
+			CreatedAt:  time.Now().UnixNano(),
+			StartedAt:  time.Now().UnixNano(),
+			FinishedAt: time.Now().UnixNano(),
+		},
+	)
+	require.NoError(t, err)
+
+	t.Logf("should return error if container doesn't exist")
+	_, err = c.ContainerStats(context.Background(), &runtime.ContainerStatsRequest{ContainerId: testID})
+	assert.Error(t, err)
+
+	require.NoError(t, c.containerStore.Add(container))
+	fakeSnapshotter.SetFakeSnapshots([]snapshot.Info{{Name: testID, Kind: snapshot.KindActive}})
+	fakeSnapshotter.SetFakeUsage(testID, snapshot.Usage{Size: 100, Inodes: 10})
+
+	t.Logf("should return zeroed cpu and memory stats for stopped container")
+	resp, err := c.ContainerStats(context.Background(), &runtime.ContainerStatsRequest{ContainerId: testID})
+	require.NoError(t, err)
+	stats := resp.GetStats()
+	assert.Equal(t, &runtime.ContainerAttributes{
+		Id:          testID,
+		Metadata:    config.Metadata,
+		Labels:      config.Labels,
+		Annotations: config.Annotations,
+	}, stats.GetAttributes())
+	assert.EqualValues(t, 0, stats.GetCpu().GetUsageCoreNanoSeconds().GetValue())
+	assert.EqualValues(t, 0, stats.GetMemory().GetWorkingSetBytes().GetValue())
+	assert.EqualValues(t, 100, stats.GetWritableLayer().GetUsedBytes().GetValue())
+	assert.EqualValues(t, 10, stats.GetWritableLayer().GetInodesUsed().GetValue())
+}
@@ -17,27 +17,25 @@ limitations under the License.
 package server
 
 import (
-	"fmt"
-
-	"github.com/golang/glog"
 	"golang.org/x/net/context"
 	"k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
 
+	"github.com/kubernetes-incubator/cri-containerd/pkg/log"
 	containerstore "github.com/kubernetes-incubator/cri-containerd/pkg/store/container"
 )
 
 // ContainerStatus inspects the container and returns the status.
 func (c *criContainerdService) ContainerStatus(ctx context.Context, r *runtime.ContainerStatusRequest) (retRes *runtime.ContainerStatusResponse, retErr error) {
-	glog.V(4).Infof("ContainerStatus for container %q", r.GetContainerId())
+	log.G(ctx).V(4).Infof("ContainerStatus for container %q", r.GetContainerId())
 	defer func() {
 		if retErr == nil {
-			glog.V(4).Infof("ContainerStatus for %q returns status %+v", r.GetContainerId(), retRes.GetStatus())
+			log.G(ctx).V(4).Infof("ContainerStatus for %q returns status %+v", r.GetContainerId(), retRes.GetStatus())
 		}
 	}()
 
 	container, err := c.containerStore.Get(r.GetContainerId())
 	if err != nil {
-		return nil, fmt.Errorf("an error occurred when try to find container %q: %v", r.GetContainerId(), err)
+		return nil, wrapGRPCError(err, "an error occurred when try to find container %q", r.GetContainerId())
 	}
 
 	return &runtime.ContainerStatusResponse{
@@ -59,7 +57,7 @@ func toCRIContainerStatus(container containerstore.Container) *runtime.Container
 	}
 	return &runtime.ContainerStatus{
 		Id:          meta.ID,
-		Metadata:    meta.Config.GetMetadata(),
+		Metadata:    toCRIContainerMetadata(meta),
 		State:       status.State(),
 		CreatedAt:   status.CreatedAt,
 		StartedAt:   status.StartedAt,
@@ -72,5 +70,6 @@ func toCRIContainerStatus(container containerstore.Container) *runtime.Container
 		Labels:      meta.Config.GetLabels(),
 		Annotations: meta.Config.GetAnnotations(),
 		Mounts:      meta.Config.GetMounts(),
+		LogPath:     meta.LogPath,
 	}
 }
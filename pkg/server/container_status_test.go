@@ -52,6 +52,7 @@ func getContainerStatusTestData() (*containerstore.Metadata, *containerstore.Sta
 		SandboxID: "test-sandbox-id",
 		Config:    config,
 		ImageRef:  "test-image-ref",
+		LogPath:   "test-log-path",
 	}
 	status := &containerstore.Status{
 		Pid:       1234,
@@ -70,6 +71,7 @@ func getContainerStatusTestData() (*containerstore.Metadata, *containerstore.Sta
 		Labels:      config.GetLabels(),
 		Annotations: config.GetAnnotations(),
 		Mounts:      config.GetMounts(),
+		LogPath:     "test-log-path",
 	}
 
 	return metadata, status, expected
@@ -95,6 +97,13 @@ func TestToCRIContainerStatus(t *testing.T) {
 			expectedState:  runtime.ContainerState_CONTAINER_EXITED,
 			expectedReason: "test-reason",
 		},
+		"container exited with oom killed reason": {
+			finishedAt:     time.Now().UnixNano(),
+			exitCode:       137,
+			reason:         oomExitReason,
+			expectedState:  runtime.ContainerState_CONTAINER_EXITED,
+			expectedReason: oomExitReason,
+		},
 		"container exited with exit code 0 without reason": {
 			finishedAt:     time.Now().UnixNano(),
 			exitCode:       0,
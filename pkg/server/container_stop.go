@@ -22,11 +22,11 @@ import (
 
 	"github.com/containerd/containerd/api/services/tasks/v1"
 	"github.com/docker/docker/pkg/signal"
-	"github.com/golang/glog"
 	"golang.org/x/net/context"
 	"golang.org/x/sys/unix"
 	"k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
 
+	"github.com/kubernetes-incubator/cri-containerd/pkg/log"
 	"github.com/kubernetes-incubator/cri-containerd/pkg/store"
 	containerstore "github.com/kubernetes-incubator/cri-containerd/pkg/store/container"
 )
@@ -43,17 +43,17 @@ const (
 
 // StopContainer stops a running container with a grace period (i.e., timeout).
 func (c *criContainerdService) StopContainer(ctx context.Context, r *runtime.StopContainerRequest) (retRes *runtime.StopContainerResponse, retErr error) {
-	glog.V(2).Infof("StopContainer for %q with timeout %d (s)", r.GetContainerId(), r.GetTimeout())
+	log.G(ctx).V(2).Infof("StopContainer for %q with timeout %d (s)", r.GetContainerId(), r.GetTimeout())
 	defer func() {
 		if retErr == nil {
-			glog.V(2).Infof("StopContainer %q returns successfully", r.GetContainerId())
+			log.G(ctx).V(2).Infof("StopContainer %q returns successfully", r.GetContainerId())
 		}
 	}()
 
 	// Get container config from container store.
 	container, err := c.containerStore.Get(r.GetContainerId())
 	if err != nil {
-		return nil, fmt.Errorf("an error occurred when try to find container %q: %v", r.GetContainerId(), err)
+		return nil, wrapGRPCError(err, "an error occurred when try to find container %q", r.GetContainerId())
 	}
 
 	if err := c.stopContainer(ctx, container, time.Duration(r.GetTimeout())*time.Second); err != nil {
@@ -71,30 +71,23 @@ func (c *criContainerdService) stopContainer(ctx context.Context, container cont
 	// stop only takes real action after the container is started.
 	state := container.Status.Get().State()
 	if state != runtime.ContainerState_CONTAINER_RUNNING {
-		glog.V(2).Infof("Container to stop %q is not running, current state %q",
+		log.G(ctx).V(2).Infof("Container to stop %q is not running, current state %q",
 			id, criContainerStateToString(state))
 		return nil
 	}
 
 	if timeout > 0 {
 		stopSignal := unix.SIGTERM
-		image, err := c.imageStore.Get(container.ImageRef)
-		if err != nil {
-			// NOTE(random-liu): It's possible that the container is stopped,
-			// deleted and image is garbage collected before this point. However,
-			// the chance is really slim, even it happens, it's still fine to return
-			// an error here.
-			return fmt.Errorf("failed to get image metadata %q: %v", container.ImageRef, err)
-		}
-		if image.Config.StopSignal != "" {
-			stopSignal, err = signal.ParseSignal(image.Config.StopSignal)
+		if container.StopSignal != "" {
+			var err error
+			stopSignal, err = signal.ParseSignal(container.StopSignal)
 			if err != nil {
 				return fmt.Errorf("failed to parse stop signal %q: %v",
-					image.Config.StopSignal, err)
+					container.StopSignal, err)
 			}
 		}
-		glog.V(2).Infof("Stop container %q with signal %v", id, stopSignal)
-		_, err = c.taskService.Kill(ctx, &tasks.KillRequest{
+		log.G(ctx).V(2).Infof("Stop container %q with signal %v", id, stopSignal)
+		_, err := c.taskService.Kill(ctx, &tasks.KillRequest{
 			ContainerID: id,
 			Signal:      uint32(stopSignal),
 			All:         true,
@@ -110,11 +103,25 @@ func (c *criContainerdService) stopContainer(ctx context.Context, container cont
 		if err == nil {
 			return nil
 		}
-		glog.Errorf("Stop container %q timed out: %v", id, err)
+		log.G(ctx).Errorf("Stop container %q timed out: %v", id, err)
 	}
 
 	// Event handler will Delete the container from containerd after it handles the Exited event.
-	glog.V(2).Infof("Kill container %q", id)
+	if err := c.killContainer(ctx, id); err != nil {
+		return err
+	}
+
+	// Wait for a fixed timeout until container stop is observed by event monitor.
+	if err := c.waitContainerStop(ctx, id, killContainerTimeout); err != nil {
+		return fmt.Errorf("an error occurs during waiting for container %q to stop: %v", id, err)
+	}
+	return nil
+}
+
+// killContainer sends SIGKILL to all processes in the container. It doesn't wait
+// for the container to exit.
+func (c *criContainerdService) killContainer(ctx context.Context, id string) error {
+	log.G(ctx).V(2).Infof("Kill container %q", id)
 	_, err := c.taskService.Kill(ctx, &tasks.KillRequest{
 		ContainerID: id,
 		Signal:      uint32(unix.SIGKILL),
@@ -126,43 +133,30 @@ func (c *criContainerdService) stopContainer(ctx context.Context, container cont
 		}
 		// Move on to make sure container status is updated.
 	}
-
-	// Wait for a fixed timeout until container stop is observed by event monitor.
-	if err := c.waitContainerStop(ctx, id, killContainerTimeout); err != nil {
-		return fmt.Errorf("an error occurs during waiting for container %q to stop: %v", id, err)
-	}
 	return nil
 }
 
-// waitContainerStop polls container state until timeout exceeds or container is stopped.
+// waitContainerStop waits until timeout exceeds or container is stopped. The container
+// status is updated by the event monitor when the container exit event is received.
 func (c *criContainerdService) waitContainerStop(ctx context.Context, id string, timeout time.Duration) error {
-	ticker := time.NewTicker(stopCheckPollInterval)
-	defer ticker.Stop()
+	container, err := c.containerStore.Get(id)
+	if err != nil {
+		if err != store.ErrNotExist {
+			return fmt.Errorf("failed to get container %q: %v", id, err)
+		}
+		// Do not return error here because container was removed means
+		// it is already stopped.
+		log.G(ctx).Warningf("Container %q was removed during stopping", id)
+		return nil
+	}
 	timeoutTimer := time.NewTimer(timeout)
 	defer timeoutTimer.Stop()
-	for {
-		// Poll once before waiting for stopCheckPollInterval.
-		container, err := c.containerStore.Get(id)
-		if err != nil {
-			if err != store.ErrNotExist {
-				return fmt.Errorf("failed to get container %q: %v", id, err)
-			}
-			// Do not return error here because container was removed means
-			// it is already stopped.
-			glog.Warningf("Container %q was removed during stopping", id)
-			return nil
-		}
-		// TODO(random-liu): Use channel with event handler instead of polling.
-		if container.Status.Get().State() == runtime.ContainerState_CONTAINER_EXITED {
-			return nil
-		}
-		select {
-		case <-ctx.Done():
-			return fmt.Errorf("wait container %q is cancelled", id)
-		case <-timeoutTimer.C:
-			return fmt.Errorf("wait container %q stop timeout", id)
-		case <-ticker.C:
-			continue
-		}
+	select {
+	case <-ctx.Done():
+		return fmt.Errorf("wait container %q is cancelled", id)
+	case <-timeoutTimer.C:
+		return fmt.Errorf("wait container %q stop timeout", id)
+	case <-container.Status.Stopped():
+		return nil
 	}
 }
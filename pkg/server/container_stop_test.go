@@ -17,12 +17,19 @@ limitations under the License.
 package server
 
 import (
+	"syscall"
 	"testing"
 	"time"
 
+	"github.com/containerd/containerd/api/services/tasks/v1"
+	"github.com/containerd/containerd/api/types/task"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"golang.org/x/net/context"
+	"golang.org/x/sys/unix"
+	"k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
 
+	servertesting "github.com/kubernetes-incubator/cri-containerd/pkg/server/testing"
 	containerstore "github.com/kubernetes-incubator/cri-containerd/pkg/store/container"
 )
 
@@ -31,6 +38,7 @@ func TestWaitContainerStop(t *testing.T) {
 	for desc, test := range map[string]struct {
 		status    *containerstore.Status
 		cancel    bool
+		stop      bool
 		timeout   time.Duration
 		expectErr bool
 	}{
@@ -65,6 +73,15 @@ func TestWaitContainerStop(t *testing.T) {
 			timeout:   time.Hour,
 			expectErr: false,
 		},
+		"should not return error if container is stopped during waiting": {
+			status: &containerstore.Status{
+				CreatedAt: time.Now().UnixNano(),
+				StartedAt: time.Now().UnixNano(),
+			},
+			stop:      true,
+			timeout:   time.Hour,
+			expectErr: false,
+		},
 	} {
 		c := newTestCRIContainerdService()
 		if test.status != nil {
@@ -74,6 +91,13 @@ func TestWaitContainerStop(t *testing.T) {
 			)
 			assert.NoError(t, err)
 			assert.NoError(t, c.containerStore.Add(container))
+			if test.stop {
+				// Set the container exited as the event monitor does.
+				go func() {
+					time.Sleep(stopCheckPollInterval)
+					assert.NoError(t, setContainerExited(container, 0, time.Now(), ""))
+				}()
+			}
 		}
 		ctx := context.Background()
 		if test.cancel {
@@ -85,3 +109,100 @@ func TestWaitContainerStop(t *testing.T) {
 		assert.Equal(t, test.expectErr, err != nil, desc)
 	}
 }
+
+func TestStopContainer(t *testing.T) {
+	for desc, test := range map[string]struct {
+		status          containerstore.Status
+		stopSignal      string
+		timeout         int64
+		exitSignal      syscall.Signal
+		expectedSignals []syscall.Signal
+	}{
+		"should return success if container is not running": {
+			status: containerstore.Status{
+				CreatedAt:  time.Now().UnixNano(),
+				StartedAt:  time.Now().UnixNano(),
+				FinishedAt: time.Now().UnixNano(),
+			},
+		},
+		"should kill container immediately if timeout is 0": {
+			status: containerstore.Status{
+				CreatedAt: time.Now().UnixNano(),
+				StartedAt: time.Now().UnixNano(),
+			},
+			exitSignal:      unix.SIGKILL,
+			expectedSignals: []syscall.Signal{unix.SIGKILL},
+		},
+		"should stop container with stop signal if it exits before timeout": {
+			status: containerstore.Status{
+				CreatedAt: time.Now().UnixNano(),
+				StartedAt: time.Now().UnixNano(),
+			},
+			timeout:         3600,
+			exitSignal:      unix.SIGTERM,
+			expectedSignals: []syscall.Signal{unix.SIGTERM},
+		},
+		"should stop container with the image stop signal": {
+			status: containerstore.Status{
+				CreatedAt: time.Now().UnixNano(),
+				StartedAt: time.Now().UnixNano(),
+			},
+			stopSignal:      "SIGQUIT",
+			timeout:         3600,
+			exitSignal:      syscall.SIGQUIT,
+			expectedSignals: []syscall.Signal{syscall.SIGQUIT},
+		},
+		"should kill container if it doesn't exit before timeout": {
+			status: containerstore.Status{
+				CreatedAt: time.Now().UnixNano(),
+				StartedAt: time.Now().UnixNano(),
+			},
+			timeout:         1,
+			exitSignal:      unix.SIGKILL,
+			expectedSignals: []syscall.Signal{unix.SIGTERM, unix.SIGKILL},
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		c := newTestCRIContainerdService()
+		fakeTaskService := c.taskService.(*servertesting.FakeTaskService)
+		container, err := containerstore.NewContainer(
+			containerstore.Metadata{ID: "test-id", StopSignal: test.stopSignal},
+			test.status,
+		)
+		require.NoError(t, err)
+		require.NoError(t, c.containerStore.Add(container))
+		fakeTaskService.SetFakeTasks([]task.Task{{ID: "test-id", Pid: 1, Status: task.StatusRunning}})
+
+		// Set the container exited as the event monitor does once the exit
+		// signal is received.
+		done := make(chan struct{})
+		go func() {
+			for {
+				for _, call := range fakeTaskService.GetCalledDetails() {
+					if req, ok := call.Argument.(*tasks.KillRequest); ok && req.Signal == uint32(test.exitSignal) {
+						assert.NoError(t, setContainerExited(container, 0, time.Now(), ""))
+						return
+					}
+				}
+				select {
+				case <-done:
+					return
+				case <-time.After(10 * time.Millisecond):
+				}
+			}
+		}()
+		_, err = c.StopContainer(context.Background(), &runtime.StopContainerRequest{
+			ContainerId: "test-id",
+			Timeout:     test.timeout,
+		})
+		close(done)
+		assert.NoError(t, err)
+		var signals []syscall.Signal
+		for _, call := range fakeTaskService.GetCalledDetails() {
+			if req, ok := call.Argument.(*tasks.KillRequest); ok {
+				signals = append(signals, syscall.Signal(req.Signal))
+			}
+		}
+		assert.Equal(t, test.expectedSignals, signals)
+	}
+}
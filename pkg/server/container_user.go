@@ -0,0 +1,450 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
+	runtimespec "github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+
+	"github.com/kubernetes-incubator/cri-containerd/pkg/log"
+)
+
+const (
+	// runAsGroupAnnotationKey is the container annotation key of the numeric
+	// group id the container process runs as.
+	// TODO: Switch to the CRI RunAsGroup field once the CRI api is bumped.
+	runAsGroupAnnotationKey = "io.kubernetes.cri-containerd.run-as-group"
+	// runAsNonRootAnnotationKey is the container annotation key requiring the
+	// container process not to run as root. The value is a boolean.
+	// TODO: Switch to the CRI RunAsNonRoot field once the CRI api is bumped.
+	runAsNonRootAnnotationKey = "io.kubernetes.cri-containerd.run-as-non-root"
+	// fsGroupAnnotationKey is the sandbox annotation key of the numeric pod
+	// fsGroup, which is added to the additional gids of all containers in the
+	// sandbox.
+	// TODO: Switch to the CRI fsGroup field once the CRI api is bumped.
+	fsGroupAnnotationKey = "io.kubernetes.cri-containerd.fs-group"
+	// etcPasswd is the path of the user database in the container rootfs.
+	etcPasswd = "/etc/passwd"
+	// etcGroup is the path of the group database in the container rootfs.
+	etcGroup = "/etc/group"
+)
+
+// passwdEntry is a user entry in /etc/passwd.
+type passwdEntry struct {
+	name string
+	uid  uint32
+	gid  uint32
+}
+
+// groupEntry is a group entry in /etc/group.
+type groupEntry struct {
+	name    string
+	gid     uint32
+	members []string
+}
+
+// getContainerUserAndGroup returns the user and group the container process
+// should run as, either of which could be numeric or a name. RunAsUser takes
+// precedence over RunAsUsername, and the image user is used if neither is set.
+func getContainerUserAndGroup(config *runtime.ContainerConfig, imageConfig *imagespec.ImageConfig) (string, string, error) {
+	var user, group string
+	securityContext := config.GetLinux().GetSecurityContext()
+	switch {
+	case securityContext.GetRunAsUser() != nil:
+		user = strconv.FormatInt(securityContext.GetRunAsUser().GetValue(), 10)
+	case securityContext.GetRunAsUsername() != "":
+		user = securityContext.GetRunAsUsername()
+	default:
+		parts := strings.SplitN(imageConfig.User, ":", 2)
+		user = parts[0]
+		if len(parts) == 2 {
+			group = parts[1]
+		}
+	}
+	if value, ok := config.GetAnnotations()[runAsGroupAnnotationKey]; ok {
+		if _, err := parseID(value); err != nil {
+			return "", "", grpc.Errorf(codes.InvalidArgument, "invalid run as group %q: %v", value, err)
+		}
+		group = value
+	}
+	return user, group, nil
+}
+
+// getContainerUser resolves the uid, gid and additional gids of the container
+// process. User and group names are looked up in the /etc/passwd and
+// /etc/group of the container rootfs, which must have been prepared. The
+// groups the user name is a member of are returned as additional gids.
+func (c *criContainerdService) getContainerUser(ctx context.Context, id string, config *runtime.ContainerConfig,
+	imageConfig *imagespec.ImageConfig) (runtimespec.User, error) {
+	user, group, err := getContainerUserAndGroup(config, imageConfig)
+	if err != nil {
+		return runtimespec.User{}, err
+	}
+	uid, userErr := parseID(user)
+	gid, groupErr := parseID(group)
+	if (user == "" || userErr == nil) && groupErr == nil {
+		// Numeric ids don't need the rootfs. The primary group and the
+		// additional groups of a numeric uid without a group are still looked
+		// up in the rootfs.
+		return runtimespec.User{UID: uid, GID: gid}, nil
+	}
+	var u runtimespec.User
+	var retErr error
+	if err := c.withContainerRootfs(ctx, id, func(root string) error {
+		u, retErr = resolveUserInRootfs(root, user, group)
+		return nil
+	}); err != nil {
+		return runtimespec.User{}, err
+	}
+	return u, retErr
+}
+
+// getFSGroup returns the fsGroup of the sandbox, or nil if it's not specified.
+func getFSGroup(sandboxConfig *runtime.PodSandboxConfig) (*uint32, error) {
+	value, ok := sandboxConfig.GetAnnotations()[fsGroupAnnotationKey]
+	if !ok {
+		return nil, nil
+	}
+	gid, err := parseID(value)
+	if err != nil {
+		return nil, grpc.Errorf(codes.InvalidArgument, "invalid fs group %q: %v", value, err)
+	}
+	return &gid, nil
+}
+
+// getSupplementalGroups returns the validated supplemental groups of the
+// sandbox and the container, and the sandbox fsGroup, without duplication.
+func getSupplementalGroups(sandboxConfig *runtime.PodSandboxConfig, config *runtime.ContainerConfig) ([]uint32, error) {
+	var gids []uint32
+	for _, groups := range [][]int64{
+		sandboxConfig.GetLinux().GetSecurityContext().GetSupplementalGroups(),
+		config.GetLinux().GetSecurityContext().GetSupplementalGroups(),
+	} {
+		for _, group := range groups {
+			if group < 0 || group > math.MaxUint32 {
+				return nil, grpc.Errorf(codes.InvalidArgument, "invalid supplemental group %d", group)
+			}
+			gids = mergeGids(gids, []uint32{uint32(group)})
+		}
+	}
+	fsGroup, err := getFSGroup(sandboxConfig)
+	if err != nil {
+		return nil, err
+	}
+	if fsGroup != nil {
+		gids = mergeGids(gids, []uint32{*fsGroup})
+	}
+	return gids, nil
+}
+
+// mergeGids appends the gids not in the existing list, keeping the order.
+func mergeGids(gids []uint32, extra []uint32) []uint32 {
+	for _, gid := range extra {
+		found := false
+		for _, g := range gids {
+			if g == gid {
+				found = true
+				break
+			}
+		}
+		if !found {
+			gids = append(gids, gid)
+		}
+	}
+	return gids
+}
+
+// validateRunAsNonRoot returns error if the container is required to run as
+// non-root, but the resolved uid is root.
+func validateRunAsNonRoot(config *runtime.ContainerConfig, uid uint32) error {
+	value, ok := config.GetAnnotations()[runAsNonRootAnnotationKey]
+	if !ok {
+		return nil
+	}
+	nonRoot, err := strconv.ParseBool(value)
+	if err != nil {
+		return grpc.Errorf(codes.InvalidArgument, "invalid run as non-root %q: %v", value, err)
+	}
+	if nonRoot && uid == 0 {
+		return grpc.Errorf(codes.InvalidArgument, "container has run as non-root set and will run as root (uid 0)")
+	}
+	return nil
+}
+
+// withContainerRootfs temporarily mounts the container rootfs and calls f
+// with the mount point.
+func (c *criContainerdService) withContainerRootfs(ctx context.Context, id string, f func(root string) error) error {
+	mounts, err := c.snapshotService.Mounts(ctx, id)
+	if err != nil {
+		return fmt.Errorf("failed to get container rootfs mounts %q: %v", id, err)
+	}
+	root, err := ioutil.TempDir("", "cri-containerd-rootfs-")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary rootfs mount point: %v", err)
+	}
+	defer func() {
+		// Only remove the mount point if it is empty, in case the unmount failed.
+		if err := os.Remove(root); err != nil {
+			log.G(ctx).Errorf("Failed to remove temporary rootfs mount point %q: %v", root, err)
+		}
+	}()
+	if err := c.os.MountAll(mounts, root); err != nil {
+		return fmt.Errorf("failed to mount container rootfs %q: %v", id, err)
+	}
+	defer func() {
+		if err := c.os.Unmount(root, 0); err != nil {
+			log.G(ctx).Errorf("Failed to unmount container rootfs %q: %v", root, err)
+		}
+	}()
+	return f(root)
+}
+
+// resolveUserInRootfs resolves the uid, gid and additional gids of the user
+// and group in the rootfs. An empty user is root. If the group is not
+// specified, the primary group of the user in /etc/passwd is used. A numeric
+// uid not in /etc/passwd gets gid 0 and no additional gids.
+func resolveUserInRootfs(root, user, group string) (runtimespec.User, error) {
+	var u runtimespec.User
+	var entry passwdEntry
+	var found bool
+	if id, err := parseID(user); user == "" || err == nil {
+		u.UID = id
+		entry, found, err = lookupPasswdEntryByUID(root, id)
+		if err != nil {
+			return runtimespec.User{}, err
+		}
+	} else {
+		entry, err = lookupPasswdEntry(root, user)
+		if err != nil {
+			return runtimespec.User{}, err
+		}
+		found = true
+	}
+	if found {
+		u.UID, u.GID = entry.uid, entry.gid
+		groups, err := lookupMemberGroups(root, entry.name)
+		if err != nil {
+			return runtimespec.User{}, err
+		}
+		for _, g := range groups {
+			u.AdditionalGids = mergeGids(u.AdditionalGids, []uint32{g.gid})
+		}
+	}
+	if group != "" {
+		if id, err := parseID(group); err == nil {
+			u.GID = id
+		} else {
+			entry, err := lookupGroupEntry(root, group)
+			if err != nil {
+				return runtimespec.User{}, err
+			}
+			u.GID = entry.gid
+		}
+	}
+	return u, nil
+}
+
+// lookupPasswdEntry finds the user in the /etc/passwd of the rootfs.
+func lookupPasswdEntry(root, name string) (passwdEntry, error) {
+	entries, err := readPasswd(root)
+	if err != nil {
+		return passwdEntry{}, err
+	}
+	for _, e := range entries {
+		if e.name == name {
+			return e, nil
+		}
+	}
+	return passwdEntry{}, grpc.Errorf(codes.InvalidArgument, "user %q not found in image %s", name, etcPasswd)
+}
+
+// lookupPasswdEntryByUID finds the first user with the uid in the /etc/passwd
+// of the rootfs. It returns false if the uid is not found.
+func lookupPasswdEntryByUID(root string, uid uint32) (passwdEntry, bool, error) {
+	entries, err := readPasswd(root)
+	if err != nil {
+		return passwdEntry{}, false, err
+	}
+	for _, e := range entries {
+		if e.uid == uid {
+			return e, true, nil
+		}
+	}
+	return passwdEntry{}, false, nil
+}
+
+// lookupGroupEntry finds the group in the /etc/group of the rootfs.
+func lookupGroupEntry(root, name string) (groupEntry, error) {
+	entries, err := readGroups(root)
+	if err != nil {
+		return groupEntry{}, err
+	}
+	for _, e := range entries {
+		if e.name == name {
+			return e, nil
+		}
+	}
+	return groupEntry{}, grpc.Errorf(codes.InvalidArgument, "group %q not found in image %s", name, etcGroup)
+}
+
+// lookupMemberGroups finds the groups the user is a member of in the
+// /etc/group of the rootfs.
+func lookupMemberGroups(root, user string) ([]groupEntry, error) {
+	entries, err := readGroups(root)
+	if err != nil {
+		return nil, err
+	}
+	var groups []groupEntry
+	for _, e := range entries {
+		for _, m := range e.members {
+			if m == user {
+				groups = append(groups, e)
+				break
+			}
+		}
+	}
+	return groups, nil
+}
+
+// readPasswd reads the /etc/passwd of the rootfs.
+func readPasswd(root string) ([]passwdEntry, error) {
+	r, err := openRootfsFile(root, etcPasswd)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	entries, err := parsePasswd(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse image %s: %v", etcPasswd, err)
+	}
+	return entries, nil
+}
+
+// readGroups reads the /etc/group of the rootfs.
+func readGroups(root string) ([]groupEntry, error) {
+	r, err := openRootfsFile(root, etcGroup)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	entries, err := parseGroup(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse image %s: %v", etcGroup, err)
+	}
+	return entries, nil
+}
+
+// openRootfsFile opens a file in the rootfs. The file must be a regular file,
+// so that a symlink in the image can't point to a file on the host. A missing
+// file is treated as empty.
+func openRootfsFile(root, path string) (io.ReadCloser, error) {
+	fullPath := filepath.Join(root, path)
+	fi, err := os.Lstat(fullPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ioutil.NopCloser(strings.NewReader("")), nil
+		}
+		return nil, fmt.Errorf("failed to stat image %s: %v", path, err)
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, fmt.Errorf("image %s is not a regular file", path)
+	}
+	f, err := os.Open(fullPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open image %s: %v", path, err)
+	}
+	return f, nil
+}
+
+// parsePasswd parses the passwd file format, i.e.
+// `name:password:uid:gid:gecos:home:shell`. Malformed lines are skipped.
+func parsePasswd(r io.Reader) ([]passwdEntry, error) {
+	var entries []passwdEntry
+	err := parseColonFile(r, func(fields []string) {
+		if len(fields) < 4 {
+			return
+		}
+		uid, err := parseID(fields[2])
+		if err != nil {
+			return
+		}
+		gid, err := parseID(fields[3])
+		if err != nil {
+			return
+		}
+		entries = append(entries, passwdEntry{name: fields[0], uid: uid, gid: gid})
+	})
+	return entries, err
+}
+
+// parseGroup parses the group file format, i.e.
+// `name:password:gid:members`. Malformed lines are skipped.
+func parseGroup(r io.Reader) ([]groupEntry, error) {
+	var entries []groupEntry
+	err := parseColonFile(r, func(fields []string) {
+		if len(fields) < 3 {
+			return
+		}
+		gid, err := parseID(fields[2])
+		if err != nil {
+			return
+		}
+		entry := groupEntry{name: fields[0], gid: gid}
+		if len(fields) > 3 && fields[3] != "" {
+			entry.members = strings.Split(fields[3], ",")
+		}
+		entries = append(entries, entry)
+	})
+	return entries, err
+}
+
+// parseColonFile calls f with the colon separated fields of each non-empty,
+// non-comment line.
+func parseColonFile(r io.Reader, f func([]string)) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		f(strings.Split(line, ":"))
+	}
+	return scanner.Err()
+}
+
+// parseID parses a numeric uid or gid.
+func parseID(id string) (uint32, error) {
+	v, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		return 0, err
+	}
+	return uint32(v), nil
+}
@@ -0,0 +1,521 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/snapshot"
+	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+
+	ostesting "github.com/kubernetes-incubator/cri-containerd/pkg/os/testing"
+	servertesting "github.com/kubernetes-incubator/cri-containerd/pkg/server/testing"
+	imagestore "github.com/kubernetes-incubator/cri-containerd/pkg/store/image"
+	sandboxstore "github.com/kubernetes-incubator/cri-containerd/pkg/store/sandbox"
+)
+
+const (
+	testPasswd = `# comment
+root:x:0:0:root:/root:/bin/sh
+malformed
+nobody:x:65534:65533:nobody:/nonexistent:/usr/sbin/nologin
+app:x:1000:1001::/home/app:/bin/sh
+`
+	testGroup = `root:x:0:
+nogroup:x:65533:
+app:x:1001:
+staff:x:50:app
+video:x:44:nobody,app
+audio:x:29:nobody
+`
+)
+
+func TestGetContainerUserAndGroup(t *testing.T) {
+	for desc, test := range map[string]struct {
+		securityContext *runtime.LinuxContainerSecurityContext
+		annotations     map[string]string
+		imageUser       string
+		expectUser      string
+		expectGroup     string
+		expectErr       bool
+	}{
+		"should return empty user if nothing is specified": {},
+		"should use image user and group": {
+			imageUser:   "app:staff",
+			expectUser:  "app",
+			expectGroup: "staff",
+		},
+		"should prefer run as user over image user": {
+			securityContext: &runtime.LinuxContainerSecurityContext{
+				RunAsUser: &runtime.Int64Value{Value: 1234},
+			},
+			imageUser:  "app:staff",
+			expectUser: "1234",
+		},
+		"should prefer run as user over run as username": {
+			securityContext: &runtime.LinuxContainerSecurityContext{
+				RunAsUser:     &runtime.Int64Value{Value: 1234},
+				RunAsUsername: "app",
+			},
+			expectUser: "1234",
+		},
+		"should use run as username": {
+			securityContext: &runtime.LinuxContainerSecurityContext{
+				RunAsUsername: "app",
+			},
+			imageUser:  "root",
+			expectUser: "app",
+		},
+		"should use run as group annotation": {
+			securityContext: &runtime.LinuxContainerSecurityContext{
+				RunAsUser: &runtime.Int64Value{Value: 1234},
+			},
+			annotations: map[string]string{runAsGroupAnnotationKey: "5678"},
+			expectUser:  "1234",
+			expectGroup: "5678",
+		},
+		"should return error for non-numeric run as group annotation": {
+			annotations: map[string]string{runAsGroupAnnotationKey: "staff"},
+			expectErr:   true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		config := &runtime.ContainerConfig{
+			Annotations: test.annotations,
+			Linux:       &runtime.LinuxContainerConfig{SecurityContext: test.securityContext},
+		}
+		user, group, err := getContainerUserAndGroup(config, &imagespec.ImageConfig{User: test.imageUser})
+		if test.expectErr {
+			assert.Error(t, err)
+			continue
+		}
+		assert.NoError(t, err)
+		assert.Equal(t, test.expectUser, user)
+		assert.Equal(t, test.expectGroup, group)
+	}
+}
+
+func TestParsePasswdAndGroup(t *testing.T) {
+	users, err := parsePasswd(strings.NewReader(testPasswd))
+	assert.NoError(t, err)
+	assert.Equal(t, []passwdEntry{
+		{name: "root", uid: 0, gid: 0},
+		{name: "nobody", uid: 65534, gid: 65533},
+		{name: "app", uid: 1000, gid: 1001},
+	}, users)
+	groups, err := parseGroup(strings.NewReader(testGroup))
+	assert.NoError(t, err)
+	assert.Equal(t, []groupEntry{
+		{name: "root", gid: 0},
+		{name: "nogroup", gid: 65533},
+		{name: "app", gid: 1001},
+		{name: "staff", gid: 50, members: []string{"app"}},
+		{name: "video", gid: 44, members: []string{"nobody", "app"}},
+		{name: "audio", gid: 29, members: []string{"nobody"}},
+	}, groups)
+}
+
+func TestResolveUserInRootfs(t *testing.T) {
+	root, err := ioutil.TempDir("", "test-rootfs")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+	writeTestRootfsFiles(t, root)
+	noPasswdRoot, err := ioutil.TempDir("", "test-rootfs")
+	require.NoError(t, err)
+	defer os.RemoveAll(noPasswdRoot)
+	symlinkRoot, err := ioutil.TempDir("", "test-rootfs")
+	require.NoError(t, err)
+	defer os.RemoveAll(symlinkRoot)
+	require.NoError(t, os.MkdirAll(filepath.Join(symlinkRoot, "etc"), 0755))
+	require.NoError(t, os.Symlink(filepath.Join(root, etcPasswd), filepath.Join(symlinkRoot, etcPasswd)))
+
+	for desc, test := range map[string]struct {
+		root        string
+		user        string
+		group       string
+		expectUID   uint32
+		expectGID   uint32
+		expectGids  []uint32
+		expectErr   bool
+		expectCode  codes.Code
+		errContains string
+	}{
+		"should use primary group of user name": {
+			root:       root,
+			user:       "app",
+			expectUID:  1000,
+			expectGID:  1001,
+			expectGids: []uint32{50, 44},
+		},
+		"should resolve group name": {
+			root:       root,
+			user:       "app",
+			group:      "staff",
+			expectUID:  1000,
+			expectGID:  50,
+			expectGids: []uint32{50, 44},
+		},
+		"should use numeric group over primary group": {
+			root:       root,
+			user:       "nobody",
+			group:      "7",
+			expectUID:  65534,
+			expectGID:  7,
+			expectGids: []uint32{44, 29},
+		},
+		"should use primary group of numeric user": {
+			root:       root,
+			user:       "65534",
+			expectUID:  65534,
+			expectGID:  65533,
+			expectGids: []uint32{44, 29},
+		},
+		"should resolve empty user as root": {
+			root:      root,
+			expectUID: 0,
+			expectGID: 0,
+		},
+		"should use gid 0 for numeric user if passwd doesn't exist": {
+			root:      noPasswdRoot,
+			user:      "1000",
+			expectUID: 1000,
+			expectGID: 0,
+		},
+		"should resolve group name with numeric user": {
+			root:      root,
+			user:      "1234",
+			group:     "nogroup",
+			expectUID: 1234,
+			expectGID: 65533,
+		},
+		"should return error for nonexistent user": {
+			root:        root,
+			user:        "missing",
+			expectErr:   true,
+			expectCode:  codes.InvalidArgument,
+			errContains: `user "missing" not found`,
+		},
+		"should return error for nonexistent group": {
+			root:        root,
+			user:        "app",
+			group:       "missing",
+			expectErr:   true,
+			expectCode:  codes.InvalidArgument,
+			errContains: `group "missing" not found`,
+		},
+		"should return error for user name if passwd doesn't exist": {
+			root:        noPasswdRoot,
+			user:        "app",
+			expectErr:   true,
+			expectCode:  codes.InvalidArgument,
+			errContains: `user "app" not found`,
+		},
+		"should not follow symlinked passwd": {
+			root:        symlinkRoot,
+			user:        "app",
+			expectErr:   true,
+			expectCode:  codes.Unknown,
+			errContains: "not a regular file",
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		user, err := resolveUserInRootfs(test.root, test.user, test.group)
+		if test.expectErr {
+			require.Error(t, err)
+			assert.Equal(t, test.expectCode, grpc.Code(err))
+			assert.Contains(t, err.Error(), test.errContains)
+			continue
+		}
+		assert.NoError(t, err)
+		assert.Equal(t, test.expectUID, user.UID)
+		assert.Equal(t, test.expectGID, user.GID)
+		assert.Equal(t, test.expectGids, user.AdditionalGids)
+	}
+}
+
+func TestGetContainerUser(t *testing.T) {
+	const testID = "test-id"
+	for desc, test := range map[string]struct {
+		securityContext *runtime.LinuxContainerSecurityContext
+		imageUser       string
+		expectUID       uint32
+		expectGID       uint32
+		expectGids      []uint32
+		expectMount     bool
+		expectErr       bool
+	}{
+		"should run as root by default": {
+			expectMount: true,
+		},
+		"should look up primary group and additional groups of numeric user": {
+			securityContext: &runtime.LinuxContainerSecurityContext{
+				RunAsUser: &runtime.Int64Value{Value: 1000},
+			},
+			expectUID:   1000,
+			expectGID:   1001,
+			expectGids:  []uint32{50, 44},
+			expectMount: true,
+		},
+		"should use gid 0 for numeric user not in passwd": {
+			securityContext: &runtime.LinuxContainerSecurityContext{
+				RunAsUser: &runtime.Int64Value{Value: 1234},
+			},
+			expectUID:   1234,
+			expectMount: true,
+		},
+		"should not mount rootfs for numeric user and group": {
+			imageUser: "1234:5678",
+			expectUID: 1234,
+			expectGID: 5678,
+		},
+		"should resolve run as username in rootfs": {
+			securityContext: &runtime.LinuxContainerSecurityContext{
+				RunAsUsername: "app",
+			},
+			expectUID:   1000,
+			expectGID:   1001,
+			expectGids:  []uint32{50, 44},
+			expectMount: true,
+		},
+		"should resolve image user in rootfs": {
+			imageUser:   "nobody:staff",
+			expectUID:   65534,
+			expectGID:   50,
+			expectGids:  []uint32{44, 29},
+			expectMount: true,
+		},
+		"should return error for nonexistent user": {
+			securityContext: &runtime.LinuxContainerSecurityContext{
+				RunAsUsername: "missing",
+			},
+			expectMount: true,
+			expectErr:   true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		c := newTestCRIContainerdService()
+		fakeOS := c.os.(*ostesting.FakeOS)
+		fakeSnapshotter := c.snapshotService.(*servertesting.FakeSnapshotter)
+		fakeSnapshotter.SetFakeSnapshots([]snapshot.Info{{Name: testID, Kind: snapshot.KindActive}})
+		var mountPoint string
+		fakeOS.MountAllFn = func(mounts []mount.Mount, target string) error {
+			mountPoint = target
+			writeTestRootfsFiles(t, target)
+			return nil
+		}
+		fakeOS.UnmountFn = func(target string, flags int) error {
+			assert.Equal(t, mountPoint, target)
+			return os.RemoveAll(filepath.Join(target, "etc"))
+		}
+		config := &runtime.ContainerConfig{
+			Linux: &runtime.LinuxContainerConfig{SecurityContext: test.securityContext},
+		}
+		user, err := c.getContainerUser(context.Background(), testID, config,
+			&imagespec.ImageConfig{User: test.imageUser})
+		assert.Equal(t, test.expectErr, err != nil)
+		assert.Equal(t, test.expectUID, user.UID)
+		assert.Equal(t, test.expectGID, user.GID)
+		assert.Equal(t, test.expectGids, user.AdditionalGids)
+		assert.Equal(t, test.expectMount, mountPoint != "")
+		if mountPoint != "" {
+			_, err := os.Stat(mountPoint)
+			assert.True(t, os.IsNotExist(err), "temporary mount point should be removed")
+		}
+	}
+}
+
+func TestGetSupplementalGroups(t *testing.T) {
+	for desc, test := range map[string]struct {
+		sandboxGroups   []int64
+		containerGroups []int64
+		fsGroup         string
+		expected        []uint32
+		expectErr       bool
+	}{
+		"should return nil if no group is specified": {},
+		"should merge sandbox and container groups without duplication": {
+			sandboxGroups:   []int64{1111, 2222, 1111},
+			containerGroups: []int64{2222, 3333},
+			expected:        []uint32{1111, 2222, 3333},
+		},
+		"should return error for negative group": {
+			containerGroups: []int64{-1},
+			expectErr:       true,
+		},
+		"should return error for group out of range": {
+			sandboxGroups: []int64{1 << 32},
+			expectErr:     true,
+		},
+		"should add fs group": {
+			sandboxGroups: []int64{1111},
+			fsGroup:       "2000",
+			expected:      []uint32{1111, 2000},
+		},
+		"should not duplicate fs group": {
+			containerGroups: []int64{2000},
+			fsGroup:         "2000",
+			expected:        []uint32{2000},
+		},
+		"should return error for invalid fs group": {
+			fsGroup:   "-1",
+			expectErr: true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		var annotations map[string]string
+		if test.fsGroup != "" {
+			annotations = map[string]string{fsGroupAnnotationKey: test.fsGroup}
+		}
+		sandboxConfig := &runtime.PodSandboxConfig{
+			Annotations: annotations,
+			Linux: &runtime.LinuxPodSandboxConfig{
+				SecurityContext: &runtime.LinuxSandboxSecurityContext{SupplementalGroups: test.sandboxGroups},
+			},
+		}
+		config := &runtime.ContainerConfig{
+			Linux: &runtime.LinuxContainerConfig{
+				SecurityContext: &runtime.LinuxContainerSecurityContext{SupplementalGroups: test.containerGroups},
+			},
+		}
+		gids, err := getSupplementalGroups(sandboxConfig, config)
+		if test.expectErr {
+			require.Error(t, err)
+			assert.Equal(t, codes.InvalidArgument, grpc.Code(err))
+			continue
+		}
+		assert.NoError(t, err)
+		assert.Equal(t, test.expected, gids)
+	}
+}
+
+func TestValidateRunAsNonRoot(t *testing.T) {
+	for desc, test := range map[string]struct {
+		annotations map[string]string
+		uid         uint32
+		expectErr   bool
+	}{
+		"should allow root if run as non-root is not set": {},
+		"should allow root if run as non-root is false": {
+			annotations: map[string]string{runAsNonRootAnnotationKey: "false"},
+		},
+		"should reject root if run as non-root is true": {
+			annotations: map[string]string{runAsNonRootAnnotationKey: "true"},
+			expectErr:   true,
+		},
+		"should allow non-root if run as non-root is true": {
+			annotations: map[string]string{runAsNonRootAnnotationKey: "true"},
+			uid:         1000,
+		},
+		"should return error for invalid run as non-root": {
+			annotations: map[string]string{runAsNonRootAnnotationKey: "invalid"},
+			uid:         1000,
+			expectErr:   true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		err := validateRunAsNonRoot(&runtime.ContainerConfig{Annotations: test.annotations}, test.uid)
+		assert.Equal(t, test.expectErr, err != nil)
+		if err != nil {
+			assert.Equal(t, codes.InvalidArgument, grpc.Code(err))
+		}
+	}
+}
+
+func TestCreateContainerRunAsNonRoot(t *testing.T) {
+	for desc, test := range map[string]struct {
+		imageUser string
+		expectErr bool
+	}{
+		"should reject image without user": {
+			expectErr: true,
+		},
+		"should reject image running as root user name": {
+			imageUser: "root",
+			expectErr: true,
+		},
+		"should allow image running as non-root user name": {
+			imageUser: "app",
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		rootDir, err := ioutil.TempDir("", "test-root")
+		require.NoError(t, err)
+		defer os.RemoveAll(rootDir)
+		c := newTestCRIContainerdService()
+		c.rootDir = rootDir
+		fakeOS := c.os.(*ostesting.FakeOS)
+		fakeOS.MkdirAllFn = os.MkdirAll
+		fakeOS.MountAllFn = func(mounts []mount.Mount, target string) error {
+			writeTestRootfsFiles(t, target)
+			return nil
+		}
+		fakeOS.UnmountFn = func(target string, flags int) error {
+			return os.RemoveAll(filepath.Join(target, "etc"))
+		}
+		imageID := "sha256:c75bebcdd211f41b3a460c7bf82970ed6c75acaab9cd4c9a4e125b03ca113799"
+		c.imageStore.Add(imagestore.Image{
+			ID:      imageID,
+			ChainID: "test-chain-id",
+			Config:  &imagespec.ImageConfig{Entrypoint: []string{"/bin/sh"}, User: test.imageUser},
+		})
+		sandboxConfig := &runtime.PodSandboxConfig{
+			Metadata: &runtime.PodSandboxMetadata{
+				Name:      "test-sandbox-name",
+				Namespace: "test-sandbox-ns",
+				Uid:       "test-sandbox-uid",
+			},
+		}
+		require.NoError(t, c.sandboxStore.Add(sandboxstore.Sandbox{
+			Metadata: sandboxstore.Metadata{
+				ID:     "test-sandbox-id",
+				Config: sandboxConfig,
+			},
+		}))
+		_, err = c.CreateContainer(context.Background(), &runtime.CreateContainerRequest{
+			PodSandboxId: "test-sandbox-id",
+			Config: &runtime.ContainerConfig{
+				Metadata:    &runtime.ContainerMetadata{Name: "test-name"},
+				Image:       &runtime.ImageSpec{Image: imageID},
+				Annotations: map[string]string{runAsNonRootAnnotationKey: "true"},
+			},
+			SandboxConfig: sandboxConfig,
+		})
+		if test.expectErr {
+			require.Error(t, err)
+			assert.Equal(t, codes.InvalidArgument, grpc.Code(err))
+			continue
+		}
+		assert.NoError(t, err)
+	}
+}
+
+func writeTestRootfsFiles(t *testing.T, root string) {
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "etc"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(root, etcPasswd), []byte(testPasswd), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(root, etcGroup), []byte(testGroup), 0644))
+}
@@ -0,0 +1,212 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/containerd/containerd/remotes"
+	imagedigest "github.com/opencontainers/go-digest"
+	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/kubernetes-incubator/cri-containerd/pkg/log"
+)
+
+// contentCacheFetcher is a remotes.Fetcher which serves content from a local
+// content cache directory before fetching it from the registry. Cache entries
+// are stored at <dir>/<algorithm>/<hex> and keyed by content digest.
+type contentCacheFetcher struct {
+	// dir is the content cache directory.
+	dir string
+	// populate indicates whether content fetched from the registry should be
+	// added into the cache.
+	populate bool
+	// fetcher is the registry fetcher used on cache miss.
+	fetcher remotes.Fetcher
+}
+
+// newContentCacheFetcher wraps a registry fetcher with a local content cache.
+func newContentCacheFetcher(dir string, populate bool, fetcher remotes.Fetcher) remotes.Fetcher {
+	return &contentCacheFetcher{dir: dir, populate: populate, fetcher: fetcher}
+}
+
+// Fetch returns the content from the cache if a valid entry exists, otherwise
+// it fetches the content from the registry.
+func (f *contentCacheFetcher) Fetch(ctx context.Context, desc imagespec.Descriptor) (io.ReadCloser, error) {
+	path, err := f.entryPath(desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := openContentCacheEntry(path, desc)
+	if err == nil {
+		log.G(ctx).V(4).Infof("Use content %q from content cache %q", desc.Digest, path)
+		return rc, nil
+	}
+	if !os.IsNotExist(err) {
+		// Remove the invalid entry, so that it can be repopulated.
+		log.G(ctx).Warningf("Ignore invalid content cache entry %q: %v", path, err)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.G(ctx).Errorf("Failed to remove invalid content cache entry %q: %v", path, err)
+		}
+	}
+	rc, err = f.fetcher.Fetch(ctx, desc)
+	if err != nil || !f.populate {
+		return rc, err
+	}
+	w, err := newContentCacheWriter(path, desc)
+	if err != nil {
+		// Failing to populate the cache should not fail the pull.
+		log.G(ctx).Errorf("Failed to create content cache entry %q: %v", path, err)
+		return rc, nil
+	}
+	return &contentCacheTeeReader{ReadCloser: rc, w: w}, nil
+}
+
+// entryPath returns the cache entry path of the digest.
+func (f *contentCacheFetcher) entryPath(digest imagedigest.Digest) (string, error) {
+	if err := digest.Validate(); err != nil {
+		return "", fmt.Errorf("invalid digest %q: %v", digest, err)
+	}
+	return filepath.Join(f.dir, digest.Algorithm().String(), digest.Hex()), nil
+}
+
+// openContentCacheEntry opens a cache entry after verifying its size and
+// digest against the descriptor, so that corrupted entries are never used.
+func openContentCacheEntry(path string, desc imagespec.Descriptor) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	verifier := desc.Digest.Verifier()
+	n, err := io.Copy(verifier, file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to read content cache entry: %v", err)
+	}
+	if desc.Size > 0 && n != desc.Size {
+		file.Close()
+		return nil, fmt.Errorf("unexpected size %d, expected %d", n, desc.Size)
+	}
+	if !verifier.Verified() {
+		file.Close()
+		return nil, fmt.Errorf("content doesn't match digest %q", desc.Digest)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to seek content cache entry: %v", err)
+	}
+	return file, nil
+}
+
+// contentCacheWriter writes content into a temporary file, and only commits it
+// into the cache when the written content matches the expected digest.
+type contentCacheWriter struct {
+	path     string
+	desc     imagespec.Descriptor
+	file     *os.File
+	verifier imagedigest.Verifier
+	size     int64
+	err      error
+}
+
+// newContentCacheWriter creates a writer for the cache entry path.
+func newContentCacheWriter(path string, desc imagespec.Descriptor) (*contentCacheWriter, error) {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create content cache directory %q: %v", dir, err)
+	}
+	file, err := ioutil.TempFile(dir, ".tmp-"+filepath.Base(path))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary file: %v", err)
+	}
+	return &contentCacheWriter{
+		path:     path,
+		desc:     desc,
+		file:     file,
+		verifier: desc.Digest.Verifier(),
+	}, nil
+}
+
+// write writes data into the temporary file. Errors are recorded and reported
+// on commit, because cache failures should not interrupt the fetch.
+func (w *contentCacheWriter) write(p []byte) {
+	if w.err != nil {
+		return
+	}
+	if _, err := w.file.Write(p); err != nil {
+		w.err = err
+		return
+	}
+	w.verifier.Write(p) // nolint: errcheck
+	w.size += int64(len(p))
+}
+
+// commit moves the temporary file into place if all the content is written
+// and verified, otherwise the temporary file is discarded.
+func (w *contentCacheWriter) commit(complete bool) error {
+	tmp := w.file.Name()
+	defer os.Remove(tmp) // nolint: errcheck
+	if err := w.file.Close(); err != nil && w.err == nil {
+		w.err = err
+	}
+	if w.err != nil {
+		return fmt.Errorf("failed to write content: %v", w.err)
+	}
+	if !complete {
+		return fmt.Errorf("content is not fully read")
+	}
+	if w.desc.Size > 0 && w.size != w.desc.Size {
+		return fmt.Errorf("unexpected size %d, expected %d", w.size, w.desc.Size)
+	}
+	if !w.verifier.Verified() {
+		return fmt.Errorf("content doesn't match digest %q", w.desc.Digest)
+	}
+	return os.Rename(tmp, w.path)
+}
+
+// contentCacheTeeReader copies content read from the registry into the cache.
+type contentCacheTeeReader struct {
+	io.ReadCloser
+	w   *contentCacheWriter
+	eof bool
+}
+
+func (r *contentCacheTeeReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		r.w.write(p[:n])
+	}
+	if err == io.EOF {
+		r.eof = true
+	}
+	return n, err
+}
+
+// Close closes the registry reader and commits the cache entry.
+func (r *contentCacheTeeReader) Close() error {
+	if err := r.w.commit(r.eof); err != nil {
+		log.L.Errorf("Failed to populate content cache entry %q: %v", r.w.path, err)
+	} else {
+		log.L.V(4).Infof("Populated content cache entry %q", r.w.path)
+	}
+	return r.ReadCloser.Close()
+}
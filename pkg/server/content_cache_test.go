@@ -0,0 +1,146 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	imagedigest "github.com/opencontainers/go-digest"
+	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRemoteFetcher is a fake remotes.Fetcher serving content from memory.
+type fakeRemoteFetcher struct {
+	content map[imagedigest.Digest][]byte
+	called  int
+}
+
+func (f *fakeRemoteFetcher) Fetch(ctx context.Context, desc imagespec.Descriptor) (io.ReadCloser, error) {
+	f.called++
+	content, ok := f.content[desc.Digest]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	return ioutil.NopCloser(bytes.NewReader(content)), nil
+}
+
+func TestContentCacheFetcher(t *testing.T) {
+	content := []byte("test-content")
+	contentDesc := imagespec.Descriptor{
+		Digest: imagedigest.FromBytes(content),
+		Size:   int64(len(content)),
+	}
+	for desc, test := range map[string]struct {
+		cached         []byte
+		populate       bool
+		remoteErr      bool
+		expectRemote   bool
+		expectErr      bool
+		expectPopulate bool
+	}{
+		"should use cached content": {
+			cached: content,
+		},
+		"should fetch from registry on cache miss": {
+			expectRemote: true,
+		},
+		"should populate cache after fetching from registry": {
+			populate:       true,
+			expectRemote:   true,
+			expectPopulate: true,
+		},
+		"should ignore corrupted cache entry": {
+			cached:       []byte("corrupted"),
+			expectRemote: true,
+		},
+		"should replace corrupted cache entry when populating": {
+			cached:         []byte("corrupted"),
+			populate:       true,
+			expectRemote:   true,
+			expectPopulate: true,
+		},
+		"should return error if registry fetch fails on cache miss": {
+			remoteErr:    true,
+			expectRemote: true,
+			expectErr:    true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		dir, err := ioutil.TempDir("", "content-cache-test")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, contentDesc.Digest.Algorithm().String(), contentDesc.Digest.Hex())
+		if test.cached != nil {
+			require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+			require.NoError(t, ioutil.WriteFile(path, test.cached, 0644))
+		}
+		remote := &fakeRemoteFetcher{content: map[imagedigest.Digest][]byte{}}
+		if !test.remoteErr {
+			remote.content[contentDesc.Digest] = content
+		}
+		fetcher := newContentCacheFetcher(dir, test.populate, remote)
+		rc, err := fetcher.Fetch(context.Background(), contentDesc)
+		assert.Equal(t, test.expectRemote, remote.called > 0)
+		if test.expectErr {
+			assert.Error(t, err)
+			continue
+		}
+		require.NoError(t, err)
+		data, err := ioutil.ReadAll(rc)
+		assert.NoError(t, err)
+		assert.NoError(t, rc.Close())
+		assert.Equal(t, content, data)
+		cached, err := ioutil.ReadFile(path)
+		if test.expectPopulate || test.cached != nil && !test.expectRemote {
+			assert.NoError(t, err)
+			assert.Equal(t, content, cached)
+		} else {
+			assert.True(t, os.IsNotExist(err), "cache entry should not exist")
+		}
+	}
+}
+
+func TestContentCacheFetcherPartialRead(t *testing.T) {
+	content := []byte("test-content")
+	contentDesc := imagespec.Descriptor{
+		Digest: imagedigest.FromBytes(content),
+		Size:   int64(len(content)),
+	}
+	dir, err := ioutil.TempDir("", "content-cache-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	remote := &fakeRemoteFetcher{content: map[imagedigest.Digest][]byte{contentDesc.Digest: content}}
+	fetcher := newContentCacheFetcher(dir, true, remote)
+	rc, err := fetcher.Fetch(context.Background(), contentDesc)
+	require.NoError(t, err)
+	buf := make([]byte, 4)
+	_, err = rc.Read(buf)
+	assert.NoError(t, err)
+	assert.NoError(t, rc.Close())
+	files, err := ioutil.ReadDir(filepath.Join(dir, contentDesc.Digest.Algorithm().String()))
+	assert.NoError(t, err)
+	assert.Empty(t, files, "partially read content should not be cached")
+}
@@ -0,0 +1,80 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	"github.com/kubernetes-incubator/cri-containerd/pkg/store"
+)
+
+// toGRPCCode returns the grpc code of an error returned by containerd, the
+// in-memory stores or a context. The code of a grpc error is kept.
+func toGRPCCode(err error) codes.Code {
+	if code := grpc.Code(err); code != codes.Unknown {
+		return code
+	}
+	switch cause := errors.Cause(err); {
+	case cause == store.ErrNotExist || errdefs.IsNotFound(cause):
+		return codes.NotFound
+	case cause == store.ErrAlreadyExist || errdefs.IsAlreadyExists(cause):
+		return codes.AlreadyExists
+	case errdefs.IsInvalidArgument(cause):
+		return codes.InvalidArgument
+	case cause == context.DeadlineExceeded:
+		return codes.DeadlineExceeded
+	case cause == context.Canceled:
+		return codes.Canceled
+	default:
+		return codes.Unknown
+	}
+}
+
+// wrapGRPCError wraps the error with a message, and keeps the grpc code of the
+// error, so that the caller could tell e.g. a not found error from the code.
+func wrapGRPCError(err error, format string, args ...interface{}) error {
+	return grpc.Errorf(toGRPCCode(err), "%s: %s", fmt.Sprintf(format, args...), grpc.ErrorDesc(err))
+}
+
+// toGRPCError converts an error returned by a CRI handler into a grpc error
+// with the code of the error.
+func toGRPCError(err error) error {
+	if err == nil {
+		return nil
+	}
+	code := toGRPCCode(err)
+	if code == codes.Unknown {
+		return err
+	}
+	return grpc.Errorf(code, "%s", grpc.ErrorDesc(err))
+}
+
+// withRequestID appends the request id to the error message and keeps the grpc
+// code of the error, so that a failure could be correlated with the logs of the
+// request.
+func withRequestID(err error, id string) error {
+	if err == nil {
+		return nil
+	}
+	return grpc.Errorf(grpc.Code(err), "%s (request id: %s)", grpc.ErrorDesc(err), id)
+}
@@ -0,0 +1,122 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/containerd/containerd/errdefs"
+	pkgerrors "github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+
+	"github.com/kubernetes-incubator/cri-containerd/pkg/store"
+)
+
+func TestToGRPCCode(t *testing.T) {
+	for desc, test := range map[string]struct {
+		err      error
+		expected codes.Code
+	}{
+		"should keep grpc code": {
+			err:      grpc.Errorf(codes.Unavailable, "random error"),
+			expected: codes.Unavailable,
+		},
+		"should map store not exist error": {
+			err:      store.ErrNotExist,
+			expected: codes.NotFound,
+		},
+		"should map store already exist error": {
+			err:      store.ErrAlreadyExist,
+			expected: codes.AlreadyExists,
+		},
+		"should map containerd not found error": {
+			err:      pkgerrors.Wrap(errdefs.ErrNotFound, "image"),
+			expected: codes.NotFound,
+		},
+		"should map containerd already exists error": {
+			err:      errdefs.ErrAlreadyExists,
+			expected: codes.AlreadyExists,
+		},
+		"should map containerd invalid argument error": {
+			err:      errdefs.ErrInvalidArgument,
+			expected: codes.InvalidArgument,
+		},
+		"should map deadline exceeded error": {
+			err:      context.DeadlineExceeded,
+			expected: codes.DeadlineExceeded,
+		},
+		"should map canceled error": {
+			err:      context.Canceled,
+			expected: codes.Canceled,
+		},
+		"should return unknown for other errors": {
+			err:      errors.New("random error"),
+			expected: codes.Unknown,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		assert.Equal(t, test.expected, toGRPCCode(test.err))
+	}
+}
+
+func TestWrapGRPCError(t *testing.T) {
+	err := wrapGRPCError(store.ErrNotExist, "failed to find container %q", "test-id")
+	assert.Equal(t, codes.NotFound, grpc.Code(err))
+	assert.Equal(t, `failed to find container "test-id": does not exist`, grpc.ErrorDesc(err))
+
+	// Wrap again should keep the code.
+	err = wrapGRPCError(err, "failed to start container")
+	assert.Equal(t, codes.NotFound, grpc.Code(err))
+	assert.Equal(t, `failed to start container: failed to find container "test-id": does not exist`, grpc.ErrorDesc(err))
+}
+
+func TestToGRPCError(t *testing.T) {
+	assert.NoError(t, toGRPCError(nil))
+	err := errors.New("random error")
+	assert.Equal(t, err, toGRPCError(err), "unknown error should be kept")
+	err = toGRPCError(fmt.Errorf("failed: %v", context.DeadlineExceeded))
+	assert.Equal(t, codes.Unknown, grpc.Code(err), "wrapped cause is not visible")
+	err = toGRPCError(store.ErrNotExist)
+	assert.Equal(t, codes.NotFound, grpc.Code(err))
+	assert.Equal(t, store.ErrNotExist.Error(), grpc.ErrorDesc(err))
+}
+
+func TestCRIHandlerErrorCodes(t *testing.T) {
+	c := newTestCRIContainerdService()
+	_, err := c.ContainerStatus(context.Background(), &runtime.ContainerStatusRequest{ContainerId: "unknown"})
+	assert.Equal(t, codes.NotFound, grpc.Code(err), "ContainerStatus of unknown container")
+	_, err = c.PodSandboxStatus(context.Background(), &runtime.PodSandboxStatusRequest{PodSandboxId: "unknown"})
+	assert.Equal(t, codes.NotFound, grpc.Code(err), "PodSandboxStatus of unknown sandbox")
+	_, err = c.StartContainer(context.Background(), &runtime.StartContainerRequest{ContainerId: "unknown"})
+	assert.Equal(t, codes.NotFound, grpc.Code(err), "StartContainer of unknown container")
+	_, err = c.RunPodSandbox(context.Background(), &runtime.RunPodSandboxRequest{
+		Config: &runtime.PodSandboxConfig{
+			Annotations: map[string]string{runtimeHandlerAnnotationKey: "unknown"},
+		},
+	})
+	assert.Equal(t, codes.InvalidArgument, grpc.Code(err), "RunPodSandbox with unknown runtime handler")
+	_, err = c.PullImage(context.Background(), &runtime.PullImageRequest{
+		Image: &runtime.ImageSpec{Image: "INVALID"},
+	})
+	assert.Equal(t, codes.InvalidArgument, grpc.Code(err), "PullImage with invalid image reference")
+}
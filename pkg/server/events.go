@@ -17,15 +17,18 @@ limitations under the License.
 package server
 
 import (
+	"fmt"
 	"time"
 
 	"github.com/containerd/containerd/api/services/events/v1"
 	"github.com/containerd/containerd/api/services/tasks/v1"
+	"github.com/containerd/containerd/api/types/task"
 	"github.com/containerd/containerd/typeurl"
-	"github.com/golang/glog"
 	"github.com/jpillora/backoff"
 	"golang.org/x/net/context"
+	"k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
 
+	"github.com/kubernetes-incubator/cri-containerd/pkg/log"
 	containerstore "github.com/kubernetes-incubator/cri-containerd/pkg/store/container"
 )
 
@@ -47,21 +50,35 @@ func (c *criContainerdService) startEventMonitor() {
 		Max:    maxRetryInterval,
 		Factor: exponentialFactor,
 	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c.stopEventMonitor = cancel
 	go func() {
 		for {
-			eventstream, err := c.eventService.Subscribe(context.Background(), &events.SubscribeRequest{})
+			eventstream, err := c.eventService.Subscribe(ctx, &events.SubscribeRequest{})
 			if err != nil {
-				glog.Errorf("Failed to connect to containerd event stream: %v", err)
+				if ctx.Err() != nil {
+					log.G(ctx).V(2).Infof("Event monitor is stopped")
+					return
+				}
+				log.G(ctx).Errorf("Failed to connect to containerd event stream: %v", err)
 				time.Sleep(b.Duration())
 				continue
 			}
 			// Successfully connect with containerd, reset backoff.
 			b.Reset()
-			// TODO(random-liu): Relist to recover state, should prevent other operations
-			// until state is fully recovered.
+			// Reconcile container state after subscribing, so that container exits
+			// missed while the event stream was disconnected are not lost.
+			// TODO(random-liu): Prevent other operations until state is fully recovered.
+			if err := c.reconcileContainers(context.Background()); err != nil {
+				log.G(ctx).Errorf("Failed to reconcile container state: %v", err)
+			}
 			for {
 				if err := c.handleEventStream(eventstream); err != nil {
-					glog.Errorf("Failed to handle event stream: %v", err)
+					if ctx.Err() != nil {
+						log.G(ctx).V(2).Infof("Event monitor is stopped")
+						return
+					}
+					log.G(ctx).Errorf("Failed to handle event stream: %v", err)
 					break
 				}
 			}
@@ -75,7 +92,7 @@ func (c *criContainerdService) handleEventStream(eventstream events.Events_Subsc
 	if err != nil {
 		return err
 	}
-	glog.V(4).Infof("Received container event timestamp - %v, namespace - %q, topic - %q", e.Timestamp, e.Namespace, e.Topic)
+	log.L.V(4).Infof("Received container event timestamp - %v, namespace - %q, topic - %q", e.Timestamp, e.Namespace, e.Topic)
 	c.handleEvent(e)
 	return nil
 }
@@ -84,7 +101,7 @@ func (c *criContainerdService) handleEventStream(eventstream events.Events_Subsc
 func (c *criContainerdService) handleEvent(evt *events.Envelope) {
 	any, err := typeurl.UnmarshalAny(evt.Event)
 	if err != nil {
-		glog.Errorf("Failed to convert event envelope %+v: %v", evt, err)
+		log.L.Errorf("Failed to convert event envelope %+v: %v", evt, err)
 		return
 	}
 	switch any.(type) {
@@ -94,10 +111,10 @@ func (c *criContainerdService) handleEvent(evt *events.Envelope) {
 	// TODO(random-liu): [P2] Handle containerd-shim exit.
 	case *events.TaskExit:
 		e := any.(*events.TaskExit)
-		glog.V(2).Infof("TaskExit event %+v", e)
+		log.L.V(2).Infof("TaskExit event %+v", e)
 		cntr, err := c.containerStore.Get(e.ContainerID)
 		if err != nil {
-			glog.Errorf("Failed to get container %q: %v", e.ContainerID, err)
+			log.L.Errorf("Failed to get container %q: %v", e.ContainerID, err)
 			return
 		}
 		if e.Pid != cntr.Status.Get().Pid {
@@ -106,42 +123,107 @@ func (c *criContainerdService) handleEvent(evt *events.Envelope) {
 		}
 		// Delete the container from containerd.
 		_, err = c.taskService.Delete(context.Background(), &tasks.DeleteTaskRequest{ContainerID: e.ContainerID})
-		// TODO(random-liu): Change isContainerdGRPCNotFoundError to use errdefs.
 		if err != nil && !isContainerdGRPCNotFoundError(err) {
 			// TODO(random-liu): [P0] Enqueue the event and retry.
-			glog.Errorf("Failed to delete container %q: %v", e.ContainerID, err)
+			log.L.Errorf("Failed to delete container %q: %v", e.ContainerID, err)
 			return
 		}
-		err = cntr.Status.Update(func(status containerstore.Status) (containerstore.Status, error) {
-			// If FinishedAt has been set (e.g. with start failure), keep as
-			// it is.
-			if status.FinishedAt != 0 {
-				return status, nil
-			}
-			status.Pid = 0
-			status.FinishedAt = e.ExitedAt.UnixNano()
-			status.ExitCode = int32(e.ExitStatus)
-			return status, nil
-		})
-		if err != nil {
-			glog.Errorf("Failed to update container %q state: %v", e.ContainerID, err)
+		if err := setContainerExited(cntr, int32(e.ExitStatus), e.ExitedAt, ""); err != nil {
+			log.L.Errorf("Failed to update container %q state: %v", e.ContainerID, err)
 			// TODO(random-liu): [P0] Enqueue the event and retry.
 			return
 		}
 	case *events.TaskOOM:
 		e := any.(*events.TaskOOM)
-		glog.V(2).Infof("TaskOOM event %+v", e)
+		log.L.V(2).Infof("TaskOOM event %+v", e)
 		cntr, err := c.containerStore.Get(e.ContainerID)
 		if err != nil {
-			glog.Errorf("Failed to get container %q: %v", e.ContainerID, err)
+			log.L.Errorf("Failed to get container %q: %v", e.ContainerID, err)
+			return
 		}
 		err = cntr.Status.Update(func(status containerstore.Status) (containerstore.Status, error) {
 			status.Reason = oomExitReason
 			return status, nil
 		})
 		if err != nil {
-			glog.Errorf("Failed to update container %q oom: %v", e.ContainerID, err)
+			log.L.Errorf("Failed to update container %q oom: %v", e.ContainerID, err)
 			return
 		}
 	}
 }
+
+// setContainerExited updates the container status with the exit code and exit time.
+// The reason is kept as it is if it's empty.
+func setContainerExited(cntr containerstore.Container, exitCode int32, exitedAt time.Time, reason string) error {
+	return cntr.Status.Update(func(status containerstore.Status) (containerstore.Status, error) {
+		// If FinishedAt has been set (e.g. with start failure), keep as
+		// it is.
+		if status.FinishedAt != 0 {
+			return status, nil
+		}
+		status.Pid = 0
+		status.FinishedAt = exitedAt.UnixNano()
+		status.ExitCode = exitCode
+		if reason != "" {
+			status.Reason = reason
+		}
+		return status, nil
+	})
+}
+
+// reconcileContainers lists containerd tasks and updates the status of running
+// containers whose task has stopped or disappeared.
+func (c *criContainerdService) reconcileContainers(ctx context.Context) error {
+	// Get running containers before listing tasks. The task of a container is
+	// created before the container becomes running, so a container started after
+	// the task list is not treated as exited because its task is not listed.
+	var cntrs []containerstore.Container
+	for _, cntr := range c.containerStore.List() {
+		if cntr.Status.Get().State() == runtime.ContainerState_CONTAINER_RUNNING {
+			cntrs = append(cntrs, cntr)
+		}
+	}
+	resp, err := c.taskService.List(ctx, &tasks.ListTasksRequest{})
+	if err != nil {
+		return fmt.Errorf("failed to list tasks: %v", err)
+	}
+	taskMap := make(map[string]*task.Task)
+	for _, t := range resp.Tasks {
+		taskMap[t.ID] = t
+	}
+	for _, cntr := range cntrs {
+		// The container may have exited after it's listed.
+		if cntr.Status.Get().State() != runtime.ContainerState_CONTAINER_RUNNING {
+			continue
+		}
+		t, ok := taskMap[cntr.ID]
+		if ok && t.Status != task.StatusStopped {
+			continue
+		}
+		if !ok {
+			log.G(ctx).V(2).Infof("Task of running container %q is not found", cntr.ID)
+			if err := setContainerExited(cntr, unknownExitCode, time.Now(), unknownExitReason); err != nil {
+				log.G(ctx).Errorf("Failed to update container %q state: %v", cntr.ID, err)
+			}
+			continue
+		}
+		log.G(ctx).V(2).Infof("Task of running container %q has exited", cntr.ID)
+		// Delete the stopped task from containerd to get the exit status.
+		deleteResp, err := c.taskService.Delete(ctx, &tasks.DeleteTaskRequest{ContainerID: cntr.ID})
+		if err != nil && !isContainerdGRPCNotFoundError(err) {
+			log.G(ctx).Errorf("Failed to delete container %q: %v", cntr.ID, err)
+			continue
+		}
+		exitCode, exitedAt, reason := int32(unknownExitCode), time.Now(), unknownExitReason
+		if err == nil {
+			exitCode, reason = int32(deleteResp.ExitStatus), ""
+			if !deleteResp.ExitedAt.IsZero() {
+				exitedAt = deleteResp.ExitedAt
+			}
+		}
+		if err := setContainerExited(cntr, exitCode, exitedAt, reason); err != nil {
+			log.G(ctx).Errorf("Failed to update container %q state: %v", cntr.ID, err)
+		}
+	}
+	return nil
+}
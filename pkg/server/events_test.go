@@ -0,0 +1,139 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/api/services/tasks/v1"
+	"github.com/containerd/containerd/api/types/task"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+
+	servertesting "github.com/kubernetes-incubator/cri-containerd/pkg/server/testing"
+	containerstore "github.com/kubernetes-incubator/cri-containerd/pkg/store/container"
+)
+
+func TestReconcileContainers(t *testing.T) {
+	now := time.Now().UnixNano()
+	for desc, test := range map[string]struct {
+		status         containerstore.Status
+		task           *task.Task
+		expectedState  runtime.ContainerState
+		expectedReason string
+		expectDelete   bool
+	}{
+		"should not change running container with running task": {
+			status:        containerstore.Status{Pid: 1234, CreatedAt: now, StartedAt: now},
+			task:          &task.Task{ID: "test-id", Pid: 1234, Status: task.StatusRunning},
+			expectedState: runtime.ContainerState_CONTAINER_RUNNING,
+		},
+		"should set running container with stopped task exited": {
+			status:        containerstore.Status{Pid: 1234, CreatedAt: now, StartedAt: now},
+			task:          &task.Task{ID: "test-id", Pid: 1234, Status: task.StatusStopped},
+			expectedState: runtime.ContainerState_CONTAINER_EXITED,
+			expectDelete:  true,
+		},
+		"should set running container without task exited with unknown reason": {
+			status:         containerstore.Status{Pid: 1234, CreatedAt: now, StartedAt: now},
+			expectedState:  runtime.ContainerState_CONTAINER_EXITED,
+			expectedReason: unknownExitReason,
+		},
+		"should not change created container": {
+			status:        containerstore.Status{CreatedAt: now},
+			expectedState: runtime.ContainerState_CONTAINER_CREATED,
+		},
+		"should not change exited container": {
+			status:         containerstore.Status{CreatedAt: now, StartedAt: now, FinishedAt: now, Reason: "test-reason"},
+			expectedState:  runtime.ContainerState_CONTAINER_EXITED,
+			expectedReason: "test-reason",
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		c := newTestCRIContainerdService()
+		fakeTaskService := c.taskService.(*servertesting.FakeTaskService)
+		container, err := containerstore.NewContainer(containerstore.Metadata{ID: "test-id"}, test.status)
+		require.NoError(t, err)
+		require.NoError(t, c.containerStore.Add(container))
+		if test.task != nil {
+			fakeTaskService.SetFakeTasks([]task.Task{*test.task})
+		}
+		assert.NoError(t, c.reconcileContainers(context.Background()))
+		status := container.Status.Get()
+		assert.Equal(t, test.expectedState, status.State())
+		assert.Equal(t, test.expectedReason, status.Reason)
+		if test.expectedState == runtime.ContainerState_CONTAINER_EXITED {
+			assert.EqualValues(t, 0, status.Pid)
+		}
+		_, err = fakeTaskService.Get(context.Background(), &tasks.GetTaskRequest{ContainerID: "test-id"})
+		if test.expectDelete {
+			assert.True(t, isContainerdGRPCNotFoundError(err), "task should be deleted")
+		}
+	}
+}
+
+func TestReconcileContainersListError(t *testing.T) {
+	c := newTestCRIContainerdService()
+	fakeTaskService := c.taskService.(*servertesting.FakeTaskService)
+	fakeTaskService.InjectError("list", errors.New("random error"))
+	assert.Error(t, c.reconcileContainers(context.Background()))
+}
+
+// listHookTaskService is a fake task service which calls onList after listing tasks.
+type listHookTaskService struct {
+	*servertesting.FakeTaskService
+	onList func()
+}
+
+func (s *listHookTaskService) List(ctx context.Context, req *tasks.ListTasksRequest, opts ...grpc.CallOption) (*tasks.ListTasksResponse, error) {
+	resp, err := s.FakeTaskService.List(ctx, req, opts...)
+	s.onList()
+	return resp, err
+}
+
+func TestReconcileContainersStartedAfterTaskList(t *testing.T) {
+	c := newTestCRIContainerdService()
+	now := time.Now().UnixNano()
+	container, err := containerstore.NewContainer(
+		containerstore.Metadata{ID: "test-id"},
+		containerstore.Status{CreatedAt: now},
+	)
+	require.NoError(t, err)
+	require.NoError(t, c.containerStore.Add(container))
+	fakeTaskService := c.taskService.(*servertesting.FakeTaskService)
+	c.taskService = &listHookTaskService{
+		FakeTaskService: fakeTaskService,
+		onList: func() {
+			// The container is started after tasks are listed.
+			fakeTaskService.SetFakeTasks([]task.Task{{ID: "test-id", Pid: 1234, Status: task.StatusRunning}})
+			require.NoError(t, container.Status.Update(func(status containerstore.Status) (containerstore.Status, error) {
+				status.Pid = 1234
+				status.StartedAt = time.Now().UnixNano()
+				return status, nil
+			}))
+		},
+	}
+
+	assert.NoError(t, c.reconcileContainers(context.Background()))
+	assert.Equal(t, runtime.ContainerState_CONTAINER_RUNNING, container.Status.Get().State(),
+		"container started after task list should not be marked exited")
+}
@@ -0,0 +1,149 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/golang/protobuf/ptypes/empty"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthapi "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/kubernetes-incubator/cri-containerd/pkg/log"
+)
+
+const (
+	// healthReportHeader is the grpc response header carrying the health
+	// report in json format.
+	healthReportHeader = "cri-containerd-health-report"
+	// healthProbeKey is the snapshot key and image name looked up to probe the
+	// snapshotter and the image store. They are not expected to exist.
+	healthProbeKey = "cri-containerd-health-probe"
+
+	// healthComponentContainerd is the component name of the containerd
+	// connection.
+	healthComponentContainerd = "containerd"
+	// healthComponentSnapshotter is the component name of the snapshotter.
+	healthComponentSnapshotter = "snapshotter"
+	// healthComponentImageStore is the component name of the containerd image
+	// store.
+	healthComponentImageStore = "imageStore"
+)
+
+// componentHealth is the health of a component cri-containerd depends on.
+type componentHealth struct {
+	// Name is the name of the component.
+	Name string `json:"name"`
+	// Healthy is whether the component is reachable.
+	Healthy bool `json:"healthy"`
+	// Message is the reason why the component is unhealthy.
+	Message string `json:"message,omitempty"`
+}
+
+// healthReport is the result of the cri-containerd self test.
+type healthReport struct {
+	// Healthy is whether all components are healthy.
+	Healthy bool `json:"healthy"`
+	// Components are the health of each component.
+	Components []componentHealth `json:"components"`
+}
+
+// selfTest verifies that the containerd connection, the snapshotter and the
+// image store are all reachable. It only issues cheap lookups, so that it can
+// be called frequently, e.g. by node problem detectors.
+func (c *criContainerdService) selfTest(ctx context.Context) *healthReport {
+	checks := []struct {
+		name  string
+		check func() error
+	}{
+		{
+			name: healthComponentContainerd,
+			check: func() error {
+				if _, err := c.versionService.Version(ctx, &empty.Empty{}); err != nil {
+					return fmt.Errorf("failed to connect to containerd: %v", err)
+				}
+				resp, err := c.healthService.Check(ctx, &healthapi.HealthCheckRequest{})
+				if err != nil {
+					return fmt.Errorf("containerd healthcheck returns error: %v", err)
+				}
+				if resp.Status != healthapi.HealthCheckResponse_SERVING {
+					return fmt.Errorf("containerd grpc server is not serving")
+				}
+				return nil
+			},
+		},
+		{
+			name: healthComponentSnapshotter,
+			check: func() error {
+				// Not found means the snapshotter is reachable.
+				if _, err := c.snapshotService.Stat(ctx, healthProbeKey); err != nil && !isContainerdGRPCNotFoundError(err) {
+					return fmt.Errorf("failed to stat snapshot: %v", err)
+				}
+				return nil
+			},
+		},
+		{
+			name: healthComponentImageStore,
+			check: func() error {
+				// Not found means the image store is reachable.
+				if _, err := c.imageStoreService.Get(ctx, healthProbeKey); err != nil && !isContainerdGRPCNotFoundError(err) {
+					return fmt.Errorf("failed to get image: %v", err)
+				}
+				return nil
+			},
+		},
+	}
+	report := &healthReport{Healthy: true}
+	for _, check := range checks {
+		health := componentHealth{Name: check.name, Healthy: true}
+		if err := check.check(); err != nil {
+			health.Healthy = false
+			health.Message = err.Error()
+			report.Healthy = false
+		}
+		report.Components = append(report.Components, health)
+	}
+	return report
+}
+
+// Check implements the grpc health service on the cri-containerd socket. It
+// runs the self test, and returns the health report in json format in the
+// response header.
+func (c *criContainerdService) Check(ctx context.Context, r *healthapi.HealthCheckRequest) (*healthapi.HealthCheckResponse, error) {
+	// Only the overall health of cri-containerd is supported.
+	if r.Service != "" {
+		return nil, grpc.Errorf(codes.NotFound, "unknown service %q", r.Service)
+	}
+	report := c.selfTest(ctx)
+	data, err := json.Marshal(report)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal health report %+v: %v", report, err)
+	}
+	if err := grpc.SetHeader(ctx, metadata.Pairs(healthReportHeader, string(data))); err != nil {
+		// The header can't be set if the method is not called through grpc.
+		log.G(ctx).V(4).Infof("Failed to set health report header: %v", err)
+	}
+	if !report.Healthy {
+		log.G(ctx).Warningf("cri-containerd is not healthy: %s", data)
+		return &healthapi.HealthCheckResponse{Status: healthapi.HealthCheckResponse_NOT_SERVING}, nil
+	}
+	return &healthapi.HealthCheckResponse{Status: healthapi.HealthCheckResponse_SERVING}, nil
+}
@@ -0,0 +1,174 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	versionapi "github.com/containerd/containerd/api/services/version/v1"
+	"github.com/golang/mock/gomock"
+	"github.com/golang/protobuf/ptypes/empty"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	healthapi "google.golang.org/grpc/health/grpc_health_v1"
+
+	servertesting "github.com/kubernetes-incubator/cri-containerd/pkg/server/testing"
+)
+
+func TestSelfTest(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	for desc, test := range map[string]struct {
+		containerdVersionErr error
+		containerdNotServing bool
+		snapshotterErr       error
+		imageStoreErr        error
+		expectUnhealthy      []string
+	}{
+		"should be healthy when all components are reachable": {},
+		"containerd should be unhealthy when containerd is not connected": {
+			containerdVersionErr: errors.New("connection error"),
+			expectUnhealthy:      []string{healthComponentContainerd},
+		},
+		"containerd should be unhealthy when containerd is not serving": {
+			containerdNotServing: true,
+			expectUnhealthy:      []string{healthComponentContainerd},
+		},
+		"snapshotter should be unhealthy when it returns error": {
+			snapshotterErr:  errors.New("random error"),
+			expectUnhealthy: []string{healthComponentSnapshotter},
+		},
+		"image store should be unhealthy when it returns error": {
+			imageStoreErr:   errors.New("random error"),
+			expectUnhealthy: []string{healthComponentImageStore},
+		},
+		"should report all unhealthy components": {
+			snapshotterErr:  errors.New("random error"),
+			imageStoreErr:   errors.New("random error"),
+			expectUnhealthy: []string{healthComponentSnapshotter, healthComponentImageStore},
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		c := newTestCRIContainerdService()
+		ctx := context.Background()
+		versionMock := servertesting.NewMockVersionClient(ctrl)
+		versionMock.EXPECT().Version(ctx, &empty.Empty{}).Return(
+			&versionapi.VersionResponse{Version: "1.1.1"}, test.containerdVersionErr)
+		c.versionService = versionMock
+		healthMock := servertesting.NewMockHealthClient(ctrl)
+		if test.containerdVersionErr == nil {
+			status := healthapi.HealthCheckResponse_SERVING
+			if test.containerdNotServing {
+				status = healthapi.HealthCheckResponse_NOT_SERVING
+			}
+			healthMock.EXPECT().Check(ctx, &healthapi.HealthCheckRequest{}).Return(
+				&healthapi.HealthCheckResponse{Status: status}, nil)
+		}
+		c.healthService = healthMock
+		fakeImageStore := servertesting.NewFakeImageStore()
+		c.imageStoreService = fakeImageStore
+		if test.snapshotterErr != nil {
+			c.snapshotService.(*servertesting.FakeSnapshotter).InjectError("stat", test.snapshotterErr)
+		}
+		if test.imageStoreErr != nil {
+			fakeImageStore.InjectError("get", test.imageStoreErr)
+		}
+
+		report := c.selfTest(ctx)
+		assert.Equal(t, len(test.expectUnhealthy) == 0, report.Healthy)
+		var names, unhealthy []string
+		for _, component := range report.Components {
+			names = append(names, component.Name)
+			if !component.Healthy {
+				unhealthy = append(unhealthy, component.Name)
+				assert.NotEmpty(t, component.Message)
+			}
+		}
+		assert.Equal(t, []string{
+			healthComponentContainerd,
+			healthComponentSnapshotter,
+			healthComponentImageStore,
+		}, names)
+		assert.Equal(t, test.expectUnhealthy, unhealthy)
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	for desc, test := range map[string]struct {
+		service        string
+		snapshotterErr error
+		expectStatus   healthapi.HealthCheckResponse_ServingStatus
+		expectErr      bool
+	}{
+		"should return serving when healthy": {
+			expectStatus: healthapi.HealthCheckResponse_SERVING,
+		},
+		"should return not serving when unhealthy": {
+			snapshotterErr: errors.New("random error"),
+			expectStatus:   healthapi.HealthCheckResponse_NOT_SERVING,
+		},
+		"should return error for unknown service": {
+			service:   "unknown",
+			expectErr: true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		c := newTestCRIContainerdService()
+		ctx := context.Background()
+		versionMock := servertesting.NewMockVersionClient(ctrl)
+		healthMock := servertesting.NewMockHealthClient(ctrl)
+		if !test.expectErr {
+			versionMock.EXPECT().Version(ctx, &empty.Empty{}).Return(
+				&versionapi.VersionResponse{Version: "1.1.1"}, nil)
+			healthMock.EXPECT().Check(ctx, &healthapi.HealthCheckRequest{}).Return(
+				&healthapi.HealthCheckResponse{Status: healthapi.HealthCheckResponse_SERVING}, nil)
+		}
+		c.versionService = versionMock
+		c.healthService = healthMock
+		c.imageStoreService = servertesting.NewFakeImageStore()
+		if test.snapshotterErr != nil {
+			c.snapshotService.(*servertesting.FakeSnapshotter).InjectError("stat", test.snapshotterErr)
+		}
+
+		resp, err := c.Check(ctx, &healthapi.HealthCheckRequest{Service: test.service})
+		if test.expectErr {
+			assert.Error(t, err)
+			continue
+		}
+		require.NoError(t, err)
+		assert.Equal(t, test.expectStatus, resp.Status)
+	}
+}
+
+func TestHealthReportJSON(t *testing.T) {
+	data, err := json.Marshal(&healthReport{
+		Healthy: false,
+		Components: []componentHealth{
+			{Name: healthComponentContainerd, Healthy: true},
+			{Name: healthComponentSnapshotter, Message: "failed to stat snapshot"},
+		},
+	})
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"healthy":false,"components":[`+
+		`{"name":"containerd","healthy":true},`+
+		`{"name":"snapshotter","healthy":false,"message":"failed to stat snapshot"}]}`, string(data))
+}
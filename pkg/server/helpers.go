@@ -27,17 +27,22 @@ import (
 	"syscall"
 
 	"github.com/containerd/containerd/errdefs"
+	containerdimages "github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/plugin"
 	"github.com/docker/distribution/reference"
 	"github.com/docker/docker/pkg/stringid"
 	imagedigest "github.com/opencontainers/go-digest"
 	"github.com/opencontainers/image-spec/identity"
 	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
 
 	"github.com/kubernetes-incubator/cri-containerd/pkg/store"
+	containerstore "github.com/kubernetes-incubator/cri-containerd/pkg/store/container"
 	imagestore "github.com/kubernetes-incubator/cri-containerd/pkg/store/image"
 )
 
@@ -53,6 +58,24 @@ const (
 	errorExitReason = "Error"
 	// oomExitReason is the exit reason when process in container is oom killed.
 	oomExitReason = "OOMKilled"
+	// unknownExitReason is the exit reason when the container task disappears
+	// and the exit status is unknown.
+	unknownExitReason = "Unknown"
+	// unknownExitCode is the exit code when the container exit status is unknown.
+	unknownExitCode = 255
+)
+
+const (
+	// containerKindLabel is a label key indicating whether the containerd container is
+	// a sandbox container or an application container.
+	containerKindLabel = "io.cri-containerd.kind"
+	// containerKindSandbox is a label value indicating container is sandbox container.
+	containerKindSandbox = "sandbox"
+	// containerKindContainer is a label value indicating container is application container.
+	containerKindContainer = "container"
+	// containerMetadataLabel is a label key of the cri-containerd metadata checkpointed
+	// in the containerd container labels.
+	containerMetadataLabel = "io.cri-containerd.metadata"
 )
 
 const (
@@ -62,13 +85,17 @@ const (
 	defaultSandboxOOMAdj = -998
 	// defaultSandboxCPUshares is default cpu shares for sandbox container.
 	defaultSandboxCPUshares = 2
-	// defaultShmSize is the default size of the sandbox shm.
+	// defaultShmSize is the default size of the sandbox shm if it's not
+	// configured.
 	defaultShmSize = int64(1024 * 1024 * 64)
 	// relativeRootfsPath is the rootfs path relative to bundle path.
 	relativeRootfsPath = "rootfs"
 	// defaultRuntime is the runtime to use in containerd. We may support
 	// other runtime in the future.
 	defaultRuntime = "io.containerd.runtime.v1.linux"
+	// defaultSnapshotter is the default snapshotter of containerd on linux,
+	// which is used when no snapshotter is configured.
+	defaultSnapshotter = "overlayfs"
 	// sandboxesDir contains all sandbox root. A sandbox root is the running
 	// directory of the sandbox, all files created for the sandbox will be
 	// placed under this directory.
@@ -78,6 +105,8 @@ const (
 	// According to http://man7.org/linux/man-pages/man5/resolv.conf.5.html:
 	// "The search list is currently limited to six domains with a total of 256 characters."
 	maxDNSSearches = 6
+	// maxDNSSearchListChars is the max total number of characters of the search list.
+	maxDNSSearchListChars = 256
 	// stdinNamedPipe is the name of stdin named pipe.
 	stdinNamedPipe = "stdin"
 	// stdoutNamedPipe is the name of stdout named pipe.
@@ -94,10 +123,14 @@ const (
 	utsNSFormat = "/proc/%v/ns/uts"
 	// pidNSFormat is the format of pid namespace of a process.
 	pidNSFormat = "/proc/%v/ns/pid"
+	// userNSFormat is the format of user namespace of a process.
+	userNSFormat = "/proc/%v/ns/user"
 	// devShm is the default path of /dev/shm.
 	devShm = "/dev/shm"
 	// etcHosts is the default path of /etc/hosts file.
 	etcHosts = "/etc/hosts"
+	// etcHostname is the default path of /etc/hostname file.
+	etcHostname = "/etc/hostname"
 	// resolvConfPath is the abs path of resolv.conf on host or container.
 	resolvConfPath = "/etc/resolv.conf"
 )
@@ -131,10 +164,13 @@ func makeContainerName(c *runtime.ContainerMetadata, s *runtime.PodSandboxMetada
 	}, nameDelimiter)
 }
 
-// getCgroupsPath generates container cgroups path.
-func getCgroupsPath(cgroupsParent string, id string) string {
-	// TODO(random-liu): [P0] Handle systemd.
-	return filepath.Join(cgroupsParent, id)
+// getImageFSPath returns the backing directory of a containerd snapshotter.
+// The containerd default snapshotter is assumed if snapshotter is empty.
+func getImageFSPath(rootDir, snapshotter string) string {
+	if snapshotter == "" {
+		snapshotter = defaultSnapshotter
+	}
+	return filepath.Join(rootDir, fmt.Sprintf("%s.%s", plugin.SnapshotPlugin, snapshotter))
 }
 
 // getSandboxRootDir returns the root directory for managing sandbox files,
@@ -143,6 +179,19 @@ func getSandboxRootDir(rootDir, id string) string {
 	return filepath.Join(rootDir, sandboxesDir, id)
 }
 
+// toCRIContainerMetadata returns the CRI container metadata with the restart count
+// of the container as the attempt.
+func toCRIContainerMetadata(meta containerstore.Metadata) *runtime.ContainerMetadata {
+	attempt := meta.Config.GetMetadata().GetAttempt()
+	if meta.RestartCount > attempt {
+		attempt = meta.RestartCount
+	}
+	return &runtime.ContainerMetadata{
+		Name:    meta.Config.GetMetadata().GetName(),
+		Attempt: attempt,
+	}
+}
+
 // getContainerRootDir returns the root directory for managing container files.
 func getContainerRootDir(rootDir, id string) string {
 	return filepath.Join(rootDir, containersDir, id)
@@ -162,6 +211,11 @@ func getSandboxHosts(sandboxRootDir string) string {
 	return filepath.Join(sandboxRootDir, "hosts")
 }
 
+// getSandboxHostnamePath returns the hostname file path inside the sandbox root directory.
+func getSandboxHostnamePath(sandboxRootDir string) string {
+	return filepath.Join(sandboxRootDir, "hostname")
+}
+
 // getResolvPath returns resolv.conf filepath for specified sandbox.
 func getResolvPath(sandboxRoot string) string {
 	return filepath.Join(sandboxRoot, "resolv.conf")
@@ -223,16 +277,67 @@ func getPIDNamespace(pid uint32) string {
 	return fmt.Sprintf(pidNSFormat, pid)
 }
 
+// getUserNamespace returns the user namespace of a process.
+func getUserNamespace(pid uint32) string {
+	return fmt.Sprintf(userNSFormat, pid)
+}
+
 // isContainerdGRPCNotFoundError checks whether a grpc error is not found error.
+// The grpc status code of the error (or its cause if it's wrapped) is checked
+// instead of the message, and containerd typed not found error is also accepted,
+// e.g. errors converted by the containerd client.
 func isContainerdGRPCNotFoundError(grpcError error) bool {
-	return grpc.Code(grpcError) == codes.NotFound
+	if grpcError == nil {
+		return false
+	}
+	cause := errors.Cause(grpcError)
+	if s, ok := status.FromError(cause); ok {
+		return s.Code() == codes.NotFound
+	}
+	return errdefs.IsNotFound(cause)
+}
+
+// matchLabelSelector checks whether all labels in the selector match the labels. Empty
+// selector matches any labels.
+func matchLabelSelector(selector, labels map[string]string) bool {
+	for k, v := range selector {
+		if got, ok := labels[k]; !ok || got != v {
+			return false
+		}
+	}
+	return true
+}
+
+// isUnauthenticatedError checks whether a grpc error is unauthenticated error.
+func isUnauthenticatedError(grpcError error) bool {
+	return grpc.Code(grpcError) == codes.Unauthenticated
+}
+
+// processAlreadyFinishedErrors are the known (lowercased) error messages returned
+// by runc, containerd and kill(2) across versions when the process to signal has
+// already exited.
+var processAlreadyFinishedErrors = []string{
+	"process already finished",
+	"container not running",
+	// e.g. "container is not running", "process is not running".
+	"is not running",
+	"no such process",
 }
 
 // isRuncProcessAlreadyFinishedError checks whether a grpc error is a process already
 // finished error.
 // TODO(random-liu): Containerd should expose this error in api. (containerd#999)
 func isRuncProcessAlreadyFinishedError(grpcError error) bool {
-	return strings.Contains(grpc.ErrorDesc(grpcError), "os: process already finished")
+	if grpcError == nil {
+		return false
+	}
+	desc := strings.ToLower(grpc.ErrorDesc(grpcError))
+	for _, msg := range processAlreadyFinishedErrors {
+		if strings.Contains(desc, msg) {
+			return true
+		}
+	}
+	return false
 }
 
 // criContainerStateToString formats CRI container state to string.
@@ -283,6 +388,13 @@ func (c *criContainerdService) getImageInfo(ctx context.Context, ref string) (
 		return "", 0, nil, fmt.Errorf("failed to get image %q from containerd image store: %v",
 			normalizedRef, err)
 	}
+	return c.getContainerdImageInfo(ctx, image)
+}
+
+// getContainerdImageInfo returns chainID, compressed size and oci config of the
+// image in containerd image store.
+func (c *criContainerdService) getContainerdImageInfo(ctx context.Context, image containerdimages.Image) (
+	imagedigest.Digest, int64, *imagespec.ImageConfig, error) {
 	// Get image config
 	desc, err := image.Config(ctx, c.contentStoreService)
 	if err != nil {
@@ -326,6 +438,46 @@ func getRepoDigestAndTag(namedRef reference.Named, digest imagedigest.Digest, sc
 	return repoDigest, repoTag
 }
 
+// getTagOfDigestedRef returns the repo tag of an image reference which is both tagged
+// and digested, e.g. "busybox:latest@sha256:...". The tag is dropped during image
+// reference normalization, but it should still be added as a repo tag of the image.
+// It returns empty string if the reference is not both tagged and digested.
+func getTagOfDigestedRef(ref string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return "", err
+	}
+	tagged, ok := named.(reference.NamedTagged)
+	if !ok {
+		return "", nil
+	}
+	if _, ok := named.(reference.Canonical); !ok {
+		return "", nil
+	}
+	newNamed, err := reference.WithName(tagged.Name())
+	if err != nil {
+		return "", err
+	}
+	newTagged, err := reference.WithTag(newNamed, tagged.Tag())
+	if err != nil {
+		return "", err
+	}
+	return newTagged.String(), nil
+}
+
+// verifyImageDigest verifies that the resolved image digest matches the digest in
+// the image reference. It does nothing if the image reference is not digested.
+func verifyImageDigest(namedRef reference.Named, digest imagedigest.Digest) error {
+	canonical, ok := namedRef.(reference.Canonical)
+	if !ok {
+		return nil
+	}
+	if canonical.Digest() != digest {
+		return fmt.Errorf("resolved digest %q doesn't match requested digest %q", digest, canonical.Digest())
+	}
+	return nil
+}
+
 // localResolve resolves image reference locally and returns corresponding image metadata. It returns
 // nil without error if the reference doesn't exist.
 func (c *criContainerdService) localResolve(ctx context.Context, ref string) (*imagestore.Image, error) {
@@ -416,3 +568,20 @@ func resolveSymbolicLink(path string) (string, error) {
 	}
 	return filepath.EvalSymlinks(path)
 }
+
+// matchPatterns returns true if s matches any of the patterns. A pattern ending
+// with "*" matches all strings with the prefix.
+func matchPatterns(s string, patterns []string) bool {
+	for _, p := range patterns {
+		if strings.HasSuffix(p, "*") {
+			if strings.HasPrefix(s, strings.TrimSuffix(p, "*")) {
+				return true
+			}
+			continue
+		}
+		if s == p {
+			return true
+		}
+	}
+	return false
+}
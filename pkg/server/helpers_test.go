@@ -23,12 +23,18 @@ import (
 	"syscall"
 	"testing"
 
+	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/reference"
 	imagedigest "github.com/opencontainers/go-digest"
+	pkgerrors "github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
 
 	ostesting "github.com/kubernetes-incubator/cri-containerd/pkg/os/testing"
+	containerstore "github.com/kubernetes-incubator/cri-containerd/pkg/store/container"
 )
 
 func TestPrepareStreamingPipes(t *testing.T) {
@@ -255,3 +261,193 @@ func TestGetRepoDigestAndTag(t *testing.T) {
 		assert.Equal(t, test.expectedRepoTag, repoTag)
 	}
 }
+
+func TestGetTagOfDigestedRef(t *testing.T) {
+	digest := "sha256:e6693c20186f837fc393390135d8a598a96a833917917789d63766cab6c59582"
+	for desc, test := range map[string]struct {
+		ref         string
+		expectedTag string
+		expectErr   bool
+	}{
+		"should return empty for tagged only reference": {
+			ref: "gcr.io/library/busybox:latest",
+		},
+		"should return empty for digested only reference": {
+			ref: "gcr.io/library/busybox@" + digest,
+		},
+		"should return tag for tagged and digested reference": {
+			ref:         "gcr.io/library/busybox:1.2@" + digest,
+			expectedTag: "gcr.io/library/busybox:1.2",
+		},
+		"should return normalized tag for tagged and digested reference": {
+			ref:         "busybox:1.2@" + digest,
+			expectedTag: "docker.io/library/busybox:1.2",
+		},
+		"should return error for invalid reference": {
+			ref:       "busybox:latest@sha256:invalid",
+			expectErr: true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		tag, err := getTagOfDigestedRef(test.ref)
+		assert.Equal(t, test.expectErr, err != nil)
+		assert.Equal(t, test.expectedTag, tag)
+	}
+}
+
+func TestVerifyImageDigest(t *testing.T) {
+	digest := imagedigest.Digest("sha256:e6693c20186f837fc393390135d8a598a96a833917917789d63766cab6c59582")
+	otherDigest := imagedigest.Digest("sha256:e6693c20186f837fc393390135d8a598a96a833917917789d63766cab6c59594")
+	for desc, test := range map[string]struct {
+		ref       string
+		digest    imagedigest.Digest
+		expectErr bool
+	}{
+		"should not verify tagged reference": {
+			ref:    "gcr.io/library/busybox:latest",
+			digest: otherDigest,
+		},
+		"should pass if resolved digest matches": {
+			ref:    "gcr.io/library/busybox@" + digest.String(),
+			digest: digest,
+		},
+		"should fail if resolved digest doesn't match": {
+			ref:       "gcr.io/library/busybox@" + digest.String(),
+			digest:    otherDigest,
+			expectErr: true,
+		},
+		"should fail if resolved digest doesn't match for tagged and digested reference": {
+			ref:       "gcr.io/library/busybox:latest@" + digest.String(),
+			digest:    otherDigest,
+			expectErr: true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		named, err := normalizeImageRef(test.ref)
+		assert.NoError(t, err)
+		err = verifyImageDigest(named, test.digest)
+		assert.Equal(t, test.expectErr, err != nil)
+	}
+}
+
+func TestToCRIContainerMetadata(t *testing.T) {
+	for desc, test := range map[string]struct {
+		attempt         uint32
+		restartCount    uint32
+		expectedAttempt uint32
+	}{
+		"should return restart count as attempt": {
+			attempt:         1,
+			restartCount:    3,
+			expectedAttempt: 3,
+		},
+		"should return attempt if it is larger than restart count": {
+			attempt:         2,
+			restartCount:    0,
+			expectedAttempt: 2,
+		},
+	} {
+		meta := containerstore.Metadata{
+			Config: &runtime.ContainerConfig{
+				Metadata: &runtime.ContainerMetadata{Name: "test-name", Attempt: test.attempt},
+			},
+			RestartCount: test.restartCount,
+		}
+		assert.Equal(t, &runtime.ContainerMetadata{Name: "test-name", Attempt: test.expectedAttempt},
+			toCRIContainerMetadata(meta), desc)
+	}
+}
+
+func TestIsRuncProcessAlreadyFinishedError(t *testing.T) {
+	for desc, test := range map[string]struct {
+		err      error
+		expected bool
+	}{
+		"nil error": {
+			err:      nil,
+			expected: false,
+		},
+		"go os process already finished": {
+			err:      grpc.Errorf(codes.Unknown, "os: process already finished"),
+			expected: true,
+		},
+		"containerd process already finished not found": {
+			err:      grpc.Errorf(codes.NotFound, "process already finished: not found"),
+			expected: true,
+		},
+		"runc container not running": {
+			err:      grpc.Errorf(codes.Unknown, "runc did not terminate sucessfully: container not running"),
+			expected: true,
+		},
+		"containerd container is not running": {
+			err:      grpc.Errorf(codes.FailedPrecondition, "container \"test-id\" is not running: failed precondition"),
+			expected: true,
+		},
+		"containerd task container is not running": {
+			err:      grpc.Errorf(codes.FailedPrecondition, "cannot kill: container is not running"),
+			expected: true,
+		},
+		"process is not running": {
+			err:      grpc.Errorf(codes.Unknown, "Process is not running"),
+			expected: true,
+		},
+		"kill no such process": {
+			err:      grpc.Errorf(codes.Unknown, "kill: no such process"),
+			expected: true,
+		},
+		"plain error": {
+			err:      fmt.Errorf("failed to kill: os: process already finished"),
+			expected: true,
+		},
+		"other error": {
+			err:      grpc.Errorf(codes.Unknown, "random error"),
+			expected: false,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		assert.Equal(t, test.expected, isRuncProcessAlreadyFinishedError(test.err))
+	}
+}
+
+func TestIsContainerdGRPCNotFoundError(t *testing.T) {
+	for desc, test := range map[string]struct {
+		err      error
+		expected bool
+	}{
+		"nil error": {
+			err:      nil,
+			expected: false,
+		},
+		"grpc not found error": {
+			err:      grpc.Errorf(codes.NotFound, "container \"test-id\" not found"),
+			expected: true,
+		},
+		"wrapped grpc not found error": {
+			err:      pkgerrors.Wrap(grpc.Errorf(codes.NotFound, "not found"), "failed to get container"),
+			expected: true,
+		},
+		"grpc not found error with localized message": {
+			err:      grpc.Errorf(codes.NotFound, "introuvable"),
+			expected: true,
+		},
+		"grpc error with other code": {
+			err:      grpc.Errorf(codes.Unknown, "container not found"),
+			expected: false,
+		},
+		"containerd not found error": {
+			err:      errdefs.ErrNotFound,
+			expected: true,
+		},
+		"wrapped containerd not found error": {
+			err:      pkgerrors.Wrapf(errdefs.ErrNotFound, "snapshot %q", "test-id"),
+			expected: true,
+		},
+		"plain error with not found message": {
+			err:      fmt.Errorf("not found"),
+			expected: false,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		assert.Equal(t, test.expected, isContainerdGRPCNotFoundError(test.err))
+	}
+}
@@ -0,0 +1,145 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+
+	runtimespec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/opencontainers/runtime-tools/generate"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+const (
+	// hugepageLimitsAnnotationKey is the container annotation key of hugepage
+	// limits. The value is a json map from page size to limit, both in
+	// kubernetes quantity format, e.g. {"2Mi": "100Mi"}.
+	// TODO: Switch to the CRI HugepageLimits field once the CRI api is bumped.
+	hugepageLimitsAnnotationKey = "io.kubernetes.cri-containerd.hugepage-limits"
+	// hugepageMountPrefix is the container path prefix of hugetlbfs mounts. Each
+	// requested page size is mounted at "<prefix>-<page size>", e.g.
+	// /dev/hugepages-2MB.
+	hugepageMountPrefix = "/dev/hugepages"
+)
+
+// hugepagesDir is the sysfs directory listing hugepage sizes supported on the
+// host. It's a variable so that it can be overridden in tests.
+var hugepagesDir = "/sys/kernel/mm/hugepages"
+
+// hugepageSizeUnits are the units of page sizes in the cgroup hugetlb format.
+var hugepageSizeUnits = []string{"B", "KB", "MB", "GB", "TB", "PB"}
+
+// formatHugepageSize formats a page size in bytes into the cgroup hugetlb format,
+// e.g. 2097152 into "2MB".
+func formatHugepageSize(size uint64) string {
+	i := 0
+	for size >= 1024 && size%1024 == 0 && i < len(hugepageSizeUnits)-1 {
+		size /= 1024
+		i++
+	}
+	return fmt.Sprintf("%d%s", size, hugepageSizeUnits[i])
+}
+
+// getHostHugepageSizes returns the hugepage sizes supported on the host in the
+// cgroup hugetlb format.
+func getHostHugepageSizes() (map[string]bool, error) {
+	infos, err := ioutil.ReadDir(hugepagesDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read hugepages dir %q: %v", hugepagesDir, err)
+	}
+	sizes := make(map[string]bool)
+	for _, info := range infos {
+		// The directory name is in the format of "hugepages-<size>kB".
+		name := strings.TrimSuffix(strings.TrimPrefix(info.Name(), "hugepages-"), "kB")
+		kb, err := strconv.ParseUint(name, 10, 64)
+		if err != nil {
+			continue
+		}
+		sizes[formatHugepageSize(kb*1024)] = true
+	}
+	return sizes, nil
+}
+
+// getHugepageLimits returns the hugepage limits keyed by page size in the cgroup
+// hugetlb format, which are requested in the container annotations. It returns
+// error if a page size is not supported on the host.
+func getHugepageLimits(annotations map[string]string) (map[string]uint64, error) {
+	value, ok := annotations[hugepageLimitsAnnotationKey]
+	if !ok {
+		return nil, nil
+	}
+	var requests map[string]string
+	if err := json.Unmarshal([]byte(value), &requests); err != nil {
+		return nil, grpc.Errorf(codes.InvalidArgument, "failed to unmarshal hugepage limits %q: %v", value, err)
+	}
+	supported, err := getHostHugepageSizes()
+	if err != nil {
+		return nil, err
+	}
+	limits := make(map[string]uint64)
+	for pageSize, limit := range requests {
+		size, err := resource.ParseQuantity(pageSize)
+		if err != nil || size.Value() <= 0 {
+			return nil, grpc.Errorf(codes.InvalidArgument, "invalid hugepage size %q", pageSize)
+		}
+		l, err := resource.ParseQuantity(limit)
+		if err != nil || l.Value() < 0 {
+			return nil, grpc.Errorf(codes.InvalidArgument, "invalid limit %q of hugepage size %q", limit, pageSize)
+		}
+		formatted := formatHugepageSize(uint64(size.Value()))
+		if !supported[formatted] {
+			var sizes []string
+			for s := range supported {
+				sizes = append(sizes, s)
+			}
+			sort.Strings(sizes)
+			return nil, grpc.Errorf(codes.InvalidArgument, "hugepage size %q is not supported on the host, supported sizes are %v",
+				pageSize, sizes)
+		}
+		limits[formatted] = uint64(l.Value())
+	}
+	return limits, nil
+}
+
+// setOCIHugepageLimits sets the hugepage limits and mounts a hugetlbfs for each
+// page size into the container.
+func setOCIHugepageLimits(g *generate.Generator, limits map[string]uint64) {
+	var pageSizes []string
+	for pageSize := range limits {
+		pageSizes = append(pageSizes, pageSize)
+	}
+	// Sort the page sizes so that the generated spec is deterministic.
+	sort.Strings(pageSizes)
+	for _, pageSize := range pageSizes {
+		g.AddLinuxResourcesHugepageLimit(pageSize, limits[pageSize])
+		spec := g.Spec()
+		spec.Mounts = append(spec.Mounts, runtimespec.Mount{
+			Destination: hugepageMountPrefix + "-" + pageSize,
+			Type:        "hugetlbfs",
+			Source:      "hugetlbfs",
+			// The hugetlbfs pagesize option is in the kernel memparse format, e.g. "2M".
+			Options: []string{"nosuid", "nodev", "noexec", "pagesize=" + strings.TrimSuffix(pageSize, "B")},
+		})
+	}
+}
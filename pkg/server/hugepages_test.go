@@ -0,0 +1,104 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	runtimespec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/opencontainers/runtime-tools/generate"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormatHugepageSize(t *testing.T) {
+	for size, expected := range map[uint64]string{
+		512:                "512B",
+		64 * 1024:          "64KB",
+		2 * 1024 * 1024:    "2MB",
+		1024 * 1024 * 1024: "1GB",
+		1536 * 1024:        "1536KB",
+	} {
+		assert.Equal(t, expected, formatHugepageSize(size))
+	}
+}
+
+func TestGetHugepageLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hugepages-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	for _, d := range []string{"hugepages-2048kB", "hugepages-1048576kB", "invalid"} {
+		require.NoError(t, os.Mkdir(filepath.Join(dir, d), 0755))
+	}
+	defer func(d string) { hugepagesDir = d }(hugepagesDir)
+	hugepagesDir = dir
+
+	for desc, test := range map[string]struct {
+		annotations map[string]string
+		expected    map[string]uint64
+		expectErr   bool
+	}{
+		"should return nil if no hugepage limit is requested": {},
+		"should return limits of supported page sizes": {
+			annotations: map[string]string{hugepageLimitsAnnotationKey: `{"2Mi":"100Mi","1Gi":"2Gi"}`},
+			expected: map[string]uint64{
+				"2MB": 100 * 1024 * 1024,
+				"1GB": 2 * 1024 * 1024 * 1024,
+			},
+		},
+		"should return error for unsupported page size": {
+			annotations: map[string]string{hugepageLimitsAnnotationKey: `{"64Ki":"100Mi"}`},
+			expectErr:   true,
+		},
+		"should return error for invalid page size": {
+			annotations: map[string]string{hugepageLimitsAnnotationKey: `{"invalid":"100Mi"}`},
+			expectErr:   true,
+		},
+		"should return error for invalid limit": {
+			annotations: map[string]string{hugepageLimitsAnnotationKey: `{"2Mi":"invalid"}`},
+			expectErr:   true,
+		},
+		"should return error for invalid json": {
+			annotations: map[string]string{hugepageLimitsAnnotationKey: "invalid"},
+			expectErr:   true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		limits, err := getHugepageLimits(test.annotations)
+		if test.expectErr {
+			assert.Error(t, err)
+			continue
+		}
+		assert.NoError(t, err)
+		assert.Equal(t, test.expected, limits)
+	}
+}
+
+func TestSetOCIHugepageLimits(t *testing.T) {
+	g := generate.New()
+	setOCIHugepageLimits(&g, map[string]uint64{"2MB": 1024, "1GB": 2048})
+	spec := g.Spec()
+	assert.Equal(t, []runtimespec.LinuxHugepageLimit{
+		{Pagesize: "1GB", Limit: 2048},
+		{Pagesize: "2MB", Limit: 1024},
+	}, spec.Linux.Resources.HugepageLimits)
+	checkMount(t, spec.Mounts, "hugetlbfs", "/dev/hugepages-2MB", "hugetlbfs", []string{"pagesize=2M"}, nil)
+	checkMount(t, spec.Mounts, "hugetlbfs", "/dev/hugepages-1GB", "hugetlbfs", []string{"pagesize=1G"}, nil)
+}
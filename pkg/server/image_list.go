@@ -17,21 +17,21 @@ limitations under the License.
 package server
 
 import (
-	"github.com/golang/glog"
 	"golang.org/x/net/context"
 	"k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
 
+	"github.com/kubernetes-incubator/cri-containerd/pkg/log"
 	imagestore "github.com/kubernetes-incubator/cri-containerd/pkg/store/image"
 )
 
-// ListImages lists existing images.
-// TODO(random-liu): Add image list filters after CRI defines this more clear, and kubelet
-// actually needs it.
+// ListImages lists existing images. Each image is returned once with all its repo tags
+// and repo digests. If the image filter is specified, only the image with the image id,
+// repo tag or repo digest is returned.
 func (c *criContainerdService) ListImages(ctx context.Context, r *runtime.ListImagesRequest) (retRes *runtime.ListImagesResponse, retErr error) {
-	glog.V(4).Infof("ListImages with filter %+v", r.GetFilter())
+	log.G(ctx).V(4).Infof("ListImages with filter %+v", r.GetFilter())
 	defer func() {
 		if retErr == nil {
-			glog.V(4).Infof("ListImages returns image list %+v", retRes.GetImages())
+			log.G(ctx).V(4).Infof("ListImages returns image list %+v", retRes.GetImages())
 		}
 	}()
 
@@ -39,6 +39,9 @@ func (c *criContainerdService) ListImages(ctx context.Context, r *runtime.ListIm
 
 	var images []*runtime.Image
 	for _, image := range imagesInStore {
+		if !imageMatchesFilter(image, r.GetFilter().GetImage().GetImage()) {
+			continue
+		}
 		// TODO(random-liu): [P0] Make sure corresponding snapshot exists. What if snapshot
 		// doesn't exist?
 		images = append(images, toCRIImage(image))
@@ -47,6 +50,25 @@ func (c *criContainerdService) ListImages(ctx context.Context, r *runtime.ListIm
 	return &runtime.ListImagesResponse{Images: images}, nil
 }
 
+// imageMatchesFilter checks whether the image matches the image filter, which could be
+// an image id, repo tag or repo digest. Repo tags and repo digests of the image are
+// normalized, so the filter is normalized before matching. Empty filter matches all
+// images.
+func imageMatchesFilter(image imagestore.Image, filter string) bool {
+	if filter == "" || filter == image.ID {
+		return true
+	}
+	if normalized, err := normalizeImageRef(filter); err == nil {
+		filter = normalized.String()
+	}
+	for _, ref := range append(append([]string{}, image.RepoTags...), image.RepoDigests...) {
+		if ref == filter {
+			return true
+		}
+	}
+	return false
+}
+
 // toCRIImage converts image to CRI image type.
 func toCRIImage(image imagestore.Image) *runtime.Image {
 	runtimeImage := &runtime.Image{
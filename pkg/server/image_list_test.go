@@ -99,3 +99,75 @@ func TestListImages(t *testing.T) {
 		assert.Contains(t, images, i)
 	}
 }
+
+func TestListImagesWithFilter(t *testing.T) {
+	const (
+		testID     = "sha256:d848ce12891bf78792cda4a23c58984033b0c397a55e93a1556202222ecc5ed4"
+		testDigest = "docker.io/library/busybox@sha256:e6693c20186f837fc393390135d8a598a96a833917917789d63766cab6c59582"
+	)
+	c := newTestCRIContainerdService()
+	// The image is pulled under multiple tags.
+	for _, tag := range []string{"docker.io/library/busybox:1", "docker.io/library/busybox:latest"} {
+		c.imageStore.Add(imagestore.Image{
+			ID:          testID,
+			RepoTags:    []string{tag},
+			RepoDigests: []string{testDigest},
+			Size:        1000,
+			Config:      &imagespec.ImageConfig{},
+		})
+	}
+	c.imageStore.Add(imagestore.Image{
+		ID:       "test-other-id",
+		RepoTags: []string{"gcr.io/library/other:latest"},
+		Config:   &imagespec.ImageConfig{},
+	})
+	for desc, test := range map[string]struct {
+		filter      string
+		expectedIDs []string
+	}{
+		"should list all images without filter": {
+			expectedIDs: []string{testID, "test-other-id"},
+		},
+		"should filter by image id": {
+			filter:      testID,
+			expectedIDs: []string{testID},
+		},
+		"should filter by repo tag": {
+			filter:      "docker.io/library/busybox:1",
+			expectedIDs: []string{testID},
+		},
+		"should filter by normalized repo tag": {
+			filter:      "busybox",
+			expectedIDs: []string{testID},
+		},
+		"should filter by repo digest": {
+			filter:      testDigest,
+			expectedIDs: []string{testID},
+		},
+		"should return empty list if nothing matches": {
+			filter: "busybox:2",
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		resp, err := c.ListImages(context.Background(), &runtime.ListImagesRequest{
+			Filter: &runtime.ImageFilter{Image: &runtime.ImageSpec{Image: test.filter}},
+		})
+		assert.NoError(t, err)
+		require.NotNil(t, resp)
+		var ids []string
+		for _, image := range resp.GetImages() {
+			ids = append(ids, image.Id)
+			if image.Id == testID {
+				assert.Len(t, image.RepoTags, 2)
+				assert.Contains(t, image.RepoTags, "docker.io/library/busybox:1")
+				assert.Contains(t, image.RepoTags, "docker.io/library/busybox:latest")
+				assert.Equal(t, []string{testDigest}, image.RepoDigests)
+				assert.Equal(t, uint64(1000), image.Size_)
+			}
+		}
+		assert.Len(t, ids, len(test.expectedIDs))
+		for _, id := range test.expectedIDs {
+			assert.Contains(t, ids, id)
+		}
+	}
+}
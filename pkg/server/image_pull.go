@@ -21,7 +21,6 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"net/http"
 	"strings"
 	"sync"
 	"time"
@@ -30,14 +29,15 @@ import (
 	"github.com/containerd/containerd/errdefs"
 	containerdimages "github.com/containerd/containerd/images"
 	"github.com/containerd/containerd/remotes"
-	"github.com/containerd/containerd/remotes/docker"
 	"github.com/containerd/containerd/remotes/docker/schema1"
 	containerdrootfs "github.com/containerd/containerd/rootfs"
-	"github.com/golang/glog"
 	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
 	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
 
+	"github.com/kubernetes-incubator/cri-containerd/pkg/log"
 	imagestore "github.com/kubernetes-incubator/cri-containerd/pkg/store/image"
 )
 
@@ -81,21 +81,35 @@ import (
 
 // PullImage pulls an image with authentication config.
 func (c *criContainerdService) PullImage(ctx context.Context, r *runtime.PullImageRequest) (retRes *runtime.PullImageResponse, retErr error) {
-	glog.V(2).Infof("PullImage %q with auth config %+v", r.GetImage().GetImage(), r.GetAuth())
+	// Never log the auth config, which contains credentials.
+	log.G(ctx).V(2).Infof("PullImage %q with auth config provided %v", r.GetImage().GetImage(), r.GetAuth() != nil)
 	defer func() {
 		if retErr == nil {
-			glog.V(2).Infof("PullImage %q returns image reference %q",
+			log.G(ctx).V(2).Infof("PullImage %q returns image reference %q",
 				r.GetImage().GetImage(), retRes.GetImageRef())
 		}
 	}()
 	imageRef := r.GetImage().GetImage()
 
 	// TODO(mikebrow): add truncIndex for image id
-	imageID, repoTag, repoDigest, err := c.pullImage(ctx, imageRef, r.GetAuth())
+	key, err := getImagePullKey(imageRef, r.GetAuth())
 	if err != nil {
+		return nil, grpc.Errorf(codes.InvalidArgument, "failed to parse image reference %q: %v", imageRef, err)
+	}
+	// Concurrent pulls of the same image share a single pull.
+	result, err := c.imagePullGroup.do(ctx, key, func(ctx context.Context) (imagePullResult, error) {
+		imageID, repoTag, repoDigest, err := c.pullImage(ctx, imageRef, r.GetAuth())
+		return imagePullResult{imageID: imageID, repoTag: repoTag, repoDigest: repoDigest}, err
+	})
+	imageID, repoTag, repoDigest := result.imageID, result.repoTag, result.repoDigest
+	if err != nil {
+		if isUnauthenticatedError(err) {
+			// Keep the error code, so that the client knows the credentials are rejected.
+			return nil, grpc.Errorf(codes.Unauthenticated, "failed to pull image %q: %v", imageRef, grpc.ErrorDesc(err))
+		}
 		return nil, fmt.Errorf("failed to pull image %q: %v", imageRef, err)
 	}
-	glog.V(4).Infof("Pulled image %q with image id %q, repo tag %q, repo digest %q", imageRef, imageID,
+	log.G(ctx).V(4).Infof("Pulled image %q with image id %q, repo tag %q, repo digest %q", imageRef, imageID,
 		repoTag, repoDigest)
 
 	// Get image information.
@@ -155,16 +169,18 @@ func (r *resourceSet) all() map[string]struct{} {
 }
 
 // ParseAuth parses AuthConfig and returns username and password/secret required by containerd.
+// Identity token is preferred over username and password. Registry token is not returned,
+// because it's sent to the registry directly as bearer token, see registryTokenTransport.
 func ParseAuth(auth *runtime.AuthConfig) (string, string, error) {
 	if auth == nil {
 		return "", "", nil
 	}
-	if auth.Username != "" {
-		return auth.Username, auth.Password, nil
-	}
 	if auth.IdentityToken != "" {
 		return "", auth.IdentityToken, nil
 	}
+	if auth.Username != "" {
+		return auth.Username, auth.Password, nil
+	}
 	if auth.Auth != "" {
 		decLen := base64.StdEncoding.DecodedLen(len(auth.Auth))
 		decoded := make([]byte, decLen)
@@ -179,7 +195,9 @@ func ParseAuth(auth *runtime.AuthConfig) (string, string, error) {
 		user, passwd := fields[0], fields[1]
 		return user, strings.Trim(passwd, "\x00"), nil
 	}
-	// TODO(random-liu): Support RegistryToken.
+	if auth.RegistryToken != "" {
+		return "", "", nil
+	}
 	return "", "", fmt.Errorf("invalid auth config")
 }
 
@@ -194,28 +212,29 @@ func (c *criContainerdService) pullImage(ctx context.Context, rawRef string, aut
 	// TODO(random-liu): [P0] Avoid concurrent pulling/removing on the same image reference.
 	ref := namedRef.String()
 	if ref != rawRef {
-		glog.V(4).Infof("PullImage using normalized image ref: %q", ref)
+		log.G(ctx).V(4).Infof("PullImage using normalized image ref: %q", ref)
 	}
 
-	// Resolve the image reference to get descriptor and fetcher.
-	resolver := docker.NewResolver(docker.ResolverOptions{
-		Credentials: func(string) (string, string, error) { return ParseAuth(auth) },
-		Client:      http.DefaultClient,
-	})
-	_, desc, err := resolver.Resolve(ctx, ref)
+	// Resolve the image reference to get descriptor and fetcher. Registry mirrors
+	// are tried before the canonical registry, and the resolved digest is verified
+	// against the requested digest.
+	desc, fetcher, err := c.resolveImage(ctx, namedRef, auth)
 	if err != nil {
+		if isUnauthenticatedError(err) {
+			return "", "", "", grpc.Errorf(codes.Unauthenticated, "failed to resolve ref %q: %v", ref, grpc.ErrorDesc(err))
+		}
 		return "", "", "", fmt.Errorf("failed to resolve ref %q: %v", ref, err)
 	}
-	fetcher, err := resolver.Fetcher(ctx, ref)
-	if err != nil {
-		return "", "", "", fmt.Errorf("failed to get fetcher for ref %q: %v", ref, err)
+	if c.config.ContentCacheDir != "" {
+		// Serve contents from the local content cache before hitting the registry.
+		fetcher = newContentCacheFetcher(c.config.ContentCacheDir, c.config.PopulateContentCache, fetcher)
 	}
 	// Currently, the resolved image name is the same with ref in docker resolver,
 	// but they may be different in the future.
 	// TODO(random-liu): Always resolve image reference and use resolved image name in
 	// the system.
 
-	glog.V(4).Infof("Start downloading resources for image %q", ref)
+	log.G(ctx).V(4).Infof("Start downloading resources for image %q", ref)
 	resources := newResourceSet()
 	resourceTrackHandler := containerdimages.HandlerFunc(func(ctx gocontext.Context, desc imagespec.Descriptor) (
 		[]imagespec.Descriptor, error) {
@@ -245,18 +264,17 @@ func (c *criContainerdService) pullImage(ctx context.Context, rawRef string, aut
 			containerdimages.ChildrenHandler(c.contentStoreService),
 		)
 	}
-	if err := containerdimages.Dispatch(ctx, handler, desc); err != nil {
-		// Dispatch returns error when requested resources are locked.
-		// In that case, we should start waiting and checking the pulling
-		// progress.
-		// TODO(random-liu): Check specific resource locked error type.
-		glog.V(5).Infof("Dispatch for %q returns error: %v", ref, err)
-	}
+	// Dispatch in a separate goroutine, so that downloading progress could be
+	// reported and the pulling could be aborted when the request is cancelled.
+	dispatchCh := make(chan error, 1)
+	go func() {
+		dispatchCh <- containerdimages.Dispatch(ctx, handler, desc)
+	}()
 	// Wait for the image pulling to finish
-	if err := c.waitForResourcesDownloading(ctx, resources.all()); err != nil {
+	if err := c.waitForResourcesDownloading(ctx, ref, resources, dispatchCh); err != nil {
 		return "", "", "", fmt.Errorf("failed to wait for image %q downloading: %v", ref, err)
 	}
-	glog.V(4).Infof("Finished downloading resources for image %q", ref)
+	log.G(ctx).V(4).Infof("Finished downloading resources for image %q", ref)
 	if schema1Converter != nil {
 		desc, err = schema1Converter.Convert(ctx)
 		if err != nil {
@@ -276,6 +294,13 @@ func (c *criContainerdService) pullImage(ctx context.Context, rawRef string, aut
 	if ref != repoTag && ref != repoDigest {
 		return "", "", "", fmt.Errorf("unexpected repo tag %q and repo digest %q for %q", repoTag, repoDigest, ref)
 	}
+	if repoTag == "" {
+		// Keep the tag of a reference which is both tagged and digested.
+		repoTag, err = getTagOfDigestedRef(rawRef)
+		if err != nil {
+			return "", "", "", fmt.Errorf("failed to get repo tag of %q: %v", rawRef, err)
+		}
+	}
 	for _, r := range []string{repoTag, repoDigest} {
 		if r == "" {
 			continue
@@ -362,36 +387,75 @@ func (c *criContainerdService) createImageReference(ctx context.Context, name st
 // waitDownloadingPollInterval is the interval to check resource downloading progress.
 const waitDownloadingPollInterval = 200 * time.Millisecond
 
-// waitForResourcesDownloading waits for all resource downloading to finish.
-func (c *criContainerdService) waitForResourcesDownloading(ctx context.Context, resources map[string]struct{}) error {
+// waitForResourcesDownloading waits for the dispatch to return and all resource
+// downloading to finish. Downloading progress of each resource is logged. If the
+// context is cancelled, the ongoing downloading is aborted.
+func (c *criContainerdService) waitForResourcesDownloading(ctx context.Context, ref string, resources *resourceSet,
+	dispatchCh <-chan error) error {
 	ticker := time.NewTicker(waitDownloadingPollInterval)
 	defer ticker.Stop()
+	dispatched := false
 	for {
 		select {
+		case err := <-dispatchCh:
+			if err != nil {
+				// Dispatch returns error when requested resources are locked.
+				// In that case, we should keep waiting and checking the pulling
+				// progress.
+				// TODO(random-liu): Check specific resource locked error type.
+				log.G(ctx).V(5).Infof("Dispatch for %q returns error: %v", ref, err)
+			}
+			dispatched = true
+			// Stop selecting on the channel, it only receives once.
+			dispatchCh = nil
 		case <-ticker.C:
 			// TODO(random-liu): Use better regexp when containerd `MakeRefKey` contains more
 			// information.
 			statuses, err := c.contentStoreService.ListStatuses(ctx, "")
 			if err != nil {
+				if ctx.Err() != nil {
+					c.abortResourcesDownloading(ref, resources.all())
+					return fmt.Errorf("image resources pulling is cancelled: %v", ctx.Err())
+				}
 				return fmt.Errorf("failed to get content status: %v", err)
 			}
+			all := resources.all()
 			pulling := false
-			// TODO(random-liu): Move Dispatch into a separate goroutine, so that we could report
-			// image pulling progress concurrently.
 			for _, status := range statuses {
-				_, ok := resources[status.Ref]
-				if ok {
-					glog.V(5).Infof("Pulling resource %q with progress %d/%d",
-						status.Ref, status.Offset, status.Total)
+				if _, ok := all[status.Ref]; ok {
+					log.G(ctx).V(4).Infof("Pulling resource %q for image %q with progress %d/%d",
+						status.Ref, ref, status.Offset, status.Total)
 					pulling = true
 				}
 			}
-			if !pulling {
+			if dispatched && !pulling {
 				return nil
 			}
 		case <-ctx.Done():
-			// TODO(random-liu): Abort ongoing pulling if cancelled.
-			return fmt.Errorf("image resources pulling is cancelled")
+			c.abortResourcesDownloading(ref, resources.all())
+			return fmt.Errorf("image resources pulling is cancelled: %v", ctx.Err())
+		}
+	}
+}
+
+// abortResourcesDownloading aborts the ongoing downloading of the resources in the
+// content store, so that partially downloaded content is not left behind locked.
+func (c *criContainerdService) abortResourcesDownloading(ref string, resources map[string]struct{}) {
+	// Use a new context because the request context is already cancelled.
+	ctx := context.Background()
+	statuses, err := c.contentStoreService.ListStatuses(ctx, "")
+	if err != nil {
+		log.G(ctx).Errorf("Failed to get content status to abort pulling image %q: %v", ref, err)
+		return
+	}
+	for _, status := range statuses {
+		if _, ok := resources[status.Ref]; !ok {
+			continue
+		}
+		if err := c.contentStoreService.Abort(ctx, status.Ref); err != nil && !errdefs.IsNotFound(err) {
+			log.G(ctx).Errorf("Failed to abort downloading resource %q for image %q: %v", status.Ref, ref, err)
+			continue
 		}
+		log.G(ctx).V(4).Infof("Aborted downloading resource %q for image %q", status.Ref, ref)
 	}
 }
@@ -0,0 +1,137 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/docker/distribution/reference"
+	"github.com/gogo/protobuf/proto"
+	imagedigest "github.com/opencontainers/go-digest"
+	"golang.org/x/net/context"
+	"k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+)
+
+// imagePullResult is the result of an image pull.
+type imagePullResult struct {
+	imageID    string
+	repoTag    string
+	repoDigest string
+}
+
+// imagePull is an in-flight image pull shared by concurrent pull requests of the
+// same image.
+type imagePull struct {
+	// done is closed when the pull finishes.
+	done chan struct{}
+	// cancel cancels the pull.
+	cancel context.CancelFunc
+	// waiters is the number of pull requests waiting for the pull.
+	waiters int
+	// result and err are the result of the pull, which are only valid after
+	// done is closed.
+	result imagePullResult
+	err    error
+}
+
+// imagePullGroup deduplicates concurrent pulls of the same image, so that the
+// image is only pulled once.
+type imagePullGroup struct {
+	sync.Mutex
+	pulls map[string]*imagePull
+}
+
+// newImagePullGroup creates an imagePullGroup.
+func newImagePullGroup() *imagePullGroup {
+	return &imagePullGroup{pulls: make(map[string]*imagePull)}
+}
+
+// do runs the pull function for the key, or waits for the in-flight pull with the
+// same key to finish, and returns its result. A failed pull returns the error to
+// all waiters, and a new pull is started for the next request.
+// The pull function is called with a context which is only cancelled when all
+// waiters are cancelled, so that a cancelled request doesn't fail the pull shared
+// by other requests.
+func (g *imagePullGroup) do(ctx context.Context, key string,
+	pull func(context.Context) (imagePullResult, error)) (imagePullResult, error) {
+	g.Lock()
+	p, ok := g.pulls[key]
+	if !ok {
+		pullCtx, cancel := context.WithCancel(context.Background())
+		p = &imagePull{done: make(chan struct{}), cancel: cancel}
+		g.pulls[key] = p
+		go func() {
+			p.result, p.err = pull(pullCtx)
+			g.Lock()
+			g.remove(key, p)
+			g.Unlock()
+			cancel()
+			close(p.done)
+		}()
+	}
+	p.waiters++
+	g.Unlock()
+
+	select {
+	case <-p.done:
+		return p.result, p.err
+	case <-ctx.Done():
+		g.Lock()
+		defer g.Unlock()
+		p.waiters--
+		if p.waiters == 0 {
+			// Abort the pull if no one is waiting for it, and remove it
+			// so that the next request starts a new pull.
+			p.cancel()
+			g.remove(key, p)
+		}
+		return imagePullResult{}, fmt.Errorf("image pulling is cancelled: %v", ctx.Err())
+	}
+}
+
+// remove removes the pull of the key if it's not replaced by a new one. Caller
+// should hold the lock.
+func (g *imagePullGroup) remove(key string, p *imagePull) {
+	if g.pulls[key] == p {
+		delete(g.pulls, key)
+	}
+}
+
+// getImagePullKey returns the key to deduplicate pulls of the image reference. It's
+// the normalized image reference, with the tag kept for a reference which is both
+// tagged and digested, because the tag is also added to the pulled image.
+// The digest of the auth config is appended if any credential is provided, so that
+// a request never shares the result of a pull authorized by other credentials.
+func getImagePullKey(ref string, auth *runtime.AuthConfig) (string, error) {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return "", err
+	}
+	key := reference.TagNameOnly(named).String()
+	if auth == nil {
+		return key, nil
+	}
+	data, err := proto.Marshal(auth)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal auth config: %v", err)
+	}
+	if len(data) == 0 {
+		return key, nil
+	}
+	return key + " " + imagedigest.FromBytes(data).String(), nil
+}
@@ -0,0 +1,197 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+)
+
+// waitForImagePullWaiters waits for the in-flight pull of the key to have the number
+// of waiters.
+func waitForImagePullWaiters(t *testing.T, g *imagePullGroup, key string, waiters int) {
+	for i := 0; i < 100; i++ {
+		g.Lock()
+		p, ok := g.pulls[key]
+		done := ok && p.waiters == waiters
+		g.Unlock()
+		if done {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timeout waiting for %d waiters of pull %q", waiters, key)
+}
+
+func TestImagePullGroup(t *testing.T) {
+	const (
+		testKey = "test-key"
+		waiters = 5
+	)
+	expectedResult := imagePullResult{imageID: "test-id", repoTag: "test-tag", repoDigest: "test-digest"}
+	for desc, test := range map[string]struct {
+		pullErr error
+	}{
+		"concurrent pulls should share the result of a single pull": {},
+		"concurrent pulls should share the error of a single pull": {
+			pullErr: errors.New("random error"),
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		g := newImagePullGroup()
+		release := make(chan struct{})
+		pulled := 0
+		pull := func(context.Context) (imagePullResult, error) {
+			pulled++
+			<-release
+			if test.pullErr != nil {
+				return imagePullResult{}, test.pullErr
+			}
+			return expectedResult, nil
+		}
+		var wg sync.WaitGroup
+		results := make([]imagePullResult, waiters)
+		errs := make([]error, waiters)
+		for i := 0; i < waiters; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				results[i], errs[i] = g.do(context.Background(), testKey, pull)
+			}(i)
+		}
+		waitForImagePullWaiters(t, g, testKey, waiters)
+		close(release)
+		wg.Wait()
+		assert.Equal(t, 1, pulled)
+		for i := 0; i < waiters; i++ {
+			assert.Equal(t, test.pullErr, errs[i])
+			if test.pullErr == nil {
+				assert.Equal(t, expectedResult, results[i])
+			}
+		}
+		assert.Empty(t, g.pulls, "finished pull should be removed")
+		// A new pull should be started after the previous one finishes.
+		_, err := g.do(context.Background(), testKey, pull)
+		assert.Equal(t, test.pullErr, err)
+		assert.Equal(t, 2, pulled)
+	}
+}
+
+func TestImagePullGroupCancel(t *testing.T) {
+	const testKey = "test-key"
+	g := newImagePullGroup()
+	pullCancelled := make(chan struct{})
+	pull := func(ctx context.Context) (imagePullResult, error) {
+		<-ctx.Done()
+		close(pullCancelled)
+		return imagePullResult{}, ctx.Err()
+	}
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	errCh := make(chan error, 2)
+	go func() {
+		_, err := g.do(ctx1, testKey, pull)
+		errCh <- err
+	}()
+	go func() {
+		_, err := g.do(ctx2, testKey, pull)
+		errCh <- err
+	}()
+	waitForImagePullWaiters(t, g, testKey, 2)
+
+	cancel1()
+	assert.Error(t, <-errCh)
+	waitForImagePullWaiters(t, g, testKey, 1)
+	select {
+	case <-pullCancelled:
+		t.Fatal("pull should not be cancelled when there are other waiters")
+	default:
+	}
+
+	cancel2()
+	assert.Error(t, <-errCh)
+	select {
+	case <-pullCancelled:
+	case <-time.After(time.Second):
+		t.Fatal("pull should be cancelled when all waiters are cancelled")
+	}
+	g.Lock()
+	defer g.Unlock()
+	assert.Empty(t, g.pulls, "cancelled pull should be removed")
+}
+
+func TestGetImagePullKey(t *testing.T) {
+	digest := "sha256:e6693c20186f837fc393390135d8a598a96a833917917789d63766cab6c59582"
+	for desc, test := range map[string]struct {
+		ref       string
+		expected  string
+		expectErr bool
+	}{
+		"should normalize reference without tag": {
+			ref:      "busybox",
+			expected: "docker.io/library/busybox:latest",
+		},
+		"should normalize tagged reference": {
+			ref:      "gcr.io/library/busybox:1.2",
+			expected: "gcr.io/library/busybox:1.2",
+		},
+		"should keep digested reference": {
+			ref:      "busybox@" + digest,
+			expected: "docker.io/library/busybox@" + digest,
+		},
+		"should keep tag of tagged and digested reference": {
+			ref:      "busybox:1.2@" + digest,
+			expected: "docker.io/library/busybox:1.2@" + digest,
+		},
+		"should return error for invalid reference": {
+			ref:       "busybox:latest@sha256:invalid",
+			expectErr: true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		key, err := getImagePullKey(test.ref, nil)
+		assert.Equal(t, test.expectErr, err != nil)
+		assert.Equal(t, test.expected, key)
+	}
+}
+
+func TestGetImagePullKeyWithAuth(t *testing.T) {
+	const ref = "busybox"
+	noAuthKey, err := getImagePullKey(ref, nil)
+	require.NoError(t, err)
+	emptyAuthKey, err := getImagePullKey(ref, &runtime.AuthConfig{})
+	require.NoError(t, err)
+	assert.Equal(t, noAuthKey, emptyAuthKey, "empty auth config should be the same as no auth config")
+
+	auth1Key, err := getImagePullKey(ref, &runtime.AuthConfig{Username: "user1", Password: "password"})
+	require.NoError(t, err)
+	auth1KeyAgain, err := getImagePullKey(ref, &runtime.AuthConfig{Username: "user1", Password: "password"})
+	require.NoError(t, err)
+	auth2Key, err := getImagePullKey(ref, &runtime.AuthConfig{Username: "user2", Password: "password"})
+	require.NoError(t, err)
+	assert.Equal(t, auth1Key, auth1KeyAgain, "same credentials should share the pull")
+	assert.NotEqual(t, noAuthKey, auth1Key, "credentials should not share the anonymous pull")
+	assert.NotEqual(t, auth1Key, auth2Key, "different credentials should not share the pull")
+	assert.NotContains(t, auth1Key, "password", "credentials should not be in the key")
+}
@@ -18,12 +18,17 @@ package server
 
 import (
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"sync"
 	"testing"
 
+	"github.com/containerd/containerd/content"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
 	"k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+
+	servertesting "github.com/kubernetes-incubator/cri-containerd/pkg/server/testing"
 )
 
 func TestResources(t *testing.T) {
@@ -81,6 +86,24 @@ func TestParseAuth(t *testing.T) {
 			expectedUser:   testUser,
 			expectedSecret: testPasswd,
 		},
+		"should prefer identity token over username and password": {
+			auth: &runtime.AuthConfig{
+				Username:      testUser,
+				Password:      testPasswd,
+				IdentityToken: "abcd",
+			},
+			expectedSecret: "abcd",
+		},
+		"should prefer identity token over auth": {
+			auth: &runtime.AuthConfig{
+				Auth:          string(testAuth),
+				IdentityToken: "abcd",
+			},
+			expectedSecret: "abcd",
+		},
+		"should not return registry token": {
+			auth: &runtime.AuthConfig{RegistryToken: "abcd"},
+		},
 		"should return error for invalid auth": {
 			auth:      &runtime.AuthConfig{Auth: string(invalidAuth)},
 			expectErr: true,
@@ -93,3 +116,72 @@ func TestParseAuth(t *testing.T) {
 		assert.Equal(t, test.expectedSecret, s)
 	}
 }
+
+func TestWaitForResourcesDownloading(t *testing.T) {
+	const (
+		testResource     = "test-resource"
+		testOtherIngest  = "test-other-ingest"
+		testImageRefName = "test-image"
+	)
+	for desc, test := range map[string]struct {
+		ingests       []string
+		dispatchErr   error
+		finishIngests bool
+		cancel        bool
+		expectErr     bool
+		expectAborted []string
+	}{
+		"should return when dispatch returns and no resource is downloading": {},
+		"should return when dispatch returns error and no resource is downloading": {
+			dispatchErr: errors.New("random error"),
+		},
+		"should ignore downloading of untracked resources": {
+			ingests: []string{testOtherIngest},
+		},
+		"should wait for resource downloading to finish": {
+			ingests:       []string{testResource, testOtherIngest},
+			finishIngests: true,
+		},
+		"should abort tracked resource downloading when cancelled": {
+			ingests:       []string{testResource, testOtherIngest},
+			cancel:        true,
+			expectErr:     true,
+			expectAborted: []string{testResource},
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		c := newTestCRIContainerdService()
+		fakeContentStore := servertesting.NewFakeContentStore()
+		c.contentStoreService = fakeContentStore
+		var statuses []content.Status
+		for _, ingest := range test.ingests {
+			statuses = append(statuses, content.Status{Ref: ingest, Offset: 1, Total: 2})
+		}
+		fakeContentStore.SetFakeStatuses(statuses)
+		resources := newResourceSet()
+		resources.add(testResource)
+		ctx, cancel := context.WithCancel(context.Background())
+		dispatchCh := make(chan error, 1)
+		dispatchCh <- test.dispatchErr
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- c.waitForResourcesDownloading(ctx, testImageRefName, resources, dispatchCh)
+		}()
+		if test.finishIngests {
+			fakeContentStore.RemoveFakeStatus(testResource)
+		}
+		if test.cancel {
+			cancel()
+		}
+		err := <-errCh
+		cancel()
+		assert.Equal(t, test.expectErr, err != nil)
+		var aborted []string
+		for _, call := range fakeContentStore.GetCalledDetails() {
+			if call.Name == "abort" {
+				aborted = append(aborted, call.Argument.(string))
+			}
+		}
+		assert.Equal(t, test.expectAborted, aborted)
+	}
+}
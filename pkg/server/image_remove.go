@@ -20,22 +20,26 @@ import (
 	"fmt"
 
 	"github.com/containerd/containerd/errdefs"
-	"github.com/golang/glog"
+	imagedigest "github.com/opencontainers/go-digest"
 	"golang.org/x/net/context"
 	"k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+
+	"github.com/kubernetes-incubator/cri-containerd/pkg/log"
 )
 
 // RemoveImage removes the image.
 // TODO(random-liu): Update CRI to pass image reference instead of ImageSpec. (See
 // kubernetes/kubernetes#46255)
 // TODO(random-liu): We should change CRI to distinguish image id and image spec.
-// Remove the whole image no matter the it's image id or reference. This is the
-// semantic defined in CRI now.
+// If the image is specified by image id, the whole image is removed. If it's specified
+// by repo tag or repo digest, only the reference is removed, and the whole image is
+// only removed when there is no repo tag left, so that the content shared by other
+// references is not removed.
 func (c *criContainerdService) RemoveImage(ctx context.Context, r *runtime.RemoveImageRequest) (retRes *runtime.RemoveImageResponse, retErr error) {
-	glog.V(2).Infof("RemoveImage %q", r.GetImage().GetImage())
+	log.G(ctx).V(2).Infof("RemoveImage %q", r.GetImage().GetImage())
 	defer func() {
 		if retErr == nil {
-			glog.V(2).Infof("RemoveImage %q returns successfully", r.GetImage().GetImage())
+			log.G(ctx).V(2).Infof("RemoveImage %q returns successfully", r.GetImage().GetImage())
 		}
 	}()
 	image, err := c.localResolve(ctx, r.GetImage().GetImage())
@@ -47,18 +51,48 @@ func (c *criContainerdService) RemoveImage(ctx context.Context, r *runtime.Remov
 		return &runtime.RemoveImageResponse{}, nil
 	}
 
+	if _, err := imagedigest.Parse(r.GetImage().GetImage()); err != nil {
+		// The image is specified by repo tag or repo digest. The reference is
+		// already verified by localResolve.
+		normalized, err := normalizeImageRef(r.GetImage().GetImage())
+		if err != nil {
+			return nil, fmt.Errorf("invalid image reference %q: %v", r.GetImage().GetImage(), err)
+		}
+		ref := normalized.String()
+		if err := c.deleteImageReference(ctx, ref); err != nil {
+			return nil, fmt.Errorf("failed to delete image reference %q for image %q: %v", ref, image.ID, err)
+		}
+		updated, err := c.imageStore.DeleteReference(image.ID, ref)
+		if err != nil {
+			return nil, fmt.Errorf("failed to delete reference %q of image %q: %v", ref, image.ID, err)
+		}
+		if len(updated.RepoTags) != 0 {
+			// The image is still referenced by other repo tags.
+			return &runtime.RemoveImageResponse{}, nil
+		}
+		image = &updated
+	}
+
 	// Include all image references, including RepoTag, RepoDigest and id.
 	for _, ref := range append(append(image.RepoTags, image.RepoDigests...), image.ID) {
-		// TODO(random-liu): Containerd should schedule a garbage collection immediately,
-		// and we may want to wait for the garbage collection to be over here.
-		// TODO(random-liu): Should check whether descriptor is as expected before delete,
-		// so as to avoid deleting new reference because of staled reference.
-		err = c.imageStoreService.Delete(ctx, ref)
-		if err == nil || errdefs.IsNotFound(err) {
-			continue
+		if err := c.deleteImageReference(ctx, ref); err != nil {
+			return nil, fmt.Errorf("failed to delete image reference %q for image %q: %v", ref, image.ID, err)
 		}
-		return nil, fmt.Errorf("failed to delete image reference %q for image %q: %v", ref, image.ID, err)
 	}
 	c.imageStore.Delete(image.ID)
 	return &runtime.RemoveImageResponse{}, nil
 }
+
+// deleteImageReference deletes the image reference from containerd image store. It
+// doesn't return error if the reference doesn't exist.
+func (c *criContainerdService) deleteImageReference(ctx context.Context, ref string) error {
+	// TODO(random-liu): Containerd should schedule a garbage collection immediately,
+	// and we may want to wait for the garbage collection to be over here.
+	// TODO(random-liu): Should check whether descriptor is as expected before delete,
+	// so as to avoid deleting new reference because of staled reference.
+	err := c.imageStoreService.Delete(ctx, ref)
+	if err == nil || errdefs.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
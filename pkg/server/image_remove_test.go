@@ -0,0 +1,144 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"testing"
+
+	containerdimages "github.com/containerd/containerd/images"
+	imagedigest "github.com/opencontainers/go-digest"
+	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+
+	servertesting "github.com/kubernetes-incubator/cri-containerd/pkg/server/testing"
+	imagestore "github.com/kubernetes-incubator/cri-containerd/pkg/store/image"
+)
+
+const (
+	testRemoveImageID    = "sha256:d848ce12891bf78792cda4a23c58984033b0c397a55e93a1556202222ecc5ed4"
+	testRemoveImageTag1  = "docker.io/library/busybox:1"
+	testRemoveImageTag2  = "docker.io/library/busybox:2"
+	testRemoveManifest   = "sha256:e6693c20186f837fc393390135d8a598a96a833917917789d63766cab6c59582"
+	testRemoveRepoDigest = "docker.io/library/busybox@" + testRemoveManifest
+)
+
+// newTestRemoveImageService creates a test service with an image tagged twice
+// in both cri-containerd and containerd.
+func newTestRemoveImageService(t *testing.T) (*criContainerdService, *servertesting.FakeImageStore) {
+	c := newTestCRIContainerdService()
+	fakeContentStore := servertesting.NewFakeContentStore()
+	fakeImageStore := servertesting.NewFakeImageStore()
+	c.contentStoreService = fakeContentStore
+	c.imageStoreService = fakeImageStore
+
+	manifest, err := json.Marshal(imagespec.Manifest{
+		Config: imagespec.Descriptor{
+			MediaType: imagespec.MediaTypeImageConfig,
+			Digest:    testRemoveImageID,
+		},
+	})
+	require.NoError(t, err)
+	fakeContentStore.SetFakeBlobs(map[imagedigest.Digest][]byte{testRemoveManifest: manifest})
+	target := imagespec.Descriptor{
+		MediaType: containerdimages.MediaTypeDockerSchema2Manifest,
+		Digest:    testRemoveManifest,
+		Size:      int64(len(manifest)),
+	}
+	var imgs []containerdimages.Image
+	for _, name := range []string{testRemoveImageTag1, testRemoveImageTag2, testRemoveRepoDigest, testRemoveImageID} {
+		imgs = append(imgs, containerdimages.Image{Name: name, Target: target})
+	}
+	fakeImageStore.SetFakeImages(imgs)
+	c.imageStore.Add(imagestore.Image{
+		ID:          testRemoveImageID,
+		RepoTags:    []string{testRemoveImageTag1, testRemoveImageTag2},
+		RepoDigests: []string{testRemoveRepoDigest},
+		Config:      &imagespec.ImageConfig{},
+	})
+	return c, fakeImageStore
+}
+
+// getImageStatus returns the image status of the image reference.
+func getImageStatus(t *testing.T, c *criContainerdService, ref string) *runtime.Image {
+	resp, err := c.ImageStatus(context.Background(), &runtime.ImageStatusRequest{
+		Image: &runtime.ImageSpec{Image: ref},
+	})
+	require.NoError(t, err)
+	return resp.GetImage()
+}
+
+func TestRemoveImageByRepoTag(t *testing.T) {
+	c, fakeImageStore := newTestRemoveImageService(t)
+
+	t.Logf("should only remove the requested repo tag")
+	_, err := c.RemoveImage(context.Background(), &runtime.RemoveImageRequest{
+		Image: &runtime.ImageSpec{Image: "busybox:1"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"get", "delete"}, fakeImageStore.GetCalledNames())
+	assert.Nil(t, getImageStatus(t, c, "busybox:1"))
+	image := getImageStatus(t, c, "busybox:2")
+	require.NotNil(t, image, "image should still be referenced by the other repo tag")
+	assert.Equal(t, testRemoveImageID, image.Id)
+	assert.Equal(t, []string{testRemoveImageTag2}, image.RepoTags)
+	assert.Equal(t, []string{testRemoveRepoDigest}, image.RepoDigests)
+	assert.NotNil(t, getImageStatus(t, c, testRemoveRepoDigest))
+	assert.NotNil(t, getImageStatus(t, c, testRemoveImageID))
+
+	t.Logf("should remove the whole image when the last repo tag is removed")
+	_, err = c.RemoveImage(context.Background(), &runtime.RemoveImageRequest{
+		Image: &runtime.ImageSpec{Image: "busybox:2"},
+	})
+	assert.NoError(t, err)
+	for _, ref := range []string{testRemoveImageTag2, testRemoveRepoDigest, testRemoveImageID} {
+		assert.Nil(t, getImageStatus(t, c, ref))
+	}
+	imgs, err := fakeImageStore.List(context.Background())
+	assert.NoError(t, err)
+	assert.Empty(t, imgs)
+}
+
+func TestRemoveImageByRepoDigest(t *testing.T) {
+	c, _ := newTestRemoveImageService(t)
+	_, err := c.RemoveImage(context.Background(), &runtime.RemoveImageRequest{
+		Image: &runtime.ImageSpec{Image: testRemoveRepoDigest},
+	})
+	assert.NoError(t, err)
+	assert.Nil(t, getImageStatus(t, c, testRemoveRepoDigest))
+	image := getImageStatus(t, c, testRemoveImageID)
+	require.NotNil(t, image, "image should still be referenced by repo tags")
+	assert.Len(t, image.RepoTags, 2)
+	assert.Empty(t, image.RepoDigests)
+}
+
+func TestRemoveImageByID(t *testing.T) {
+	c, fakeImageStore := newTestRemoveImageService(t)
+	_, err := c.RemoveImage(context.Background(), &runtime.RemoveImageRequest{
+		Image: &runtime.ImageSpec{Image: testRemoveImageID},
+	})
+	assert.NoError(t, err)
+	for _, ref := range []string{testRemoveImageTag1, testRemoveImageTag2, testRemoveRepoDigest, testRemoveImageID} {
+		assert.Nil(t, getImageStatus(t, c, ref))
+	}
+	imgs, err := fakeImageStore.List(context.Background())
+	assert.NoError(t, err)
+	assert.Empty(t, imgs)
+}
@@ -19,19 +19,20 @@ package server
 import (
 	"fmt"
 
-	"github.com/golang/glog"
 	"golang.org/x/net/context"
 	"k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+
+	"github.com/kubernetes-incubator/cri-containerd/pkg/log"
 )
 
 // ImageStatus returns the status of the image, returns nil if the image isn't present.
 // TODO(random-liu): We should change CRI to distinguish image id and image spec. (See
 // kubernetes/kubernetes#46255)
 func (c *criContainerdService) ImageStatus(ctx context.Context, r *runtime.ImageStatusRequest) (retRes *runtime.ImageStatusResponse, retErr error) {
-	glog.V(4).Infof("ImageStatus for image %q", r.GetImage().GetImage())
+	log.G(ctx).V(4).Infof("ImageStatus for image %q", r.GetImage().GetImage())
 	defer func() {
 		if retErr == nil {
-			glog.V(4).Infof("ImageStatus for %q returns image status %+v",
+			log.G(ctx).V(4).Infof("ImageStatus for %q returns image status %+v",
 				r.GetImage().GetImage(), retRes.GetImage())
 		}
 	}()
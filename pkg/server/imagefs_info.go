@@ -17,14 +17,65 @@ limitations under the License.
 package server
 
 import (
-	"errors"
+	"fmt"
+	"time"
 
 	"golang.org/x/net/context"
-
 	"k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+
+	"github.com/kubernetes-incubator/cri-containerd/pkg/log"
 )
 
 // ImageFsInfo returns information of the filesystem that is used to store images.
-func (c *criContainerdService) ImageFsInfo(ctx context.Context, r *runtime.ImageFsInfoRequest) (*runtime.ImageFsInfoResponse, error) {
-	return nil, errors.New("not implemented")
+func (c *criContainerdService) ImageFsInfo(ctx context.Context, r *runtime.ImageFsInfoRequest) (retRes *runtime.ImageFsInfoResponse, retErr error) {
+	log.G(ctx).V(4).Infof("ImageFsInfo")
+	defer func() {
+		if retErr == nil {
+			log.G(ctx).V(4).Infof("ImageFsInfo returns filesystem info %+v", retRes.GetImageFilesystems())
+		}
+	}()
+
+	usage, err := c.getImageFSUsage()
+	if err != nil {
+		return nil, err
+	}
+	return &runtime.ImageFsInfoResponse{ImageFilesystems: []*runtime.FilesystemUsage{usage}}, nil
+}
+
+// initImageFSPath sets the backing directory of the snapshotter in use, which is
+// the configured path if it's not empty, or the snapshotter directory under the
+// containerd root directory otherwise. The directory must exist, so that a wrong
+// containerd root directory or snapshotter is found at startup instead of when
+// ImageFsInfo is called.
+func (c *criContainerdService) initImageFSPath(path, containerdRootDir, snapshotter string) error {
+	if path == "" {
+		path = getImageFSPath(containerdRootDir, snapshotter)
+	}
+	if _, err := c.os.Stat(path); err != nil {
+		return fmt.Errorf("failed to stat image filesystem %q: %v", path, err)
+	}
+	c.imageFSPath = path
+	return nil
+}
+
+// getImageFSUsage returns the filesystem usage of the backing directory of the
+// snapshotter in use.
+func (c *criContainerdService) getImageFSUsage() (*runtime.FilesystemUsage, error) {
+	timestamp := time.Now().UnixNano()
+	stat, err := c.os.Statfs(c.imageFSPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to statfs image filesystem %q: %v", c.imageFSPath, err)
+	}
+	mountPoint, err := c.os.MountPoint(c.imageFSPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get mount point of image filesystem %q: %v", c.imageFSPath, err)
+	}
+	usedBytes := (stat.Blocks - stat.Bfree) * uint64(stat.Bsize)
+	inodesUsed := stat.Files - stat.Ffree
+	return &runtime.FilesystemUsage{
+		Timestamp:  timestamp,
+		StorageId:  &runtime.StorageIdentifier{Uuid: mountPoint},
+		UsedBytes:  &runtime.UInt64Value{Value: usedBytes},
+		InodesUsed: &runtime.UInt64Value{Value: inodesUsed},
+	}, nil
 }
@@ -0,0 +1,121 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"golang.org/x/sys/unix"
+	"k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+
+	ostesting "github.com/kubernetes-incubator/cri-containerd/pkg/os/testing"
+)
+
+func TestImageFsInfo(t *testing.T) {
+	c := newTestCRIContainerdService()
+	fakeOS := c.os.(*ostesting.FakeOS)
+	fakeOS.StatfsFn = func(path string) (unix.Statfs_t, error) {
+		assert.Equal(t, testImageFSPath, path)
+		return unix.Statfs_t{
+			Bsize:  4096,
+			Blocks: 100,
+			Bfree:  40,
+			Files:  50,
+			Ffree:  20,
+		}, nil
+	}
+	fakeOS.MountPointFn = func(path string) (string, error) {
+		assert.Equal(t, testImageFSPath, path)
+		return "/test/image", nil
+	}
+	resp, err := c.ImageFsInfo(context.Background(), &runtime.ImageFsInfoRequest{})
+	require.NoError(t, err)
+	require.Len(t, resp.GetImageFilesystems(), 1)
+	usage := resp.GetImageFilesystems()[0]
+	assert.NotZero(t, usage.GetTimestamp())
+	assert.Equal(t, "/test/image", usage.GetStorageId().GetUuid())
+	assert.EqualValues(t, 60*4096, usage.GetUsedBytes().GetValue())
+	assert.EqualValues(t, 30, usage.GetInodesUsed().GetValue())
+
+	t.Logf("should return error if statfs fails")
+	fakeOS.InjectError("Statfs", errors.New("random error"))
+	_, err = c.ImageFsInfo(context.Background(), &runtime.ImageFsInfoRequest{})
+	assert.Error(t, err)
+}
+
+func TestGetImageFSPath(t *testing.T) {
+	for desc, test := range map[string]struct {
+		snapshotter string
+		expected    string
+	}{
+		"should return the directory of the snapshotter": {
+			snapshotter: "btrfs",
+			expected:    "/var/lib/containerd/io.containerd.snapshotter.v1.btrfs",
+		},
+		"should return the directory of the default snapshotter if snapshotter is not set": {
+			expected: "/var/lib/containerd/io.containerd.snapshotter.v1.overlayfs",
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		assert.Equal(t, test.expected, getImageFSPath("/var/lib/containerd", test.snapshotter))
+	}
+}
+
+func TestInitImageFSPath(t *testing.T) {
+	for desc, test := range map[string]struct {
+		path      string
+		statErr   error
+		expected  string
+		expectErr bool
+	}{
+		"should use the snapshotter directory if path is not set": {
+			expected: "/var/lib/containerd/io.containerd.snapshotter.v1.overlayfs",
+		},
+		"should use the configured path": {
+			path:     "/test/image/fs",
+			expected: "/test/image/fs",
+		},
+		"should return error if the path doesn't exist": {
+			statErr:   os.ErrNotExist,
+			expectErr: true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		c := newTestCRIContainerdService()
+		c.imageFSPath = ""
+		fakeOS := c.os.(*ostesting.FakeOS)
+		var statPath string
+		fakeOS.StatFn = func(path string) (os.FileInfo, error) {
+			statPath = path
+			return nil, test.statErr
+		}
+		err := c.initImageFSPath(test.path, "/var/lib/containerd", "")
+		if test.expectErr {
+			assert.Error(t, err)
+			assert.Empty(t, c.imageFSPath)
+			continue
+		}
+		assert.NoError(t, err)
+		assert.Equal(t, test.expected, statPath)
+		assert.Equal(t, test.expected, c.imageFSPath)
+	}
+}
@@ -0,0 +1,194 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package io
+
+import (
+	"errors"
+	"io"
+	"strconv"
+	"sync"
+
+	"github.com/kubernetes-incubator/cri-containerd/pkg/log"
+)
+
+// AttachOptions specifies how to attach to a container.
+type AttachOptions struct {
+	Stdin  io.Reader
+	Stdout io.WriteCloser
+	Stderr io.WriteCloser
+	Tty    bool
+	// StdinOnce indicates that the container stdin should be closed once the
+	// attached stdin is closed.
+	StdinOnce bool
+}
+
+// ContainerIO holds the stdio of a container. The container output is
+// broadcasted to all outputs added, e.g. the container logger and attached
+// clients.
+type ContainerIO struct {
+	id string
+
+	mu        sync.Mutex
+	stdin     io.WriteCloser
+	stdout    *writerGroup
+	stderr    *writerGroup
+	attachIdx int
+}
+
+// NewContainerIO creates a ContainerIO for the container.
+func NewContainerIO(id string) *ContainerIO {
+	return &ContainerIO{
+		id:     id,
+		stdout: newWriterGroup(),
+		stderr: newWriterGroup(),
+	}
+}
+
+// Pipe starts redirecting the container stdio pipes. stdin should be nil if stdin
+// is not enabled for the container, and stderr should be nil if tty is enabled.
+func (c *ContainerIO) Pipe(stdin io.WriteCloser, stdout, stderr io.ReadCloser) {
+	c.mu.Lock()
+	c.stdin = stdin
+	c.mu.Unlock()
+	for _, p := range []struct {
+		name  string
+		r     io.ReadCloser
+		group *writerGroup
+	}{
+		{"stdout", stdout, c.stdout},
+		{"stderr", stderr, c.stderr},
+	} {
+		if p.r == nil {
+			p.group.Close()
+			continue
+		}
+		go func(name string, r io.ReadCloser, group *writerGroup) {
+			if _, err := io.Copy(group, r); err != nil {
+				log.L.Errorf("Failed to redirect %s of container %q: %v", name, c.id, err)
+			}
+			r.Close()
+			group.Close()
+		}(p.name, p.r, p.group)
+	}
+}
+
+// AddOutput adds writers for container stdout and stderr. The writers are
+// closed when the corresponding stream ends. Nil writer is ignored.
+func (c *ContainerIO) AddOutput(name string, stdout, stderr io.WriteCloser) {
+	if stdout != nil {
+		c.stdout.Add(name, stdout)
+	}
+	if stderr != nil {
+		c.stderr.Add(name, stderr)
+	}
+}
+
+// RemoveOutput removes the writers added with the name, and closes them.
+func (c *ContainerIO) RemoveOutput(name string) {
+	c.stdout.Remove(name)
+	c.stderr.Remove(name)
+}
+
+// Attach attaches the streams to the container stdio. It returns when the
+// container output ends, the client fails to receive output, or the client
+// closes stdin while StdinOnce is not set.
+func (c *ContainerIO) Attach(opts AttachOptions) error {
+	c.mu.Lock()
+	stdin := c.stdin
+	c.attachIdx++
+	name := "attach-" + strconv.Itoa(c.attachIdx)
+	c.mu.Unlock()
+	if opts.Stdin != nil && stdin == nil {
+		return errors.New("stdin is not enabled for the container")
+	}
+
+	stdinDone := make(chan struct{})
+	if opts.Stdin != nil {
+		go func() {
+			if _, err := io.Copy(stdin, opts.Stdin); err != nil {
+				log.L.Errorf("Failed to redirect attached stdin to container %q: %v", c.id, err)
+			}
+			if opts.StdinOnce {
+				stdin.Close()
+			}
+			close(stdinDone)
+		}()
+	}
+
+	var outputs []<-chan struct{}
+	wrap := func(w io.WriteCloser) io.WriteCloser {
+		if w == nil {
+			return nil
+		}
+		n := newNotifyWriteCloser(w)
+		outputs = append(outputs, n.done)
+		return n
+	}
+	stdout := wrap(opts.Stdout)
+	var stderr io.WriteCloser
+	if !opts.Tty {
+		// Stderr is merged into stdout when tty is enabled.
+		stderr = wrap(opts.Stderr)
+	}
+	c.AddOutput(name, stdout, stderr)
+	defer c.RemoveOutput(name)
+
+	if len(outputs) == 0 {
+		if opts.Stdin != nil {
+			<-stdinDone
+		}
+		return nil
+	}
+	allOutputsDone := make(chan struct{})
+	go func() {
+		for _, done := range outputs {
+			<-done
+		}
+		close(allOutputsDone)
+	}()
+	// Only detach on stdin close if the container stdin is not closed with it,
+	// otherwise wait for the container to finish output.
+	var detach <-chan struct{}
+	if opts.Stdin != nil && !opts.StdinOnce {
+		detach = stdinDone
+	}
+	select {
+	case <-allOutputsDone:
+	case <-detach:
+	}
+	return nil
+}
+
+// notifyWriteCloser closes the done channel when it is closed.
+type notifyWriteCloser struct {
+	io.WriteCloser
+	once sync.Once
+	done chan struct{}
+}
+
+func newNotifyWriteCloser(w io.WriteCloser) *notifyWriteCloser {
+	return &notifyWriteCloser{WriteCloser: w, done: make(chan struct{})}
+}
+
+func (n *notifyWriteCloser) Close() error {
+	var err error
+	n.once.Do(func() {
+		err = n.WriteCloser.Close()
+		close(n.done)
+	})
+	return err
+}
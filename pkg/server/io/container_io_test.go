@@ -0,0 +1,188 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package io
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeCloserBuffer is a thread-safe buffer with a fake Close.
+type writeCloserBuffer struct {
+	sync.Mutex
+	buf    bytes.Buffer
+	err    error
+	closed bool
+}
+
+func (w *writeCloserBuffer) Write(p []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+	if w.err != nil {
+		return 0, w.err
+	}
+	return w.buf.Write(p)
+}
+
+func (w *writeCloserBuffer) Close() error {
+	w.Lock()
+	defer w.Unlock()
+	w.closed = true
+	return nil
+}
+
+func (w *writeCloserBuffer) String() string {
+	w.Lock()
+	defer w.Unlock()
+	return w.buf.String()
+}
+
+func (w *writeCloserBuffer) Closed() bool {
+	w.Lock()
+	defer w.Unlock()
+	return w.closed
+}
+
+func TestWriterGroup(t *testing.T) {
+	g := newWriterGroup()
+	w1, w2 := &writeCloserBuffer{}, &writeCloserBuffer{err: errors.New("random error")}
+	g.Add("w1", w1)
+	g.Add("w2", w2)
+	n, err := g.Write([]byte("test"))
+	assert.NoError(t, err)
+	assert.Equal(t, 4, n)
+	assert.Equal(t, "test", w1.String())
+	assert.False(t, w1.Closed())
+	assert.True(t, w2.Closed(), "writer failed to write should be closed")
+
+	g.Remove("w1")
+	assert.True(t, w1.Closed())
+	_, err = g.Write([]byte("test"))
+	assert.NoError(t, err, "should not fail without writer")
+
+	g.Close()
+	w3 := &writeCloserBuffer{}
+	g.Add("w3", w3)
+	assert.True(t, w3.Closed(), "writer added after close should be closed")
+}
+
+func TestContainerIOAttach(t *testing.T) {
+	for desc, test := range map[string]struct {
+		stdinEnabled bool
+		attachStdin  bool
+		tty          bool
+		expectErr    bool
+	}{
+		"should redirect stdout and stderr": {},
+		"should merge stderr into stdout with tty": {
+			tty: true,
+		},
+		"should redirect stdin": {
+			stdinEnabled: true,
+			attachStdin:  true,
+		},
+		"should return error if stdin is not enabled": {
+			attachStdin: true,
+			expectErr:   true,
+		},
+	} {
+		c := NewContainerIO("test-id")
+		stdoutR, stdoutW := io.Pipe()
+		stderrR, stderrW := io.Pipe()
+		stdinPipe := &writeCloserBuffer{}
+		var containerStdin io.WriteCloser
+		if test.stdinEnabled {
+			containerStdin = stdinPipe
+		}
+		var containerStderr io.ReadCloser = stderrR
+		if test.tty {
+			containerStderr = nil
+		}
+		c.Pipe(containerStdin, stdoutR, containerStderr)
+
+		stdout, stderr := &writeCloserBuffer{}, &writeCloserBuffer{}
+		opts := AttachOptions{Stdout: stdout, Stderr: stderr, Tty: test.tty, StdinOnce: true}
+		if test.attachStdin {
+			opts.Stdin = bytes.NewBufferString("test-stdin")
+		}
+		errCh := make(chan error, 1)
+		go func() { errCh <- c.Attach(opts) }()
+		if test.expectErr {
+			assert.Error(t, <-errCh, desc)
+			continue
+		}
+		// Wait for the attach to be added.
+		require.NoError(t, waitFor(func() bool {
+			c.stdout.mu.Lock()
+			defer c.stdout.mu.Unlock()
+			return len(c.stdout.writers) > 0
+		}), desc)
+		_, err := stdoutW.Write([]byte("test-stdout"))
+		assert.NoError(t, err, desc)
+		stdoutW.Close()
+		if !test.tty {
+			_, err = stderrW.Write([]byte("test-stderr"))
+			assert.NoError(t, err, desc)
+			stderrW.Close()
+		}
+		assert.NoError(t, <-errCh, desc)
+		assert.Equal(t, "test-stdout", stdout.String(), desc)
+		if !test.tty {
+			assert.Equal(t, "test-stderr", stderr.String(), desc)
+		} else {
+			assert.Empty(t, stderr.String(), desc)
+		}
+		if test.attachStdin {
+			assert.NoError(t, waitFor(stdinPipe.Closed), "container stdin should be closed with StdinOnce")
+			assert.Equal(t, "test-stdin", stdinPipe.String(), desc)
+		}
+	}
+}
+
+// waitFor waits for the condition to be true.
+func waitFor(condition func() bool) error {
+	for i := 0; i < 100; i++ {
+		if condition() {
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return errors.New("timeout waiting for condition")
+}
+
+func TestContainerIOOutputWithoutAttach(t *testing.T) {
+	c := NewContainerIO("test-id")
+	stdoutR, stdoutW := io.Pipe()
+	logR, logW := io.Pipe()
+	c.AddOutput("log", logW, nil)
+	c.Pipe(nil, stdoutR, nil)
+	go func() {
+		stdoutW.Write([]byte("test-log")) // nolint: errcheck
+		stdoutW.Close()
+	}()
+	data, err := ioutil.ReadAll(logR)
+	assert.NoError(t, err)
+	assert.Equal(t, "test-log", string(data))
+}
@@ -0,0 +1,89 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package io
+
+import (
+	"io"
+	"sync"
+)
+
+// writerGroup is a group of writers. Data written into the group is written
+// into every writer in the group. A writer is closed and removed from the
+// group once it fails to write.
+type writerGroup struct {
+	mu      sync.Mutex
+	writers map[string]io.WriteCloser
+	closed  bool
+}
+
+func newWriterGroup() *writerGroup {
+	return &writerGroup{writers: make(map[string]io.WriteCloser)}
+}
+
+// Write writes data into all writers in the group. It never returns error, so
+// that the source is always drained even if there is no writer.
+func (g *writerGroup) Write(p []byte) (int, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for k, w := range g.writers {
+		n, err := w.Write(p)
+		if err == nil && n == len(p) {
+			continue
+		}
+		w.Close()
+		delete(g.writers, k)
+	}
+	return len(p), nil
+}
+
+// Add adds a writer into the group. The writer is closed immediately if the
+// group is already closed. An existing writer with the same key is replaced
+// and closed.
+func (g *writerGroup) Add(key string, w io.WriteCloser) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closed {
+		w.Close()
+		return
+	}
+	if old, ok := g.writers[key]; ok {
+		old.Close()
+	}
+	g.writers[key] = w
+}
+
+// Remove removes the writer from the group and closes it.
+func (g *writerGroup) Remove(key string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if w, ok := g.writers[key]; ok {
+		w.Close()
+		delete(g.writers, key)
+	}
+}
+
+// Close closes all writers in the group, writers added later are closed
+// immediately.
+func (g *writerGroup) Close() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, w := range g.writers {
+		w.Close()
+	}
+	g.writers = make(map[string]io.WriteCloser)
+	g.closed = true
+}
@@ -0,0 +1,55 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"path"
+
+	"github.com/docker/docker/pkg/stringid"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	"github.com/kubernetes-incubator/cri-containerd/pkg/log"
+)
+
+// newRequestID generates a short unique id for a CRI request.
+func newRequestID() string {
+	return stringid.TruncateID(generateID())
+}
+
+// withRequestLogger generates a request id, and returns a context carrying a
+// logger with the request id, the operation, the sandbox id and the container
+// id of the CRI request, so that all logs of the request have consistent fields
+// and could be correlated. The request id is also returned.
+func withRequestLogger(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo) (context.Context, string) {
+	id := newRequestID()
+	fields := log.Fields{
+		log.RequestIDKey: id,
+		log.OperationKey: path.Base(info.FullMethod),
+	}
+	if r, ok := req.(interface {
+		GetPodSandboxId() string
+	}); ok && r.GetPodSandboxId() != "" {
+		fields[log.SandboxIDKey] = r.GetPodSandboxId()
+	}
+	if r, ok := req.(interface {
+		GetContainerId() string
+	}); ok && r.GetContainerId() != "" {
+		fields[log.ContainerIDKey] = r.GetContainerId()
+	}
+	return log.WithFields(ctx, fields), id
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+
+	"github.com/kubernetes-incubator/cri-containerd/pkg/log"
+	logtesting "github.com/kubernetes-incubator/cri-containerd/pkg/log/testing"
+	"github.com/kubernetes-incubator/cri-containerd/pkg/store"
+)
+
+func TestRequestLogger(t *testing.T) {
+	for desc, test := range map[string]struct {
+		method   string
+		req      interface{}
+		expected log.Fields
+	}{
+		"request without ids": {
+			method:   "/runtime.RuntimeService/ListContainers",
+			req:      &runtime.ListContainersRequest{},
+			expected: log.Fields{log.OperationKey: "ListContainers"},
+		},
+		"container request": {
+			method: "/runtime.RuntimeService/StartContainer",
+			req:    &runtime.StartContainerRequest{ContainerId: "test-id"},
+			expected: log.Fields{
+				log.OperationKey:   "StartContainer",
+				log.ContainerIDKey: "test-id",
+			},
+		},
+		"sandbox request": {
+			method: "/runtime.RuntimeService/StopPodSandbox",
+			req:    &runtime.StopPodSandboxRequest{PodSandboxId: "test-sandbox-id"},
+			expected: log.Fields{
+				log.OperationKey: "StopPodSandbox",
+				log.SandboxIDKey: "test-sandbox-id",
+			},
+		},
+		"request with both sandbox and container": {
+			method: "/runtime.RuntimeService/CreateContainer",
+			req:    &runtime.CreateContainerRequest{PodSandboxId: "test-sandbox-id"},
+			expected: log.Fields{
+				log.OperationKey: "CreateContainer",
+				log.SandboxIDKey: "test-sandbox-id",
+			},
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		c := newTestCRIContainerdService()
+		fakeLogger := logtesting.NewFakeLogger()
+		ctx := log.WithLogger(context.Background(), fakeLogger)
+		_, err := c.unaryInterceptor(ctx, test.req, &grpc.UnaryServerInfo{FullMethod: test.method},
+			func(ctx context.Context, req interface{}) (interface{}, error) {
+				log.G(ctx).V(2).Infof("handling request")
+				return nil, nil
+			})
+		assert.NoError(t, err)
+		entries := fakeLogger.GetEntries()
+		if assert.Len(t, entries, 1) {
+			assert.Equal(t, "handling request", entries[0].Message)
+			fields := log.Fields{}
+			for k, v := range entries[0].Fields {
+				fields[k] = v
+			}
+			assert.NotEmpty(t, fields[log.RequestIDKey], "request id should be set")
+			delete(fields, log.RequestIDKey)
+			assert.Equal(t, test.expected, fields)
+		}
+	}
+}
+
+func TestRequestIDInErrorAndLogs(t *testing.T) {
+	c := newTestCRIContainerdService()
+	fakeLogger := logtesting.NewFakeLogger()
+	ctx := log.WithLogger(context.Background(), fakeLogger)
+	info := &grpc.UnaryServerInfo{FullMethod: "/runtime.RuntimeService/ContainerStatus"}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		log.G(ctx).Errorf("failed to get container")
+		return nil, wrapGRPCError(store.ErrNotExist, "an error occurred when try to find container %q", "test-id")
+	}
+	var ids []string
+	for i := 0; i < 2; i++ {
+		_, err := c.unaryInterceptor(ctx, &runtime.ContainerStatusRequest{ContainerId: "test-id"}, info, handler)
+		require.Error(t, err)
+		entries := fakeLogger.GetEntries()
+		require.Len(t, entries, i+1)
+		id, ok := entries[i].Fields[log.RequestIDKey].(string)
+		require.True(t, ok)
+		assert.Equal(t, codes.NotFound, grpc.Code(err), "grpc code should be kept")
+		assert.Contains(t, grpc.ErrorDesc(err), "(request id: "+id+")")
+		ids = append(ids, id)
+	}
+	assert.NotEqual(t, ids[0], ids[1], "each request should have a unique request id")
+}
@@ -0,0 +1,134 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"path"
+	"reflect"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+)
+
+// defaultOperationTimeouts are the default timeouts of CRI operations which
+// don't use the configured default operation timeout. 0 means no timeout.
+var defaultOperationTimeouts = map[string]time.Duration{
+	// Pulling large images may take a long time.
+	"PullImage": 30 * time.Minute,
+	// ExecSync is bounded by the timeout in the request.
+	"ExecSync": 0,
+	// StopContainer is bounded by the grace period in the request.
+	"StopContainer": 0,
+	// Mutating sandbox and container operations are not given a timeout, because
+	// cancelling them halfway leaves resources behind which need to be cleaned up
+	// with the same cancelled context.
+	"RunPodSandbox":    0,
+	"StopPodSandbox":   0,
+	"RemovePodSandbox": 0,
+	"CreateContainer":  0,
+	"StartContainer":   0,
+	"RemoveContainer":  0,
+}
+
+// isCRIOperation checks whether the operation is a method of the CRI runtime
+// or image service.
+func isCRIOperation(op string) bool {
+	for _, t := range []reflect.Type{
+		reflect.TypeOf((*runtime.RuntimeServiceServer)(nil)).Elem(),
+		reflect.TypeOf((*runtime.ImageServiceServer)(nil)).Elem(),
+	} {
+		if _, ok := t.MethodByName(op); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// parseOperationTimeouts parses operation timeouts in the format of
+// "<operation>=<duration>", e.g. "PullImage=1h", and merges them with the
+// default operation timeouts. The operation must be a CRI method.
+func parseOperationTimeouts(timeouts []string) (map[string]time.Duration, error) {
+	result := make(map[string]time.Duration)
+	for op, timeout := range defaultOperationTimeouts {
+		result[op] = timeout
+	}
+	seen := make(map[string]bool)
+	for _, t := range timeouts {
+		parts := strings.SplitN(t, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid operation timeout %q", t)
+		}
+		if !isCRIOperation(parts[0]) {
+			return nil, fmt.Errorf("unknown operation %q", parts[0])
+		}
+		if seen[parts[0]] {
+			return nil, fmt.Errorf("duplicated operation timeout %q", parts[0])
+		}
+		seen[parts[0]] = true
+		timeout, err := time.ParseDuration(parts[1])
+		if err != nil || timeout < 0 {
+			return nil, fmt.Errorf("invalid timeout %q of operation %q", parts[1], parts[0])
+		}
+		result[parts[0]] = timeout
+	}
+	return result, nil
+}
+
+// getOperationTimeout returns the timeout of the operation, e.g. "PullImage".
+func (c *criContainerdService) getOperationTimeout(op string) time.Duration {
+	if timeout, ok := c.operationTimeouts[op]; ok {
+		return timeout
+	}
+	return c.config.DefaultOperationTimeout
+}
+
+// withOperationTimeout runs the grpc handler with a context bounded by the
+// operation timeout. If the deadline is exceeded, the error is returned with
+// the DeadlineExceeded code.
+func (c *criContainerdService) withOperationTimeout(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+	op := path.Base(info.FullMethod)
+	timeout := c.getOperationTimeout(op)
+	if timeout <= 0 {
+		return handler(ctx, req)
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	resp, err := handler(ctx, req)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return nil, grpc.Errorf(codes.DeadlineExceeded, "%s exceeded deadline %v: %v", op, timeout, grpc.ErrorDesc(err))
+	}
+	return resp, err
+}
+
+// unaryInterceptor is the grpc unary interceptor of the service. It attaches
+// a request logger to the context, tracks the request for graceful shutdown,
+// enforces the operation timeout, and converts returned errors into grpc
+// errors with proper codes and the request id.
+func (c *criContainerdService) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, id := withRequestLogger(ctx, req, info)
+	resp, err := c.requestTracker.unaryInterceptor(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return c.withOperationTimeout(ctx, req, info, handler)
+	})
+	return resp, withRequestID(toGRPCError(err), id)
+}
@@ -0,0 +1,139 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+func TestParseOperationTimeouts(t *testing.T) {
+	for desc, test := range map[string]struct {
+		timeouts  []string
+		expected  map[string]time.Duration
+		expectErr bool
+	}{
+		"should return default timeouts": {
+			expected: defaultOperationTimeouts,
+		},
+		"should override default timeouts": {
+			timeouts: []string{"PullImage=1h", "RunPodSandbox=10s", "ExecSync=5m"},
+			expected: map[string]time.Duration{
+				"PullImage":        time.Hour,
+				"RunPodSandbox":    10 * time.Second,
+				"ExecSync":         5 * time.Minute,
+				"StopContainer":    0,
+				"StopPodSandbox":   0,
+				"RemovePodSandbox": 0,
+				"CreateContainer":  0,
+				"StartContainer":   0,
+				"RemoveContainer":  0,
+			},
+		},
+		"should return error for unknown operation": {
+			timeouts:  []string{"PulImage=1h"},
+			expectErr: true,
+		},
+		"should return error for invalid format": {
+			timeouts:  []string{"PullImage"},
+			expectErr: true,
+		},
+		"should return error for invalid duration": {
+			timeouts:  []string{"PullImage=invalid"},
+			expectErr: true,
+		},
+		"should return error for negative duration": {
+			timeouts:  []string{"PullImage=-1s"},
+			expectErr: true,
+		},
+		"should return error for duplicated operation": {
+			timeouts:  []string{"PullImage=1h", "PullImage=2h"},
+			expectErr: true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		timeouts, err := parseOperationTimeouts(test.timeouts)
+		if test.expectErr {
+			assert.Error(t, err)
+			continue
+		}
+		assert.NoError(t, err)
+		assert.Equal(t, test.expected, timeouts)
+	}
+}
+
+func TestDefaultOperationTimeoutsAreCRIOperations(t *testing.T) {
+	for op := range defaultOperationTimeouts {
+		assert.True(t, isCRIOperation(op), op)
+	}
+	assert.True(t, isCRIOperation("ListImages"), "image service operation should be a CRI operation")
+}
+
+func TestWithOperationTimeout(t *testing.T) {
+	for desc, test := range map[string]struct {
+		method         string
+		expectDeadline bool
+		block          bool
+		expectCode     codes.Code
+	}{
+		"should set deadline with default timeout": {
+			method:         "/runtime.RuntimeService/ListPodSandbox",
+			expectDeadline: true,
+			expectCode:     codes.OK,
+		},
+		"should not set deadline for operation without timeout": {
+			method:     "/runtime.RuntimeService/ExecSync",
+			expectCode: codes.OK,
+		},
+		"should not set deadline for mutating sandbox operation by default": {
+			method:     "/runtime.RuntimeService/StopPodSandbox",
+			expectCode: codes.OK,
+		},
+		"should not set deadline for mutating container operation by default": {
+			method:     "/runtime.RuntimeService/CreateContainer",
+			expectCode: codes.OK,
+		},
+		"should return DeadlineExceeded if deadline is exceeded": {
+			method:         "/runtime.RuntimeService/ListPodSandbox",
+			expectDeadline: true,
+			block:          true,
+			expectCode:     codes.DeadlineExceeded,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		c := newTestCRIContainerdService()
+		c.config.DefaultOperationTimeout = 10 * time.Millisecond
+		c.operationTimeouts = defaultOperationTimeouts
+		_, err := c.withOperationTimeout(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: test.method},
+			func(ctx context.Context, req interface{}) (interface{}, error) {
+				_, ok := ctx.Deadline()
+				assert.Equal(t, test.expectDeadline, ok)
+				if test.block {
+					<-ctx.Done()
+					return nil, errors.New("operation is cancelled")
+				}
+				return nil, nil
+			})
+		assert.Equal(t, test.expectCode, grpc.Code(err))
+	}
+}
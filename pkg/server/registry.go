@@ -0,0 +1,378 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/docker/distribution/reference"
+	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+
+	"github.com/kubernetes-incubator/cri-containerd/pkg/log"
+)
+
+const (
+	// registryCACertFile is the CA certificate file name in the certs directory
+	// of a registry.
+	registryCACertFile = "ca.crt"
+	// registryClientCertFile is the client certificate file name in the certs
+	// directory of a registry.
+	registryClientCertFile = "client.cert"
+	// registryClientKeyFile is the client key file name in the certs directory
+	// of a registry.
+	registryClientKeyFile = "client.key"
+)
+
+// registryEndpoint is an endpoint which serves images of a registry.
+type registryEndpoint struct {
+	// host is the host (and port) of the endpoint.
+	host string
+	// plainHTTP indicates to use plain http instead of https.
+	plainHTTP bool
+}
+
+// String returns the endpoint in url format.
+func (e registryEndpoint) String() string {
+	if e.plainHTTP {
+		return "http://" + e.host
+	}
+	return "https://" + e.host
+}
+
+// parseRegistryEndpoint parses a registry endpoint, e.g. "https://mirror.gcr.io" or
+// "http://localhost:5000". Https is used if scheme is not specified.
+func parseRegistryEndpoint(endpoint string) (registryEndpoint, error) {
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "https://" + endpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return registryEndpoint{}, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return registryEndpoint{}, fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return registryEndpoint{}, fmt.Errorf("empty host")
+	}
+	if u.Path != "" && u.Path != "/" {
+		return registryEndpoint{}, fmt.Errorf("path %q is not supported", u.Path)
+	}
+	return registryEndpoint{host: u.Host, plainHTTP: u.Scheme == "http"}, nil
+}
+
+// parseRegistryMirrors parses registry mirrors in the format of "<registry host>=<endpoint>",
+// e.g. "docker.io=https://mirror.gcr.io". A registry could have multiple mirrors, which are
+// tried in the specified order.
+func parseRegistryMirrors(mirrors []string) (map[string][]registryEndpoint, error) {
+	endpoints := make(map[string][]registryEndpoint)
+	for _, mirror := range mirrors {
+		parts := strings.SplitN(mirror, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid registry mirror %q", mirror)
+		}
+		endpoint, err := parseRegistryEndpoint(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid endpoint of registry mirror %q: %v", mirror, err)
+		}
+		endpoints[parts[0]] = append(endpoints[parts[0]], endpoint)
+	}
+	return endpoints, nil
+}
+
+// registryCandidate is an image reference to resolve and fetch an image from,
+// with the endpoint it's served by.
+type registryCandidate struct {
+	// ref is the image reference pointing to the endpoint.
+	ref string
+	// host is the host (and port) of the endpoint.
+	host string
+	// endpoint is the endpoint serving the image.
+	endpoint string
+	// plainHTTP indicates to use plain http instead of https.
+	plainHTTP bool
+	// mirror indicates the endpoint is a mirror of the image registry.
+	mirror bool
+}
+
+// getRegistryCandidates returns the image references to try in order when pulling an
+// image, which are the configured mirrors of the image registry followed by the
+// canonical registry.
+func (c *criContainerdService) getRegistryCandidates(namedRef reference.Named) []registryCandidate {
+	ref := namedRef.String()
+	domain := reference.Domain(namedRef)
+	var candidates []registryCandidate
+	for _, endpoint := range c.registryMirrors[domain] {
+		candidates = append(candidates, registryCandidate{
+			ref:       endpoint.host + strings.TrimPrefix(ref, domain),
+			host:      endpoint.host,
+			endpoint:  endpoint.String(),
+			plainHTTP: endpoint.plainHTTP || c.isInsecureRegistry(endpoint.host),
+			mirror:    true,
+		})
+	}
+	return append(candidates, registryCandidate{
+		ref:       ref,
+		host:      domain,
+		endpoint:  domain,
+		plainHTTP: c.isInsecureRegistry(domain),
+	})
+}
+
+// isInsecureRegistry checks whether the registry host should be contacted over plain http.
+func (c *criContainerdService) isInsecureRegistry(host string) bool {
+	for _, h := range c.config.InsecureRegistries {
+		if h == host {
+			return true
+		}
+	}
+	return false
+}
+
+// isRegistryTLSSkipVerify checks whether to skip verifying certificates of the registry host.
+func (c *criContainerdService) isRegistryTLSSkipVerify(host string) bool {
+	for _, h := range c.config.RegistryTLSSkipVerify {
+		if h == host {
+			return true
+		}
+	}
+	return false
+}
+
+// getRegistryTLSConfig returns the tls config of the registry host. Certificates are
+// loaded from the certs directory "<registry certs dir>/<host>", which could contain
+// the CA certificate "ca.crt", and the client certificate "client.cert" with the client
+// key "client.key". It returns nil if there is no tls config specified for the host.
+func (c *criContainerdService) getRegistryTLSConfig(host string) (*tls.Config, error) {
+	var tlsConfig *tls.Config
+	if c.isRegistryTLSSkipVerify(host) {
+		tlsConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	if c.config.RegistryCertsDir == "" {
+		return tlsConfig, nil
+	}
+	dir := filepath.Join(c.config.RegistryCertsDir, host)
+	if _, err := os.Stat(dir); err != nil {
+		if os.IsNotExist(err) {
+			return tlsConfig, nil
+		}
+		return nil, fmt.Errorf("failed to stat certs directory %q: %v", dir, err)
+	}
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	caCert, err := ioutil.ReadFile(filepath.Join(dir, registryCACertFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read CA certificate: %v", err)
+	}
+	if err == nil {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get system cert pool: %v", err)
+		}
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("failed to parse CA certificate %q", filepath.Join(dir, registryCACertFile))
+		}
+		tlsConfig.RootCAs = pool
+	}
+	certFile := filepath.Join(dir, registryClientCertFile)
+	keyFile := filepath.Join(dir, registryClientKeyFile)
+	_, certErr := os.Stat(certFile)
+	_, keyErr := os.Stat(keyFile)
+	if os.IsNotExist(certErr) && os.IsNotExist(keyErr) {
+		return tlsConfig, nil
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load client certificate: %v", err)
+	}
+	tlsConfig.Certificates = []tls.Certificate{cert}
+	return tlsConfig, nil
+}
+
+// getRegistryHTTPClient returns the http client used to contact the registry host. A
+// separate transport is created for each host with tls config, so that the tls config
+// of one host is never used for another.
+func (c *criContainerdService) getRegistryHTTPClient(host string) (*http.Client, error) {
+	tlsConfig, err := c.getRegistryTLSConfig(host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tls config: %v", err)
+	}
+	if tlsConfig == nil {
+		return http.DefaultClient, nil
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   30 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			TLSClientConfig:     tlsConfig,
+			TLSHandshakeTimeout: 10 * time.Second,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}, nil
+}
+
+// resolveImage resolves the image reference and returns the descriptor and fetcher of
+// the image. The mirror endpoints of the image registry are tried in order before the
+// canonical registry, the next one is tried if the current one fails. The final error
+// contains the failure of each endpoint tried, and it's unauthenticated grpc error if
+// any endpoint rejects the credentials.
+func (c *criContainerdService) resolveImage(ctx context.Context, namedRef reference.Named,
+	auth *runtime.AuthConfig) (imagespec.Descriptor, remotes.Fetcher, error) {
+	username, secret, err := ParseAuth(auth)
+	if err != nil {
+		return imagespec.Descriptor{}, nil, fmt.Errorf("failed to parse auth config: %v", err)
+	}
+	var registryToken string
+	if username == "" && secret == "" {
+		registryToken = auth.GetRegistryToken()
+	}
+	var errs []string
+	unauthenticated := false
+	for _, candidate := range c.getRegistryCandidates(namedRef) {
+		desc, fetcher, err := c.resolveImageFromCandidate(ctx, namedRef, candidate, username, secret, registryToken)
+		if err == nil {
+			return desc, fetcher, nil
+		}
+		if ctx.Err() != nil {
+			return imagespec.Descriptor{}, nil, fmt.Errorf("image resolving is cancelled: %v", ctx.Err())
+		}
+		log.G(ctx).V(4).Infof("Failed to resolve ref %q from endpoint %q: %v", namedRef, candidate.endpoint, err)
+		if isUnauthenticatedError(err) {
+			unauthenticated = true
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v", candidate.endpoint, grpc.ErrorDesc(err)))
+	}
+	if unauthenticated {
+		return imagespec.Descriptor{}, nil, grpc.Errorf(codes.Unauthenticated, "all endpoints failed: [%s]",
+			strings.Join(errs, "; "))
+	}
+	return imagespec.Descriptor{}, nil, fmt.Errorf("all endpoints failed: [%s]", strings.Join(errs, "; "))
+}
+
+// resolveImageFromCandidate resolves the image reference and gets fetcher from a
+// single endpoint. It returns unauthenticated grpc error if the endpoint rejects
+// the credentials.
+// The credentials are issued for the image registry, so they are never sent to
+// mirrors, which are accessed anonymously.
+func (c *criContainerdService) resolveImageFromCandidate(ctx context.Context, namedRef reference.Named,
+	candidate registryCandidate, username, secret, registryToken string) (imagespec.Descriptor, remotes.Fetcher, error) {
+	if candidate.mirror {
+		username, secret, registryToken = "", "", ""
+	}
+	client, err := c.getRegistryHTTPClient(candidate.host)
+	if err != nil {
+		return imagespec.Descriptor{}, nil, fmt.Errorf("failed to get http client for %q: %v", candidate.host, err)
+	}
+	if registryToken != "" {
+		client = newRegistryTokenClient(client, candidate.host, registryToken)
+	}
+	resolver := docker.NewResolver(docker.ResolverOptions{
+		Credentials: func(string) (string, string, error) { return username, secret, nil },
+		PlainHTTP:   candidate.plainHTTP,
+		Client:      client,
+	})
+	_, desc, err := resolver.Resolve(ctx, candidate.ref)
+	if err != nil {
+		if isRegistryUnauthorizedError(err) {
+			return imagespec.Descriptor{}, nil, grpc.Errorf(codes.Unauthenticated, "failed to resolve ref %q: %v",
+				candidate.ref, err)
+		}
+		return imagespec.Descriptor{}, nil, fmt.Errorf("failed to resolve ref %q: %v", candidate.ref, err)
+	}
+	// Reject the endpoint if it returns content different from the requested digest,
+	// e.g. because of registry tampering or mirror inconsistency.
+	if err := verifyImageDigest(namedRef, desc.Digest); err != nil {
+		return imagespec.Descriptor{}, nil, fmt.Errorf("failed to verify digest of ref %q: %v", candidate.ref, err)
+	}
+	fetcher, err := resolver.Fetcher(ctx, candidate.ref)
+	if err != nil {
+		return imagespec.Descriptor{}, nil, fmt.Errorf("failed to get fetcher for ref %q: %v", candidate.ref, err)
+	}
+	return desc, fetcher, nil
+}
+
+// isRegistryUnauthorizedError checks whether an error returned by the docker resolver
+// means the credentials are rejected by the registry. The resolver doesn't return typed
+// error for unexpected status code, so the status in error message is checked.
+func isRegistryUnauthorizedError(err error) bool {
+	if errors.Cause(err) == docker.ErrInvalidAuthorization {
+		return true
+	}
+	return strings.Contains(err.Error(), http.StatusText(http.StatusUnauthorized))
+}
+
+// registryTokenTransport sets the registry token as bearer token of requests to the
+// registry, which are not authorized otherwise. Requests to other hosts, e.g. the
+// token server, never get the registry token.
+type registryTokenTransport struct {
+	host  string
+	token string
+	base  http.RoundTripper
+}
+
+// newRegistryTokenClient returns a http client sending the registry token to the
+// registry host, based on the transport of the client.
+func newRegistryTokenClient(client *http.Client, host, token string) *http.Client {
+	base := client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	// Docker resolver contacts "registry-1.docker.io" for "docker.io".
+	if host == "docker.io" {
+		host = "registry-1.docker.io"
+	}
+	return &http.Client{
+		Transport: &registryTokenTransport{host: host, token: token, base: base},
+	}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *registryTokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host != t.host || req.Header.Get("Authorization") != "" {
+		return t.base.RoundTrip(req)
+	}
+	// RoundTripper should not modify the request, copy it before setting the header.
+	newReq := new(http.Request)
+	*newReq = *req
+	newReq.Header = make(http.Header, len(req.Header))
+	for k, v := range req.Header {
+		newReq.Header[k] = append([]string(nil), v...)
+	}
+	newReq.Header.Set("Authorization", "Bearer "+t.token)
+	return t.base.RoundTrip(newReq)
+}
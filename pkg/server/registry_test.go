@@ -0,0 +1,470 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	imagedigest "github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+)
+
+func TestParseRegistryMirrors(t *testing.T) {
+	for desc, test := range map[string]struct {
+		mirrors   []string
+		expected  map[string][]registryEndpoint
+		expectErr bool
+	}{
+		"should return empty map for no mirrors": {
+			expected: map[string][]registryEndpoint{},
+		},
+		"should keep the order of mirrors of a registry": {
+			mirrors: []string{
+				"docker.io=https://mirror-1.example.com",
+				"gcr.io=mirror.example.com:5000",
+				"docker.io=http://mirror-2.example.com/",
+			},
+			expected: map[string][]registryEndpoint{
+				"docker.io": {
+					{host: "mirror-1.example.com"},
+					{host: "mirror-2.example.com", plainHTTP: true},
+				},
+				"gcr.io": {
+					{host: "mirror.example.com:5000"},
+				},
+			},
+		},
+		"should return error for mirror without registry": {
+			mirrors:   []string{"=https://mirror.example.com"},
+			expectErr: true,
+		},
+		"should return error for mirror without endpoint": {
+			mirrors:   []string{"docker.io"},
+			expectErr: true,
+		},
+		"should return error for unsupported scheme": {
+			mirrors:   []string{"docker.io=ftp://mirror.example.com"},
+			expectErr: true,
+		},
+		"should return error for endpoint with path": {
+			mirrors:   []string{"docker.io=https://mirror.example.com/v2"},
+			expectErr: true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		mirrors, err := parseRegistryMirrors(test.mirrors)
+		assert.Equal(t, test.expectErr, err != nil)
+		if !test.expectErr {
+			assert.Equal(t, test.expected, mirrors)
+		}
+	}
+}
+
+func TestGetRegistryCandidates(t *testing.T) {
+	c := newTestCRIContainerdService()
+	c.registryMirrors = map[string][]registryEndpoint{
+		"docker.io": {
+			{host: "mirror-1.example.com"},
+			{host: "localhost:5000", plainHTTP: true},
+		},
+	}
+	c.config.InsecureRegistries = []string{"insecure.example.com"}
+	for desc, test := range map[string]struct {
+		ref      string
+		expected []registryCandidate
+	}{
+		"should try mirrors before the registry": {
+			ref: "busybox",
+			expected: []registryCandidate{
+				{
+					ref:      "mirror-1.example.com/library/busybox:latest",
+					host:     "mirror-1.example.com",
+					endpoint: "https://mirror-1.example.com",
+					mirror:   true,
+				},
+				{
+					ref:       "localhost:5000/library/busybox:latest",
+					host:      "localhost:5000",
+					endpoint:  "http://localhost:5000",
+					plainHTTP: true,
+					mirror:    true,
+				},
+				{
+					ref:      "docker.io/library/busybox:latest",
+					host:     "docker.io",
+					endpoint: "docker.io",
+				},
+			},
+		},
+		"should only try the registry without mirrors": {
+			ref: "gcr.io/library/busybox@sha256:e6693c20186f837fc393390135d8a598a96a833917917789d63766cab6c59582",
+			expected: []registryCandidate{
+				{
+					ref:      "gcr.io/library/busybox@sha256:e6693c20186f837fc393390135d8a598a96a833917917789d63766cab6c59582",
+					host:     "gcr.io",
+					endpoint: "gcr.io",
+				},
+			},
+		},
+		"should use plain http for insecure registry": {
+			ref: "insecure.example.com/busybox:1.0",
+			expected: []registryCandidate{
+				{
+					ref:       "insecure.example.com/busybox:1.0",
+					host:      "insecure.example.com",
+					endpoint:  "insecure.example.com",
+					plainHTTP: true,
+				},
+			},
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		named, err := normalizeImageRef(test.ref)
+		require.NoError(t, err)
+		assert.Equal(t, test.expected, c.getRegistryCandidates(named))
+	}
+}
+
+// newFakeRegistryHandler creates a fake registry handler which resolves any manifest
+// with the digest, or returns the status code if it's not http.StatusOK.
+func newFakeRegistryHandler(digest imagedigest.Digest, code int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if code != http.StatusOK {
+			w.WriteHeader(code)
+			return
+		}
+		w.Header().Set("Docker-Content-Digest", digest.String())
+		w.Header().Set("Content-Type", "application/vnd.docker.distribution.manifest.v2+json")
+		w.Header().Set("Content-Length", "100")
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+func TestResolveImage(t *testing.T) {
+	digest := imagedigest.Digest("sha256:e6693c20186f837fc393390135d8a598a96a833917917789d63766cab6c59582")
+	otherDigest := imagedigest.Digest("sha256:e6693c20186f837fc393390135d8a598a96a833917917789d63766cab6c59594")
+	for desc, test := range map[string]struct {
+		mirrorCodes           []int
+		mirrorDigest          imagedigest.Digest
+		registryCode          int
+		digestedRef           bool
+		expectErr             bool
+		expectUnauthenticated bool
+		expectedTried         int
+	}{
+		"should resolve from the registry without mirrors": {
+			registryCode:  http.StatusOK,
+			expectedTried: 1,
+		},
+		"should resolve from the first available mirror": {
+			mirrorCodes:   []int{http.StatusInternalServerError, http.StatusOK, http.StatusOK},
+			registryCode:  http.StatusOK,
+			expectedTried: 2,
+		},
+		"should fallback to the registry if all mirrors fail": {
+			mirrorCodes:   []int{http.StatusUnauthorized, http.StatusInternalServerError},
+			registryCode:  http.StatusOK,
+			expectedTried: 3,
+		},
+		"should fallback if digest from the mirror doesn't match": {
+			mirrorCodes:   []int{http.StatusOK},
+			mirrorDigest:  otherDigest,
+			registryCode:  http.StatusOK,
+			digestedRef:   true,
+			expectedTried: 2,
+		},
+		"should return unauthenticated error if credentials are rejected": {
+			mirrorCodes:           []int{http.StatusInternalServerError},
+			registryCode:          http.StatusUnauthorized,
+			expectErr:             true,
+			expectUnauthenticated: true,
+			expectedTried:         2,
+		},
+		"should return error if all endpoints fail": {
+			mirrorCodes:   []int{http.StatusInternalServerError},
+			registryCode:  http.StatusInternalServerError,
+			expectErr:     true,
+			expectedTried: 2,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		tried := 0
+		count := func(s *httptest.Server) *httptest.Server {
+			handler := s.Config.Handler
+			s.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				tried++
+				handler.ServeHTTP(w, r)
+			})
+			return s
+		}
+		c := newTestCRIContainerdService()
+		registry := count(httptest.NewServer(newFakeRegistryHandler(digest, test.registryCode)))
+		defer registry.Close()
+		u, err := url.Parse(registry.URL)
+		require.NoError(t, err)
+		// Registry on localhost is accessed with plain http.
+		host := "localhost:" + u.Port()
+		mirrorDigest := digest
+		if test.mirrorDigest != "" {
+			mirrorDigest = test.mirrorDigest
+		}
+		c.registryMirrors = map[string][]registryEndpoint{}
+		for _, code := range test.mirrorCodes {
+			mirror := count(httptest.NewServer(newFakeRegistryHandler(mirrorDigest, code)))
+			defer mirror.Close()
+			endpoint, err := parseRegistryEndpoint(mirror.URL)
+			require.NoError(t, err)
+			c.registryMirrors[host] = append(c.registryMirrors[host], endpoint)
+		}
+		ref := host + "/library/busybox:latest"
+		if test.digestedRef {
+			ref = host + "/library/busybox@" + digest.String()
+		}
+		named, err := normalizeImageRef(ref)
+		require.NoError(t, err)
+		resolved, fetcher, err := c.resolveImage(context.Background(), named, nil)
+		assert.Equal(t, test.expectErr, err != nil)
+		assert.Equal(t, test.expectUnauthenticated, isUnauthenticatedError(err))
+		assert.Equal(t, test.expectedTried, tried)
+		if !test.expectErr {
+			assert.Equal(t, digest, resolved.Digest)
+			assert.NotNil(t, fetcher)
+		}
+	}
+}
+
+func TestResolveImageCredentialsNotSentToMirrors(t *testing.T) {
+	digest := imagedigest.Digest("sha256:e6693c20186f837fc393390135d8a598a96a833917917789d63766cab6c59582")
+	const token = "test-token"
+	var mirrorAuth, registryAuth []string
+	record := func(auth *[]string, handler http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			*auth = append(*auth, r.Header.Get("Authorization"))
+			handler.ServeHTTP(w, r)
+		})
+	}
+	c := newTestCRIContainerdService()
+	registry := httptest.NewServer(record(&registryAuth, newFakeRegistryHandler(digest, http.StatusOK)))
+	defer registry.Close()
+	mirror := httptest.NewServer(record(&mirrorAuth, newFakeRegistryHandler(digest, http.StatusInternalServerError)))
+	defer mirror.Close()
+	u, err := url.Parse(registry.URL)
+	require.NoError(t, err)
+	host := "localhost:" + u.Port()
+	endpoint, err := parseRegistryEndpoint(mirror.URL)
+	require.NoError(t, err)
+	c.registryMirrors = map[string][]registryEndpoint{host: {endpoint}}
+	named, err := normalizeImageRef(host + "/library/busybox:latest")
+	require.NoError(t, err)
+	_, _, err = c.resolveImage(context.Background(), named, &runtime.AuthConfig{RegistryToken: token})
+	require.NoError(t, err)
+	require.NotEmpty(t, mirrorAuth)
+	for _, auth := range mirrorAuth {
+		assert.Empty(t, auth, "credentials should not be sent to the mirror")
+	}
+	require.NotEmpty(t, registryAuth)
+	assert.Equal(t, "Bearer "+token, registryAuth[0])
+}
+
+// writeTestCert generates a self-signed certificate and key, and writes them into
+// the files in pem format.
+func writeTestCert(t *testing.T, certFile, keyFile string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(certFile,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644))
+	if keyFile != "" {
+		require.NoError(t, ioutil.WriteFile(keyFile,
+			pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600))
+	}
+}
+
+func TestGetRegistryTLSConfig(t *testing.T) {
+	const host = "registry.example.com"
+	for desc, test := range map[string]struct {
+		skipVerify    []string
+		caCert        bool
+		invalidCACert bool
+		clientCert    bool
+		clientKey     bool
+		expectNil     bool
+		expectErr     bool
+	}{
+		"should return nil without tls config": {
+			expectNil: true,
+		},
+		"should not skip verify for other hosts": {
+			skipVerify: []string{"other.example.com"},
+			expectNil:  true,
+		},
+		"should skip verify for the host": {
+			skipVerify: []string{host},
+		},
+		"should load CA certificate": {
+			caCert: true,
+		},
+		"should return error for invalid CA certificate": {
+			invalidCACert: true,
+			expectErr:     true,
+		},
+		"should load client certificate": {
+			clientCert: true,
+			clientKey:  true,
+		},
+		"should return error for client certificate without key": {
+			clientCert: true,
+			expectErr:  true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		certsDir, err := ioutil.TempDir(os.TempDir(), "test-certs")
+		require.NoError(t, err)
+		defer os.RemoveAll(certsDir)
+		c := newTestCRIContainerdService()
+		c.config.RegistryCertsDir = certsDir
+		c.config.RegistryTLSSkipVerify = test.skipVerify
+		dir := filepath.Join(certsDir, host)
+		if test.caCert || test.invalidCACert || test.clientCert {
+			require.NoError(t, os.MkdirAll(dir, 0755))
+		}
+		if test.caCert {
+			writeTestCert(t, filepath.Join(dir, registryCACertFile), "")
+		}
+		if test.invalidCACert {
+			require.NoError(t, ioutil.WriteFile(filepath.Join(dir, registryCACertFile), []byte("invalid"), 0644))
+		}
+		if test.clientCert {
+			keyFile := ""
+			if test.clientKey {
+				keyFile = filepath.Join(dir, registryClientKeyFile)
+			}
+			writeTestCert(t, filepath.Join(dir, registryClientCertFile), keyFile)
+		}
+		tlsConfig, err := c.getRegistryTLSConfig(host)
+		assert.Equal(t, test.expectErr, err != nil)
+		if test.expectErr {
+			continue
+		}
+		if test.expectNil {
+			assert.Nil(t, tlsConfig)
+			continue
+		}
+		require.NotNil(t, tlsConfig)
+		assert.Equal(t, len(test.skipVerify) > 0, tlsConfig.InsecureSkipVerify)
+		assert.Equal(t, test.caCert, tlsConfig.RootCAs != nil)
+		assert.Equal(t, test.clientCert, len(tlsConfig.Certificates) == 1)
+		// The tls config of the host should not be used for other hosts.
+		otherConfig, err := c.getRegistryTLSConfig("other.example.com")
+		assert.NoError(t, err)
+		assert.Nil(t, otherConfig)
+	}
+}
+
+func TestResolveImageWithRegistryCACert(t *testing.T) {
+	digest := imagedigest.Digest("sha256:e6693c20186f837fc393390135d8a598a96a833917917789d63766cab6c59582")
+	registry := httptest.NewTLSServer(newFakeRegistryHandler(digest, http.StatusOK))
+	defer registry.Close()
+	u, err := url.Parse(registry.URL)
+	require.NoError(t, err)
+	named, err := normalizeImageRef(u.Host + "/library/busybox:latest")
+	require.NoError(t, err)
+
+	c := newTestCRIContainerdService()
+	certsDir, err := ioutil.TempDir(os.TempDir(), "test-certs")
+	require.NoError(t, err)
+	defer os.RemoveAll(certsDir)
+	c.config.RegistryCertsDir = certsDir
+
+	_, _, err = c.resolveImage(context.Background(), named, nil)
+	assert.Error(t, err, "should fail to verify the registry certificate without CA certificate")
+
+	dir := filepath.Join(certsDir, u.Host)
+	require.NoError(t, os.MkdirAll(dir, 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, registryCACertFile),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: registry.Certificate().Raw}), 0644))
+	resolved, _, err := c.resolveImage(context.Background(), named, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, digest, resolved.Digest)
+}
+
+func TestRegistryTokenTransport(t *testing.T) {
+	var authorization string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+	}))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	for desc, test := range map[string]struct {
+		host          string
+		authorization string
+		expected      string
+	}{
+		"should set registry token for the registry": {
+			host:     u.Host,
+			expected: "Bearer test-token",
+		},
+		"should not override existing authorization": {
+			host:          u.Host,
+			authorization: "Bearer other-token",
+			expected:      "Bearer other-token",
+		},
+		"should not set registry token for other hosts": {
+			host:     "other.example.com",
+			expected: "",
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		client := newRegistryTokenClient(http.DefaultClient, test.host, "test-token")
+		req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+		require.NoError(t, err)
+		if test.authorization != "" {
+			req.Header.Set("Authorization", test.authorization)
+		}
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, test.expected, authorization)
+		assert.Equal(t, test.authorization, req.Header.Get("Authorization"), "request should not be modified")
+	}
+}
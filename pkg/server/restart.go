@@ -0,0 +1,286 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+
+	"github.com/containerd/containerd/api/services/tasks/v1"
+	"github.com/containerd/containerd/api/types/task"
+	"github.com/containerd/containerd/containers"
+	containerdimages "github.com/containerd/containerd/images"
+	"github.com/docker/distribution/reference"
+	"golang.org/x/net/context"
+	"k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+
+	"github.com/kubernetes-incubator/cri-containerd/pkg/log"
+	cio "github.com/kubernetes-incubator/cri-containerd/pkg/server/io"
+	containerstore "github.com/kubernetes-incubator/cri-containerd/pkg/store/container"
+	imagestore "github.com/kubernetes-incubator/cri-containerd/pkg/store/image"
+	sandboxstore "github.com/kubernetes-incubator/cri-containerd/pkg/store/sandbox"
+)
+
+// NOTE: The recovery logic has following assumption: when cri-containerd is down:
+// 1) Files (e.g. root directory, netns) and checkpoint maintained by cri-containerd
+// MUST NOT be touched. Or else, recovery logic for those containers/sandboxes may
+// return error.
+// 2) Containerd containers may be deleted, but SHOULD NOT be added. Or else, recovery
+// logic for the newly added container/sandbox will return error, because there is
+// no corresponding root directory created.
+// 3) Containerd container tasks may exit or be stopped, deleted. Even though current
+// logic could tolerant tasks being created or started, we prefer that not to happen.
+
+// recover recovers system state from containerd and status checkpoint.
+func (c *criContainerdService) recover(ctx context.Context) error {
+	// Recover images first, so that containers could be created with images
+	// pulled before restart.
+	if err := c.loadImages(ctx); err != nil {
+		return fmt.Errorf("failed to load images: %v", err)
+	}
+	cntrs, err := c.containerService.List(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list containers: %v", err)
+	}
+	// Recover sandboxes first, so that containers are recovered after the
+	// sandboxes they belong to.
+	var containerCntrs []containers.Container
+	for _, cntr := range cntrs {
+		switch cntr.Labels[containerKindLabel] {
+		case containerKindSandbox:
+			sandbox, err := c.loadSandbox(cntr)
+			if err != nil {
+				log.G(ctx).Errorf("Failed to load sandbox %q: %v", cntr.ID, err)
+				c.handleUnloadableContainer(ctx, cntr)
+				continue
+			}
+			log.G(ctx).V(4).Infof("Loaded sandbox %+v", sandbox)
+			if err := c.sandboxStore.Add(sandbox); err != nil {
+				return fmt.Errorf("failed to add sandbox %q to store: %v", sandbox.ID, err)
+			}
+			if err := c.sandboxNameIndex.Reserve(sandbox.Name, sandbox.ID); err != nil {
+				return fmt.Errorf("failed to reserve sandbox name %q: %v", sandbox.Name, err)
+			}
+		case containerKindContainer:
+			containerCntrs = append(containerCntrs, cntr)
+		default:
+			// The containerd namespace may be shared with other clients, and containers
+			// created by older versions of cri-containerd are not labeled. Never touch
+			// them.
+			log.G(ctx).Warningf("Skip recovering container %q without %q label", cntr.ID, containerKindLabel)
+		}
+	}
+	if len(containerCntrs) > 0 {
+		resp, err := c.taskService.List(ctx, &tasks.ListTasksRequest{})
+		if err != nil {
+			return fmt.Errorf("failed to list tasks: %v", err)
+		}
+		taskMap := make(map[string]*task.Task)
+		for _, t := range resp.Tasks {
+			taskMap[t.ID] = t
+		}
+		for _, cntr := range containerCntrs {
+			container, err := c.loadContainer(ctx, cntr, taskMap[cntr.ID])
+			if err != nil {
+				log.G(ctx).Errorf("Failed to load container %q: %v", cntr.ID, err)
+				c.handleUnloadableContainer(ctx, cntr)
+				continue
+			}
+			log.G(ctx).V(4).Infof("Loaded container %+v", container)
+			if err := c.containerStore.Add(container); err != nil {
+				return fmt.Errorf("failed to add container %q to store: %v", container.ID, err)
+			}
+			if err := c.containerNameIndex.Reserve(container.Name, container.ID); err != nil {
+				return fmt.Errorf("failed to reserve container name %q: %v", container.Name, err)
+			}
+		}
+	}
+	// Update the status of containers exited while cri-containerd was down.
+	return c.reconcileContainers(ctx)
+}
+
+// loadImages loads images from containerd image store into the in-memory image
+// store. The references of an image are grouped by the image id (config digest).
+// Only images with the image id reference are loaded, because the image id
+// reference is only created after the image is successfully pulled and unpacked.
+func (c *criContainerdService) loadImages(ctx context.Context) error {
+	imgs, err := c.imageStoreService.List(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list images: %v", err)
+	}
+	refs := make(map[string][]containerdimages.Image)
+	for _, img := range imgs {
+		desc, err := img.Config(ctx, c.contentStoreService)
+		if err != nil {
+			log.G(ctx).Warningf("Failed to get config of image %q: %v", img.Name, err)
+			continue
+		}
+		id := desc.Digest.String()
+		refs[id] = append(refs[id], img)
+	}
+	for id, imgs := range refs {
+		pulled := false
+		for _, img := range imgs {
+			if img.Name == id {
+				pulled = true
+				break
+			}
+		}
+		if !pulled {
+			log.G(ctx).Warningf("Skip loading image %q which is not successfully pulled", id)
+			continue
+		}
+		// All references of an image point to the same manifest.
+		chainID, size, config, err := c.getContainerdImageInfo(ctx, imgs[0])
+		if err != nil {
+			log.G(ctx).Errorf("Failed to get information of image %q: %v", id, err)
+			continue
+		}
+		image := imagestore.Image{
+			ID:      id,
+			ChainID: chainID.String(),
+			Size:    size,
+			Config:  config,
+		}
+		for _, img := range imgs {
+			if img.Name == id {
+				continue
+			}
+			named, err := reference.ParseNormalizedNamed(img.Name)
+			if err != nil {
+				log.G(ctx).Warningf("Failed to parse reference %q of image %q: %v", img.Name, id, err)
+				continue
+			}
+			if _, ok := named.(reference.Canonical); ok {
+				image.RepoDigests = append(image.RepoDigests, img.Name)
+			} else if _, ok := named.(reference.NamedTagged); ok {
+				image.RepoTags = append(image.RepoTags, img.Name)
+			}
+		}
+		log.G(ctx).V(4).Infof("Loaded image %+v", image)
+		c.imageStore.Add(image)
+	}
+	return nil
+}
+
+// loadSandbox loads sandbox from the metadata checkpointed in the containerd
+// container labels.
+func (c *criContainerdService) loadSandbox(cntr containers.Container) (sandboxstore.Sandbox, error) {
+	data, ok := cntr.Labels[containerMetadataLabel]
+	if !ok {
+		return sandboxstore.Sandbox{}, fmt.Errorf("metadata label %q is not found", containerMetadataLabel)
+	}
+	var meta sandboxstore.Metadata
+	if err := meta.Decode([]byte(data)); err != nil {
+		return sandboxstore.Sandbox{}, fmt.Errorf("failed to decode sandbox metadata: %v", err)
+	}
+	return sandboxstore.Sandbox{Metadata: meta}, nil
+}
+
+// loadContainer loads container from the metadata checkpointed in the containerd
+// container labels and the status checkpoint. If the status checkpoint is not
+// available, the status is generated from the containerd task. The io of a
+// running container is reconnected.
+func (c *criContainerdService) loadContainer(ctx context.Context, cntr containers.Container, t *task.Task) (containerstore.Container, error) {
+	data, ok := cntr.Labels[containerMetadataLabel]
+	if !ok {
+		return containerstore.Container{}, fmt.Errorf("metadata label %q is not found", containerMetadataLabel)
+	}
+	var meta containerstore.Metadata
+	if err := meta.Decode([]byte(data)); err != nil {
+		return containerstore.Container{}, fmt.Errorf("failed to decode container metadata: %v", err)
+	}
+	containerRootDir := getContainerRootDir(c.rootDir, meta.ID)
+	var status containerstore.Status
+	s, err := containerstore.LoadStatus(containerRootDir, meta.ID)
+	if err == nil {
+		status = s.Get()
+	} else {
+		log.L.Warningf("Failed to load status of container %q, generate it from task: %v", meta.ID, err)
+		createdAt := cntr.CreatedAt.UnixNano()
+		status = containerstore.Status{CreatedAt: createdAt, StartedAt: createdAt}
+		if t != nil {
+			status.Pid = t.Pid
+		} else {
+			status.FinishedAt = createdAt
+			status.ExitCode = unknownExitCode
+			status.Reason = unknownExitReason
+		}
+	}
+	containerIO := cio.NewContainerIO(meta.ID)
+	if status.State() == runtime.ContainerState_CONTAINER_RUNNING {
+		// Reopen the streaming pipes, which are still held by the containerd shim,
+		// and restart the container loggers, which append to the log file.
+		if _, _, _, _, err := c.pipeContainerIO(ctx, meta, containerIO); err != nil {
+			// The container can still be managed without io.
+			log.G(ctx).Errorf("Failed to reconnect io of container %q: %v", meta.ID, err)
+		}
+	}
+	return containerstore.NewContainer(meta, status,
+		containerstore.WithStatusCheckpoint(containerRootDir),
+		containerstore.WithContainerIO(containerIO),
+	)
+}
+
+// handleUnloadableContainer handles a containerd container created by
+// cri-containerd which fails to be loaded. It's only cleaned up as orphan if
+// the metadata is not checkpointed, e.g. cri-containerd was down in the middle
+// of creation. Otherwise, e.g. the metadata is corrupted or checkpointed by a
+// newer version, it's left untouched.
+func (c *criContainerdService) handleUnloadableContainer(ctx context.Context, cntr containers.Container) {
+	if _, ok := cntr.Labels[containerMetadataLabel]; ok {
+		log.G(ctx).Warningf("Skip recovering container %q with metadata checkpointed, it's not cleaned up", cntr.ID)
+		return
+	}
+	c.cleanupOrphanContainer(ctx, cntr)
+}
+
+// cleanupOrphanContainer stops and removes the containerd container created by
+// cri-containerd whose metadata is not checkpointed, e.g. cri-containerd was down
+// in the middle of creation. The root directory of the container is also removed.
+func (c *criContainerdService) cleanupOrphanContainer(ctx context.Context, cntr containers.Container) {
+	id := cntr.ID
+	log.G(ctx).V(2).Infof("Cleanup orphan container %q", id)
+	if err := c.stopSandboxContainer(ctx, id, true); err != nil {
+		log.G(ctx).Errorf("Failed to stop orphan container %q: %v", id, err)
+		return
+	}
+	if err := c.containerService.Delete(ctx, id); err != nil && !isContainerdGRPCNotFoundError(err) {
+		log.G(ctx).Errorf("Failed to delete orphan container %q: %v", id, err)
+		return
+	}
+	if err := c.snapshotService.Remove(ctx, id); err != nil && !isContainerdGRPCNotFoundError(err) {
+		log.G(ctx).Errorf("Failed to remove snapshot of orphan container %q: %v", id, err)
+	}
+	var rootDir string
+	switch cntr.Labels[containerKindLabel] {
+	case containerKindSandbox:
+		rootDir = getSandboxRootDir(c.rootDir, id)
+		// The sandbox config is not available, unmount everything under the
+		// sandbox root directory.
+		if err := c.unmountSandboxFiles(rootDir, nil); err != nil {
+			log.G(ctx).Errorf("Failed to unmount sandbox files of orphan sandbox %q: %v", id, err)
+			return
+		}
+	case containerKindContainer:
+		rootDir = getContainerRootDir(c.rootDir, id)
+	default:
+		return
+	}
+	if err := c.os.RemoveAll(rootDir); err != nil {
+		log.G(ctx).Errorf("Failed to remove root directory %q of orphan container %q: %v", rootDir, id, err)
+	}
+}
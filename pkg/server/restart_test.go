@@ -0,0 +1,290 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/api/services/tasks/v1"
+	"github.com/containerd/containerd/api/types/task"
+	"github.com/containerd/containerd/containers"
+	containerdimages "github.com/containerd/containerd/images"
+	imagedigest "github.com/opencontainers/go-digest"
+	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+
+	ostesting "github.com/kubernetes-incubator/cri-containerd/pkg/os/testing"
+	servertesting "github.com/kubernetes-incubator/cri-containerd/pkg/server/testing"
+	containerstore "github.com/kubernetes-incubator/cri-containerd/pkg/store/container"
+	sandboxstore "github.com/kubernetes-incubator/cri-containerd/pkg/store/sandbox"
+)
+
+func TestRecover(t *testing.T) {
+	c := newTestCRIContainerdService()
+	tempDir, err := ioutil.TempDir(os.TempDir(), "test-recover")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+	c.rootDir = tempDir
+	c.imageStoreService = servertesting.NewFakeImageStore()
+	fakeContainerService := c.containerService.(*servertesting.FakeContainerService)
+	fakeTaskService := c.taskService.(*servertesting.FakeTaskService)
+
+	sandboxMeta := sandboxstore.Metadata{
+		ID:     "sandbox-id",
+		Name:   "sandbox-name",
+		Config: &runtime.PodSandboxConfig{},
+	}
+	sandboxData, err := sandboxMeta.Encode()
+	require.NoError(t, err)
+	newContainerData := func(id string) string {
+		meta := containerstore.Metadata{
+			ID:        id,
+			Name:      id + "-name",
+			SandboxID: "sandbox-id",
+			Config:    &runtime.ContainerConfig{},
+		}
+		data, err := meta.Encode()
+		require.NoError(t, err)
+		return string(data)
+	}
+	// Container with status checkpoint.
+	checkpointedStatus := containerstore.Status{
+		Pid:       1234,
+		CreatedAt: time.Now().UnixNano(),
+		StartedAt: time.Now().UnixNano(),
+	}
+	checkpointedRootDir := getContainerRootDir(tempDir, "checkpointed-id")
+	require.NoError(t, os.MkdirAll(checkpointedRootDir, 0755))
+	_, err = containerstore.StoreStatus(checkpointedRootDir, "checkpointed-id", checkpointedStatus)
+	require.NoError(t, err)
+	for _, id := range []string{"running-id", "exited-id"} {
+		require.NoError(t, os.MkdirAll(getContainerRootDir(tempDir, id), 0755))
+	}
+
+	fakeContainerService.SetFakeContainers([]containers.Container{
+		{
+			ID: "sandbox-id",
+			Labels: map[string]string{
+				containerKindLabel:     containerKindSandbox,
+				containerMetadataLabel: string(sandboxData),
+			},
+		},
+		{
+			// Sandbox container without metadata is orphan.
+			ID:     "orphan-sandbox-id",
+			Labels: map[string]string{containerKindLabel: containerKindSandbox},
+		},
+		{
+			ID: "checkpointed-id",
+			Labels: map[string]string{
+				containerKindLabel:     containerKindContainer,
+				containerMetadataLabel: newContainerData("checkpointed-id"),
+			},
+		},
+		{
+			ID: "running-id",
+			Labels: map[string]string{
+				containerKindLabel:     containerKindContainer,
+				containerMetadataLabel: newContainerData("running-id"),
+			},
+			CreatedAt: time.Now(),
+		},
+		{
+			ID: "exited-id",
+			Labels: map[string]string{
+				containerKindLabel:     containerKindContainer,
+				containerMetadataLabel: newContainerData("exited-id"),
+			},
+			CreatedAt: time.Now(),
+		},
+		{
+			// Container created by cri-containerd but without metadata is orphan.
+			ID:     "orphan-id",
+			Labels: map[string]string{containerKindLabel: containerKindContainer},
+		},
+		{
+			// Container without kind label is not touched.
+			ID: "unlabeled-id",
+		},
+		{
+			// Container with corrupted metadata is not orphan.
+			ID: "corrupted-id",
+			Labels: map[string]string{
+				containerKindLabel:     containerKindContainer,
+				containerMetadataLabel: "invalid",
+			},
+		},
+	})
+	fakeTaskService.SetFakeTasks([]task.Task{
+		{ID: "sandbox-id", Pid: 1, Status: task.StatusRunning},
+		{ID: "checkpointed-id", Pid: 1234, Status: task.StatusRunning},
+		{ID: "running-id", Pid: 5678, Status: task.StatusRunning},
+		{ID: "corrupted-id", Pid: 9012, Status: task.StatusRunning},
+		{ID: "unlabeled-id", Pid: 3456, Status: task.StatusRunning},
+	})
+	fakeOS := c.os.(*ostesting.FakeOS)
+
+	require.NoError(t, c.recover(context.Background()))
+
+	t.Logf("sandbox should be recovered from metadata")
+	sandbox, err := c.sandboxStore.Get("sandbox-id")
+	assert.NoError(t, err)
+	assert.Equal(t, sandboxMeta, sandbox.Metadata)
+	assert.Error(t, c.sandboxNameIndex.Reserve("sandbox-name", "other-id"), "sandbox name should be reserved")
+
+	t.Logf("container should be recovered with checkpointed status")
+	container, err := c.containerStore.Get("checkpointed-id")
+	assert.NoError(t, err)
+	assert.Equal(t, checkpointedStatus, container.Status.Get())
+	assert.Error(t, c.containerNameIndex.Reserve("checkpointed-id-name", "other-id"), "container name should be reserved")
+
+	t.Logf("container without status checkpoint should be recovered from task")
+	container, err = c.containerStore.Get("running-id")
+	assert.NoError(t, err)
+	assert.Equal(t, runtime.ContainerState_CONTAINER_RUNNING, container.Status.Get().State())
+	assert.EqualValues(t, 5678, container.Status.Get().Pid)
+
+	t.Logf("io of running container should be reconnected")
+	require.NotNil(t, container.IO)
+	var fifos []string
+	for _, call := range fakeOS.GetCalls() {
+		if call.Name == "OpenFifo" {
+			fifos = append(fifos, call.Arguments[1].(string))
+		}
+	}
+	_, stdout, stderr := getStreamingPipes(getContainerRootDir(tempDir, "running-id"))
+	assert.Contains(t, fifos, stdout)
+	assert.Contains(t, fifos, stderr)
+
+	t.Logf("container without status checkpoint and task should be exited")
+	container, err = c.containerStore.Get("exited-id")
+	assert.NoError(t, err)
+	assert.Equal(t, runtime.ContainerState_CONTAINER_EXITED, container.Status.Get().State())
+	assert.Equal(t, unknownExitReason, container.Status.Get().Reason)
+
+	t.Logf("container with corrupted metadata should be skipped but not removed")
+	_, err = c.containerStore.Get("corrupted-id")
+	assert.Error(t, err)
+	_, err = fakeContainerService.Get(context.Background(), "corrupted-id")
+	assert.NoError(t, err)
+	_, err = fakeTaskService.Get(context.Background(), &tasks.GetTaskRequest{ContainerID: "corrupted-id"})
+	assert.NoError(t, err, "task of container with corrupted metadata should not be killed")
+
+	t.Logf("container without kind label should be skipped but not removed")
+	_, err = c.containerStore.Get("unlabeled-id")
+	assert.Error(t, err)
+	_, err = fakeContainerService.Get(context.Background(), "unlabeled-id")
+	assert.NoError(t, err)
+	_, err = fakeTaskService.Get(context.Background(), &tasks.GetTaskRequest{ContainerID: "unlabeled-id"})
+	assert.NoError(t, err, "task of container without kind label should not be killed")
+
+	t.Logf("root directory of orphan sandbox should be removed")
+	assert.Contains(t, fakeOS.GetCalls(), ostesting.CalledDetail{
+		Name:      "RemoveAll",
+		Arguments: []interface{}{getSandboxRootDir(tempDir, "orphan-sandbox-id")},
+	})
+
+	t.Logf("orphan containers should be removed")
+	for _, id := range []string{"orphan-sandbox-id", "orphan-id"} {
+		_, err := fakeContainerService.Get(context.Background(), id)
+		assert.True(t, isContainerdGRPCNotFoundError(err), "orphan container %q should be removed", id)
+		_, err = c.sandboxStore.Get(id)
+		assert.Error(t, err)
+		_, err = c.containerStore.Get(id)
+		assert.Error(t, err)
+	}
+}
+
+func TestLoadImages(t *testing.T) {
+	c := newTestCRIContainerdService()
+	fakeContentStore := servertesting.NewFakeContentStore()
+	fakeImageStore := servertesting.NewFakeImageStore()
+	c.contentStoreService = fakeContentStore
+	c.imageStoreService = fakeImageStore
+
+	// newImage adds the manifest and config blobs of an image into the content
+	// store, and returns the image id and the manifest descriptor.
+	newImage := func(user string) (string, imagespec.Descriptor) {
+		config, err := json.Marshal(imagespec.Image{
+			Config: imagespec.ImageConfig{User: user},
+			RootFS: imagespec.RootFS{Type: "layers", DiffIDs: []imagedigest.Digest{imagedigest.FromString(user)}},
+		})
+		require.NoError(t, err)
+		configDigest := imagedigest.FromBytes(config)
+		manifest, err := json.Marshal(imagespec.Manifest{
+			Config: imagespec.Descriptor{
+				MediaType: imagespec.MediaTypeImageConfig,
+				Digest:    configDigest,
+				Size:      int64(len(config)),
+			},
+			Layers: []imagespec.Descriptor{{
+				MediaType: imagespec.MediaTypeImageLayerGzip,
+				Digest:    imagedigest.FromString("layer-" + user),
+				Size:      100,
+			}},
+		})
+		require.NoError(t, err)
+		manifestDigest := imagedigest.FromBytes(manifest)
+		fakeContentStore.SetFakeBlobs(map[imagedigest.Digest][]byte{
+			configDigest:   config,
+			manifestDigest: manifest,
+		})
+		return configDigest.String(), imagespec.Descriptor{
+			MediaType: containerdimages.MediaTypeDockerSchema2Manifest,
+			Digest:    manifestDigest,
+			Size:      int64(len(manifest)),
+		}
+	}
+	pulledID, pulledTarget := newImage("pulled")
+	pullingID, pullingTarget := newImage("pulling")
+	repoDigest := "docker.io/library/pulled@" + pulledTarget.Digest.String()
+	fakeImageStore.SetFakeImages([]containerdimages.Image{
+		{Name: "docker.io/library/pulled:latest", Target: pulledTarget},
+		{Name: repoDigest, Target: pulledTarget},
+		{Name: pulledID, Target: pulledTarget},
+		// The image id reference is not created if the pull is not finished.
+		{Name: "docker.io/library/pulling:latest", Target: pullingTarget},
+	})
+
+	require.NoError(t, c.loadImages(context.Background()))
+
+	t.Logf("successfully pulled image should be loaded")
+	image, err := c.imageStore.Get(pulledID)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"docker.io/library/pulled:latest"}, image.RepoTags)
+	assert.Equal(t, []string{repoDigest}, image.RepoDigests)
+	assert.Equal(t, imagedigest.FromString("pulled").String(), image.ChainID)
+	require.NotNil(t, image.Config)
+	assert.Equal(t, "pulled", image.Config.User)
+	assert.NotZero(t, image.Size)
+
+	t.Logf("image not successfully pulled should not be loaded")
+	_, err = c.imageStore.Get(pullingID)
+	assert.Error(t, err)
+
+	t.Logf("should return error if failed to list images")
+	fakeImageStore.InjectError("list", errors.New("random error"))
+	assert.Error(t, c.loadImages(context.Background()))
+}
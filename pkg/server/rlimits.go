@@ -0,0 +1,148 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/opencontainers/runtime-tools/generate"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+const (
+	// rlimitsAnnotationKey is the container annotation key of the container
+	// process rlimits. The value is a comma-separated list in the same format
+	// with the default rlimits option, e.g. "nofile=1024:65536,nproc=4096".
+	// TODO: Switch to the CRI rlimits field once the CRI api supports it.
+	rlimitsAnnotationKey = "io.kubernetes.cri-containerd.rlimits"
+	// rlimitUnlimited is the rlimit value meaning unlimited.
+	rlimitUnlimited = "unlimited"
+)
+
+// rlimitTypes maps the supported rlimit names to the OCI rlimit types.
+var rlimitTypes = map[string]string{
+	"as":         "RLIMIT_AS",
+	"core":       "RLIMIT_CORE",
+	"cpu":        "RLIMIT_CPU",
+	"data":       "RLIMIT_DATA",
+	"fsize":      "RLIMIT_FSIZE",
+	"locks":      "RLIMIT_LOCKS",
+	"memlock":    "RLIMIT_MEMLOCK",
+	"msgqueue":   "RLIMIT_MSGQUEUE",
+	"nice":       "RLIMIT_NICE",
+	"nofile":     "RLIMIT_NOFILE",
+	"nproc":      "RLIMIT_NPROC",
+	"rss":        "RLIMIT_RSS",
+	"rtprio":     "RLIMIT_RTPRIO",
+	"rttime":     "RLIMIT_RTTIME",
+	"sigpending": "RLIMIT_SIGPENDING",
+	"stack":      "RLIMIT_STACK",
+}
+
+// rlimit is the soft and hard limit of a resource.
+type rlimit struct {
+	soft uint64
+	hard uint64
+}
+
+// parseRlimitValue parses a rlimit value, which is either a number or
+// "unlimited".
+func parseRlimitValue(value string) (uint64, error) {
+	if value == rlimitUnlimited {
+		return ^uint64(0), nil
+	}
+	return strconv.ParseUint(value, 10, 64)
+}
+
+// parseRlimits parses rlimits in the format of <name>=<soft>:<hard>, e.g.
+// "nofile=1024:65536". The hard limit is the same with the soft limit if
+// only one value is specified. It returns rlimits keyed by OCI rlimit type,
+// and returns error if a name is unknown or a soft limit is larger than
+// its hard limit.
+func parseRlimits(values []string) (map[string]rlimit, error) {
+	rlimits := make(map[string]rlimit)
+	for _, v := range values {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid rlimit %q", v)
+		}
+		rType, ok := rlimitTypes[parts[0]]
+		if !ok {
+			return nil, fmt.Errorf("unknown rlimit name %q", parts[0])
+		}
+		if _, ok := rlimits[rType]; ok {
+			return nil, fmt.Errorf("duplicated rlimit %q", parts[0])
+		}
+		limits := strings.SplitN(parts[1], ":", 2)
+		soft, err := parseRlimitValue(limits[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid soft limit %q of rlimit %q", limits[0], parts[0])
+		}
+		hard := soft
+		if len(limits) == 2 {
+			hard, err = parseRlimitValue(limits[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid hard limit %q of rlimit %q", limits[1], parts[0])
+			}
+		}
+		if soft > hard {
+			return nil, fmt.Errorf("soft limit %q is larger than hard limit %q of rlimit %q",
+				limits[0], limits[1], parts[0])
+		}
+		rlimits[rType] = rlimit{soft: soft, hard: hard}
+	}
+	return rlimits, nil
+}
+
+// getRlimits returns the rlimits of a container. Rlimits requested in the
+// container annotations override the default rlimits of the same type.
+func getRlimits(annotations map[string]string, defaults map[string]rlimit) (map[string]rlimit, error) {
+	rlimits := make(map[string]rlimit)
+	for rType, l := range defaults {
+		rlimits[rType] = l
+	}
+	value, ok := annotations[rlimitsAnnotationKey]
+	if !ok {
+		return rlimits, nil
+	}
+	requested, err := parseRlimits(strings.Split(value, ","))
+	if err != nil {
+		return nil, grpc.Errorf(codes.InvalidArgument, "invalid rlimits %q: %v", value, err)
+	}
+	for rType, l := range requested {
+		rlimits[rType] = l
+	}
+	return rlimits, nil
+}
+
+// setOCIRlimits sets the process rlimits. Rlimits not specified are left as
+// the runtime defaults.
+func setOCIRlimits(g *generate.Generator, rlimits map[string]rlimit) {
+	var rTypes []string
+	for rType := range rlimits {
+		rTypes = append(rTypes, rType)
+	}
+	// Sort the types so that the generated spec is deterministic.
+	sort.Strings(rTypes)
+	for _, rType := range rTypes {
+		g.AddProcessRlimits(rType, rlimits[rType].hard, rlimits[rType].soft)
+	}
+}
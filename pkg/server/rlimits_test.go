@@ -0,0 +1,147 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"testing"
+
+	runtimespec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/opencontainers/runtime-tools/generate"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRlimits(t *testing.T) {
+	for desc, test := range map[string]struct {
+		values    []string
+		expected  map[string]rlimit
+		expectErr bool
+	}{
+		"should return empty rlimits if nothing is specified": {
+			expected: map[string]rlimit{},
+		},
+		"should parse soft and hard limits": {
+			values: []string{"nofile=1024:65536", "nproc=100:200"},
+			expected: map[string]rlimit{
+				"RLIMIT_NOFILE": {soft: 1024, hard: 65536},
+				"RLIMIT_NPROC":  {soft: 100, hard: 200},
+			},
+		},
+		"should use the same hard limit if only one value is specified": {
+			values:   []string{"nofile=4096"},
+			expected: map[string]rlimit{"RLIMIT_NOFILE": {soft: 4096, hard: 4096}},
+		},
+		"should parse unlimited": {
+			values: []string{"memlock=unlimited", "core=0:unlimited"},
+			expected: map[string]rlimit{
+				"RLIMIT_MEMLOCK": {soft: ^uint64(0), hard: ^uint64(0)},
+				"RLIMIT_CORE":    {soft: 0, hard: ^uint64(0)},
+			},
+		},
+		"should return error if soft limit is larger than hard limit": {
+			values:    []string{"nofile=2048:1024"},
+			expectErr: true,
+		},
+		"should return error if soft limit is unlimited but hard limit is not": {
+			values:    []string{"nofile=unlimited:1024"},
+			expectErr: true,
+		},
+		"should return error for unknown rlimit name": {
+			values:    []string{"unknown=1024"},
+			expectErr: true,
+		},
+		"should return error for invalid format": {
+			values:    []string{"nofile"},
+			expectErr: true,
+		},
+		"should return error for invalid limit": {
+			values:    []string{"nofile=-1"},
+			expectErr: true,
+		},
+		"should return error for duplicated rlimit": {
+			values:    []string{"nofile=1024", "nofile=2048"},
+			expectErr: true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		rlimits, err := parseRlimits(test.values)
+		if test.expectErr {
+			assert.Error(t, err)
+			continue
+		}
+		require.NoError(t, err)
+		assert.Equal(t, test.expected, rlimits)
+	}
+}
+
+func TestGetRlimits(t *testing.T) {
+	defaults := map[string]rlimit{
+		"RLIMIT_NOFILE": {soft: 1024, hard: 4096},
+		"RLIMIT_NPROC":  {soft: 100, hard: 100},
+	}
+	for desc, test := range map[string]struct {
+		annotations map[string]string
+		expected    map[string]rlimit
+		expectErr   bool
+	}{
+		"should return default rlimits if nothing is requested": {
+			expected: defaults,
+		},
+		"should override default rlimits of the same type": {
+			annotations: map[string]string{rlimitsAnnotationKey: "nofile=65536:65536,core=0"},
+			expected: map[string]rlimit{
+				"RLIMIT_NOFILE": {soft: 65536, hard: 65536},
+				"RLIMIT_NPROC":  {soft: 100, hard: 100},
+				"RLIMIT_CORE":   {soft: 0, hard: 0},
+			},
+		},
+		"should return error for invalid rlimits": {
+			annotations: map[string]string{rlimitsAnnotationKey: "nofile=2:1"},
+			expectErr:   true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		rlimits, err := getRlimits(test.annotations, defaults)
+		if test.expectErr {
+			assert.Error(t, err)
+			continue
+		}
+		require.NoError(t, err)
+		assert.Equal(t, test.expected, rlimits)
+	}
+}
+
+func TestSetOCIRlimits(t *testing.T) {
+	g := generate.New()
+	defaultRlimits := append([]runtimespec.POSIXRlimit{}, g.Spec().Process.Rlimits...)
+	setOCIRlimits(&g, nil)
+	assert.Equal(t, defaultRlimits, g.Spec().Process.Rlimits, "runtime default rlimits should be kept")
+
+	setOCIRlimits(&g, map[string]rlimit{
+		"RLIMIT_NOFILE": {soft: 1024, hard: 65536},
+		"RLIMIT_NPROC":  {soft: 100, hard: 200},
+	})
+	assert.Contains(t, g.Spec().Process.Rlimits, runtimespec.POSIXRlimit{Type: "RLIMIT_NOFILE", Soft: 1024, Hard: 65536})
+	assert.Contains(t, g.Spec().Process.Rlimits, runtimespec.POSIXRlimit{Type: "RLIMIT_NPROC", Soft: 100, Hard: 200})
+	var nofile int
+	for _, r := range g.Spec().Process.Rlimits {
+		if r.Type == "RLIMIT_NOFILE" {
+			nofile++
+		}
+	}
+	assert.Equal(t, 1, nofile, "existing rlimit should be replaced")
+}
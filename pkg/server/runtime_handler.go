@@ -0,0 +1,109 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/containerd/containerd/containers"
+	"github.com/containerd/containerd/linux/runcopts"
+	"github.com/containerd/containerd/typeurl"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+
+	sandboxstore "github.com/kubernetes-incubator/cri-containerd/pkg/store/sandbox"
+)
+
+const (
+	// runtimeHandlerAnnotationKey is the sandbox annotation key of the runtime
+	// handler to run the sandbox with.
+	// TODO: Switch to the CRI RuntimeHandler field once the CRI api is bumped.
+	runtimeHandlerAnnotationKey = "io.kubernetes.cri-containerd.runtime-handler"
+	// defaultRuntimeHandler is the runtime handler used when none is specified.
+	// It always maps to the default containerd runtime.
+	defaultRuntimeHandler = ""
+)
+
+// parseRuntimeHandlers parses runtime handlers in the format of
+// "<handler>=<containerd runtime>", e.g. "kata=io.containerd.runtime.v1.kata".
+func parseRuntimeHandlers(handlers []string) (map[string]containers.RuntimeInfo, error) {
+	runtimes := make(map[string]containers.RuntimeInfo)
+	for _, handler := range handlers {
+		parts := strings.SplitN(handler, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid runtime handler %q", handler)
+		}
+		if _, ok := runtimes[parts[0]]; ok {
+			return nil, fmt.Errorf("duplicated runtime handler %q", parts[0])
+		}
+		runtimes[parts[0]] = containers.RuntimeInfo{Name: parts[1]}
+	}
+	return runtimes, nil
+}
+
+// getSandboxRuntimeHandler returns the runtime handler of a sandbox.
+func getSandboxRuntimeHandler(config *runtime.PodSandboxConfig) string {
+	return config.GetAnnotations()[runtimeHandlerAnnotationKey]
+}
+
+// getRuntime returns the containerd runtime of a runtime handler. It returns
+// error listing the supported handlers if the handler is unknown.
+func (c *criContainerdService) getRuntime(handler string) (containers.RuntimeInfo, error) {
+	if handler == defaultRuntimeHandler {
+		return c.withRuntimeOptions(containers.RuntimeInfo{Name: defaultRuntime})
+	}
+	r, ok := c.runtimeHandlers[handler]
+	if !ok {
+		supported := []string{"\"\""}
+		for h := range c.runtimeHandlers {
+			supported = append(supported, fmt.Sprintf("%q", h))
+		}
+		sort.Strings(supported)
+		return containers.RuntimeInfo{}, grpc.Errorf(codes.InvalidArgument, "unknown runtime handler %q, supported handlers are %s",
+			handler, strings.Join(supported, ", "))
+	}
+	return c.withRuntimeOptions(r)
+}
+
+// withRuntimeOptions sets the runc options of the default containerd runtime,
+// e.g. to make runc create cgroups through systemd with the systemd cgroup
+// driver. Other runtimes are returned unchanged.
+func (c *criContainerdService) withRuntimeOptions(r containers.RuntimeInfo) (containers.RuntimeInfo, error) {
+	if r.Name != defaultRuntime || c.config.CgroupDriver != cgroupDriverSystemd {
+		return r, nil
+	}
+	options, err := typeurl.MarshalAny(&runcopts.RuncOptions{SystemdCgroup: "true"})
+	if err != nil {
+		return containers.RuntimeInfo{}, fmt.Errorf("failed to marshal runc options: %v", err)
+	}
+	r.Options = options
+	return r, nil
+}
+
+// getContainerRuntime returns the containerd runtime of a container, which is
+// always the runtime of its sandbox. It returns error if the container asks for
+// a runtime handler different from the sandbox one.
+func (c *criContainerdService) getContainerRuntime(sandbox sandboxstore.Sandbox, config *runtime.ContainerConfig) (containers.RuntimeInfo, error) {
+	if handler, ok := config.GetAnnotations()[runtimeHandlerAnnotationKey]; ok && handler != sandbox.RuntimeHandler {
+		return containers.RuntimeInfo{}, grpc.Errorf(codes.InvalidArgument, "runtime handler %q is different from sandbox runtime handler %q",
+			handler, sandbox.RuntimeHandler)
+	}
+	return c.getRuntime(sandbox.RuntimeHandler)
+}
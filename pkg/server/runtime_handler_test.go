@@ -0,0 +1,222 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"testing"
+
+	"github.com/containerd/containerd/containers"
+	"github.com/containerd/containerd/linux/runcopts"
+	"github.com/containerd/containerd/typeurl"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+
+	servertesting "github.com/kubernetes-incubator/cri-containerd/pkg/server/testing"
+	sandboxstore "github.com/kubernetes-incubator/cri-containerd/pkg/store/sandbox"
+)
+
+func TestParseRuntimeHandlers(t *testing.T) {
+	for desc, test := range map[string]struct {
+		handlers  []string
+		expected  map[string]containers.RuntimeInfo
+		expectErr bool
+	}{
+		"should return empty map if no handler is configured": {
+			expected: map[string]containers.RuntimeInfo{},
+		},
+		"should parse runtime handlers": {
+			handlers: []string{"kata=io.containerd.runtime.v1.kata", "gvisor=io.containerd.runsc.v1"},
+			expected: map[string]containers.RuntimeInfo{
+				"kata":   {Name: "io.containerd.runtime.v1.kata"},
+				"gvisor": {Name: "io.containerd.runsc.v1"},
+			},
+		},
+		"should return error for handler without runtime": {
+			handlers:  []string{"kata="},
+			expectErr: true,
+		},
+		"should return error for runtime without handler": {
+			handlers:  []string{"=io.containerd.runtime.v1.kata"},
+			expectErr: true,
+		},
+		"should return error for duplicated handler": {
+			handlers:  []string{"kata=runtime-1", "kata=runtime-2"},
+			expectErr: true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		runtimes, err := parseRuntimeHandlers(test.handlers)
+		if test.expectErr {
+			assert.Error(t, err)
+			continue
+		}
+		assert.NoError(t, err)
+		assert.Equal(t, test.expected, runtimes)
+	}
+}
+
+func TestGetRuntime(t *testing.T) {
+	c := newTestCRIContainerdService()
+	c.runtimeHandlers = map[string]containers.RuntimeInfo{
+		"kata": {Name: "io.containerd.runtime.v1.kata"},
+	}
+	for desc, test := range map[string]struct {
+		handler   string
+		expected  containers.RuntimeInfo
+		expectErr bool
+	}{
+		"should return default runtime for default handler": {
+			handler:  defaultRuntimeHandler,
+			expected: containers.RuntimeInfo{Name: defaultRuntime},
+		},
+		"should return runtime of configured handler": {
+			handler:  "kata",
+			expected: containers.RuntimeInfo{Name: "io.containerd.runtime.v1.kata"},
+		},
+		"should return error for unknown handler": {
+			handler:   "unknown",
+			expectErr: true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		r, err := c.getRuntime(test.handler)
+		if test.expectErr {
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), `supported handlers are "", "kata"`)
+			continue
+		}
+		assert.NoError(t, err)
+		assert.Equal(t, test.expected, r)
+	}
+}
+
+func TestGetRuntimeWithSystemdCgroup(t *testing.T) {
+	c := newTestCRIContainerdService()
+	c.config.CgroupDriver = cgroupDriverSystemd
+	c.runtimeHandlers = map[string]containers.RuntimeInfo{
+		"runc": {Name: defaultRuntime},
+		"kata": {Name: "io.containerd.runtime.v1.kata"},
+	}
+	for _, handler := range []string{defaultRuntimeHandler, "runc"} {
+		r, err := c.getRuntime(handler)
+		require.NoError(t, err)
+		require.NotNil(t, r.Options, "handler %q should have runc options", handler)
+		v, err := typeurl.UnmarshalAny(r.Options)
+		require.NoError(t, err)
+		assert.Equal(t, &runcopts.RuncOptions{SystemdCgroup: "true"}, v)
+	}
+	r, err := c.getRuntime("kata")
+	assert.NoError(t, err)
+	assert.Equal(t, containers.RuntimeInfo{Name: "io.containerd.runtime.v1.kata"}, r,
+		"non-runc runtime should not have runc options")
+}
+
+func TestRunPodSandboxUnknownRuntimeHandler(t *testing.T) {
+	c := newTestCRIContainerdService()
+	fakeContainerService := c.containerService.(*servertesting.FakeContainerService)
+	config := &runtime.PodSandboxConfig{
+		Metadata: &runtime.PodSandboxMetadata{
+			Name:      "test-name",
+			Namespace: "test-ns",
+			Uid:       "test-uid",
+		},
+		Annotations: map[string]string{runtimeHandlerAnnotationKey: "unknown"},
+	}
+	_, err := c.RunPodSandbox(context.Background(), &runtime.RunPodSandboxRequest{Config: config})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), `unknown runtime handler "unknown"`)
+	cntrs, err := fakeContainerService.List(context.Background())
+	assert.NoError(t, err)
+	assert.Empty(t, cntrs, "no container should be created")
+	assert.NoError(t, c.sandboxNameIndex.Reserve(makeSandboxName(config.GetMetadata()), "other-id"),
+		"sandbox name should not be reserved")
+}
+
+func TestGetContainerRuntime(t *testing.T) {
+	c := newTestCRIContainerdService()
+	c.runtimeHandlers = map[string]containers.RuntimeInfo{
+		"kata": {Name: "io.containerd.runtime.v1.kata"},
+	}
+	for desc, test := range map[string]struct {
+		sandboxHandler string
+		annotations    map[string]string
+		expected       containers.RuntimeInfo
+		expectErr      bool
+	}{
+		"should inherit default runtime from sandbox": {
+			expected: containers.RuntimeInfo{Name: defaultRuntime},
+		},
+		"should inherit runtime from sandbox": {
+			sandboxHandler: "kata",
+			expected:       containers.RuntimeInfo{Name: "io.containerd.runtime.v1.kata"},
+		},
+		"should accept the same runtime handler as sandbox": {
+			sandboxHandler: "kata",
+			annotations:    map[string]string{runtimeHandlerAnnotationKey: "kata"},
+			expected:       containers.RuntimeInfo{Name: "io.containerd.runtime.v1.kata"},
+		},
+		"should reject runtime handler different from sandbox": {
+			sandboxHandler: "kata",
+			annotations:    map[string]string{runtimeHandlerAnnotationKey: ""},
+			expectErr:      true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		sandbox := sandboxstore.Sandbox{
+			Metadata: sandboxstore.Metadata{
+				ID:             "test-sandbox-id",
+				RuntimeHandler: test.sandboxHandler,
+			},
+		}
+		r, err := c.getContainerRuntime(sandbox, &runtime.ContainerConfig{Annotations: test.annotations})
+		if test.expectErr {
+			assert.Error(t, err)
+			continue
+		}
+		assert.NoError(t, err)
+		assert.Equal(t, test.expected, r)
+	}
+}
+
+func TestCreateContainerRuntimeHandlerMismatch(t *testing.T) {
+	c := newTestCRIContainerdService()
+	c.runtimeHandlers = map[string]containers.RuntimeInfo{
+		"kata": {Name: "io.containerd.runtime.v1.kata"},
+	}
+	fakeContainerService := c.containerService.(*servertesting.FakeContainerService)
+	assert.NoError(t, c.sandboxStore.Add(sandboxstore.Sandbox{
+		Metadata: sandboxstore.Metadata{
+			ID:             "test-sandbox-id",
+			Config:         &runtime.PodSandboxConfig{},
+			RuntimeHandler: "kata",
+		},
+	}))
+	_, err := c.CreateContainer(context.Background(), &runtime.CreateContainerRequest{
+		PodSandboxId: "test-sandbox-id",
+		Config: &runtime.ContainerConfig{
+			Metadata:    &runtime.ContainerMetadata{Name: "test-name"},
+			Annotations: map[string]string{runtimeHandlerAnnotationKey: "unknown"},
+		},
+		SandboxConfig: &runtime.PodSandboxConfig{},
+	})
+	assert.Error(t, err)
+	cntrs, err := fakeContainerService.List(context.Background())
+	assert.NoError(t, err)
+	assert.Empty(t, cntrs, "no container should be created")
+}
@@ -0,0 +1,188 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+)
+
+const (
+	// managedHostsHeader is the header of the hosts file generated for a sandbox.
+	managedHostsHeader = "# Kubernetes-managed hosts file (cri-containerd).\n"
+	// hostAliasesHeader is the header of the host alias entries in the hosts file
+	// generated for a sandbox.
+	hostAliasesHeader = "# Entries added by HostAliases.\n"
+	// hostAliasesAnnotationKey is the sandbox annotation key of the host aliases
+	// added into the hosts file of the sandbox. The value is a json list, e.g.
+	// [{"ip": "10.1.2.3", "hostnames": ["foo.local", "bar.local"]}].
+	// TODO: Switch to the CRI HostAliases field once the CRI api is bumped.
+	hostAliasesAnnotationKey = "io.kubernetes.cri-containerd.host-aliases"
+)
+
+// hostAlias maps hostnames to an ip in the hosts file of a sandbox.
+type hostAlias struct {
+	IP        string   `json:"ip"`
+	Hostnames []string `json:"hostnames"`
+}
+
+// defaultHostsEntries are the standard localhost entries of the hosts file
+// generated for a sandbox.
+var defaultHostsEntries = [][2]string{
+	{"127.0.0.1", "localhost"},
+	{"::1", "localhost ip6-localhost ip6-loopback"},
+	{"fe00::0", "ip6-localnet"},
+	{"fe00::0", "ip6-mcastprefix"},
+	{"fe00::1", "ip6-allnodes"},
+	{"fe00::2", "ip6-allrouters"},
+}
+
+// getSandboxHostname returns the hostname of the sandbox. The host hostname
+// is returned if the sandbox config doesn't specify one.
+func getSandboxHostname(config *runtime.PodSandboxConfig) (string, error) {
+	if hostname := config.GetHostname(); hostname != "" {
+		return hostname, nil
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", fmt.Errorf("failed to get host hostname: %v", err)
+	}
+	return hostname, nil
+}
+
+// getHostAliases returns the host aliases in the sandbox annotations. It returns
+// an InvalidArgument error if the annotation is malformed, or any ip or hostname
+// is invalid.
+func getHostAliases(annotations map[string]string) ([]hostAlias, error) {
+	value, ok := annotations[hostAliasesAnnotationKey]
+	if !ok {
+		return nil, nil
+	}
+	var aliases []hostAlias
+	if err := json.Unmarshal([]byte(value), &aliases); err != nil {
+		return nil, grpc.Errorf(codes.InvalidArgument, "invalid host aliases %q in annotation %q: %v",
+			value, hostAliasesAnnotationKey, err)
+	}
+	for _, alias := range aliases {
+		if net.ParseIP(alias.IP) == nil {
+			return nil, grpc.Errorf(codes.InvalidArgument, "invalid ip %q in host aliases", alias.IP)
+		}
+		if len(alias.Hostnames) == 0 {
+			return nil, grpc.Errorf(codes.InvalidArgument, "no hostname for ip %q in host aliases", alias.IP)
+		}
+		for _, hostname := range alias.Hostnames {
+			if errs := validation.IsDNS1123Subdomain(hostname); len(errs) > 0 {
+				return nil, grpc.Errorf(codes.InvalidArgument, "invalid hostname %q for ip %q in host aliases: %s",
+					hostname, alias.IP, strings.Join(errs, "; "))
+			}
+		}
+	}
+	return aliases, nil
+}
+
+// generateSandboxHosts generates the content of the hosts file of a sandbox,
+// which includes the standard localhost entries, an entry mapping each ip of
+// the sandbox to its hostname, and the host aliases. Hostnames of the host
+// aliases which are already mapped to the same ip are skipped.
+func generateSandboxHosts(hostname string, ips []string, aliases []hostAlias) []byte {
+	var buf bytes.Buffer
+	// existing is the set of existing ip and hostname pairs.
+	existing := make(map[[2]string]bool)
+	add := func(ip string, hostnames []string) {
+		fmt.Fprintf(&buf, "%s\t%s\n", ip, strings.Join(hostnames, " "))
+		for _, h := range hostnames {
+			existing[[2]string{normalizeIP(ip), h}] = true
+		}
+	}
+	buf.WriteString(managedHostsHeader)
+	for _, entry := range defaultHostsEntries {
+		add(entry[0], strings.Fields(entry[1]))
+	}
+	for _, ip := range ips {
+		add(ip, []string{hostname})
+	}
+	headerAdded := false
+	for _, alias := range aliases {
+		var hostnames []string
+		for _, h := range alias.Hostnames {
+			if !existing[[2]string{normalizeIP(alias.IP), h}] {
+				hostnames = append(hostnames, h)
+				// Also deduplicate hostnames within the alias.
+				existing[[2]string{normalizeIP(alias.IP), h}] = true
+			}
+		}
+		if len(hostnames) == 0 {
+			continue
+		}
+		if !headerAdded {
+			buf.WriteString("\n" + hostAliasesHeader)
+			headerAdded = true
+		}
+		fmt.Fprintf(&buf, "%s\t%s\n", alias.IP, strings.Join(hostnames, " "))
+	}
+	return buf.Bytes()
+}
+
+// normalizeIP returns the canonical form of the ip, e.g. "fe00::" for "fe00::0",
+// so that different forms of the same ip are deduplicated.
+func normalizeIP(ip string) string {
+	if parsed := net.ParseIP(ip); parsed != nil {
+		return parsed.String()
+	}
+	return ip
+}
+
+// setupSandboxHostname writes the hostname file of the sandbox.
+func (c *criContainerdService) setupSandboxHostname(rootDir string, config *runtime.PodSandboxConfig) error {
+	hostname, err := getSandboxHostname(config)
+	if err != nil {
+		return err
+	}
+	sandboxHostname := getSandboxHostnamePath(rootDir)
+	if err := c.os.WriteFile(sandboxHostname, []byte(hostname+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to write sandbox hostname file %q: %v", sandboxHostname, err)
+	}
+	return nil
+}
+
+// setupSandboxHosts writes the hosts file of a non-host-network sandbox with
+// the ips and the host aliases of the sandbox. It must be called after the
+// sandbox network is set up.
+func (c *criContainerdService) setupSandboxHosts(rootDir string, config *runtime.PodSandboxConfig, ips []string) error {
+	hostname, err := getSandboxHostname(config)
+	if err != nil {
+		return err
+	}
+	aliases, err := getHostAliases(config.GetAnnotations())
+	if err != nil {
+		return err
+	}
+	sandboxEtcHosts := getSandboxHosts(rootDir)
+	if err := c.os.WriteFile(sandboxEtcHosts, generateSandboxHosts(hostname, ips, aliases), 0644); err != nil {
+		return fmt.Errorf("failed to write sandbox hosts file %q: %v", sandboxEtcHosts, err)
+	}
+	return nil
+}
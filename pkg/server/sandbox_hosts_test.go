@@ -0,0 +1,146 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+func TestGenerateSandboxHosts(t *testing.T) {
+	for desc, test := range map[string]struct {
+		hostname string
+		ips      []string
+		aliases  []hostAlias
+		expected string
+	}{
+		"should generate default entries without ip": {
+			hostname: "test-hostname",
+			expected: `# Kubernetes-managed hosts file (cri-containerd).
+127.0.0.1	localhost
+::1	localhost ip6-localhost ip6-loopback
+fe00::0	ip6-localnet
+fe00::0	ip6-mcastprefix
+fe00::1	ip6-allnodes
+fe00::2	ip6-allrouters
+`,
+		},
+		"should map all sandbox ips to hostname": {
+			hostname: "test-hostname",
+			ips:      []string{"10.0.0.1", "fd00::1"},
+			expected: `# Kubernetes-managed hosts file (cri-containerd).
+127.0.0.1	localhost
+::1	localhost ip6-localhost ip6-loopback
+fe00::0	ip6-localnet
+fe00::0	ip6-mcastprefix
+fe00::1	ip6-allnodes
+fe00::2	ip6-allrouters
+10.0.0.1	test-hostname
+fd00::1	test-hostname
+`,
+		},
+		"should append host aliases and skip existing entries": {
+			hostname: "test-hostname",
+			ips:      []string{"10.0.0.1"},
+			aliases: []hostAlias{
+				{IP: "10.0.0.1", Hostnames: []string{"test-hostname", "foo.local"}},
+				{IP: "127.0.0.1", Hostnames: []string{"localhost"}},
+				{IP: "10.1.2.3", Hostnames: []string{"bar.local", "bar.local", "baz.local"}},
+				{IP: "0:0:0:0:0:0:0:1", Hostnames: []string{"ip6-localhost", "qux.local"}},
+			},
+			expected: `# Kubernetes-managed hosts file (cri-containerd).
+127.0.0.1	localhost
+::1	localhost ip6-localhost ip6-loopback
+fe00::0	ip6-localnet
+fe00::0	ip6-mcastprefix
+fe00::1	ip6-allnodes
+fe00::2	ip6-allrouters
+10.0.0.1	test-hostname
+
+# Entries added by HostAliases.
+10.0.0.1	foo.local
+10.1.2.3	bar.local baz.local
+0:0:0:0:0:0:0:1	qux.local
+`,
+		},
+		"should not add host aliases header if all aliases exist": {
+			hostname: "test-hostname",
+			aliases:  []hostAlias{{IP: "127.0.0.1", Hostnames: []string{"localhost"}}},
+			expected: `# Kubernetes-managed hosts file (cri-containerd).
+127.0.0.1	localhost
+::1	localhost ip6-localhost ip6-loopback
+fe00::0	ip6-localnet
+fe00::0	ip6-mcastprefix
+fe00::1	ip6-allnodes
+fe00::2	ip6-allrouters
+`,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		assert.Equal(t, test.expected, string(generateSandboxHosts(test.hostname, test.ips, test.aliases)))
+	}
+}
+
+func TestGetHostAliases(t *testing.T) {
+	for desc, test := range map[string]struct {
+		annotations map[string]string
+		expected    []hostAlias
+		expectErr   bool
+	}{
+		"should return nil if host aliases annotation is not set": {
+			annotations: map[string]string{"a": "b"},
+		},
+		"should parse host aliases": {
+			annotations: map[string]string{
+				hostAliasesAnnotationKey: `[{"ip": "10.1.2.3", "hostnames": ["foo.local", "bar"]}, {"ip": "fd00::1", "hostnames": ["baz"]}]`,
+			},
+			expected: []hostAlias{
+				{IP: "10.1.2.3", Hostnames: []string{"foo.local", "bar"}},
+				{IP: "fd00::1", Hostnames: []string{"baz"}},
+			},
+		},
+		"should return error for malformed annotation": {
+			annotations: map[string]string{hostAliasesAnnotationKey: `{"ip": "10.1.2.3"}`},
+			expectErr:   true,
+		},
+		"should return error for invalid ip": {
+			annotations: map[string]string{hostAliasesAnnotationKey: `[{"ip": "10.1.2", "hostnames": ["foo"]}]`},
+			expectErr:   true,
+		},
+		"should return error for invalid hostname": {
+			annotations: map[string]string{hostAliasesAnnotationKey: `[{"ip": "10.1.2.3", "hostnames": ["Foo_Bar"]}]`},
+			expectErr:   true,
+		},
+		"should return error if no hostname is specified": {
+			annotations: map[string]string{hostAliasesAnnotationKey: `[{"ip": "10.1.2.3"}]`},
+			expectErr:   true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		aliases, err := getHostAliases(test.annotations)
+		if test.expectErr {
+			assert.Error(t, err)
+			assert.Equal(t, codes.InvalidArgument, grpc.Code(err))
+			continue
+		}
+		assert.NoError(t, err)
+		assert.Equal(t, test.expected, aliases)
+	}
+}
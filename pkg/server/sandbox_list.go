@@ -19,7 +19,6 @@ package server
 import (
 	"fmt"
 
-	"github.com/golang/glog"
 	"golang.org/x/net/context"
 
 	"github.com/containerd/containerd/api/services/tasks/v1"
@@ -27,15 +26,16 @@ import (
 	"github.com/containerd/containerd/api/types/task"
 	"k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
 
+	"github.com/kubernetes-incubator/cri-containerd/pkg/log"
 	sandboxstore "github.com/kubernetes-incubator/cri-containerd/pkg/store/sandbox"
 )
 
 // ListPodSandbox returns a list of Sandbox.
 func (c *criContainerdService) ListPodSandbox(ctx context.Context, r *runtime.ListPodSandboxRequest) (retRes *runtime.ListPodSandboxResponse, retErr error) {
-	glog.V(4).Infof("ListPodSandbox with filter %+v", r.GetFilter())
+	log.G(ctx).V(4).Infof("ListPodSandbox with filter %+v", r.GetFilter())
 	defer func() {
 		if retErr == nil {
-			glog.V(4).Infof("ListPodSandbox returns sandboxes %+v", retRes.GetItems())
+			log.G(ctx).V(4).Infof("ListPodSandbox returns sandboxes %+v", retRes.GetItems())
 		}
 	}()
 
@@ -58,13 +58,7 @@ func (c *criContainerdService) ListPodSandbox(ctx context.Context, r *runtime.Li
 			}
 		}
 
-		// Set sandbox state to NOTREADY by default.
-		state := runtime.PodSandboxState_SANDBOX_NOTREADY
-		// If the sandbox container is running, return the sandbox as READY.
-		if sandboxInContainerd != nil && sandboxInContainerd.Status == task.StatusRunning {
-			state = runtime.PodSandboxState_SANDBOX_READY
-		}
-
+		state := c.getSandboxState(sandboxInStore, sandboxInContainerd)
 		sandboxes = append(sandboxes, toCRISandbox(sandboxInStore.Metadata, state))
 	}
 
@@ -100,19 +94,10 @@ func (c *criContainerdService) filterCRISandboxes(sandboxes []*runtime.PodSandbo
 		if filter.GetState() != nil && filter.GetState().GetState() != s.State {
 			continue
 		}
-		// Filter by label
-		if filter.GetLabelSelector() != nil {
-			match := true
-			for k, v := range filter.GetLabelSelector() {
-				got, ok := s.Labels[k]
-				if !ok || got != v {
-					match = false
-					break
-				}
-			}
-			if !match {
-				continue
-			}
+		// Filter by label, all labels in the selector must match. Annotations
+		// are not used for filtering.
+		if !matchLabelSelector(filter.GetLabelSelector(), s.Labels) {
+			continue
 		}
 		filtered = append(filtered, s)
 	}
@@ -79,6 +79,13 @@ func TestFilterSandboxes(t *testing.T) {
 			State:    runtime.PodSandboxState_SANDBOX_READY,
 			Labels:   map[string]string{"c": "d"},
 		},
+		{
+			Id:          "4",
+			Metadata:    &runtime.PodSandboxMetadata{Name: "name-4", Uid: "uid-4", Namespace: "ns-4", Attempt: 1},
+			State:       runtime.PodSandboxState_SANDBOX_NOTREADY,
+			Labels:      map[string]string{"a": "b", "c": "d"},
+			Annotations: map[string]string{"e": "f"},
+		},
 	}
 	for desc, test := range map[string]struct {
 		filter *runtime.PodSandboxFilter
@@ -103,7 +110,33 @@ func TestFilterSandboxes(t *testing.T) {
 			filter: &runtime.PodSandboxFilter{
 				LabelSelector: map[string]string{"a": "b"},
 			},
-			expect: []*runtime.PodSandbox{testSandboxes[1]},
+			expect: []*runtime.PodSandbox{testSandboxes[1], testSandboxes[3]},
+		},
+		"not ready state filter": {
+			filter: &runtime.PodSandboxFilter{
+				State: &runtime.PodSandboxStateValue{
+					State: runtime.PodSandboxState_SANDBOX_NOTREADY,
+				},
+			},
+			expect: []*runtime.PodSandbox{testSandboxes[1], testSandboxes[3]},
+		},
+		"multi-label filter matched": {
+			filter: &runtime.PodSandboxFilter{
+				LabelSelector: map[string]string{"a": "b", "c": "d"},
+			},
+			expect: []*runtime.PodSandbox{testSandboxes[3]},
+		},
+		"multi-label filter not matched": {
+			filter: &runtime.PodSandboxFilter{
+				LabelSelector: map[string]string{"a": "b", "c": "x"},
+			},
+			expect: []*runtime.PodSandbox{},
+		},
+		"annotation should not be used as label": {
+			filter: &runtime.PodSandboxFilter{
+				LabelSelector: map[string]string{"e": "f"},
+			},
+			expect: []*runtime.PodSandbox{},
 		},
 		"mixed filter not matched": {
 			filter: &runtime.PodSandboxFilter{
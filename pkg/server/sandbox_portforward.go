@@ -17,14 +17,149 @@ limitations under the License.
 package server
 
 import (
-	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	goruntime "runtime"
 
+	"github.com/containerd/containerd/api/services/tasks/v1"
+	"github.com/containerd/containerd/api/types/task"
 	"golang.org/x/net/context"
-
+	"golang.org/x/sys/unix"
 	"k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+
+	"github.com/kubernetes-incubator/cri-containerd/pkg/log"
 )
 
 // PortForward prepares a streaming endpoint to forward ports from a PodSandbox, and returns the address.
-func (c *criContainerdService) PortForward(ctx context.Context, r *runtime.PortForwardRequest) (*runtime.PortForwardResponse, error) {
-	return nil, errors.New("not implemented")
+func (c *criContainerdService) PortForward(ctx context.Context, r *runtime.PortForwardRequest) (retRes *runtime.PortForwardResponse, retErr error) {
+	log.G(ctx).V(2).Infof("Portforward for sandbox %q port %v", r.GetPodSandboxId(), r.GetPort())
+	defer func() {
+		if retErr == nil {
+			log.G(ctx).V(2).Infof("Portforward for %q returns URL %q", r.GetPodSandboxId(), retRes.GetUrl())
+		}
+	}()
+
+	sandbox, err := c.sandboxStore.Get(r.GetPodSandboxId())
+	if err != nil {
+		return nil, wrapGRPCError(err, "failed to find sandbox %q", r.GetPodSandboxId())
+	}
+	if err := c.checkSandboxRunning(ctx, sandbox.ID); err != nil {
+		return nil, err
+	}
+	return c.streamServer.GetPortForward(r)
+}
+
+// portForward forwards the stream to the port inside the sandbox network namespace.
+// The host loopback is used for sandbox in host network.
+func (c *criContainerdService) portForward(id string, port int32, stream io.ReadWriteCloser) error {
+	sandbox, err := c.sandboxStore.Get(id)
+	if err != nil {
+		return wrapGRPCError(err, "failed to find sandbox %q", id)
+	}
+	id = sandbox.ID
+	if err := c.checkSandboxRunning(context.Background(), id); err != nil {
+		return err
+	}
+
+	addr := fmt.Sprintf("localhost:%d", port)
+	var conn net.Conn
+	if sandbox.Config.GetLinux().GetSecurityContext().GetNamespaceOptions().GetHostNetwork() {
+		conn, err = net.Dial("tcp", addr)
+	} else {
+		conn, err = dialInNetNS(sandbox.NetNS, addr)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to connect to %q in sandbox %q: %v", addr, id, err)
+	}
+	defer conn.Close()
+
+	log.L.V(4).Infof("Start port forwarding to %q in sandbox %q", addr, id)
+	// Half close the backend connection once the client finishes sending, so that
+	// the backend still could send the rest of response.
+	go func() {
+		if _, err := io.Copy(conn, stream); err != nil {
+			log.L.V(4).Infof("Failed to copy port forward input for %q in sandbox %q: %v", addr, id, err)
+		}
+		if tcpConn, ok := conn.(*net.TCPConn); ok {
+			tcpConn.CloseWrite() // nolint: errcheck
+		}
+	}()
+	// Port forwarding finishes once the backend closes the connection.
+	if _, err := io.Copy(stream, conn); err != nil {
+		return fmt.Errorf("failed to copy port forward output for %q in sandbox %q: %v", addr, id, err)
+	}
+	log.L.V(4).Infof("Finish port forwarding to %q in sandbox %q", addr, id)
+	return nil
+}
+
+// checkSandboxRunning returns error if the sandbox container is not running.
+func (c *criContainerdService) checkSandboxRunning(ctx context.Context, id string) error {
+	info, err := c.taskService.Get(ctx, &tasks.GetTaskRequest{ContainerID: id})
+	if err != nil {
+		if isContainerdGRPCNotFoundError(err) {
+			return fmt.Errorf("sandbox container %q is not running", id)
+		}
+		return fmt.Errorf("failed to get sandbox container info for %q: %v", id, err)
+	}
+	if info.Task.Status != task.StatusRunning {
+		return fmt.Errorf("sandbox container %q is not running", id)
+	}
+	return nil
+}
+
+// dialInNetNS connects to the tcp address inside the network namespace. The
+// socket stays in the network namespace after the calling thread switches back.
+func dialInNetNS(netNS string, addr string) (net.Conn, error) {
+	var conn net.Conn
+	err := runInNetNS(netNS, func() error {
+		var err error
+		conn, err = net.Dial("tcp", addr)
+		return err
+	})
+	return conn, err
+}
+
+// runInNetNS runs the function inside the network namespace.
+func runInNetNS(netNS string, fn func() error) error {
+	errCh := make(chan error, 1)
+	// Run in a dedicated goroutine locked to its thread. If the thread fails
+	// to switch back, the goroutine exits without unlocking the thread, so that
+	// the thread is terminated instead of being reused in the wrong namespace.
+	go func() {
+		goruntime.LockOSThread()
+		restored, err := runOnCurrentThread(netNS, fn)
+		errCh <- err
+		if restored {
+			goruntime.UnlockOSThread()
+		}
+	}()
+	return <-errCh
+}
+
+// runOnCurrentThread switches the current thread into the network namespace,
+// runs the function, and switches the thread back. It returns whether the
+// thread is switched back successfully. Must be called with the thread locked.
+func runOnCurrentThread(netNS string, fn func() error) (bool, error) {
+	origNS, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", unix.Gettid()))
+	if err != nil {
+		return true, fmt.Errorf("failed to open current network namespace: %v", err)
+	}
+	defer origNS.Close()
+	targetNS, err := os.Open(netNS)
+	if err != nil {
+		return true, fmt.Errorf("failed to open network namespace %q: %v", netNS, err)
+	}
+	defer targetNS.Close()
+
+	if err := unix.Setns(int(targetNS.Fd()), unix.CLONE_NEWNET); err != nil {
+		return true, fmt.Errorf("failed to enter network namespace %q: %v", netNS, err)
+	}
+	fnErr := fn()
+	if err := unix.Setns(int(origNS.Fd()), unix.CLONE_NEWNET); err != nil {
+		log.L.Errorf("Failed to switch back from network namespace %q: %v", netNS, err)
+		return false, fnErr
+	}
+	return true, fnErr
 }
@@ -0,0 +1,100 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/containerd/containerd/api/types/task"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+
+	servertesting "github.com/kubernetes-incubator/cri-containerd/pkg/server/testing"
+	sandboxstore "github.com/kubernetes-incubator/cri-containerd/pkg/store/sandbox"
+)
+
+// fakeStream is a fake port forward stream.
+type fakeStream struct {
+	in  io.Reader
+	out bytes.Buffer
+}
+
+func (f *fakeStream) Read(p []byte) (int, error) { return f.in.Read(p) }
+
+func (f *fakeStream) Write(p []byte) (int, error) { return f.out.Write(p) }
+
+func (f *fakeStream) Close() error { return nil }
+
+func TestPortForwardHostNetwork(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// Only respond after the client half closes the connection.
+		data, _ := ioutil.ReadAll(conn)
+		conn.Write(append([]byte("response to "), data...)) // nolint: errcheck
+	}()
+	port := l.Addr().(*net.TCPAddr).Port
+
+	for desc, test := range map[string]struct {
+		taskStatus task.Status
+		expectErr  bool
+	}{
+		"should return error if sandbox is not running": {
+			taskStatus: task.StatusStopped,
+			expectErr:  true,
+		},
+		"should forward port on host loopback for host network sandbox": {
+			taskStatus: task.StatusRunning,
+		},
+	} {
+		c := newTestCRIContainerdService()
+		require.NoError(t, c.sandboxStore.Add(sandboxstore.Sandbox{
+			Metadata: sandboxstore.Metadata{
+				ID: "test-id",
+				Config: &runtime.PodSandboxConfig{
+					Linux: &runtime.LinuxPodSandboxConfig{
+						SecurityContext: &runtime.LinuxSandboxSecurityContext{
+							NamespaceOptions: &runtime.NamespaceOption{HostNetwork: true},
+						},
+					},
+				},
+			},
+		}))
+		c.taskService.(*servertesting.FakeTaskService).SetFakeTasks([]task.Task{
+			{ID: "test-id", Pid: 1, Status: test.taskStatus},
+		})
+		stream := &fakeStream{in: bytes.NewBufferString("request")}
+		err := c.portForward("test-id", int32(port), stream)
+		if test.expectErr {
+			assert.Error(t, err, desc)
+			continue
+		}
+		assert.NoError(t, err, desc)
+		assert.Equal(t, "response to request", stream.out.String(), desc)
+	}
+}
@@ -18,34 +18,34 @@ package server
 
 import (
 	"fmt"
+	"sort"
 
 	"github.com/containerd/containerd/api/services/tasks/v1"
-	"github.com/containerd/containerd/errdefs"
-	"github.com/golang/glog"
 	"golang.org/x/net/context"
 	"k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
 
+	"github.com/kubernetes-incubator/cri-containerd/pkg/log"
 	"github.com/kubernetes-incubator/cri-containerd/pkg/store"
 )
 
-// RemovePodSandbox removes the sandbox. If there are running containers in the
-// sandbox, they should be forcibly removed.
+// RemovePodSandbox removes the sandbox. The sandbox must be stopped, and all
+// containers in the sandbox must be removed before.
 func (c *criContainerdService) RemovePodSandbox(ctx context.Context, r *runtime.RemovePodSandboxRequest) (retRes *runtime.RemovePodSandboxResponse, retErr error) {
-	glog.V(2).Infof("RemovePodSandbox for sandbox %q", r.GetPodSandboxId())
+	log.G(ctx).V(2).Infof("RemovePodSandbox for sandbox %q", r.GetPodSandboxId())
 	defer func() {
 		if retErr == nil {
-			glog.V(2).Infof("RemovePodSandbox %q returns successfully", r.GetPodSandboxId())
+			log.G(ctx).V(2).Infof("RemovePodSandbox %q returns successfully", r.GetPodSandboxId())
 		}
 	}()
 
 	sandbox, err := c.sandboxStore.Get(r.GetPodSandboxId())
 	if err != nil {
 		if err != store.ErrNotExist {
-			return nil, fmt.Errorf("an error occurred when try to find sandbox %q: %v",
-				r.GetPodSandboxId(), err)
+			return nil, wrapGRPCError(err, "an error occurred when try to find sandbox %q",
+				r.GetPodSandboxId())
 		}
 		// Do not return error if the id doesn't exist.
-		glog.V(5).Infof("RemovePodSandbox called for sandbox %q that does not exist",
+		log.G(ctx).V(5).Infof("RemovePodSandbox called for sandbox %q that does not exist",
 			r.GetPodSandboxId())
 		return &runtime.RemovePodSandboxResponse{}, nil
 	}
@@ -62,34 +62,45 @@ func (c *criContainerdService) RemovePodSandbox(ctx context.Context, r *runtime.
 		return nil, fmt.Errorf("sandbox container %q is not fully stopped", id)
 	}
 
-	// Remove sandbox container snapshot.
-	if err := c.snapshotService.Remove(ctx, id); err != nil {
-		if !errdefs.IsNotFound(err) {
-			return nil, fmt.Errorf("failed to remove sandbox container snapshot %q: %v", id, err)
-		}
-		glog.V(5).Infof("Remove called for snapshot %q that does not exist", id)
-	}
-
-	// Remove all containers inside the sandbox.
+	// Refuse to remove the sandbox if it still has containers, so that container
+	// resources are cleaned up by RemoveContainer.
 	// NOTE(random-liu): container could still be created after this point, Kubelet should
 	// not rely on this behavior.
 	// TODO(random-liu): Introduce an intermediate state to avoid container creation after
 	// this point.
-	cntrs := c.containerStore.List()
-	for _, cntr := range cntrs {
-		if cntr.SandboxID != id {
-			continue
+	var cntrIDs []string
+	for _, cntr := range c.containerStore.List() {
+		if cntr.SandboxID == id {
+			cntrIDs = append(cntrIDs, cntr.ID)
 		}
-		_, err = c.RemoveContainer(ctx, &runtime.RemoveContainerRequest{ContainerId: cntr.ID})
-		if err != nil {
-			return nil, fmt.Errorf("failed to remove container %q: %v", cntr.ID, err)
+	}
+	if len(cntrIDs) > 0 {
+		sort.Strings(cntrIDs)
+		return nil, fmt.Errorf("sandbox %q still has containers %v, remove them first", id, cntrIDs)
+	}
+
+	// NOTE: The sandbox container is deleted after all other resources, so that
+	// an interrupted removal leaves the sandbox recoverable on restart, and a
+	// retry cleans up the remaining resources.
+
+	// Remove sandbox container snapshot.
+	if err := c.snapshotService.Remove(ctx, id); err != nil {
+		if !isContainerdGRPCNotFoundError(err) {
+			return nil, fmt.Errorf("failed to remove sandbox container snapshot %q: %v", id, err)
 		}
+		log.G(ctx).V(5).Infof("Remove called for snapshot %q that does not exist", id)
 	}
 
-	// TODO(random-liu): [P1] Remove permanent namespace once used.
+	// TODO(random-liu): [P1] Remove permanent namespace once used. The network
+	// namespace is the one of the sandbox container process for now, which is
+	// gone with the process.
 
-	// Cleanup the sandbox root directory.
+	// Cleanup the sandbox root directory. Unmount sandbox files first, in case
+	// StopPodSandbox failed to unmount them, so that the mounts are not leaked.
 	sandboxRootDir := getSandboxRootDir(c.rootDir, id)
+	if err := c.unmountSandboxFiles(sandboxRootDir, sandbox.Config); err != nil {
+		return nil, fmt.Errorf("failed to unmount sandbox files in %q: %v", sandboxRootDir, err)
+	}
 	if err := c.os.RemoveAll(sandboxRootDir); err != nil {
 		return nil, fmt.Errorf("failed to remove sandbox root directory %q: %v",
 			sandboxRootDir, err)
@@ -100,7 +111,7 @@ func (c *criContainerdService) RemovePodSandbox(ctx context.Context, r *runtime.
 		if !isContainerdGRPCNotFoundError(err) {
 			return nil, fmt.Errorf("failed to delete sandbox container %q: %v", id, err)
 		}
-		glog.V(5).Infof("Remove called for sandbox container %q that does not exist", id, err)
+		log.G(ctx).V(5).Infof("Remove called for sandbox container %q that does not exist", id)
 	}
 
 	// Remove sandbox from sandbox store. Note that once the sandbox is successfully
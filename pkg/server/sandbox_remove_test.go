@@ -0,0 +1,117 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/containerd/containerd/api/types/task"
+	"github.com/containerd/containerd/containers"
+	"github.com/containerd/containerd/snapshot"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+
+	ostesting "github.com/kubernetes-incubator/cri-containerd/pkg/os/testing"
+	servertesting "github.com/kubernetes-incubator/cri-containerd/pkg/server/testing"
+	containerstore "github.com/kubernetes-incubator/cri-containerd/pkg/store/container"
+	sandboxstore "github.com/kubernetes-incubator/cri-containerd/pkg/store/sandbox"
+)
+
+func TestRemovePodSandbox(t *testing.T) {
+	testID := "test-id"
+	for desc, test := range map[string]struct {
+		running       bool
+		containers    []string
+		removeAllErr  error
+		expectErr     bool
+		expectRemoved bool
+	}{
+		"should remove stopped sandbox": {
+			expectRemoved: true,
+		},
+		"should not remove running sandbox": {
+			running:   true,
+			expectErr: true,
+		},
+		"should not remove sandbox with containers": {
+			containers: []string{"test-container-2", "test-container-1"},
+			expectErr:  true,
+		},
+		"should keep sandbox container if failed to remove root directory": {
+			removeAllErr: errors.New("random error"),
+			expectErr:    true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		c := newTestCRIContainerdService()
+		fakeOS := c.os.(*ostesting.FakeOS)
+		fakeSnapshotter := c.snapshotService.(*servertesting.FakeSnapshotter)
+		fakeContainerService := c.containerService.(*servertesting.FakeContainerService)
+		fakeTaskService := c.taskService.(*servertesting.FakeTaskService)
+		require.NoError(t, c.sandboxStore.Add(sandboxstore.Sandbox{
+			Metadata: sandboxstore.Metadata{
+				ID:     testID,
+				Name:   "test-name",
+				Config: &runtime.PodSandboxConfig{},
+			},
+		}))
+		require.NoError(t, c.sandboxNameIndex.Reserve("test-name", testID))
+		fakeSnapshotter.SetFakeSnapshots([]snapshot.Info{{Name: testID, Kind: snapshot.KindView}})
+		fakeContainerService.SetFakeContainers([]containers.Container{{ID: testID}})
+		if test.running {
+			fakeTaskService.SetFakeTasks([]task.Task{{ID: testID, Pid: 1, Status: task.StatusRunning}})
+		}
+		for _, id := range test.containers {
+			cntr, err := containerstore.NewContainer(
+				containerstore.Metadata{ID: id, SandboxID: testID, Config: &runtime.ContainerConfig{}},
+				containerstore.Status{},
+			)
+			require.NoError(t, err)
+			require.NoError(t, c.containerStore.Add(cntr))
+		}
+		if test.removeAllErr != nil {
+			fakeOS.InjectError("RemoveAll", test.removeAllErr)
+		}
+
+		_, err := c.RemovePodSandbox(context.Background(), &runtime.RemovePodSandboxRequest{PodSandboxId: testID})
+		assert.Equal(t, test.expectErr, err != nil, err)
+		if len(test.containers) > 0 {
+			assert.Contains(t, err.Error(), "[test-container-1 test-container-2]")
+		}
+		_, err = c.sandboxStore.Get(testID)
+		assert.Equal(t, test.expectRemoved, err != nil, "sandbox store entry")
+		_, err = fakeContainerService.Get(context.Background(), testID)
+		assert.Equal(t, test.expectRemoved, isContainerdGRPCNotFoundError(err), "sandbox container")
+		if !test.expectRemoved {
+			continue
+		}
+		_, err = fakeSnapshotter.Stat(context.Background(), testID)
+		assert.Error(t, err, "snapshot should be removed")
+		assert.Contains(t, fakeOS.GetCalls(), ostesting.CalledDetail{
+			Name:      "RemoveAll",
+			Arguments: []interface{}{getSandboxRootDir(c.rootDir, testID)},
+		})
+		assert.NoError(t, c.sandboxNameIndex.Reserve("test-name", "another-id"), "name should be released")
+
+		// Remove again should succeed.
+		_, err = c.RemovePodSandbox(context.Background(), &runtime.RemovePodSandboxRequest{PodSandboxId: testID})
+		assert.NoError(t, err)
+	}
+}
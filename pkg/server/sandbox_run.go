@@ -19,7 +19,9 @@ package server
 import (
 	"encoding/json"
 	"fmt"
+	"net"
 	"os"
+	"sort"
 	"strings"
 	"time"
 
@@ -28,36 +30,85 @@ import (
 	"github.com/containerd/containerd/api/types"
 	"github.com/containerd/containerd/containers"
 	prototypes "github.com/gogo/protobuf/types"
-	"github.com/golang/glog"
+	"github.com/kubernetes-incubator/cri-o/pkg/ocicni"
 	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
 	runtimespec "github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/opencontainers/runtime-tools/generate"
 	"golang.org/x/net/context"
 	"golang.org/x/sys/unix"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
 	"k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
 
+	"github.com/kubernetes-incubator/cri-containerd/pkg/log"
 	sandboxstore "github.com/kubernetes-incubator/cri-containerd/pkg/store/sandbox"
 )
 
+const (
+	// networkReadyPollInterval is the interval to check network plugin readiness
+	// when waiting for it to become ready.
+	networkReadyPollInterval = 500 * time.Millisecond
+	// ipFamilyIPv4 is the ipv4 ip family.
+	ipFamilyIPv4 = "ipv4"
+	// ipFamilyIPv6 is the ipv6 ip family.
+	ipFamilyIPv6 = "ipv6"
+)
+
 // RunPodSandbox creates and starts a pod-level sandbox. Runtimes should ensure
 // the sandbox is in ready state.
 func (c *criContainerdService) RunPodSandbox(ctx context.Context, r *runtime.RunPodSandboxRequest) (retRes *runtime.RunPodSandboxResponse, retErr error) {
-	glog.V(2).Infof("RunPodSandbox with config %+v", r.GetConfig())
+	log.G(ctx).V(2).Infof("RunPodSandbox with config %+v", r.GetConfig())
 	defer func() {
 		if retErr == nil {
-			glog.V(2).Infof("RunPodSandbox returns sandbox id %q", retRes.GetPodSandboxId())
+			log.G(ctx).V(2).Infof("RunPodSandbox returns sandbox id %q", retRes.GetPodSandboxId())
 		}
 	}()
 
 	config := r.GetConfig()
 
+	// Select the containerd runtime before anything is created.
+	runtimeHandler := getSandboxRuntimeHandler(config)
+	runtimeInfo, err := c.getRuntime(runtimeHandler)
+	if err != nil {
+		return nil, wrapGRPCError(err, "failed to get sandbox runtime")
+	}
+
+	// Validate host aliases before anything is created.
+	if _, err := getHostAliases(config.GetAnnotations()); err != nil {
+		return nil, err
+	}
+
+	// Validate the shm size before anything is created.
+	if _, err := c.getSandboxShmSize(config); err != nil {
+		return nil, err
+	}
+
+	// Validate the pid namespace mode before anything is created, so that an
+	// invalid mode doesn't only fail the container creation.
+	if _, err := getPIDNamespaceMode(config); err != nil {
+		return nil, err
+	}
+
+	// Validate the force stop option before anything is created, so that an
+	// invalid value doesn't only show up when the sandbox is stopped.
+	if _, err := getForceStop(config); err != nil {
+		return nil, err
+	}
+
+	// Wait for the network plugin to become ready before anything is created,
+	// because the sandbox network setup fails if it's not ready yet.
+	if err := c.ensureSandboxNetworkReady(ctx, config); err != nil {
+		return nil, err
+	}
+
 	// Generate unique id and name for the sandbox and reserve the name.
 	id := generateID()
 	name := makeSandboxName(config.GetMetadata())
 	// Reserve the sandbox name to avoid concurrent `RunPodSandbox` request starting the
 	// same sandbox.
 	if err := c.sandboxNameIndex.Reserve(name, id); err != nil {
-		return nil, fmt.Errorf("failed to reserve sandbox name %q: %v", name, err)
+		return nil, grpc.Errorf(codes.AlreadyExists, "failed to reserve sandbox name %q: %v", name, err)
 	}
 	defer func() {
 		// Release the name if the function returns with an error.
@@ -69,25 +120,31 @@ func (c *criContainerdService) RunPodSandbox(ctx context.Context, r *runtime.Run
 	// Create initial internal sandbox object.
 	sandbox := sandboxstore.Sandbox{
 		Metadata: sandboxstore.Metadata{
-			ID:     id,
-			Name:   name,
-			Config: config,
+			ID:             id,
+			Name:           name,
+			Config:         config,
+			RuntimeHandler: runtimeHandler,
 		},
 	}
 
-	// Ensure sandbox container image snapshot.
+	// Ensure sandbox container image snapshot. The image is pulled if it's
+	// missing, e.g. removed after being pre-pulled on startup.
 	image, err := c.ensureImageExists(ctx, c.sandboxImage)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get sandbox image %q: %v", defaultSandboxImage, err)
+		return nil, fmt.Errorf("failed to get sandbox image %q: %v", c.sandboxImage, err)
 	}
-	rootfsMounts, err := c.snapshotService.View(ctx, id, image.ChainID)
+	rootfsParent, err := c.getRootfsParent(ctx, image.ChainID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to prepare sandbox rootfs %q: %v", image.ChainID, err)
+		return nil, fmt.Errorf("failed to get sandbox rootfs parent of %q: %v", image.ChainID, err)
+	}
+	rootfsMounts, err := c.snapshotService.View(ctx, id, rootfsParent)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare sandbox rootfs %q: %v", rootfsParent, err)
 	}
 	defer func() {
 		if retErr != nil {
 			if err := c.snapshotService.Remove(ctx, id); err != nil {
-				glog.Errorf("Failed to remove sandbox container snapshot %q: %v", id, err)
+				log.G(ctx).Errorf("Failed to remove sandbox container snapshot %q: %v", id, err)
 			}
 		}
 	}()
@@ -100,21 +157,30 @@ func (c *criContainerdService) RunPodSandbox(ctx context.Context, r *runtime.Run
 		})
 	}
 
+	// Generate selinux labels shared by all containers in the sandbox.
+	processLabel, mountLabel, err := c.initSandboxSelinuxLabels(config.GetLinux().GetSecurityContext().GetSelinuxOptions())
+	if err != nil {
+		return nil, fmt.Errorf("failed to init selinux labels: %v", err)
+	}
+	sandbox.ProcessLabel = processLabel
+	sandbox.MountLabel = mountLabel
+
 	// Create sandbox container.
-	spec, err := c.generateSandboxContainerSpec(id, config, image.Config)
+	spec, err := c.generateSandboxContainerSpec(id, config, image.Config, processLabel, mountLabel)
 	if err != nil {
-		return nil, fmt.Errorf("failed to generate sandbox container spec: %v", err)
+		return nil, wrapGRPCError(err, "failed to generate sandbox container spec")
 	}
 	rawSpec, err := json.Marshal(spec)
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal oci spec %+v: %v", spec, err)
 	}
-	glog.V(4).Infof("Sandbox container spec: %+v", spec)
+	log.G(ctx).V(4).Infof("Sandbox container spec: %+v", spec)
 	if _, err = c.containerService.Create(ctx, containers.Container{
 		ID: id,
-		// TODO(random-liu): Checkpoint metadata into container labels.
+		// The metadata is checkpointed after the sandbox is started.
+		Labels:  map[string]string{containerKindLabel: containerKindSandbox},
 		Image:   image.ID,
-		Runtime: containers.RuntimeInfo{Name: defaultRuntime},
+		Runtime: runtimeInfo,
 		Spec: &prototypes.Any{
 			TypeUrl: runtimespec.Version,
 			Value:   rawSpec,
@@ -126,7 +192,7 @@ func (c *criContainerdService) RunPodSandbox(ctx context.Context, r *runtime.Run
 	defer func() {
 		if retErr != nil {
 			if err := c.containerService.Delete(ctx, id); err != nil {
-				glog.Errorf("Failed to delete containerd container%q: %v", id, err)
+				log.G(ctx).Errorf("Failed to delete containerd container%q: %v", id, err)
 			}
 		}
 	}()
@@ -142,7 +208,7 @@ func (c *criContainerdService) RunPodSandbox(ctx context.Context, r *runtime.Run
 		if retErr != nil {
 			// Cleanup the sandbox root directory.
 			if err := c.os.RemoveAll(sandboxRootDir); err != nil {
-				glog.Errorf("Failed to remove sandbox root directory %q: %v",
+				log.G(ctx).Errorf("Failed to remove sandbox root directory %q: %v",
 					sandboxRootDir, err)
 			}
 		}
@@ -167,14 +233,14 @@ func (c *criContainerdService) RunPodSandbox(ctx context.Context, r *runtime.Run
 		return nil, fmt.Errorf("failed to start sandbox stderr logger: %v", err)
 	}
 
-	// Setup sandbox /dev/shm, /etc/hosts and /etc/resolv.conf.
+	// Setup sandbox /dev/shm, /etc/hostname, /etc/hosts and /etc/resolv.conf.
 	if err = c.setupSandboxFiles(sandboxRootDir, config); err != nil {
 		return nil, fmt.Errorf("failed to setup sandbox files: %v", err)
 	}
 	defer func() {
 		if retErr != nil {
 			if err = c.unmountSandboxFiles(sandboxRootDir, config); err != nil {
-				glog.Errorf("Failed to unmount sandbox files in %q: %v",
+				log.G(ctx).Errorf("Failed to unmount sandbox files in %q: %v",
 					sandboxRootDir, err)
 			}
 		}
@@ -188,7 +254,7 @@ func (c *criContainerdService) RunPodSandbox(ctx context.Context, r *runtime.Run
 		Stderr: stderr,
 	}
 	// Create sandbox task in containerd.
-	glog.V(5).Infof("Create sandbox container (id=%q, name=%q) with options %+v.",
+	log.G(ctx).V(5).Infof("Create sandbox container (id=%q, name=%q) with options %+v.",
 		id, name, createOpts)
 	createResp, err := c.taskService.Create(ctx, createOpts)
 	if err != nil {
@@ -198,8 +264,8 @@ func (c *criContainerdService) RunPodSandbox(ctx context.Context, r *runtime.Run
 	defer func() {
 		if retErr != nil {
 			// Cleanup the sandbox container if an error is returned.
-			if err := c.stopSandboxContainer(ctx, id); err != nil {
-				glog.Errorf("Failed to delete sandbox container %q: %v", id, err)
+			if err := c.stopSandboxContainer(ctx, id, false); err != nil {
+				log.G(ctx).Errorf("Failed to delete sandbox container %q: %v", id, err)
 			}
 		}
 	}()
@@ -213,15 +279,28 @@ func (c *criContainerdService) RunPodSandbox(ctx context.Context, r *runtime.Run
 		if err = c.netPlugin.SetUpPod(sandbox.NetNS, config.GetMetadata().GetNamespace(), podName, id); err != nil {
 			return nil, fmt.Errorf("failed to setup network for sandbox %q: %v", id, err)
 		}
+		sandbox.NetworkConfigured = true
 		defer func() {
 			if retErr != nil {
 				// Teardown network if an error is returned.
 				if err := c.netPlugin.TearDownPod(sandbox.NetNS, config.GetMetadata().GetNamespace(), podName, id); err != nil {
-					glog.Errorf("failed to destroy network for sandbox %q: %v", id, err)
+					log.G(ctx).Errorf("failed to destroy network for sandbox %q: %v", id, err)
 				}
 			}
 		}()
 	}
+	// Cache the sandbox ip, so that PodSandboxStatus doesn't need to query the
+	// network plugin every time.
+	c.setSandboxIPs(ctx, &sandbox.Metadata)
+	if !config.GetLinux().GetSecurityContext().GetNamespaceOptions().GetHostNetwork() {
+		var ips []string
+		if sandbox.IP != "" {
+			ips = append([]string{sandbox.IP}, sandbox.AdditionalIPs...)
+		}
+		if err := c.setupSandboxHosts(sandboxRootDir, config, ips); err != nil {
+			return nil, fmt.Errorf("failed to setup sandbox hosts file: %v", err)
+		}
+	}
 
 	// Start sandbox container in containerd.
 	if _, err := c.taskService.Start(ctx, &tasks.StartTaskRequest{ContainerID: id}); err != nil {
@@ -229,8 +308,24 @@ func (c *criContainerdService) RunPodSandbox(ctx context.Context, r *runtime.Run
 			id, err)
 	}
 
-	// Add sandbox into sandbox store.
 	sandbox.CreatedAt = time.Now().UnixNano()
+	// Checkpoint metadata into container labels. A sandbox container without metadata
+	// is cleaned up during recovery.
+	data, err := sandbox.Metadata.Encode()
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode sandbox metadata: %v", err)
+	}
+	if _, err := c.containerService.Update(ctx, containers.Container{
+		ID: id,
+		Labels: map[string]string{
+			containerKindLabel:     containerKindSandbox,
+			containerMetadataLabel: string(data),
+		},
+	}, "labels"); err != nil {
+		return nil, fmt.Errorf("failed to checkpoint sandbox metadata: %v", err)
+	}
+
+	// Add sandbox into sandbox store.
 	if err := c.sandboxStore.Add(sandbox); err != nil {
 		return nil, fmt.Errorf("failed to add sandbox %+v into store: %v", sandbox, err)
 	}
@@ -238,8 +333,152 @@ func (c *criContainerdService) RunPodSandbox(ctx context.Context, r *runtime.Run
 	return &runtime.RunPodSandboxResponse{PodSandboxId: id}, nil
 }
 
+// ensureSandboxNetworkReady waits for the network plugin to become ready if the
+// sandbox doesn't use host network. Host network sandboxes don't depend on the
+// network plugin, and proceed regardless of its readiness.
+func (c *criContainerdService) ensureSandboxNetworkReady(ctx context.Context, config *runtime.PodSandboxConfig) error {
+	if config.GetLinux().GetSecurityContext().GetNamespaceOptions().GetHostNetwork() {
+		return nil
+	}
+	err := c.netPlugin.Status()
+	if err == nil {
+		return nil
+	}
+	timeout := c.config.NetworkReadyTimeout
+	if timeout <= 0 {
+		return grpc.Errorf(codes.Unavailable, "network plugin is not ready: %v", err)
+	}
+	log.G(ctx).V(2).Infof("Wait up to %v for network plugin to become ready: %v", timeout, err)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	ticker := time.NewTicker(networkReadyPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("context is done while waiting for network plugin to become ready: %v: %v", ctx.Err(), err)
+		case <-timer.C:
+			return grpc.Errorf(codes.Unavailable, "network plugin is not ready after %v: %v", timeout, err)
+		case <-ticker.C:
+			if err = c.netPlugin.Status(); err == nil {
+				return nil
+			}
+		}
+	}
+}
+
+// setSandboxIPs sets the primary ip and the additional ips of the sandbox. The
+// error of getting the ips is ignored, and the ips are left empty, the same with
+// PodSandboxStatus.
+func (c *criContainerdService) setSandboxIPs(ctx context.Context, sandbox *sandboxstore.Metadata) {
+	ip, additionalIPs, err := c.getSandboxIPs(*sandbox)
+	if err != nil {
+		log.G(ctx).Warningf("Failed to get ip of sandbox %q: %v", sandbox.ID, err)
+		return
+	}
+	sandbox.IP, sandbox.AdditionalIPs = ip, additionalIPs
+}
+
+// chooseHostInterface returns the host ip. It's a variable so that it can be
+// overridden in tests.
+var chooseHostInterface = utilnet.ChooseHostInterface
+
+// getSandboxIPs returns the primary ip and the additional ips of the sandbox. The host
+// ip is returned for host network sandbox. Otherwise, the ipv4 address is returned by
+// the network plugin, and the ipv6 addresses are read from the interface inside the
+// network namespace, because the network plugin only reports ipv4 address. The primary
+// ip is of the configured primary ip family if the sandbox has an address of it.
+func (c *criContainerdService) getSandboxIPs(sandbox sandboxstore.Metadata) (string, []string, error) {
+	if sandbox.Config.GetLinux().GetSecurityContext().GetNamespaceOptions().GetHostNetwork() {
+		ip, err := chooseHostInterface()
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to get host ip: %v", err)
+		}
+		return ip.String(), nil, nil
+	}
+	var ips []string
+	ip, err := c.netPlugin.GetContainerNetworkStatus(sandbox.NetNS, sandbox.Config.GetMetadata().GetNamespace(),
+		sandbox.Config.GetMetadata().GetName(), sandbox.ID)
+	if err != nil {
+		log.L.V(4).Infof("Failed to get ipv4 address of sandbox %q: %v", sandbox.ID, err)
+	} else if ip != "" {
+		ips = append(ips, ip)
+	}
+	ipv6s, err := getInterfaceIPv6Addrs(sandbox.NetNS, ocicni.DefaultInterfaceName)
+	if err != nil {
+		log.L.V(4).Infof("Failed to get ipv6 addresses of sandbox %q: %v", sandbox.ID, err)
+	}
+	ips = append(ips, ipv6s...)
+	if len(ips) == 0 {
+		return "", nil, fmt.Errorf("no ip address is found on interface %q", ocicni.DefaultInterfaceName)
+	}
+	primary, additional := selectPrimaryIP(ips, c.config.PrimaryIPFamily)
+	return primary, additional, nil
+}
+
+// selectPrimaryIP returns the first ip of the primary ip family as the primary ip,
+// and the other ips in the original order as the additional ips. The first ip is
+// the primary ip if there is no ip of the primary ip family.
+func selectPrimaryIP(ips []string, family string) (string, []string) {
+	primary := 0
+	for i, ip := range ips {
+		if getIPFamily(ip) == family {
+			primary = i
+			break
+		}
+	}
+	var additional []string
+	for i, ip := range ips {
+		if i != primary {
+			additional = append(additional, ip)
+		}
+	}
+	return ips[primary], additional
+}
+
+// getIPFamily returns the ip family of the ip address.
+func getIPFamily(ip string) string {
+	if parsed := net.ParseIP(ip); parsed != nil && parsed.To4() == nil {
+		return ipFamilyIPv6
+	}
+	return ipFamilyIPv4
+}
+
+// validateIPFamily validates the primary ip family.
+func validateIPFamily(family string) error {
+	if family != ipFamilyIPv4 && family != ipFamilyIPv6 {
+		return fmt.Errorf("unsupported ip family %q, must be %q or %q", family, ipFamilyIPv4, ipFamilyIPv6)
+	}
+	return nil
+}
+
+// getInterfaceIPv6Addrs returns the global unicast ipv6 addresses of the interface
+// inside the network namespace.
+func getInterfaceIPv6Addrs(netNS string, ifName string) ([]string, error) {
+	var ips []string
+	err := runInNetNS(netNS, func() error {
+		intf, err := net.InterfaceByName(ifName)
+		if err != nil {
+			return fmt.Errorf("failed to get interface %q: %v", ifName, err)
+		}
+		addrs, err := intf.Addrs()
+		if err != nil {
+			return fmt.Errorf("failed to get addresses of interface %q: %v", ifName, err)
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || ipNet.IP.To4() != nil || !ipNet.IP.IsGlobalUnicast() {
+				continue
+			}
+			ips = append(ips, ipNet.IP.String())
+		}
+		return nil
+	})
+	return ips, err
+}
+
 func (c *criContainerdService) generateSandboxContainerSpec(id string, config *runtime.PodSandboxConfig,
-	imageConfig *imagespec.ImageConfig) (*runtimespec.Spec, error) {
+	imageConfig *imagespec.ImageConfig, processLabel, mountLabel string) (*runtimespec.Spec, error) {
 	// Creates a spec Generator with the default spec.
 	// TODO(random-liu): [P1] Compare the default settings with docker and containerd default.
 	spec, err := containerd.GenerateSpec()
@@ -277,7 +516,10 @@ func (c *criContainerdService) generateSandboxContainerSpec(id string, config *r
 
 	// Set cgroups parent.
 	if config.GetLinux().GetCgroupParent() != "" {
-		cgroupsPath := getCgroupsPath(config.GetLinux().GetCgroupParent(), id)
+		cgroupsPath, err := getCgroupsPath(config.GetLinux().GetCgroupParent(), id, c.config.CgroupDriver)
+		if err != nil {
+			return nil, err
+		}
 		g.SetLinuxCgroupsPath(cgroupsPath)
 	}
 	// When cgroup parent is not set, containerd-shim will create container in a child cgroup
@@ -303,7 +545,15 @@ func (c *criContainerdService) generateSandboxContainerSpec(id string, config *r
 		g.RemoveLinuxNamespace(string(runtimespec.IPCNamespace)) // nolint: errcheck
 	}
 
-	// TODO(random-liu): [P1] Apply SeLinux options.
+	g.SetProcessSelinuxLabel(processLabel)
+	g.SetLinuxMountLabel(mountLabel)
+
+	// Mount the sandbox resolv.conf, which is generated under the sandbox root
+	// directory before the sandbox container is started.
+	g.AddBindMount(getResolvPath(getSandboxRootDir(c.rootDir, id)), resolvConfPath, []string{"ro"})
+
+	// Create a new user namespace shared by all containers in the sandbox.
+	c.setOCIUserNamespace(&g, "")
 
 	// TODO(random-liu): [P1] Set user.
 
@@ -313,6 +563,9 @@ func (c *criContainerdService) generateSandboxContainerSpec(id string, config *r
 
 	// Add sysctls
 	sysctls := config.GetLinux().GetSysctls()
+	if err := c.validateSysctls(sysctls, nsOptions); err != nil {
+		return nil, err
+	}
 	for key, value := range sysctls {
 		g.AddLinuxSysctl(key, value)
 	}
@@ -322,16 +575,25 @@ func (c *criContainerdService) generateSandboxContainerSpec(id string, config *r
 	g.SetLinuxResourcesCPUShares(uint64(defaultSandboxCPUshares))
 	g.SetProcessOOMScoreAdj(int(defaultSandboxOOMAdj))
 
+	addOCIAnnotations(&g, config.GetAnnotations(), c.config.AllowedAnnotations)
+
 	return g.Spec(), nil
 }
 
-// setupSandboxFiles sets up necessary sandbox files including /dev/shm, /etc/hosts
-// and /etc/resolv.conf.
+// setupSandboxFiles sets up necessary sandbox files including /dev/shm, /etc/hostname,
+// /etc/hosts of host network sandbox and /etc/resolv.conf.
 func (c *criContainerdService) setupSandboxFiles(rootDir string, config *runtime.PodSandboxConfig) error {
 	// TODO(random-liu): Consider whether we should maintain /etc/hosts and /etc/resolv.conf in kubelet.
-	sandboxEtcHosts := getSandboxHosts(rootDir)
-	if err := c.os.CopyFile(etcHosts, sandboxEtcHosts, 0644); err != nil {
-		return fmt.Errorf("failed to generate sandbox hosts file %q: %v", sandboxEtcHosts, err)
+	if err := c.setupSandboxHostname(rootDir, config); err != nil {
+		return err
+	}
+	// A host network sandbox uses the hosts file of the host. The hosts file of
+	// other sandboxes is generated after the sandbox ip is allocated.
+	if config.GetLinux().GetSecurityContext().GetNamespaceOptions().GetHostNetwork() {
+		sandboxEtcHosts := getSandboxHosts(rootDir)
+		if err := c.os.CopyFile(etcHosts, sandboxEtcHosts, 0644); err != nil {
+			return fmt.Errorf("failed to generate sandbox hosts file %q: %v", sandboxEtcHosts, err)
+		}
 	}
 
 	// Set DNS options. Maintain a resolv.conf for the sandbox.
@@ -345,6 +607,8 @@ func (c *criContainerdService) setupSandboxFiles(rootDir string, config *runtime
 	}
 	resolvPath := getResolvPath(rootDir)
 	if resolvContent == "" {
+		// Inherit host's resolv.conf if the sandbox has no dns config, e.g. a host
+		// network sandbox without explicit dns config.
 		// copy host's resolv.conf to resolvPath
 		err = c.os.CopyFile(resolvConfPath, resolvPath, 0644)
 		if err != nil {
@@ -367,7 +631,11 @@ func (c *criContainerdService) setupSandboxFiles(rootDir string, config *runtime
 		if err := c.os.MkdirAll(sandboxDevShm, 0700); err != nil {
 			return fmt.Errorf("failed to create sandbox shm: %v", err)
 		}
-		shmproperty := fmt.Sprintf("mode=1777,size=%d", defaultShmSize)
+		shmSize, err := c.getSandboxShmSize(config)
+		if err != nil {
+			return err
+		}
+		shmproperty := fmt.Sprintf("mode=1777,size=%d", shmSize)
 		if err := c.os.Mount("shm", sandboxDevShm, "tmpfs", uintptr(unix.MS_NOEXEC|unix.MS_NOSUID|unix.MS_NODEV), shmproperty); err != nil {
 			return fmt.Errorf("failed to mount sandbox shm: %v", err)
 		}
@@ -385,6 +653,10 @@ func parseDNSOptions(servers, searches, options []string) (string, error) {
 		return "", fmt.Errorf("DNSOption.Searches has more than 6 domains")
 	}
 
+	if searchList := strings.Join(searches, " "); len(searchList) > maxDNSSearchListChars {
+		return "", fmt.Errorf("DNSOption.Searches %q has more than %d characters", searchList, maxDNSSearchListChars)
+	}
+
 	if len(searches) > 0 {
 		resolvContent += fmt.Sprintf("search %s\n", strings.Join(searches, " "))
 	}
@@ -404,11 +676,67 @@ func parseDNSOptions(servers, searches, options []string) (string, error) {
 // remove these files. Unmount should *NOT* return error when:
 //  1) The mount point is already unmounted.
 //  2) The mount point doesn't exist.
+// Any other mounts still left under the sandbox root directory are lazily
+// unmounted, so that the root directory can be removed even if they are busy.
 func (c *criContainerdService) unmountSandboxFiles(rootDir string, config *runtime.PodSandboxConfig) error {
 	if !config.GetLinux().GetSecurityContext().GetNamespaceOptions().GetHostIpc() {
-		if err := c.os.Unmount(getSandboxDevShm(rootDir), unix.MNT_DETACH); err != nil && !os.IsNotExist(err) {
+		if err := c.os.Unmount(getSandboxDevShm(rootDir), unix.MNT_DETACH); err != nil && !isNotMountedError(err) {
 			return err
 		}
 	}
+	mounts, err := c.os.ListMounts(rootDir)
+	if err != nil {
+		return fmt.Errorf("failed to list mounts under %q: %v", rootDir, err)
+	}
+	for _, m := range mounts {
+		if err := c.os.Unmount(m, unix.MNT_DETACH); err != nil && !isNotMountedError(err) {
+			return fmt.Errorf("failed to unmount %q: %v", m, err)
+		}
+	}
 	return nil
 }
+
+// isNotMountedError returns true if the unmount error indicates that the
+// target is already unmounted or doesn't exist.
+func isNotMountedError(err error) bool {
+	return os.IsNotExist(err) || err == unix.EINVAL
+}
+
+// validateSysctls checks that all sysctls are namespaced with the sandbox namespace
+// options, or are explicitly allowed as unsafe sysctls.
+func (c *criContainerdService) validateSysctls(sysctls map[string]string, nsOptions *runtime.NamespaceOption) error {
+	var rejected []string
+	for key := range sysctls {
+		if isNamespacedSysctl(key, nsOptions) || isAllowedUnsafeSysctl(key, c.config.AllowedUnsafeSysctls) {
+			continue
+		}
+		rejected = append(rejected, key)
+	}
+	if len(rejected) == 0 {
+		return nil
+	}
+	sort.Strings(rejected)
+	return grpc.Errorf(codes.InvalidArgument, "sysctls %v are not allowed: only namespaced sysctls are allowed unless listed in allowed unsafe sysctls", rejected)
+}
+
+// isNamespacedSysctl returns true if the sysctl is namespaced with the namespace
+// options, e.g. net.* sysctls are namespaced only when the sandbox doesn't use
+// host network.
+func isNamespacedSysctl(sysctl string, nsOptions *runtime.NamespaceOption) bool {
+	if strings.HasPrefix(sysctl, "net.") {
+		return !nsOptions.GetHostNetwork()
+	}
+	if sysctl == "kernel.sem" ||
+		strings.HasPrefix(sysctl, "kernel.shm") ||
+		strings.HasPrefix(sysctl, "kernel.msg") ||
+		strings.HasPrefix(sysctl, "fs.mqueue.") {
+		return !nsOptions.GetHostIpc()
+	}
+	return false
+}
+
+// isAllowedUnsafeSysctl returns true if the sysctl matches any of the allowed
+// sysctls. An allowed sysctl ending with "*" matches all sysctls with the prefix.
+func isAllowedUnsafeSysctl(sysctl string, allowed []string) bool {
+	return matchPatterns(sysctl, allowed)
+}
@@ -17,16 +17,25 @@ limitations under the License.
 package server
 
 import (
+	"errors"
+	"net"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
 	runtimespec "github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
 
 	ostesting "github.com/kubernetes-incubator/cri-containerd/pkg/os/testing"
+	servertesting "github.com/kubernetes-incubator/cri-containerd/pkg/server/testing"
+	sandboxstore "github.com/kubernetes-incubator/cri-containerd/pkg/store/sandbox"
 )
 
 func getRunPodSandboxTestData() (*runtime.PodSandboxConfig, *imagespec.ImageConfig, func(*testing.T, string, *runtimespec.Spec)) {
@@ -53,7 +62,7 @@ func getRunPodSandboxTestData() (*runtime.PodSandboxConfig, *imagespec.ImageConf
 	}
 	specCheck := func(t *testing.T, id string, spec *runtimespec.Spec) {
 		assert.Equal(t, "test-hostname", spec.Hostname)
-		assert.Equal(t, getCgroupsPath("/test/cgroup/parent", id), spec.Linux.CgroupsPath)
+		assert.Equal(t, "/test/cgroup/parent/"+id, spec.Linux.CgroupsPath)
 		assert.Equal(t, relativeRootfsPath, spec.Root.Path)
 		assert.Equal(t, true, spec.Root.Readonly)
 		assert.Contains(t, spec.Process.Env, "a=b", "c=d")
@@ -61,6 +70,12 @@ func getRunPodSandboxTestData() (*runtime.PodSandboxConfig, *imagespec.ImageConf
 		assert.Equal(t, "/workspace", spec.Process.Cwd)
 		assert.EqualValues(t, *spec.Linux.Resources.CPU.Shares, defaultSandboxCPUshares)
 		assert.EqualValues(t, *spec.Process.OOMScoreAdj, defaultSandboxOOMAdj)
+		assert.Contains(t, spec.Mounts, runtimespec.Mount{
+			Source:      getResolvPath(getSandboxRootDir(testRootDir, id)),
+			Destination: resolvConfPath,
+			Type:        "bind",
+			Options:     []string{"ro", "bind"},
+		})
 	}
 	return config, imageConfig, specCheck
 }
@@ -68,10 +83,12 @@ func getRunPodSandboxTestData() (*runtime.PodSandboxConfig, *imagespec.ImageConf
 func TestGenerateSandboxContainerSpec(t *testing.T) {
 	testID := "test-id"
 	for desc, test := range map[string]struct {
-		configChange      func(*runtime.PodSandboxConfig)
-		imageConfigChange func(*imagespec.ImageConfig)
-		specCheck         func(*testing.T, *runtimespec.Spec)
-		expectErr         bool
+		configChange         func(*runtime.PodSandboxConfig)
+		imageConfigChange    func(*imagespec.ImageConfig)
+		allowedUnsafeSysctls []string
+		allowedAnnotations   []string
+		specCheck            func(*testing.T, *runtimespec.Spec)
+		expectErr            bool
 	}{
 		"spec should reflect original config": {
 			specCheck: func(t *testing.T, spec *runtimespec.Spec) {
@@ -112,6 +129,65 @@ func TestGenerateSandboxContainerSpec(t *testing.T) {
 				})
 			},
 		},
+		"should set namespaced sysctls": {
+			configChange: func(c *runtime.PodSandboxConfig) {
+				c.Linux.Sysctls = map[string]string{
+					"net.ipv4.ip_forward":    "1",
+					"kernel.shm_rmid_forced": "1",
+				}
+			},
+			specCheck: func(t *testing.T, spec *runtimespec.Spec) {
+				require.NotNil(t, spec.Linux)
+				assert.Equal(t, "1", spec.Linux.Sysctl["net.ipv4.ip_forward"])
+				assert.Equal(t, "1", spec.Linux.Sysctl["kernel.shm_rmid_forced"])
+			},
+		},
+		"should return error when sysctl is not namespaced": {
+			configChange: func(c *runtime.PodSandboxConfig) {
+				c.Linux.Sysctls = map[string]string{"vm.swappiness": "0"}
+			},
+			expectErr: true,
+		},
+		"should return error when net sysctl is set with host network": {
+			configChange: func(c *runtime.PodSandboxConfig) {
+				c.Linux.SecurityContext = &runtime.LinuxSandboxSecurityContext{
+					NamespaceOptions: &runtime.NamespaceOption{HostNetwork: true},
+				}
+				c.Linux.Sysctls = map[string]string{"net.ipv4.ip_forward": "1"}
+			},
+			expectErr: true,
+		},
+		"should return error when ipc sysctl is set with host ipc": {
+			configChange: func(c *runtime.PodSandboxConfig) {
+				c.Linux.SecurityContext = &runtime.LinuxSandboxSecurityContext{
+					NamespaceOptions: &runtime.NamespaceOption{HostIpc: true},
+				}
+				c.Linux.Sysctls = map[string]string{"kernel.msgmax": "8192"}
+			},
+			expectErr: true,
+		},
+		"should set unsafe sysctl in allowed unsafe sysctls": {
+			configChange: func(c *runtime.PodSandboxConfig) {
+				c.Linux.Sysctls = map[string]string{"vm.swappiness": "0"}
+			},
+			allowedUnsafeSysctls: []string{"vm.*"},
+			specCheck: func(t *testing.T, spec *runtimespec.Spec) {
+				require.NotNil(t, spec.Linux)
+				assert.Equal(t, "0", spec.Linux.Sysctl["vm.swappiness"])
+			},
+		},
+		"should pass through allowed sandbox annotations": {
+			configChange: func(c *runtime.PodSandboxConfig) {
+				c.Annotations = map[string]string{
+					"io.katacontainers.config": "test-value",
+					"not-allowed":              "test-value",
+				}
+			},
+			allowedAnnotations: []string{"io.katacontainers.*"},
+			specCheck: func(t *testing.T, spec *runtimespec.Spec) {
+				assert.Equal(t, map[string]string{"io.katacontainers.config": "test-value"}, spec.Annotations)
+			},
+		},
 		"should return error when entrypoint is empty": {
 			imageConfigChange: func(c *imagespec.ImageConfig) {
 				c.Entrypoint = nil
@@ -128,6 +204,8 @@ func TestGenerateSandboxContainerSpec(t *testing.T) {
 	} {
 		t.Logf("TestCase %q", desc)
 		c := newTestCRIContainerdService()
+		c.config.AllowedUnsafeSysctls = test.allowedUnsafeSysctls
+		c.config.AllowedAnnotations = test.allowedAnnotations
 		config, imageConfig, specCheck := getRunPodSandboxTestData()
 		if test.configChange != nil {
 			test.configChange(config)
@@ -135,7 +213,7 @@ func TestGenerateSandboxContainerSpec(t *testing.T) {
 		if test.imageConfigChange != nil {
 			test.imageConfigChange(imageConfig)
 		}
-		spec, err := c.generateSandboxContainerSpec(testID, config, imageConfig)
+		spec, err := c.generateSandboxContainerSpec(testID, config, imageConfig, "", "")
 		if test.expectErr {
 			assert.Error(t, err)
 			assert.Nil(t, spec)
@@ -150,16 +228,55 @@ func TestGenerateSandboxContainerSpec(t *testing.T) {
 	}
 }
 
+func TestSandboxContainerSpecHostNamespaces(t *testing.T) {
+	testID := "test-id"
+	for _, hostNetwork := range []bool{false, true} {
+		for _, hostPid := range []bool{false, true} {
+			for _, hostIpc := range []bool{false, true} {
+				t.Logf("TestCase host network %v, host pid %v, host ipc %v", hostNetwork, hostPid, hostIpc)
+				c := newTestCRIContainerdService()
+				config, imageConfig, _ := getRunPodSandboxTestData()
+				config.Linux.SecurityContext = &runtime.LinuxSandboxSecurityContext{
+					NamespaceOptions: &runtime.NamespaceOption{
+						HostNetwork: hostNetwork,
+						HostPid:     hostPid,
+						HostIpc:     hostIpc,
+					},
+				}
+				spec, err := c.generateSandboxContainerSpec(testID, config, imageConfig, "", "")
+				require.NoError(t, err)
+				namespaces := make(map[runtimespec.LinuxNamespaceType]bool)
+				for _, ns := range spec.Linux.Namespaces {
+					assert.Empty(t, ns.Path, "sandbox container should create new %s namespace", ns.Type)
+					namespaces[ns.Type] = true
+				}
+				assert.Equal(t, !hostNetwork, namespaces[runtimespec.NetworkNamespace])
+				assert.Equal(t, !hostPid, namespaces[runtimespec.PIDNamespace])
+				assert.Equal(t, !hostIpc, namespaces[runtimespec.IPCNamespace])
+				assert.True(t, namespaces[runtimespec.UTSNamespace])
+			}
+		}
+	}
+}
+
 func TestSetupSandboxFiles(t *testing.T) {
 	testRootDir := "test-sandbox-root"
 	for desc, test := range map[string]struct {
 		dnsConfig     *runtime.DNSConfig
 		hostIpc       bool
+		hostNetwork   bool
 		expectedCalls []ostesting.CalledDetail
 	}{
-		"should check host /dev/shm existence when hostIpc is true": {
-			hostIpc: true,
+		"should copy host /etc/hosts when hostNetwork is true": {
+			hostIpc:     true,
+			hostNetwork: true,
 			expectedCalls: []ostesting.CalledDetail{
+				{
+					Name: "WriteFile",
+					Arguments: []interface{}{
+						testRootDir + "/hostname", []byte("test-hostname\n"), os.FileMode(0644),
+					},
+				},
 				{
 					Name: "CopyFile",
 					Arguments: []interface{}{
@@ -178,6 +295,27 @@ func TestSetupSandboxFiles(t *testing.T) {
 				},
 			},
 		},
+		"should check host /dev/shm existence when hostIpc is true": {
+			hostIpc: true,
+			expectedCalls: []ostesting.CalledDetail{
+				{
+					Name: "WriteFile",
+					Arguments: []interface{}{
+						testRootDir + "/hostname", []byte("test-hostname\n"), os.FileMode(0644),
+					},
+				},
+				{
+					Name: "CopyFile",
+					Arguments: []interface{}{
+						"/etc/resolv.conf", testRootDir + "/resolv.conf", os.FileMode(0644),
+					},
+				},
+				{
+					Name:      "Stat",
+					Arguments: []interface{}{"/dev/shm"},
+				},
+			},
+		},
 		"should create new /etc/resolv.conf if DNSOptions is set": {
 			dnsConfig: &runtime.DNSConfig{
 				Servers:  []string{"8.8.8.8"},
@@ -187,9 +325,9 @@ func TestSetupSandboxFiles(t *testing.T) {
 			hostIpc: true,
 			expectedCalls: []ostesting.CalledDetail{
 				{
-					Name: "CopyFile",
+					Name: "WriteFile",
 					Arguments: []interface{}{
-						"/etc/hosts", testRootDir + "/hosts", os.FileMode(0644),
+						testRootDir + "/hostname", []byte("test-hostname\n"), os.FileMode(0644),
 					},
 				},
 				{
@@ -211,9 +349,9 @@ options timeout:1
 			hostIpc: false,
 			expectedCalls: []ostesting.CalledDetail{
 				{
-					Name: "CopyFile",
+					Name: "WriteFile",
 					Arguments: []interface{}{
-						"/etc/hosts", testRootDir + "/hosts", os.FileMode(0644),
+						testRootDir + "/hostname", []byte("test-hostname\n"), os.FileMode(0644),
 					},
 				},
 				{
@@ -238,11 +376,13 @@ options timeout:1
 		t.Logf("TestCase %q", desc)
 		c := newTestCRIContainerdService()
 		cfg := &runtime.PodSandboxConfig{
+			Hostname:  "test-hostname",
 			DnsConfig: test.dnsConfig,
 			Linux: &runtime.LinuxPodSandboxConfig{
 				SecurityContext: &runtime.LinuxSandboxSecurityContext{
 					NamespaceOptions: &runtime.NamespaceOption{
-						HostIpc: test.hostIpc,
+						HostIpc:     test.hostIpc,
+						HostNetwork: test.hostNetwork,
 					},
 				},
 			},
@@ -291,6 +431,14 @@ options timeout:1
 			},
 			expectErr: true,
 		},
+		"should return error if dns search list exceeds 256 characters": {
+			searches: []string{
+				strings.Repeat("a", 100) + ".com",
+				strings.Repeat("b", 100) + ".com",
+				strings.Repeat("c", 50) + ".com",
+			},
+			expectErr: true,
+		},
 	} {
 		t.Logf("TestCase %q", desc)
 		resolvContent, err := parseDNSOptions(test.servers, test.searches, test.options)
@@ -303,5 +451,221 @@ options timeout:1
 	}
 }
 
+func TestGetSandboxIPs(t *testing.T) {
+	for desc, test := range map[string]struct {
+		podNetwork bool
+		expectErr  bool
+	}{
+		"should return ipv4 address returned by the network plugin": {
+			podNetwork: true,
+		},
+		"should return error if no ip address is found": {
+			expectErr: true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		c := newTestCRIContainerdService()
+		fakeCNIPlugin := c.netPlugin.(*servertesting.FakeCNIPlugin)
+		sandbox := sandboxstore.Metadata{
+			ID:    "test-id",
+			NetNS: "test-netns",
+			Config: &runtime.PodSandboxConfig{
+				Metadata: &runtime.PodSandboxMetadata{
+					Name:      "test-name",
+					Namespace: "test-ns",
+				},
+			},
+		}
+		if test.podNetwork {
+			fakeCNIPlugin.SetFakePodNetwork("test-netns", "test-ns", "test-name", "test-id", "10.0.0.1")
+		}
+		ip, additionalIPs, err := c.getSandboxIPs(sandbox)
+		if test.expectErr {
+			assert.Error(t, err)
+			continue
+		}
+		assert.NoError(t, err)
+		assert.Equal(t, "10.0.0.1", ip)
+		// The fake network namespace doesn't exist, so no ipv6 address is found.
+		assert.Empty(t, additionalIPs)
+	}
+}
+
+func TestSetSandboxIPs(t *testing.T) {
+	defer func(f func() (net.IP, error)) { chooseHostInterface = f }(chooseHostInterface)
+	for desc, test := range map[string]struct {
+		hostNetwork bool
+		podNetwork  bool
+		hostIPErr   error
+		expectedIP  string
+	}{
+		"should set ip returned by the network plugin": {
+			podNetwork: true,
+			expectedIP: "10.0.0.1",
+		},
+		"should leave ip empty if the network plugin returns no ip": {},
+		"should set host ip for host network sandbox": {
+			hostNetwork: true,
+			expectedIP:  "192.168.0.1",
+		},
+		"should leave ip empty if host ip is not found for host network sandbox": {
+			hostNetwork: true,
+			hostIPErr:   errors.New("no host interface"),
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		c := newTestCRIContainerdService()
+		fakeCNIPlugin := c.netPlugin.(*servertesting.FakeCNIPlugin)
+		hostIPErr := test.hostIPErr
+		chooseHostInterface = func() (net.IP, error) {
+			if hostIPErr != nil {
+				return nil, hostIPErr
+			}
+			return net.ParseIP("192.168.0.1"), nil
+		}
+		sandbox := sandboxstore.Metadata{
+			ID:    "test-id",
+			NetNS: "test-netns",
+			Config: &runtime.PodSandboxConfig{
+				Metadata: &runtime.PodSandboxMetadata{
+					Name:      "test-name",
+					Namespace: "test-ns",
+				},
+				Linux: &runtime.LinuxPodSandboxConfig{
+					SecurityContext: &runtime.LinuxSandboxSecurityContext{
+						NamespaceOptions: &runtime.NamespaceOption{HostNetwork: test.hostNetwork},
+					},
+				},
+			},
+		}
+		if test.podNetwork {
+			fakeCNIPlugin.SetFakePodNetwork("test-netns", "test-ns", "test-name", "test-id", "10.0.0.1")
+		}
+		c.setSandboxIPs(context.Background(), &sandbox)
+		assert.Equal(t, test.expectedIP, sandbox.IP)
+		assert.Empty(t, sandbox.AdditionalIPs)
+	}
+}
+
 // TODO(random-liu): [P1] Add unit test for different error cases to make sure
 // the function cleans up on error properly.
+
+// notReadyCNIPlugin is a fake cni plugin which is not ready for the first
+// notReadyCount Status calls. It's never ready if notReadyCount is negative.
+type notReadyCNIPlugin struct {
+	*servertesting.FakeCNIPlugin
+	notReadyCount int
+	statusCalls   int
+}
+
+func (p *notReadyCNIPlugin) Status() error {
+	p.statusCalls++
+	if p.notReadyCount < 0 || p.statusCalls <= p.notReadyCount {
+		return errors.New("cni config not found")
+	}
+	return nil
+}
+
+func TestEnsureSandboxNetworkReady(t *testing.T) {
+	for desc, test := range map[string]struct {
+		hostNetwork   bool
+		notReadyCount int
+		timeout       time.Duration
+		expectCalls   int
+		expectErr     bool
+	}{
+		"should proceed if network plugin is ready": {
+			expectCalls: 1,
+		},
+		"should proceed for host network sandbox even if network plugin is not ready": {
+			hostNetwork:   true,
+			notReadyCount: -1,
+			expectCalls:   0,
+		},
+		"should wait for network plugin to become ready": {
+			notReadyCount: 2,
+			timeout:       10 * time.Second,
+			expectCalls:   3,
+		},
+		"should fail immediately if network plugin is not ready and timeout is not set": {
+			notReadyCount: -1,
+			expectCalls:   1,
+			expectErr:     true,
+		},
+		"should fail if network plugin is not ready before timeout": {
+			notReadyCount: -1,
+			timeout:       3 * networkReadyPollInterval / 2,
+			expectCalls:   2,
+			expectErr:     true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		c := newTestCRIContainerdService()
+		c.config.NetworkReadyTimeout = test.timeout
+		plugin := &notReadyCNIPlugin{
+			FakeCNIPlugin: c.netPlugin.(*servertesting.FakeCNIPlugin),
+			notReadyCount: test.notReadyCount,
+		}
+		c.netPlugin = plugin
+		config := &runtime.PodSandboxConfig{
+			Linux: &runtime.LinuxPodSandboxConfig{
+				SecurityContext: &runtime.LinuxSandboxSecurityContext{
+					NamespaceOptions: &runtime.NamespaceOption{HostNetwork: test.hostNetwork},
+				},
+			},
+		}
+		err := c.ensureSandboxNetworkReady(context.Background(), config)
+		if test.expectErr {
+			assert.Error(t, err)
+			assert.Equal(t, codes.Unavailable, grpc.Code(err))
+		} else {
+			assert.NoError(t, err)
+		}
+		assert.Equal(t, test.expectCalls, plugin.statusCalls)
+	}
+}
+
+func TestSelectPrimaryIP(t *testing.T) {
+	for desc, test := range map[string]struct {
+		ips                []string
+		family             string
+		expectedIP         string
+		expectedAdditional []string
+	}{
+		"should return the only ip": {
+			ips:        []string{"10.0.0.1"},
+			family:     ipFamilyIPv4,
+			expectedIP: "10.0.0.1",
+		},
+		"should return ipv4 as primary ip if ipv4 is preferred": {
+			ips:                []string{"10.0.0.1", "fd00::1", "fd00::2"},
+			family:             ipFamilyIPv4,
+			expectedIP:         "10.0.0.1",
+			expectedAdditional: []string{"fd00::1", "fd00::2"},
+		},
+		"should return the first ipv6 as primary ip if ipv6 is preferred": {
+			ips:                []string{"10.0.0.1", "fd00::1", "fd00::2"},
+			family:             ipFamilyIPv6,
+			expectedIP:         "fd00::1",
+			expectedAdditional: []string{"10.0.0.1", "fd00::2"},
+		},
+		"should fallback to the first ip if there is no ip of the preferred family": {
+			ips:                []string{"fd00::1", "fd00::2"},
+			family:             ipFamilyIPv4,
+			expectedIP:         "fd00::1",
+			expectedAdditional: []string{"fd00::2"},
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		ip, additional := selectPrimaryIP(test.ips, test.family)
+		assert.Equal(t, test.expectedIP, ip)
+		assert.Equal(t, test.expectedAdditional, additional)
+	}
+}
+
+func TestValidateIPFamily(t *testing.T) {
+	assert.NoError(t, validateIPFamily(ipFamilyIPv4))
+	assert.NoError(t, validateIPFamily(ipFamilyIPv6))
+	assert.Error(t, validateIPFamily(""))
+	assert.Error(t, validateIPFamily("ipv5"))
+}
@@ -0,0 +1,49 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+)
+
+const (
+	// shmSizeAnnotationKey is the sandbox annotation key of the size of the
+	// sandbox shm shared by all containers in the sandbox, in kubernetes
+	// quantity format, e.g. "256Mi". It's ignored for host ipc sandboxes,
+	// which use the host /dev/shm.
+	// TODO: Switch to the CRI shm size field once the CRI api is bumped.
+	shmSizeAnnotationKey = "io.kubernetes.cri-containerd.shm-size"
+)
+
+// getSandboxShmSize returns the size of the sandbox shm in bytes. The size
+// requested by the sandbox takes precedence over the configured default.
+func (c *criContainerdService) getSandboxShmSize(config *runtime.PodSandboxConfig) (int64, error) {
+	if value, ok := config.GetAnnotations()[shmSizeAnnotationKey]; ok {
+		size, err := resource.ParseQuantity(value)
+		if err != nil || size.Value() <= 0 {
+			return 0, grpc.Errorf(codes.InvalidArgument, "invalid shm size %q", value)
+		}
+		return size.Value(), nil
+	}
+	if c.config.DefaultShmSize > 0 {
+		return c.config.DefaultShmSize, nil
+	}
+	return defaultShmSize, nil
+}
@@ -0,0 +1,89 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+	"k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+
+	ostesting "github.com/kubernetes-incubator/cri-containerd/pkg/os/testing"
+)
+
+func TestGetSandboxShmSize(t *testing.T) {
+	for desc, test := range map[string]struct {
+		annotations map[string]string
+		defaultSize int64
+		expected    int64
+		expectErr   bool
+	}{
+		"should use built-in default if not configured": {
+			expected: defaultShmSize,
+		},
+		"should use configured default": {
+			defaultSize: 128 * 1024 * 1024,
+			expected:    128 * 1024 * 1024,
+		},
+		"should prefer requested size over configured default": {
+			annotations: map[string]string{shmSizeAnnotationKey: "256Mi"},
+			defaultSize: 128 * 1024 * 1024,
+			expected:    256 * 1024 * 1024,
+		},
+		"should return error for invalid size": {
+			annotations: map[string]string{shmSizeAnnotationKey: "invalid"},
+			expectErr:   true,
+		},
+		"should return error for zero size": {
+			annotations: map[string]string{shmSizeAnnotationKey: "0"},
+			expectErr:   true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		c := newTestCRIContainerdService()
+		c.config.DefaultShmSize = test.defaultSize
+		size, err := c.getSandboxShmSize(&runtime.PodSandboxConfig{Annotations: test.annotations})
+		if test.expectErr {
+			assert.Error(t, err)
+			continue
+		}
+		assert.NoError(t, err)
+		assert.Equal(t, test.expected, size)
+	}
+}
+
+func TestSetupSandboxShmSize(t *testing.T) {
+	testRootDir := "test-sandbox-root"
+	c := newTestCRIContainerdService()
+	config := &runtime.PodSandboxConfig{
+		Hostname:    "test-hostname",
+		Annotations: map[string]string{shmSizeAnnotationKey: "1Mi"},
+	}
+	require.NoError(t, c.setupSandboxFiles(testRootDir, config))
+	var mountCall *ostesting.CalledDetail
+	for _, call := range c.os.(*ostesting.FakeOS).GetCalls() {
+		if call.Name == "Mount" {
+			called := call
+			mountCall = &called
+		}
+	}
+	require.NotNil(t, mountCall, "sandbox shm should be mounted")
+	assert.Equal(t, []interface{}{"shm", testRootDir + "/shm", "tmpfs",
+		uintptr(unix.MS_NOEXEC | unix.MS_NOSUID | unix.MS_NODEV), "mode=1777,size=1048576"}, mountCall.Arguments)
+}
@@ -19,7 +19,6 @@ package server
 import (
 	"fmt"
 
-	"github.com/golang/glog"
 	"golang.org/x/net/context"
 
 	"github.com/containerd/containerd/api/services/tasks/v1"
@@ -27,22 +26,23 @@ import (
 
 	"k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
 
+	"github.com/kubernetes-incubator/cri-containerd/pkg/log"
 	sandboxstore "github.com/kubernetes-incubator/cri-containerd/pkg/store/sandbox"
 )
 
 // PodSandboxStatus returns the status of the PodSandbox.
 func (c *criContainerdService) PodSandboxStatus(ctx context.Context, r *runtime.PodSandboxStatusRequest) (retRes *runtime.PodSandboxStatusResponse, retErr error) {
-	glog.V(4).Infof("PodSandboxStatus for sandbox %q", r.GetPodSandboxId())
+	log.G(ctx).V(4).Infof("PodSandboxStatus for sandbox %q", r.GetPodSandboxId())
 	defer func() {
 		if retErr == nil {
-			glog.V(4).Infof("PodSandboxStatus for %q returns status %+v", r.GetPodSandboxId(), retRes.GetStatus())
+			log.G(ctx).V(4).Infof("PodSandboxStatus for %q returns status %+v", r.GetPodSandboxId(), retRes.GetStatus())
 		}
 	}()
 
 	sandbox, err := c.sandboxStore.Get(r.GetPodSandboxId())
 	if err != nil {
-		return nil, fmt.Errorf("an error occurred when try to find sandbox %q: %v",
-			r.GetPodSandboxId(), err)
+		return nil, wrapGRPCError(err, "an error occurred when try to find sandbox %q",
+			r.GetPodSandboxId())
 	}
 	// Use the full sandbox id.
 	id := sandbox.ID
@@ -52,32 +52,40 @@ func (c *criContainerdService) PodSandboxStatus(ctx context.Context, r *runtime.
 		return nil, fmt.Errorf("failed to get sandbox container info for %q: %v", id, err)
 	}
 
-	// Set sandbox state to NOTREADY by default.
-	state := runtime.PodSandboxState_SANDBOX_NOTREADY
-	// If the sandbox container is running, treat it as READY.
-	if info != nil && info.Task.Status == task.StatusRunning {
-		state = runtime.PodSandboxState_SANDBOX_READY
+	var t *task.Task
+	if info != nil {
+		t = info.Task
 	}
+	state := c.getSandboxState(sandbox, t)
 
-	ip, err := c.netPlugin.GetContainerNetworkStatus(sandbox.NetNS, sandbox.Config.GetMetadata().GetNamespace(), sandbox.Config.GetMetadata().GetName(), id)
-	if err != nil {
-		// Ignore the error on network status
-		ip = ""
-		glog.V(4).Infof("GetContainerNetworkStatus returns error: %v", err)
-	}
+	// TODO: Return the additional ips when the CRI PodSandboxNetworkStatus has them.
+	return &runtime.PodSandboxStatusResponse{Status: toCRISandboxStatus(sandbox.Metadata, state)}, nil
+}
 
-	return &runtime.PodSandboxStatusResponse{Status: toCRISandboxStatus(sandbox.Metadata, state, ip)}, nil
+// getSandboxState returns the state of the sandbox. The sandbox is READY only if
+// the sandbox container is running and the network namespace still exists.
+func (c *criContainerdService) getSandboxState(sandbox sandboxstore.Sandbox, t *task.Task) runtime.PodSandboxState {
+	if t == nil || t.Status != task.StatusRunning {
+		return runtime.PodSandboxState_SANDBOX_NOTREADY
+	}
+	if !sandbox.Config.GetLinux().GetSecurityContext().GetNamespaceOptions().GetHostNetwork() {
+		if _, err := c.os.Stat(sandbox.NetNS); err != nil {
+			log.L.V(4).Infof("Network namespace %q of sandbox %q is not available: %v", sandbox.NetNS, sandbox.ID, err)
+			return runtime.PodSandboxState_SANDBOX_NOTREADY
+		}
+	}
+	return runtime.PodSandboxState_SANDBOX_READY
 }
 
 // toCRISandboxStatus converts sandbox metadata into CRI pod sandbox status.
-func toCRISandboxStatus(meta sandboxstore.Metadata, state runtime.PodSandboxState, ip string) *runtime.PodSandboxStatus {
+func toCRISandboxStatus(meta sandboxstore.Metadata, state runtime.PodSandboxState) *runtime.PodSandboxStatus {
 	nsOpts := meta.Config.GetLinux().GetSecurityContext().GetNamespaceOptions()
 	return &runtime.PodSandboxStatus{
 		Id:        meta.ID,
 		Metadata:  meta.Config.GetMetadata(),
 		State:     state,
 		CreatedAt: meta.CreatedAt,
-		Network:   &runtime.PodSandboxNetworkStatus{Ip: ip},
+		Network:   &runtime.PodSandboxNetworkStatus{Ip: meta.IP},
 		Linux: &runtime.LinuxPodSandboxStatus{
 			Namespaces: &runtime.Namespace{
 				Options: &runtime.NamespaceOption{
@@ -0,0 +1,119 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/api/types/task"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+
+	ostesting "github.com/kubernetes-incubator/cri-containerd/pkg/os/testing"
+	servertesting "github.com/kubernetes-incubator/cri-containerd/pkg/server/testing"
+	sandboxstore "github.com/kubernetes-incubator/cri-containerd/pkg/store/sandbox"
+)
+
+// getTestSandbox returns a test sandbox with the namespace options.
+func getTestSandbox(nsOpts *runtime.NamespaceOption) sandboxstore.Sandbox {
+	return sandboxstore.Sandbox{
+		Metadata: sandboxstore.Metadata{
+			ID:            "test-id",
+			Pid:           1234,
+			NetNS:         "test-netns",
+			IP:            "10.0.0.1",
+			AdditionalIPs: []string{"2001:db8::1"},
+			CreatedAt:     time.Now().UnixNano(),
+			Config: &runtime.PodSandboxConfig{
+				Metadata: &runtime.PodSandboxMetadata{
+					Name:      "test-name",
+					Uid:       "test-uid",
+					Namespace: "test-ns",
+				},
+				Labels:      map[string]string{"a": "b"},
+				Annotations: map[string]string{"c": "d"},
+				Linux: &runtime.LinuxPodSandboxConfig{
+					SecurityContext: &runtime.LinuxSandboxSecurityContext{
+						NamespaceOptions: nsOpts,
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestPodSandboxStatus(t *testing.T) {
+	for desc, test := range map[string]struct {
+		taskStatus    *task.Status
+		nsOpts        *runtime.NamespaceOption
+		netnsGone     bool
+		expectedState runtime.PodSandboxState
+	}{
+		"should return ready sandbox with ip if sandbox container is running": {
+			taskStatus:    &[]task.Status{task.StatusRunning}[0],
+			expectedState: runtime.PodSandboxState_SANDBOX_READY,
+		},
+		"should return not ready sandbox if sandbox container is stopped": {
+			taskStatus:    &[]task.Status{task.StatusStopped}[0],
+			expectedState: runtime.PodSandboxState_SANDBOX_NOTREADY,
+		},
+		"should return not ready sandbox if sandbox container is gone": {
+			expectedState: runtime.PodSandboxState_SANDBOX_NOTREADY,
+		},
+		"should return not ready sandbox if network namespace is gone": {
+			taskStatus:    &[]task.Status{task.StatusRunning}[0],
+			netnsGone:     true,
+			expectedState: runtime.PodSandboxState_SANDBOX_NOTREADY,
+		},
+		"should return namespace options": {
+			taskStatus:    &[]task.Status{task.StatusRunning}[0],
+			nsOpts:        &runtime.NamespaceOption{HostNetwork: true, HostPid: true, HostIpc: true},
+			expectedState: runtime.PodSandboxState_SANDBOX_READY,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		c := newTestCRIContainerdService()
+		fakeTaskService := c.taskService.(*servertesting.FakeTaskService)
+		fakeOS := c.os.(*ostesting.FakeOS)
+		sandbox := getTestSandbox(test.nsOpts)
+		require.NoError(t, c.sandboxStore.Add(sandbox))
+		if test.netnsGone {
+			fakeOS.InjectError("Stat", os.ErrNotExist)
+		}
+		if test.taskStatus != nil {
+			fakeTaskService.SetFakeTasks([]task.Task{{ID: sandbox.ID, Pid: sandbox.Pid, Status: *test.taskStatus}})
+		}
+		resp, err := c.PodSandboxStatus(context.Background(), &runtime.PodSandboxStatusRequest{PodSandboxId: sandbox.ID})
+		assert.NoError(t, err)
+		require.NotNil(t, resp)
+		status := resp.GetStatus()
+		assert.Equal(t, sandbox.ID, status.Id)
+		assert.Equal(t, sandbox.Config.Metadata, status.Metadata)
+		assert.Equal(t, test.expectedState, status.State)
+		assert.Equal(t, sandbox.CreatedAt, status.CreatedAt)
+		assert.Equal(t, sandbox.IP, status.Network.Ip)
+		assert.Equal(t, test.nsOpts.GetHostNetwork(), status.Linux.Namespaces.Options.HostNetwork)
+		assert.Equal(t, test.nsOpts.GetHostPid(), status.Linux.Namespaces.Options.HostPid)
+		assert.Equal(t, test.nsOpts.GetHostIpc(), status.Linux.Namespaces.Options.HostIpc)
+		assert.Equal(t, sandbox.Config.Labels, status.Labels)
+		assert.Equal(t, sandbox.Config.Annotations, status.Annotations)
+	}
+}
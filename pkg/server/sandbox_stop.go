@@ -19,84 +19,308 @@ package server
 import (
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/containerd/containerd/api/services/events/v1"
 	"github.com/containerd/containerd/api/services/tasks/v1"
 	"github.com/containerd/containerd/api/types/task"
 	"github.com/containerd/containerd/typeurl"
-	"github.com/golang/glog"
+	"github.com/jpillora/backoff"
 	"golang.org/x/net/context"
 	"golang.org/x/sys/unix"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 	"k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+
+	"github.com/kubernetes-incubator/cri-containerd/pkg/log"
+	containerstore "github.com/kubernetes-incubator/cri-containerd/pkg/store/container"
+	sandboxstore "github.com/kubernetes-incubator/cri-containerd/pkg/store/sandbox"
+)
+
+const (
+	// terminationGracePeriodAnnotation is the container annotation kubelet uses to record
+	// the termination grace period (in seconds) of the pod.
+	terminationGracePeriodAnnotation = "io.kubernetes.pod.terminationGracePeriod"
+	// maxConcurrentContainerStops is the maximum number of containers stopped
+	// concurrently in one StopPodSandbox.
+	maxConcurrentContainerStops = 8
+	// networkTeardownMinRetryInterval is the minimum retry interval when failed to
+	// teardown sandbox network.
+	networkTeardownMinRetryInterval = 100 * time.Millisecond
+	// networkTeardownMaxRetryInterval is the maximum retry interval when failed to
+	// teardown sandbox network.
+	networkTeardownMaxRetryInterval = 2 * time.Second
+	// forceStopTimeout is the timeout to wait for the task of a container or the
+	// sandbox container to be reaped after SIGKILL in force mode.
+	forceStopTimeout = 5 * time.Second
+	// forceStopAnnotationKey is the sandbox annotation key to skip all graceful
+	// waits and kill everything in the sandbox immediately in StopPodSandbox,
+	// e.g. for node drain. The value is a boolean.
+	// TODO: Switch to a force field in StopPodSandboxRequest if the CRI api adds it.
+	forceStopAnnotationKey = "io.kubernetes.cri-containerd.force-stop"
 )
 
 // StopPodSandbox stops the sandbox. If there are any running containers in the
 // sandbox, they should be forcibly terminated.
 func (c *criContainerdService) StopPodSandbox(ctx context.Context, r *runtime.StopPodSandboxRequest) (retRes *runtime.StopPodSandboxResponse, retErr error) {
-	glog.V(2).Infof("StopPodSandbox for sandbox %q", r.GetPodSandboxId())
+	log.G(ctx).V(2).Infof("StopPodSandbox for sandbox %q", r.GetPodSandboxId())
 	defer func() {
 		if retErr == nil {
-			glog.V(2).Infof("StopPodSandbox %q returns successfully", r.GetPodSandboxId())
+			log.G(ctx).V(2).Infof("StopPodSandbox %q returns successfully", r.GetPodSandboxId())
 		}
 	}()
 
 	sandbox, err := c.sandboxStore.Get(r.GetPodSandboxId())
 	if err != nil {
-		return nil, fmt.Errorf("an error occurred when try to find sandbox %q: %v",
-			r.GetPodSandboxId(), err)
+		return nil, wrapGRPCError(err, "an error occurred when try to find sandbox %q",
+			r.GetPodSandboxId())
 	}
 	// Use the full sandbox id.
 	id := sandbox.ID
 
-	// Stop all containers inside the sandbox. This terminates the container forcibly,
-	// and container may still be so production should not rely on this behavior.
+	// Record the duration of each phase, so that slow sandbox teardown could be
+	// diagnosed from the log.
+	phases := newPhaseTimer()
+	defer func() {
+		log.G(ctx).V(4).Infof("StopPodSandbox for sandbox %q finished: %s error=%v", id, phases, retErr)
+	}()
+
+	// Attempt every step below even if a previous one fails, so that a half-stopped
+	// sandbox could be cleaned up by retrying StopPodSandbox. All errors are aggregated
+	// and returned together.
+	var errs []error
+	// In force mode, all graceful waits are skipped.
+	force, err := getForceStop(sandbox.Config)
+	if err != nil {
+		log.G(ctx).Warningf("Failed to get force stop option of sandbox %q, stop it gracefully: %v", id, err)
+	}
+
+	// Stop all containers inside the sandbox. Each container is given a grace period
+	// bounded by the configured StopPodSandboxTimeout, and is killed after that. Container
+	// may still be created after this, so production should not rely on this behavior.
 	// TODO(random-liu): Delete the sandbox container before this after permanent network namespace
 	// is introduced, so that no container will be started after that.
-	containers := c.containerStore.List()
-	for _, container := range containers {
-		if container.SandboxID != id {
-			continue
+	containerStopErr := c.stopContainersInSandbox(ctx, id, force)
+	if containerStopErr != nil {
+		errs = append(errs, fmt.Errorf("failed to stop containers in sandbox %q: %v", id, containerStopErr))
+	}
+	phases.observe("container_stop")
+
+	// Teardown network for sandbox.
+	if err := c.teardownSandboxNetwork(ctx, sandbox); err != nil {
+		errs = append(errs, err)
+	} else {
+		log.G(ctx).V(2).Infof("TearDown network for sandbox %q successfully", id)
+	}
+	phases.observe("network_teardown")
+
+	sandboxRoot := getSandboxRootDir(c.rootDir, id)
+	unmountErr := c.unmountSandboxFiles(sandboxRoot, sandbox.Config)
+	if unmountErr != nil {
+		errs = append(errs, fmt.Errorf("failed to unmount sandbox files in %q: %v", sandboxRoot, unmountErr))
+	}
+	phases.observe("unmount")
+
+	sandboxStopErr := c.stopSandboxContainer(ctx, id, force)
+	if sandboxStopErr != nil {
+		errs = append(errs, fmt.Errorf("failed to stop sandbox container %q: %v", id, sandboxStopErr))
+	}
+	phases.observe("sandbox_container_stop")
+
+	// In force mode, cleanup the sandbox root directory now so that nothing is leaked
+	// even if RemovePodSandbox is never called. The tasks of all containers are deleted
+	// by now, so nothing is using it. Never remove it if any container failed to stop
+	// or sandbox files are still mounted.
+	if force && containerStopErr == nil && unmountErr == nil && sandboxStopErr == nil {
+		if err := c.os.RemoveAll(sandboxRoot); err != nil {
+			errs = append(errs, fmt.Errorf("failed to remove sandbox root directory %q: %v", sandboxRoot, err))
 		}
-		// Forcibly stop the container. Do not use `StopContainer`, because it introduces a race
-		// if a container is removed after list.
-		if err = c.stopContainer(ctx, container, 0); err != nil {
-			return nil, fmt.Errorf("failed to stop container %q: %v", container.ID, err)
+	}
+
+	if err := utilerrors.NewAggregate(errs); err != nil {
+		return nil, err
+	}
+	return &runtime.StopPodSandboxResponse{}, nil
+}
+
+// teardownSandboxNetwork tears down the network of the sandbox. It's ok if the
+// network namespace of the sandbox doesn't exist. However, if the network was set
+// up, the network plugin is still called to release resources e.g. IPAM allocations.
+// Retries stop once the context is done.
+func (c *criContainerdService) teardownSandboxNetwork(ctx context.Context, sandbox sandboxstore.Sandbox) error {
+	if sandbox.Config.GetLinux().GetSecurityContext().GetNamespaceOptions().GetHostNetwork() {
+		return nil
+	}
+	id := sandbox.ID
+	if _, err := c.os.Stat(sandbox.NetNS); err != nil {
+		if !os.IsNotExist(err) {
+			return fmt.Errorf("failed to stat netns path for sandbox %q before tearing down the network: %v", id, err)
+		}
+		if !sandbox.NetworkConfigured {
+			return nil
 		}
+		log.G(ctx).V(4).Infof("Netns %q of sandbox %q doesn't exist, still teardown network to release resources",
+			sandbox.NetNS, id)
 	}
+	// CNI plugins may fail transiently, e.g. on IPAM lock contention, retry with
+	// exponential backoff.
+	b := backoff.Backoff{
+		Min:    networkTeardownMinRetryInterval,
+		Max:    networkTeardownMaxRetryInterval,
+		Factor: exponentialFactor,
+	}
+	attempts := c.config.NetworkTeardownMaxAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	var err error
+	// A single teardown releases the addresses of all ip families of the sandbox.
+	for i := 1; i <= attempts; i++ {
+		err = c.netPlugin.TearDownPod(sandbox.NetNS, sandbox.Config.GetMetadata().GetNamespace(),
+			sandbox.Config.GetMetadata().GetName(), id)
+		if err == nil {
+			return nil
+		}
+		log.G(ctx).V(4).Infof("Attempt %d/%d to teardown network for sandbox %q failed: %v", i, attempts, id, err)
+		if i == attempts {
+			break
+		}
+		retryTimer := time.NewTimer(b.Duration())
+		select {
+		case <-ctx.Done():
+			retryTimer.Stop()
+			return fmt.Errorf("teardown network for sandbox %q is cancelled after %d attempts: %v", id, i, err)
+		case <-retryTimer.C:
+		}
+	}
+	return fmt.Errorf("failed to destroy network for sandbox %q after %d attempts: %v", id, attempts, err)
+}
 
-	// Teardown network for sandbox.
-	_, err = c.os.Stat(sandbox.NetNS)
-	if err == nil {
-		if !sandbox.Config.GetLinux().GetSecurityContext().GetNamespaceOptions().GetHostNetwork() {
-			if teardownErr := c.netPlugin.TearDownPod(sandbox.NetNS, sandbox.Config.GetMetadata().GetNamespace(),
-				sandbox.Config.GetMetadata().GetName(), id); teardownErr != nil {
-				return nil, fmt.Errorf("failed to destroy network for sandbox %q: %v", id, teardownErr)
+// stopContainersInSandbox stops all containers in the sandbox concurrently, at most
+// maxConcurrentContainerStops at a time. It waits for all stops to finish, and returns
+// an aggregated error of all containers failed to stop. If force is true, running
+// containers are killed without waiting for them to exit.
+func (c *criContainerdService) stopContainersInSandbox(ctx context.Context, id string, force bool) error {
+	var (
+		wg   sync.WaitGroup
+		lock sync.Mutex
+		errs []error
+	)
+	sem := make(chan struct{}, maxConcurrentContainerStops)
+	for _, container := range c.containerStore.List() {
+		if container.SandboxID != id {
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(container containerstore.Container) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			var err error
+			if force {
+				err = c.forceStopContainer(ctx, container)
+			} else {
+				// Do not use `StopContainer`, because it introduces a race if a container is
+				// removed after list.
+				timeout := getSandboxContainerStopTimeout(container, c.config.StopPodSandboxTimeout)
+				err = c.stopContainer(ctx, container, timeout)
+			}
+			if err != nil {
+				lock.Lock()
+				defer lock.Unlock()
+				errs = append(errs, fmt.Errorf("failed to stop container %q: %v", container.ID, err))
 			}
+		}(container)
+	}
+	wg.Wait()
+	return utilerrors.NewAggregate(errs)
+}
+
+// forceStopContainer kills the container and deletes its task without waiting for
+// the exit event. The container status is updated with the exit status of the deleted
+// task, so that it's not reported as running.
+func (c *criContainerdService) forceStopContainer(ctx context.Context, container containerstore.Container) error {
+	id := container.ID
+	if container.Status.Get().State() == runtime.ContainerState_CONTAINER_RUNNING {
+		if err := c.killContainer(ctx, id); err != nil {
+			return err
 		}
-	} else if !os.IsNotExist(err) { // It's ok for sandbox.NetNS to *not* exist
-		return nil, fmt.Errorf("failed to stat netns path for sandbox %q before tearing down the network: %v", id, err)
 	}
-	glog.V(2).Infof("TearDown network for sandbox %q successfully", id)
+	// containerd can't delete the task before its process is reaped.
+	if err := c.pollTaskStop(ctx, id, forceStopTimeout); err != nil {
+		return fmt.Errorf("failed to wait for container %q to stop: %v", id, err)
+	}
+	resp, err := c.taskService.Delete(ctx, &tasks.DeleteTaskRequest{ContainerID: id})
+	if err != nil {
+		if isContainerdGRPCNotFoundError(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to delete task of container %q: %v", id, err)
+	}
+	exitedAt := resp.ExitedAt
+	if exitedAt.IsZero() {
+		exitedAt = time.Now()
+	}
+	if err := setContainerExited(container, int32(resp.ExitStatus), exitedAt, ""); err != nil {
+		return fmt.Errorf("failed to update container %q state: %v", id, err)
+	}
+	return nil
+}
 
-	sandboxRoot := getSandboxRootDir(c.rootDir, id)
-	if err := c.unmountSandboxFiles(sandboxRoot, sandbox.Config); err != nil {
-		return nil, fmt.Errorf("failed to unmount sandbox files in %q: %v", sandboxRoot, err)
+// getForceStop returns whether the sandbox should be stopped in force mode.
+func getForceStop(config *runtime.PodSandboxConfig) (bool, error) {
+	value, ok := config.GetAnnotations()[forceStopAnnotationKey]
+	if !ok {
+		return false, nil
 	}
+	force, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, grpc.Errorf(codes.InvalidArgument, "invalid force stop %q: %v", value, err)
+	}
+	return force, nil
+}
 
-	if err := c.stopSandboxContainer(ctx, id); err != nil {
-		return nil, fmt.Errorf("failed to stop sandbox container %q: %v", id, err)
+// getSandboxContainerStopTimeout returns the grace period used to stop a container
+// during StopPodSandbox. The container's own termination grace period is honored
+// when it is available, but it never exceeds the sandbox-wide maxTimeout, so that the
+// total time spent in StopPodSandbox is bounded.
+func getSandboxContainerStopTimeout(container containerstore.Container, maxTimeout time.Duration) time.Duration {
+	if maxTimeout <= 0 {
+		return 0
 	}
-	return &runtime.StopPodSandboxResponse{}, nil
+	v, ok := container.Config.GetAnnotations()[terminationGracePeriodAnnotation]
+	if !ok {
+		return maxTimeout
+	}
+	seconds, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || seconds < 0 {
+		log.L.Warningf("Invalid termination grace period %q for container %q, use %v instead",
+			v, container.ID, maxTimeout)
+		return maxTimeout
+	}
+	if timeout := time.Duration(seconds) * time.Second; timeout < maxTimeout {
+		return timeout
+	}
+	return maxTimeout
 }
 
-// stopSandboxContainer kills and deletes sandbox container.
-func (c *criContainerdService) stopSandboxContainer(ctx context.Context, id string) error {
+// stopSandboxContainer kills and deletes sandbox container. If force is true, the
+// exit event is not waited for, and the task status is only polled for a short period
+// because containerd can't delete the task before its process is reaped.
+func (c *criContainerdService) stopSandboxContainer(ctx context.Context, id string, force bool) error {
 	cancellable, cancel := context.WithCancel(ctx)
+	defer cancel()
 	eventstream, err := c.eventService.Subscribe(cancellable, &events.SubscribeRequest{})
 	if err != nil {
-		return fmt.Errorf("failed to get containerd event: %v", err)
+		// Event service could be temporarily unavailable, e.g. right after containerd
+		// restarts. Poll the task status instead of aborting the stop.
+		log.G(ctx).Warningf("Failed to subscribe containerd event, poll sandbox container %q status instead: %v", id, err)
+		eventstream = nil
 	}
-	defer cancel()
 
 	resp, err := c.taskService.Get(ctx, &tasks.GetTaskRequest{ContainerID: id})
 	if err != nil {
@@ -115,7 +339,18 @@ func (c *criContainerdService) stopSandboxContainer(ctx context.Context, id stri
 			return fmt.Errorf("failed to kill sandbox container: %v", err)
 		}
 
-		if err := c.waitSandboxContainer(eventstream, id, resp.Task.Pid); err != nil {
+		timeout := c.config.SandboxContainerStopTimeout
+		if timeout <= 0 {
+			timeout = killContainerTimeout
+		}
+		if force {
+			err = c.pollTaskStop(ctx, id, forceStopTimeout)
+		} else if eventstream != nil {
+			err = c.waitSandboxContainer(ctx, eventstream, id, resp.Task.Pid, timeout)
+		} else {
+			err = c.pollTaskStop(ctx, id, timeout)
+		}
+		if err != nil {
 			return fmt.Errorf("failed to wait for pod sandbox to stop: %v", err)
 		}
 	}
@@ -128,8 +363,69 @@ func (c *criContainerdService) stopSandboxContainer(ctx context.Context, id stri
 	return nil
 }
 
-// waitSandboxContainer wait sandbox container stop event.
-func (c *criContainerdService) waitSandboxContainer(eventstream events.Events_SubscribeClient, id string, pid uint32) error {
+// waitSandboxContainer waits for the sandbox container stop event until timeout
+// exceeds or the context is cancelled. If the event is not received in time, e.g.
+// the event is dropped, it checks the task status in containerd to confirm whether
+// the sandbox container is stopped.
+func (c *criContainerdService) waitSandboxContainer(ctx context.Context, eventstream events.Events_SubscribeClient,
+	id string, pid uint32, timeout time.Duration) error {
+	// The goroutine returns once the event stream is closed by the caller.
+	exitCh := make(chan error, 1)
+	go func() {
+		exitCh <- waitTaskExitEvent(eventstream, id, pid)
+	}()
+	timeoutTimer := time.NewTimer(timeout)
+	defer timeoutTimer.Stop()
+	select {
+	case err := <-exitCh:
+		if err == nil {
+			return nil
+		}
+		log.G(ctx).Warningf("Failed to wait for sandbox container %q exit event: %v", id, err)
+	case <-timeoutTimer.C:
+		log.G(ctx).Warningf("Timed out waiting for sandbox container %q exit event", id)
+	case <-ctx.Done():
+		return fmt.Errorf("wait sandbox container %q is cancelled: %v", id, ctx.Err())
+	}
+	stopped, err := c.isTaskStopped(ctx, id)
+	if err != nil {
+		return fmt.Errorf("failed to check sandbox container %q status: %v", id, err)
+	}
+	if !stopped {
+		return fmt.Errorf("sandbox container %q is still running after %v", id, timeout)
+	}
+	return nil
+}
+
+// pollTaskStop polls the task status of a container or the sandbox container until
+// timeout exceeds or the task is stopped.
+func (c *criContainerdService) pollTaskStop(ctx context.Context, id string, timeout time.Duration) error {
+	ticker := time.NewTicker(stopCheckPollInterval)
+	defer ticker.Stop()
+	timeoutTimer := time.NewTimer(timeout)
+	defer timeoutTimer.Stop()
+	for {
+		// Poll once before waiting for stopCheckPollInterval.
+		stopped, err := c.isTaskStopped(ctx, id)
+		if err != nil {
+			log.G(ctx).Warningf("Failed to check task %q status: %v", id, err)
+		} else if stopped {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("wait task %q is cancelled: %v", id, ctx.Err())
+		case <-timeoutTimer.C:
+			return fmt.Errorf("wait task %q stop timeout", id)
+		case <-ticker.C:
+			continue
+		}
+	}
+}
+
+// waitTaskExitEvent waits for the exit event of the task process from the event
+// stream.
+func waitTaskExitEvent(eventstream events.Events_SubscribeClient, id string, pid uint32) error {
 	for {
 		evt, err := eventstream.Recv()
 		if err != nil {
@@ -149,3 +445,43 @@ func (c *criContainerdService) waitSandboxContainer(eventstream events.Events_Su
 		}
 	}
 }
+
+// isTaskStopped checks containerd task status to determine whether the container or
+// the sandbox container is stopped. A container without task is treated as stopped.
+func (c *criContainerdService) isTaskStopped(ctx context.Context, id string) (bool, error) {
+	resp, err := c.taskService.Get(ctx, &tasks.GetTaskRequest{ContainerID: id})
+	if err != nil {
+		if isContainerdGRPCNotFoundError(err) {
+			return true, nil
+		}
+		return false, err
+	}
+	return resp.Task.Status == task.StatusStopped, nil
+}
+
+// phaseTimer records the duration of consecutive phases of an operation.
+type phaseTimer struct {
+	start  time.Time
+	last   time.Time
+	phases []string
+}
+
+// newPhaseTimer creates a phaseTimer starting from now.
+func newPhaseTimer() *phaseTimer {
+	now := time.Now()
+	return &phaseTimer{start: now, last: now}
+}
+
+// observe records the duration of a phase, which starts when the previous
+// phase ends.
+func (p *phaseTimer) observe(phase string) {
+	now := time.Now()
+	p.phases = append(p.phases, fmt.Sprintf("%s=%v", phase, now.Sub(p.last)))
+	p.last = now
+}
+
+// String returns the phase durations and the total duration as key=value pairs.
+func (p *phaseTimer) String() string {
+	fields := append([]string{}, p.phases...)
+	return strings.Join(append(fields, fmt.Sprintf("total=%v", time.Since(p.start))), " ")
+}
@@ -0,0 +1,486 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/api/services/events/v1"
+	"github.com/containerd/containerd/api/services/tasks/v1"
+	"github.com/containerd/containerd/api/types/task"
+	"github.com/containerd/containerd/typeurl"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc"
+	"k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+
+	ostesting "github.com/kubernetes-incubator/cri-containerd/pkg/os/testing"
+	servertesting "github.com/kubernetes-incubator/cri-containerd/pkg/server/testing"
+	containerstore "github.com/kubernetes-incubator/cri-containerd/pkg/store/container"
+	sandboxstore "github.com/kubernetes-incubator/cri-containerd/pkg/store/sandbox"
+)
+
+func TestGetSandboxContainerStopTimeout(t *testing.T) {
+	for desc, test := range map[string]struct {
+		annotations map[string]string
+		maxTimeout  time.Duration
+		expected    time.Duration
+	}{
+		"should return 0 if max timeout is not set": {
+			annotations: map[string]string{terminationGracePeriodAnnotation: "30"},
+			maxTimeout:  0,
+			expected:    0,
+		},
+		"should return max timeout if container grace period is not available": {
+			maxTimeout: time.Minute,
+			expected:   time.Minute,
+		},
+		"should return container grace period if it is shorter": {
+			annotations: map[string]string{terminationGracePeriodAnnotation: "10"},
+			maxTimeout:  time.Minute,
+			expected:    10 * time.Second,
+		},
+		"should return max timeout if container grace period is longer": {
+			annotations: map[string]string{terminationGracePeriodAnnotation: "120"},
+			maxTimeout:  time.Minute,
+			expected:    time.Minute,
+		},
+		"should return max timeout if container grace period is invalid": {
+			annotations: map[string]string{terminationGracePeriodAnnotation: "invalid"},
+			maxTimeout:  time.Minute,
+			expected:    time.Minute,
+		},
+	} {
+		container, err := containerstore.NewContainer(
+			containerstore.Metadata{
+				ID:     "test-id",
+				Config: &runtime.ContainerConfig{Annotations: test.annotations},
+			},
+			containerstore.Status{},
+		)
+		assert.NoError(t, err)
+		assert.Equal(t, test.expected, getSandboxContainerStopTimeout(container, test.maxTimeout), desc)
+	}
+}
+
+func TestTeardownSandboxNetwork(t *testing.T) {
+	for desc, test := range map[string]struct {
+		hostNetwork       bool
+		networkConfigured bool
+		statErr           error
+		teardownErr       error
+		noPodNetwork      bool
+		maxAttempts       int
+		cancel            bool
+		expectTeardown    int
+		expectErr         bool
+	}{
+		"should teardown network if netns exists": {
+			expectTeardown: 1,
+		},
+		"should not teardown network for host network sandbox": {
+			hostNetwork: true,
+		},
+		"should not return error if netns doesn't exist": {
+			statErr: os.ErrNotExist,
+		},
+		"should teardown network if netns doesn't exist but network is configured": {
+			networkConfigured: true,
+			statErr:           os.ErrNotExist,
+			expectTeardown:    1,
+		},
+		"should return error if failed to stat netns": {
+			statErr:   errors.New("random error"),
+			expectErr: true,
+		},
+		"should return error if failed to teardown network": {
+			teardownErr:    errors.New("random error"),
+			expectTeardown: 1,
+			expectErr:      true,
+		},
+		"should retry teardown on transient failure": {
+			teardownErr:    errors.New("random error"),
+			maxAttempts:    3,
+			expectTeardown: 2,
+		},
+		"should return error if all teardown attempts fail": {
+			noPodNetwork:   true,
+			maxAttempts:    2,
+			expectTeardown: 2,
+			expectErr:      true,
+		},
+		"should stop retrying if the context is cancelled": {
+			noPodNetwork:   true,
+			maxAttempts:    3,
+			cancel:         true,
+			expectTeardown: 1,
+			expectErr:      true,
+		},
+	} {
+		c := newTestCRIContainerdService()
+		c.config.NetworkTeardownMaxAttempts = test.maxAttempts
+		fakeOS := c.os.(*ostesting.FakeOS)
+		fakeCNIPlugin := c.netPlugin.(*servertesting.FakeCNIPlugin)
+		sandbox := sandboxstore.Sandbox{
+			Metadata: sandboxstore.Metadata{
+				ID:                "test-id",
+				NetNS:             "test-netns",
+				NetworkConfigured: test.networkConfigured,
+				Config: &runtime.PodSandboxConfig{
+					Metadata: &runtime.PodSandboxMetadata{
+						Name:      "test-name",
+						Namespace: "test-ns",
+					},
+					Linux: &runtime.LinuxPodSandboxConfig{
+						SecurityContext: &runtime.LinuxSandboxSecurityContext{
+							NamespaceOptions: &runtime.NamespaceOption{
+								HostNetwork: test.hostNetwork,
+							},
+						},
+					},
+				},
+			},
+		}
+		// Fake CNI plugin returns error on teardown if the pod network is not found.
+		if !test.noPodNetwork {
+			fakeCNIPlugin.SetFakePodNetwork("test-netns", "test-ns", "test-name", "test-id", "10.0.0.1")
+		}
+		if test.statErr != nil {
+			fakeOS.InjectError("Stat", test.statErr)
+		}
+		if test.teardownErr != nil {
+			fakeCNIPlugin.InjectError("TearDownPod", test.teardownErr)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		if test.cancel {
+			cancel()
+		}
+		err := c.teardownSandboxNetwork(ctx, sandbox)
+		cancel()
+		assert.Equal(t, test.expectErr, err != nil, desc)
+		assert.Len(t, fakeCNIPlugin.GetCalledNames(), test.expectTeardown, desc)
+	}
+}
+
+func TestStopPodSandboxTwice(t *testing.T) {
+	c := newTestCRIContainerdService()
+	fakeOS := c.os.(*ostesting.FakeOS)
+	fakeCNIPlugin := c.netPlugin.(*servertesting.FakeCNIPlugin)
+	fakeTaskService := c.taskService.(*servertesting.FakeTaskService)
+	fakeEventsClient := c.eventService.(*servertesting.FakeEventsClient)
+	sandbox := sandboxstore.Sandbox{
+		Metadata: sandboxstore.Metadata{
+			ID:    "test-id",
+			NetNS: "test-netns",
+			Config: &runtime.PodSandboxConfig{
+				Metadata: &runtime.PodSandboxMetadata{
+					Name:      "test-name",
+					Namespace: "test-ns",
+				},
+			},
+		},
+	}
+	require.NoError(t, c.sandboxStore.Add(sandbox))
+	fakeCNIPlugin.SetFakePodNetwork("test-netns", "test-ns", "test-name", "test-id", "10.0.0.1")
+	fakeTaskService.SetFakeTasks([]task.Task{{ID: "test-id", Pid: 1, Status: task.StatusRunning}})
+	// The network namespace is gone after the first stop.
+	netnsRemoved := false
+	fakeOS.StatFn = func(string) (os.FileInfo, error) {
+		if netnsRemoved {
+			return nil, os.ErrNotExist
+		}
+		return nil, nil
+	}
+	// The sandbox files are unmounted after the first stop.
+	unmounted := map[string]bool{}
+	fakeOS.UnmountFn = func(target string, flags int) error {
+		if unmounted[target] {
+			return unix.EINVAL
+		}
+		unmounted[target] = true
+		return nil
+	}
+
+	for i := 0; i < 2; i++ {
+		// Poll the task status instead of waiting for an exit event which is never sent.
+		fakeEventsClient.InjectError("subscribe", errors.New("random error"))
+		_, err := c.StopPodSandbox(context.Background(), &runtime.StopPodSandboxRequest{PodSandboxId: "test-id"})
+		assert.NoError(t, err, "StopPodSandbox call %d", i+1)
+		netnsRemoved = true
+	}
+	assert.Equal(t, []string{"TearDownPod"}, fakeCNIPlugin.GetCalledNames())
+	_, err := fakeTaskService.Get(context.Background(), &tasks.GetTaskRequest{ContainerID: "test-id"})
+	assert.True(t, isContainerdGRPCNotFoundError(err), "sandbox container should be deleted")
+}
+
+func TestGetForceStop(t *testing.T) {
+	for desc, test := range map[string]struct {
+		annotations map[string]string
+		expected    bool
+		expectErr   bool
+	}{
+		"should not force stop by default": {},
+		"should force stop if the annotation is true": {
+			annotations: map[string]string{forceStopAnnotationKey: "true"},
+			expected:    true,
+		},
+		"should not force stop if the annotation is false": {
+			annotations: map[string]string{forceStopAnnotationKey: "false"},
+		},
+		"should return error if the annotation is invalid": {
+			annotations: map[string]string{forceStopAnnotationKey: "invalid"},
+			expectErr:   true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		force, err := getForceStop(&runtime.PodSandboxConfig{Annotations: test.annotations})
+		assert.Equal(t, test.expectErr, err != nil)
+		assert.Equal(t, test.expected, force)
+	}
+}
+
+func TestStopPodSandboxForce(t *testing.T) {
+	for desc, test := range map[string]struct {
+		deleteErr       error
+		expectErr       bool
+		expectRemoveAll bool
+	}{
+		"should delete container tasks before removing sandbox root": {
+			expectRemoveAll: true,
+		},
+		"should not remove sandbox root if failed to delete container task": {
+			deleteErr: errors.New("random error"),
+			expectErr: true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		c := newTestCRIContainerdService()
+		fakeOS := c.os.(*ostesting.FakeOS)
+		fakeTaskService := c.taskService.(*servertesting.FakeTaskService)
+		sandbox := sandboxstore.Sandbox{
+			Metadata: sandboxstore.Metadata{
+				ID:    "test-sandbox-id",
+				NetNS: "test-netns",
+				Config: &runtime.PodSandboxConfig{
+					Metadata: &runtime.PodSandboxMetadata{
+						Name:      "test-name",
+						Namespace: "test-ns",
+					},
+					Annotations: map[string]string{forceStopAnnotationKey: "true"},
+					Linux: &runtime.LinuxPodSandboxConfig{
+						SecurityContext: &runtime.LinuxSandboxSecurityContext{
+							NamespaceOptions: &runtime.NamespaceOption{HostNetwork: true},
+						},
+					},
+				},
+			},
+		}
+		require.NoError(t, c.sandboxStore.Add(sandbox))
+		container, err := containerstore.NewContainer(
+			containerstore.Metadata{
+				ID:        "test-container-id",
+				SandboxID: "test-sandbox-id",
+				Config: &runtime.ContainerConfig{
+					// The grace period should be skipped in force mode.
+					Annotations: map[string]string{terminationGracePeriodAnnotation: "3600"},
+				},
+			},
+			containerstore.Status{Pid: 2, CreatedAt: 1, StartedAt: 2},
+		)
+		require.NoError(t, err)
+		require.NoError(t, c.containerStore.Add(container))
+		c.config.StopPodSandboxTimeout = time.Hour
+		fakeTaskService.SetFakeTasks([]task.Task{
+			{ID: "test-sandbox-id", Pid: 1, Status: task.StatusRunning},
+			{ID: "test-container-id", Pid: 2, Status: task.StatusRunning},
+		})
+		if test.deleteErr != nil {
+			fakeTaskService.InjectError("delete", test.deleteErr)
+		}
+		sandboxRoot := getSandboxRootDir(c.rootDir, "test-sandbox-id")
+		var removedRoot bool
+		fakeOS.RemoveAllFn = func(path string) error {
+			if path != sandboxRoot {
+				return nil
+			}
+			removedRoot = true
+			// The container task must be deleted before the sandbox root is removed.
+			_, err := fakeTaskService.Get(context.Background(), &tasks.GetTaskRequest{ContainerID: "test-container-id"})
+			assert.True(t, isContainerdGRPCNotFoundError(err), "container task should be deleted")
+			return nil
+		}
+
+		_, err = c.StopPodSandbox(context.Background(), &runtime.StopPodSandboxRequest{PodSandboxId: "test-sandbox-id"})
+		assert.Equal(t, test.expectErr, err != nil)
+		assert.Equal(t, test.expectRemoveAll, removedRoot)
+		if test.expectErr {
+			continue
+		}
+		assert.Equal(t, runtime.ContainerState_CONTAINER_EXITED, container.Status.Get().State())
+		_, err = fakeTaskService.Get(context.Background(), &tasks.GetTaskRequest{ContainerID: "test-sandbox-id"})
+		assert.True(t, isContainerdGRPCNotFoundError(err), "sandbox container should be deleted")
+	}
+}
+
+// testEventStream returns the events in order, and then blocks until its context
+// is done.
+type testEventStream struct {
+	grpc.ClientStream
+	ctx    context.Context
+	events []*events.Envelope
+}
+
+func (s *testEventStream) Recv() (*events.Envelope, error) {
+	if len(s.events) > 0 {
+		evt := s.events[0]
+		s.events = s.events[1:]
+		return evt, nil
+	}
+	<-s.ctx.Done()
+	return nil, s.ctx.Err()
+}
+
+func TestWaitSandboxContainer(t *testing.T) {
+	newExitEvent := func(id string, pid uint32) *events.Envelope {
+		any, err := typeurl.MarshalAny(&events.TaskExit{ContainerID: id, Pid: pid})
+		require.NoError(t, err)
+		return &events.Envelope{Event: any}
+	}
+	for desc, test := range map[string]struct {
+		events     []*events.Envelope
+		taskStatus task.Status
+		cancel     bool
+		expectErr  bool
+	}{
+		"should return nil when the exit event is received": {
+			events:     []*events.Envelope{newExitEvent("test-id", 1)},
+			taskStatus: task.StatusRunning,
+		},
+		"should ignore exit events of other processes": {
+			events: []*events.Envelope{
+				newExitEvent("other-id", 1),
+				newExitEvent("test-id", 2),
+			},
+			taskStatus: task.StatusRunning,
+			expectErr:  true,
+		},
+		"should return nil if the task is stopped after timeout": {
+			taskStatus: task.StatusStopped,
+		},
+		"should return error if the task is still running after timeout": {
+			taskStatus: task.StatusRunning,
+			expectErr:  true,
+		},
+		"should return error if the context is cancelled": {
+			taskStatus: task.StatusStopped,
+			cancel:     true,
+			expectErr:  true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		c := newTestCRIContainerdService()
+		fakeTaskService := c.taskService.(*servertesting.FakeTaskService)
+		fakeTaskService.SetFakeTasks([]task.Task{{ID: "test-id", Pid: 1, Status: test.taskStatus}})
+		ctx, cancel := context.WithCancel(context.Background())
+		timeout := 100 * time.Millisecond
+		if test.cancel {
+			cancel()
+			timeout = time.Minute
+		}
+		stream := &testEventStream{ctx: ctx, events: test.events}
+		err := c.waitSandboxContainer(ctx, stream, "test-id", 1, timeout)
+		assert.Equal(t, test.expectErr, err != nil)
+		cancel()
+	}
+}
+
+func TestPollTaskStop(t *testing.T) {
+	for desc, test := range map[string]struct {
+		tasks     []task.Task
+		getErr    error
+		cancel    bool
+		expectErr bool
+	}{
+		"should return nil if the task is stopped": {
+			tasks: []task.Task{{ID: "test-id", Status: task.StatusStopped}},
+		},
+		"should return nil if the task doesn't exist": {},
+		"should keep polling if failed to get the task": {
+			tasks:  []task.Task{{ID: "test-id", Status: task.StatusStopped}},
+			getErr: errors.New("random error"),
+		},
+		"should return error if the task is still running after timeout": {
+			tasks:     []task.Task{{ID: "test-id", Status: task.StatusRunning}},
+			expectErr: true,
+		},
+		"should return error if the context is cancelled": {
+			tasks:     []task.Task{{ID: "test-id", Status: task.StatusRunning}},
+			cancel:    true,
+			expectErr: true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		c := newTestCRIContainerdService()
+		fakeTaskService := c.taskService.(*servertesting.FakeTaskService)
+		fakeTaskService.SetFakeTasks(test.tasks)
+		if test.getErr != nil {
+			fakeTaskService.InjectError("get", test.getErr)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		timeout := 3 * stopCheckPollInterval
+		if test.cancel {
+			cancel()
+			timeout = time.Minute
+		}
+		err := c.pollTaskStop(ctx, "test-id", timeout)
+		assert.Equal(t, test.expectErr, err != nil)
+		cancel()
+	}
+}
+
+func TestStopSandboxContainerWithoutEvents(t *testing.T) {
+	c := newTestCRIContainerdService()
+	fakeTaskService := c.taskService.(*servertesting.FakeTaskService)
+	fakeEventsClient := c.eventService.(*servertesting.FakeEventsClient)
+	fakeTaskService.SetFakeTasks([]task.Task{{ID: "test-id", Pid: 1, Status: task.StatusRunning}})
+	fakeEventsClient.InjectError("subscribe", errors.New("random error"))
+
+	require.NoError(t, c.stopSandboxContainer(context.Background(), "test-id", false))
+	assert.Equal(t, []string{"get", "kill", "get", "delete"}, fakeTaskService.GetCalledNames(),
+		"should kill the sandbox container and poll its status")
+}
+
+func TestPhaseTimer(t *testing.T) {
+	p := newPhaseTimer()
+	p.observe("phase1")
+	p.observe("phase2")
+	fields := strings.Fields(p.String())
+	require.Len(t, fields, 3)
+	for i, key := range []string{"phase1", "phase2", "total"} {
+		kv := strings.SplitN(fields[i], "=", 2)
+		require.Len(t, kv, 2)
+		assert.Equal(t, key, kv[0])
+		_, err := time.ParseDuration(kv[1])
+		assert.NoError(t, err, "phase %q should have a valid duration", key)
+	}
+}
@@ -0,0 +1,131 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+
+	"k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+)
+
+const (
+	// defaultProcessLabel is the default selinux process label for containers
+	// without the level.
+	defaultProcessLabel = "system_u:system_r:container_t"
+	// defaultMountLabel is the default selinux label for container files without
+	// the level.
+	defaultMountLabel = "system_u:object_r:container_file_t"
+	// selinuxEnforceFile is the file only existing when selinux is enabled.
+	selinuxEnforceFile = "/sys/fs/selinux/enforce"
+	// maxMCSCategory is the max category number used in generated mcs levels.
+	maxMCSCategory = 1024
+)
+
+// isSelinuxEnabled returns whether selinux is enabled on the host.
+func isSelinuxEnabled() bool {
+	_, err := os.Stat(selinuxEnforceFile)
+	return err == nil
+}
+
+// initSandboxSelinuxLabels generates the selinux process and mount labels for
+// a sandbox. All containers in the sandbox inherit the labels, so that they
+// share the same mcs level. Empty labels are returned if selinux is disabled.
+func (c *criContainerdService) initSandboxSelinuxLabels(options *runtime.SELinuxOption) (string, string, error) {
+	if !c.selinuxEnabled {
+		return "", "", nil
+	}
+	level := options.GetLevel()
+	if level == "" {
+		var err error
+		level, err = generateMCSLevel()
+		if err != nil {
+			return "", "", fmt.Errorf("failed to generate mcs level: %v", err)
+		}
+	}
+	return addSelinuxOptions(defaultProcessLabel+":"+level, defaultMountLabel+":"+level, options)
+}
+
+// getContainerSelinuxLabels returns the selinux process and mount labels for a
+// container, which are the sandbox labels overridden by the container selinux
+// options.
+func (c *criContainerdService) getContainerSelinuxLabels(sandboxProcessLabel, sandboxMountLabel string,
+	options *runtime.SELinuxOption) (string, string, error) {
+	if !c.selinuxEnabled || sandboxProcessLabel == "" {
+		return "", "", nil
+	}
+	return addSelinuxOptions(sandboxProcessLabel, sandboxMountLabel, options)
+}
+
+// addSelinuxOptions overrides fields of the process and mount labels with the
+// selinux options. Role and type only apply to the process label.
+func addSelinuxOptions(processLabel, mountLabel string, options *runtime.SELinuxOption) (string, string, error) {
+	pcon, err := parseSelinuxLabel(processLabel)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to parse process label %q: %v", processLabel, err)
+	}
+	mcon, err := parseSelinuxLabel(mountLabel)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to parse mount label %q: %v", mountLabel, err)
+	}
+	if user := options.GetUser(); user != "" {
+		pcon[0], mcon[0] = user, user
+	}
+	if role := options.GetRole(); role != "" {
+		pcon[1] = role
+	}
+	if typ := options.GetType(); typ != "" {
+		pcon[2] = typ
+	}
+	if level := options.GetLevel(); level != "" {
+		pcon[3], mcon[3] = level, level
+	}
+	return strings.Join(pcon, ":"), strings.Join(mcon, ":"), nil
+}
+
+// parseSelinuxLabel splits a "user:role:type:level" label into its fields.
+// The level may contain ":" itself.
+func parseSelinuxLabel(label string) ([]string, error) {
+	fields := strings.SplitN(label, ":", 4)
+	if len(fields) != 4 {
+		return nil, fmt.Errorf("invalid selinux label")
+	}
+	return fields, nil
+}
+
+// generateMCSLevel generates a random mcs level with 2 different categories,
+// e.g. "s0:c1,c2".
+func generateMCSLevel() (string, error) {
+	c1, err := rand.Int(rand.Reader, big.NewInt(maxMCSCategory))
+	if err != nil {
+		return "", err
+	}
+	c2, err := rand.Int(rand.Reader, big.NewInt(maxMCSCategory-1))
+	if err != nil {
+		return "", err
+	}
+	// Make sure the 2 categories are different and ordered.
+	if c2.Cmp(c1) >= 0 {
+		c2.Add(c2, big.NewInt(1))
+	} else {
+		c1, c2 = c2, c1
+	}
+	return fmt.Sprintf("s0:c%d,c%d", c1, c2), nil
+}
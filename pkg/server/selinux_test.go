@@ -0,0 +1,167 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+
+	ostesting "github.com/kubernetes-incubator/cri-containerd/pkg/os/testing"
+)
+
+func TestInitSandboxSelinuxLabels(t *testing.T) {
+	for desc, test := range map[string]struct {
+		disabled             bool
+		options              *runtime.SELinuxOption
+		expectedProcessLabel string
+		expectedMountLabel   string
+	}{
+		"should return empty labels if selinux is disabled": {
+			disabled: true,
+			options:  &runtime.SELinuxOption{Level: "s0:c1,c2"},
+		},
+		"should use default labels with the specified level": {
+			options:              &runtime.SELinuxOption{Level: "s0:c1,c2"},
+			expectedProcessLabel: "system_u:system_r:container_t:s0:c1,c2",
+			expectedMountLabel:   "system_u:object_r:container_file_t:s0:c1,c2",
+		},
+		"should apply selinux options": {
+			options: &runtime.SELinuxOption{
+				User:  "user_u",
+				Role:  "user_r",
+				Type:  "user_t",
+				Level: "s0:c1,c2",
+			},
+			expectedProcessLabel: "user_u:user_r:user_t:s0:c1,c2",
+			expectedMountLabel:   "user_u:object_r:container_file_t:s0:c1,c2",
+		},
+	} {
+		c := newTestCRIContainerdService()
+		c.selinuxEnabled = !test.disabled
+		processLabel, mountLabel, err := c.initSandboxSelinuxLabels(test.options)
+		assert.NoError(t, err, desc)
+		assert.Equal(t, test.expectedProcessLabel, processLabel, desc)
+		assert.Equal(t, test.expectedMountLabel, mountLabel, desc)
+	}
+}
+
+func TestInitSandboxSelinuxLabelsGenerateLevel(t *testing.T) {
+	c := newTestCRIContainerdService()
+	c.selinuxEnabled = true
+	processLabel, mountLabel, err := c.initSandboxSelinuxLabels(nil)
+	require.NoError(t, err)
+	level := regexp.MustCompile(`^s0:c(\d+),c(\d+)$`)
+	pcon, err := parseSelinuxLabel(processLabel)
+	require.NoError(t, err)
+	mcon, err := parseSelinuxLabel(mountLabel)
+	require.NoError(t, err)
+	assert.Regexp(t, level, pcon[3])
+	assert.Equal(t, pcon[3], mcon[3], "sandbox process and mount labels should share the level")
+	m := level.FindStringSubmatch(pcon[3])
+	assert.NotEqual(t, m[1], m[2], "mcs categories should be different")
+}
+
+func TestGetContainerSelinuxLabels(t *testing.T) {
+	sandboxProcessLabel := "system_u:system_r:container_t:s0:c1,c2"
+	sandboxMountLabel := "system_u:object_r:container_file_t:s0:c1,c2"
+	for desc, test := range map[string]struct {
+		disabled             bool
+		options              *runtime.SELinuxOption
+		expectedProcessLabel string
+		expectedMountLabel   string
+	}{
+		"should return empty labels if selinux is disabled": {
+			disabled: true,
+		},
+		"should inherit sandbox labels": {
+			expectedProcessLabel: sandboxProcessLabel,
+			expectedMountLabel:   sandboxMountLabel,
+		},
+		"should override sandbox labels with container options": {
+			options:              &runtime.SELinuxOption{Type: "user_t"},
+			expectedProcessLabel: "system_u:system_r:user_t:s0:c1,c2",
+			expectedMountLabel:   sandboxMountLabel,
+		},
+	} {
+		c := newTestCRIContainerdService()
+		c.selinuxEnabled = !test.disabled
+		processLabel, mountLabel, err := c.getContainerSelinuxLabels(sandboxProcessLabel, sandboxMountLabel, test.options)
+		assert.NoError(t, err, desc)
+		assert.Equal(t, test.expectedProcessLabel, processLabel, desc)
+		assert.Equal(t, test.expectedMountLabel, mountLabel, desc)
+	}
+}
+
+func TestRelabelMounts(t *testing.T) {
+	mounts := []*runtime.Mount{
+		{HostPath: "/test-relabel", SelinuxRelabel: true},
+		{HostPath: "/test-no-relabel"},
+	}
+	for desc, test := range map[string]struct {
+		mounts        []*runtime.Mount
+		mountLabel    string
+		expectedCalls []ostesting.CalledDetail
+		expectErr     bool
+	}{
+		"should not relabel if mount label is empty": {
+			mounts:        mounts,
+			expectedCalls: []ostesting.CalledDetail{},
+		},
+		"should only relabel mounts requiring relabel": {
+			mounts:     mounts,
+			mountLabel: "system_u:object_r:container_file_t:s0:c1,c2",
+			expectedCalls: []ostesting.CalledDetail{{
+				Name:      "Relabel",
+				Arguments: []interface{}{"/test-relabel", "system_u:object_r:container_file_t:s0:c1,c2"},
+			}},
+		},
+		"should refuse to relabel system paths": {
+			mounts:        []*runtime.Mount{{HostPath: "/etc/", SelinuxRelabel: true}},
+			mountLabel:    "system_u:object_r:container_file_t:s0:c1,c2",
+			expectedCalls: []ostesting.CalledDetail{},
+			expectErr:     true,
+		},
+		"should allow relabel of paths under system paths": {
+			mounts:     []*runtime.Mount{{HostPath: "/var/lib/test", SelinuxRelabel: true}},
+			mountLabel: "system_u:object_r:container_file_t:s0:c1,c2",
+			expectedCalls: []ostesting.CalledDetail{{
+				Name:      "Relabel",
+				Arguments: []interface{}{"/var/lib/test", "system_u:object_r:container_file_t:s0:c1,c2"},
+			}},
+		},
+	} {
+		c := newTestCRIContainerdService()
+		fakeOS := c.os.(*ostesting.FakeOS)
+		err := c.relabelMounts(test.mounts, test.mountLabel)
+		assert.Equal(t, test.expectErr, err != nil, desc)
+		assert.Equal(t, test.expectedCalls, fakeOS.GetCalls(), desc)
+	}
+}
+
+func TestContainerSpecSelinuxLabels(t *testing.T) {
+	config, sandboxConfig, imageConfig, _ := getCreateContainerTestData()
+	c := newTestCRIContainerdService()
+	spec, err := c.generateContainerSpec("test-id", 1234, config, sandboxConfig, imageConfig, nil,
+		"test-process-label", "test-mount-label")
+	require.NoError(t, err)
+	assert.Equal(t, "test-process-label", spec.Process.SelinuxLabel)
+	assert.Equal(t, "test-mount-label", spec.Linux.MountLabel)
+}
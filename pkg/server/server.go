@@ -22,10 +22,12 @@ import (
 	"os"
 	"syscall"
 
-	"github.com/golang/glog"
 	"google.golang.org/grpc"
+	healthapi "google.golang.org/grpc/health/grpc_health_v1"
 	"k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
 	"k8s.io/kubernetes/pkg/util/interrupt"
+
+	"github.com/kubernetes-incubator/cri-containerd/pkg/log"
 )
 
 // unixProtocol is the network protocol of unix socket.
@@ -54,7 +56,7 @@ func NewCRIContainerdServer(addr string, r runtime.RuntimeServiceServer, i runti
 
 // Run runs the cri-containerd grpc server.
 func (s *CRIContainerdServer) Run() error {
-	glog.V(2).Infof("Start cri-containerd grpc server")
+	log.L.V(2).Infof("Start cri-containerd grpc server")
 	// Unlink to cleanup the previous socket file.
 	err := syscall.Unlink(s.addr)
 	if err != nil && !os.IsNotExist(err) {
@@ -64,11 +66,25 @@ func (s *CRIContainerdServer) Run() error {
 	if err != nil {
 		return fmt.Errorf("failed to listen on %q: %v", s.addr, err)
 	}
+	// Track all requests of cri-containerd service, so that they could be
+	// drained on shutdown, and enforce operation timeouts.
+	var opts []grpc.ServerOption
+	stopFns := []func(){}
+	if svc, ok := s.runtimeService.(*criContainerdService); ok {
+		opts = append(opts, grpc.UnaryInterceptor(svc.unaryInterceptor))
+		stopFns = append(stopFns, svc.Stop)
+	}
 	// Create the grpc server and register runtime and image services.
-	s.server = grpc.NewServer()
+	s.server = grpc.NewServer(opts...)
 	runtime.RegisterRuntimeServiceServer(s.server, s.runtimeService)
 	runtime.RegisterImageServiceServer(s.server, s.imageService)
-	// Use interrupt handler to make sure the server to be stopped properly.
-	h := interrupt.New(nil, s.server.Stop)
+	// Register the grpc health service backed by the cri-containerd self test.
+	if h, ok := s.runtimeService.(healthapi.HealthServer); ok {
+		healthapi.RegisterHealthServer(s.server, h)
+	}
+	// Use interrupt handler to make sure the server to be stopped properly. The
+	// service is stopped before the grpc server, so that new requests are
+	// rejected while in-flight requests are drained.
+	h := interrupt.New(nil, append(stopFns, s.server.Stop)...)
 	return h.Run(func() error { return s.server.Serve(l) })
 }
@@ -18,6 +18,8 @@ package server
 
 import (
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/containerd/containerd"
 	"github.com/containerd/containerd/api/services/events/v1"
@@ -28,12 +30,16 @@ import (
 	"github.com/containerd/containerd/images"
 	diffservice "github.com/containerd/containerd/services/diff"
 	"github.com/containerd/containerd/snapshot"
-	"github.com/golang/glog"
 	"github.com/kubernetes-incubator/cri-o/pkg/ocicni"
+	runtimespec "github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/net/context"
 	healthapi "google.golang.org/grpc/health/grpc_health_v1"
+	"k8s.io/apimachinery/pkg/util/clock"
 	"k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
 	"k8s.io/kubernetes/pkg/kubelet/server/streaming"
 
+	"github.com/kubernetes-incubator/cri-containerd/cmd/cri-containerd/options"
+	"github.com/kubernetes-incubator/cri-containerd/pkg/log"
 	osinterface "github.com/kubernetes-incubator/cri-containerd/pkg/os"
 	"github.com/kubernetes-incubator/cri-containerd/pkg/registrar"
 	"github.com/kubernetes-incubator/cri-containerd/pkg/server/agents"
@@ -48,18 +54,23 @@ const k8sContainerdNamespace = "k8s.io"
 // CRIContainerdService is the interface implement CRI remote service server.
 type CRIContainerdService interface {
 	Start()
+	// Stop gracefully stops the service.
+	Stop()
 	runtime.RuntimeServiceServer
 	runtime.ImageServiceServer
+	// HealthServer is the grpc health service backed by the self test.
+	healthapi.HealthServer
 }
 
 // criContainerdService implements CRIContainerdService.
 type criContainerdService struct {
+	// config contains all configurations.
+	config options.Config
 	// os is an interface for all required os operations.
 	os osinterface.OS
 	// rootDir is the directory for managing cri-containerd files.
 	rootDir string
 	// sandboxImage is the image to use for sandbox container.
-	// TODO(random-liu): Make this configurable via flag.
 	sandboxImage string
 	// sandboxStore stores all resources associated with sandboxes.
 	sandboxStore *sandboxstore.Store
@@ -94,29 +105,63 @@ type criContainerdService struct {
 	healthService healthapi.HealthClient
 	// netPlugin is used to setup and teardown network when run/stop pod sandbox.
 	netPlugin ocicni.CNIPlugin
+	// netConfSyncer reloads netPlugin when the cni config changes. It's nil if
+	// the cni config is not watched.
+	netConfSyncer *cniNetConfSyncer
 	// agentFactory is the factory to create agent used in the cri containerd service.
 	agentFactory agents.AgentFactory
 	// client is an instance of the containerd client
 	client *containerd.Client
 	// streamServer is the streaming server serves container streaming request.
 	streamServer streaming.Server
+	// apparmorEnabled indicates whether apparmor is enabled on the host.
+	apparmorEnabled bool
+	// selinuxEnabled indicates whether selinux is enabled on the host.
+	selinuxEnabled bool
+	// uidMapping is the uid mapping of the user namespace. User namespace is
+	// not used if it's nil.
+	uidMapping *runtimespec.LinuxIDMapping
+	// gidMapping is the gid mapping of the user namespace.
+	gidMapping *runtimespec.LinuxIDMapping
+	// remapLock serializes creation of remapped image snapshots.
+	remapLock sync.Mutex
+	// requestTracker tracks in-flight grpc requests to drain them on shutdown.
+	requestTracker *requestTracker
+	// operationTimeouts are the timeouts of specific CRI operations.
+	operationTimeouts map[string]time.Duration
+	// defaultRlimits are the rlimits of containers keyed by OCI rlimit type,
+	// which can be overridden by each container.
+	defaultRlimits map[string]rlimit
+	// stopEventMonitor stops the event monitor. It's nil if the event monitor
+	// is not started.
+	stopEventMonitor context.CancelFunc
+	// snapshotUsageCache caches usages of container writable layers.
+	snapshotUsageCache *snapshotUsageCache
+	// imageFSPath is the backing directory of the snapshotter in use.
+	imageFSPath string
+	// registryMirrors are the mirror endpoints of registries, which are tried
+	// in order before the canonical registry when pulling images.
+	registryMirrors map[string][]registryEndpoint
+	// imagePullGroup deduplicates concurrent pulls of the same image.
+	imagePullGroup *imagePullGroup
+	// runtimeHandlers are the containerd runtimes of the configured runtime
+	// handlers, keyed by handler name.
+	runtimeHandlers map[string]containers.RuntimeInfo
 }
 
 // NewCRIContainerdService returns a new instance of CRIContainerdService
-// TODO(random-liu): Add cri-containerd server config to get rid of the long arg list.
-func NewCRIContainerdService(containerdEndpoint, rootDir, networkPluginBinDir, networkPluginConfDir,
-	streamAddress, streamPort string) (CRIContainerdService, error) {
-	// TODO(random-liu): [P2] Recover from runtime state and checkpoint.
-
-	client, err := containerd.New(containerdEndpoint, containerd.WithDefaultNamespace(k8sContainerdNamespace))
+func NewCRIContainerdService(config options.Config) (CRIContainerdService, error) {
+	client, err := containerd.New(config.ContainerdEndpoint, containerd.WithDefaultNamespace(k8sContainerdNamespace))
 	if err != nil {
-		return nil, fmt.Errorf("failed to initialize containerd client with endpoint %q: %v", containerdEndpoint, err)
+		return nil, fmt.Errorf("failed to initialize containerd client with endpoint %q: %v",
+			config.ContainerdEndpoint, err)
 	}
 
 	c := &criContainerdService{
+		config:              config,
 		os:                  osinterface.RealOS{},
-		rootDir:             rootDir,
-		sandboxImage:        defaultSandboxImage,
+		rootDir:             config.RootDir,
+		sandboxImage:        config.SandboxImage,
 		sandboxStore:        sandboxstore.NewStore(),
 		containerStore:      containerstore.NewStore(),
 		imageStore:          imagestore.NewStore(),
@@ -127,35 +172,107 @@ func NewCRIContainerdService(containerdEndpoint, rootDir, networkPluginBinDir, n
 		imageStoreService:   client.ImageService(),
 		eventService:        client.EventService(),
 		contentStoreService: client.ContentStore(),
-		// Use daemon default snapshotter.
-		snapshotService: client.SnapshotService(""),
+		// Use the configured snapshotter, or the daemon default snapshotter if
+		// it's not configured.
+		snapshotService: client.SnapshotService(config.ContainerdSnapshotter),
 		diffService:     client.DiffService(),
+		apparmorEnabled: isApparmorEnabled(),
+		selinuxEnabled:  isSelinuxEnabled(),
 		versionService:  client.VersionService(),
 		healthService:   client.HealthService(),
-		agentFactory:    agents.NewAgentFactory(),
+		imagePullGroup:  newImagePullGroup(),
+		requestTracker:  newRequestTracker(),
+		agentFactory:    agents.NewAgentFactory(config.ContainerLogMaxSize, config.ContainerLogMaxFiles),
 		client:          client,
 	}
 
-	netPlugin, err := ocicni.InitCNI(networkPluginBinDir, networkPluginConfDir)
+	if c.sandboxImage == "" {
+		c.sandboxImage = defaultSandboxImage
+	}
+
+	c.snapshotUsageCache = newSnapshotUsageCache(clock.RealClock{}, snapshotUsageCacheTTL)
+	if err := c.initImageFSPath(config.ImageFSPath, config.ContainerdRootDir, config.ContainerdSnapshotter); err != nil {
+		return nil, fmt.Errorf("failed to initialize image filesystem path: %v", err)
+	}
+
+	if err := c.initUserNamespaceMappings(config.UserNamespaceUIDMap, config.UserNamespaceGIDMap); err != nil {
+		return nil, fmt.Errorf("failed to initialize user namespace mappings: %v", err)
+	}
+
+	c.registryMirrors, err = parseRegistryMirrors(config.RegistryMirrors)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse registry mirrors: %v", err)
+	}
+
+	c.runtimeHandlers, err = parseRuntimeHandlers(config.RuntimeHandlers)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse runtime handlers: %v", err)
+	}
+
+	c.operationTimeouts, err = parseOperationTimeouts(config.OperationTimeouts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse operation timeouts: %v", err)
+	}
+
+	c.defaultRlimits, err = parseRlimits(config.DefaultRlimits)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse default rlimits: %v", err)
+	}
+
+	if err := validateIPFamily(config.PrimaryIPFamily); err != nil {
+		return nil, fmt.Errorf("invalid primary ip family: %v", err)
+	}
+
+	if err := validateCgroupDriver(config.CgroupDriver); err != nil {
+		return nil, fmt.Errorf("invalid cgroup driver: %v", err)
+	}
+
+	// Reload the cni plugin whenever the cni config changes.
+	c.netConfSyncer, err = newCNINetConfSyncer(config.NetworkPluginConfDir,
+		newCNIPluginFunc(config.NetworkPluginConfDir, config.NetworkPluginBinDir))
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize cni plugin: %v", err)
 	}
-	c.netPlugin = netPlugin
+	c.netPlugin = c.netConfSyncer
 
 	// prepare streaming server
-	c.streamServer, err = newStreamServer(c, streamAddress, streamPort)
+	c.streamServer, err = newStreamServer(c, config.StreamServerAddress, config.StreamServerPort)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create stream server: %v", err)
 	}
 
+	// Recover from runtime state and checkpoint.
+	if err := c.recover(context.Background()); err != nil {
+		return nil, fmt.Errorf("failed to recover state: %v", err)
+	}
+
 	return c, nil
 }
 
+// prepullSandboxImage ensures the sandbox image exists. Failure is only logged,
+// because RunPodSandbox pulls the image again if it's still missing.
+func (c *criContainerdService) prepullSandboxImage(ctx context.Context) {
+	image, err := c.ensureImageExists(ctx, c.sandboxImage)
+	if err != nil {
+		log.G(ctx).Errorf("Failed to pre-pull sandbox image %q: %v", c.sandboxImage, err)
+		return
+	}
+	log.G(ctx).V(2).Infof("Sandbox image %q is ready with id %q", c.sandboxImage, image.ID)
+}
+
 func (c *criContainerdService) Start() {
 	c.startEventMonitor()
+	// Pull the sandbox image in the background, so that the first RunPodSandbox
+	// doesn't need to wait for it.
+	go c.prepullSandboxImage(context.Background())
+	if c.netConfSyncer != nil {
+		go c.netConfSyncer.syncLoop()
+	}
+	// Garbage collect snapshots leaked by failed container creation.
+	go c.snapshotGCLoop()
 	go func() {
 		if err := c.streamServer.Start(true); err != nil {
-			glog.Errorf("Failed to start streaming server: %v", err)
+			log.L.Errorf("Failed to start streaming server: %v", err)
 		}
 	}()
 }
@@ -19,6 +19,8 @@ package server
 import (
 	"io"
 
+	"k8s.io/apimachinery/pkg/util/clock"
+
 	ostesting "github.com/kubernetes-incubator/cri-containerd/pkg/os/testing"
 	"github.com/kubernetes-incubator/cri-containerd/pkg/registrar"
 	agentstesting "github.com/kubernetes-incubator/cri-containerd/pkg/server/agents/testing"
@@ -41,6 +43,7 @@ const (
 	// TODO(random-liu): Change this to image name after we have complete image
 	// management unit test framework.
 	testSandboxImage = "sha256:c75bebcdd211f41b3a460c7bf82970ed6c75acaab9cd4c9a4e125b03ca113798"
+	testImageFSPath  = "/test/image/fs/path"
 )
 
 // newTestCRIContainerdService creates a fake criContainerdService for test.
@@ -55,6 +58,14 @@ func newTestCRIContainerdService() *criContainerdService {
 		containerStore:     containerstore.NewStore(),
 		containerNameIndex: registrar.NewRegistrar(),
 		netPlugin:          servertesting.NewFakeCNIPlugin(),
+		containerService:   servertesting.NewFakeContainerService(),
+		taskService:        servertesting.NewFakeTaskService(),
+		eventService:       servertesting.NewFakeEventsClient(),
+		snapshotService:    servertesting.NewFakeSnapshotter(),
+		snapshotUsageCache: newSnapshotUsageCache(clock.RealClock{}, snapshotUsageCacheTTL),
+		imageFSPath:        testImageFSPath,
+		imagePullGroup:     newImagePullGroup(),
+		requestTracker:     newRequestTracker(),
 		agentFactory:       agentstesting.NewFakeAgentFactory(),
 	}
 }
@@ -0,0 +1,135 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	"github.com/kubernetes-incubator/cri-containerd/pkg/log"
+)
+
+// forceShutdownTimeout is the time to wait for in-flight requests to return
+// after they are cancelled on shutdown.
+const forceShutdownTimeout = 5 * time.Second
+
+// requestTracker tracks in-flight grpc requests, so that they could be drained
+// on shutdown.
+type requestTracker struct {
+	sync.Mutex
+	// draining indicates that no new request is accepted.
+	draining bool
+	inflight sync.WaitGroup
+	// ctx is cancelled when in-flight requests should be cancelled.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// newRequestTracker creates a request tracker.
+func newRequestTracker() *requestTracker {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &requestTracker{ctx: ctx, cancel: cancel}
+}
+
+// track starts tracking a request. It returns the request context which is
+// also cancelled when the tracker cancels in-flight requests, and a function
+// which must be called when the request is done. It returns error if the
+// tracker is draining.
+func (t *requestTracker) track(ctx context.Context) (context.Context, func(), error) {
+	t.Lock()
+	defer t.Unlock()
+	if t.draining {
+		return nil, nil, grpc.Errorf(codes.Unavailable, "cri-containerd is shutting down")
+	}
+	t.inflight.Add(1)
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-t.ctx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, func() {
+		cancel()
+		t.inflight.Done()
+	}, nil
+}
+
+// unaryInterceptor is a grpc unary interceptor tracking all requests.
+func (t *requestTracker) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, done, err := t.track(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	return handler(ctx, req)
+}
+
+// drain stops accepting new requests, and waits for in-flight requests to
+// finish within the timeout. Requests still running after the timeout are
+// cancelled, and it waits for them to return for forceShutdownTimeout.
+func (t *requestTracker) drain(timeout time.Duration) error {
+	t.Lock()
+	t.draining = true
+	t.Unlock()
+	done := make(chan struct{})
+	go func() {
+		t.inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+	}
+	log.L.Warningf("In-flight requests are not finished in %v, cancel them", timeout)
+	t.cancel()
+	select {
+	case <-done:
+		return nil
+	case <-time.After(forceShutdownTimeout):
+		return fmt.Errorf("in-flight requests are not finished %v after cancellation", forceShutdownTimeout)
+	}
+}
+
+// Stop gracefully stops the service. It stops accepting new requests, drains
+// in-flight requests within the configured shutdown timeout, and then stops
+// the event monitor, the streaming server and the cni config syncer.
+func (c *criContainerdService) Stop() {
+	log.L.V(2).Infof("Stop cri-containerd service")
+	if err := c.requestTracker.drain(c.config.ShutdownTimeout); err != nil {
+		log.L.Errorf("Failed to drain in-flight requests: %v", err)
+	}
+	if c.stopEventMonitor != nil {
+		c.stopEventMonitor()
+	}
+	if err := c.streamServer.Stop(); err != nil {
+		log.L.Errorf("Failed to stop streaming server: %v", err)
+	}
+	if c.netConfSyncer != nil {
+		if err := c.netConfSyncer.stop(); err != nil {
+			log.L.Errorf("Failed to stop cni config syncer: %v", err)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+func TestRequestTrackerDrain(t *testing.T) {
+	tracker := newRequestTracker()
+	ctx, done, err := tracker.track(context.Background())
+	require.NoError(t, err)
+
+	drained := make(chan error)
+	go func() {
+		drained <- tracker.drain(time.Minute)
+	}()
+	// Wait for the tracker to start draining.
+	for {
+		tracker.Lock()
+		draining := tracker.draining
+		tracker.Unlock()
+		if draining {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	_, _, err = tracker.track(context.Background())
+	assert.Equal(t, codes.Unavailable, grpc.Code(err), "new request should be rejected")
+	select {
+	case <-drained:
+		t.Fatal("drain should wait for in-flight requests")
+	case <-time.After(10 * time.Millisecond):
+	}
+	assert.NoError(t, ctx.Err(), "in-flight request should not be cancelled before timeout")
+
+	done()
+	select {
+	case err := <-drained:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("drain should return after in-flight requests finish")
+	}
+}
+
+func TestRequestTrackerDrainTimeout(t *testing.T) {
+	tracker := newRequestTracker()
+	ctx, done, err := tracker.track(context.Background())
+	require.NoError(t, err)
+	// The request returns once it's cancelled.
+	go func() {
+		<-ctx.Done()
+		done()
+	}()
+	assert.NoError(t, tracker.drain(10*time.Millisecond))
+	assert.Equal(t, context.Canceled, ctx.Err(), "in-flight request should be cancelled after timeout")
+}
+
+func TestRequestTrackerUnaryInterceptor(t *testing.T) {
+	tracker := newRequestTracker()
+	called := false
+	resp, err := tracker.unaryInterceptor(context.Background(), "request", &grpc.UnaryServerInfo{},
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			called = true
+			return "response", nil
+		})
+	assert.NoError(t, err)
+	assert.True(t, called)
+	assert.Equal(t, "response", resp)
+	assert.NoError(t, tracker.drain(time.Second), "finished request should not block drain")
+
+	called = false
+	_, err = tracker.unaryInterceptor(context.Background(), "request", &grpc.UnaryServerInfo{},
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			called = true
+			return nil, nil
+		})
+	assert.Equal(t, codes.Unavailable, grpc.Code(err))
+	assert.False(t, called, "handler should not be called after drain")
+}
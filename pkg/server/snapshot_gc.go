@@ -0,0 +1,106 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/containerd/containerd/snapshot"
+
+	"github.com/kubernetes-incubator/cri-containerd/pkg/log"
+)
+
+// snapshotGCInterval is the interval between two snapshot garbage collections.
+// An unreferenced snapshot is only removed when it's found unreferenced in two
+// consecutive collections, so that snapshots of containers in the middle of
+// creation are not removed.
+const snapshotGCInterval = 10 * time.Minute
+
+// snapshotGCLoop periodically removes snapshots leaked by failed container
+// creation.
+func (c *criContainerdService) snapshotGCLoop() {
+	candidates := map[string]struct{}{}
+	for range time.Tick(snapshotGCInterval) {
+		var err error
+		candidates, err = c.gcSnapshots(context.Background(), candidates)
+		if err != nil {
+			log.L.Errorf("Failed to garbage collect snapshots: %v", err)
+		}
+	}
+}
+
+// gcSnapshots removes active snapshots which are neither used by a container or
+// sandbox in the store, nor by a containerd container, and were already
+// unreferenced in the last collection (candidates). It returns the unreferenced
+// snapshots found in this collection, which are candidates of the next one.
+// Committed snapshots are image layers and managed by the image service.
+func (c *criContainerdService) gcSnapshots(ctx context.Context, candidates map[string]struct{}) (map[string]struct{}, error) {
+	// Hold the remap lock, so that the remapped snapshot being prepared is
+	// not collected.
+	c.remapLock.Lock()
+	defer c.remapLock.Unlock()
+
+	// List snapshots before references, so that a container created in between
+	// is still seen referencing its snapshot.
+	var keys []string
+	if err := c.snapshotService.Walk(ctx, func(_ context.Context, info snapshot.Info) error {
+		if info.Kind != snapshot.KindCommitted {
+			keys = append(keys, info.Name)
+		}
+		return nil
+	}); err != nil {
+		return candidates, err
+	}
+
+	referenced := map[string]struct{}{}
+	for _, cntr := range c.containerStore.List() {
+		referenced[cntr.ID] = struct{}{}
+	}
+	for _, sb := range c.sandboxStore.List() {
+		referenced[sb.ID] = struct{}{}
+	}
+	cntrs, err := c.containerService.List(ctx)
+	if err != nil {
+		return candidates, err
+	}
+	for _, cntr := range cntrs {
+		referenced[cntr.ID] = struct{}{}
+		if cntr.RootFS != "" {
+			referenced[cntr.RootFS] = struct{}{}
+		}
+	}
+
+	unreferenced := map[string]struct{}{}
+	for _, key := range keys {
+		if _, ok := referenced[key]; ok {
+			continue
+		}
+		if _, ok := candidates[key]; !ok {
+			unreferenced[key] = struct{}{}
+			continue
+		}
+		log.G(ctx).V(2).Infof("Remove unreferenced snapshot %q", key)
+		if err := c.snapshotService.Remove(ctx, key); err != nil && !isContainerdGRPCNotFoundError(err) {
+			log.G(ctx).Errorf("Failed to remove unreferenced snapshot %q: %v", key, err)
+			unreferenced[key] = struct{}{}
+			continue
+		}
+		c.snapshotUsageCache.remove(key)
+	}
+	return unreferenced, nil
+}
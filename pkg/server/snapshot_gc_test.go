@@ -0,0 +1,151 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/containerd/containerd/containers"
+	"github.com/containerd/containerd/snapshot"
+	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+
+	servertesting "github.com/kubernetes-incubator/cri-containerd/pkg/server/testing"
+	containerstore "github.com/kubernetes-incubator/cri-containerd/pkg/store/container"
+	imagestore "github.com/kubernetes-incubator/cri-containerd/pkg/store/image"
+	sandboxstore "github.com/kubernetes-incubator/cri-containerd/pkg/store/sandbox"
+)
+
+func TestGCSnapshots(t *testing.T) {
+	c := newTestCRIContainerdService()
+	fakeSnapshotter := c.snapshotService.(*servertesting.FakeSnapshotter)
+	fakeContainerService := c.containerService.(*servertesting.FakeContainerService)
+	fakeSnapshotter.SetFakeSnapshots([]snapshot.Info{
+		{Name: "image-layer", Kind: snapshot.KindCommitted},
+		{Name: "store-container", Kind: snapshot.KindActive, Parent: "image-layer"},
+		{Name: "store-sandbox", Kind: snapshot.KindView, Parent: "image-layer"},
+		{Name: "containerd-container", Kind: snapshot.KindActive, Parent: "image-layer"},
+		{Name: "leaked", Kind: snapshot.KindActive, Parent: "image-layer"},
+	})
+	cntr, err := containerstore.NewContainer(containerstore.Metadata{
+		ID:     "store-container",
+		Config: &runtime.ContainerConfig{},
+	}, containerstore.Status{})
+	require.NoError(t, err)
+	require.NoError(t, c.containerStore.Add(cntr))
+	require.NoError(t, c.sandboxStore.Add(sandboxstore.Sandbox{
+		Metadata: sandboxstore.Metadata{ID: "store-sandbox"},
+	}))
+	fakeContainerService.SetFakeContainers([]containers.Container{
+		{ID: "orphan", RootFS: "containerd-container"},
+	})
+
+	t.Logf("first collection should only mark the unreferenced snapshot")
+	candidates, err := c.gcSnapshots(context.Background(), map[string]struct{}{})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]struct{}{"leaked": {}}, candidates)
+	assert.NotContains(t, fakeSnapshotter.GetCalledNames(), "remove")
+
+	t.Logf("second collection should remove the unreferenced snapshot")
+	candidates, err = c.gcSnapshots(context.Background(), candidates)
+	assert.NoError(t, err)
+	assert.Empty(t, candidates)
+	_, err = fakeSnapshotter.Stat(context.Background(), "leaked")
+	assert.True(t, isContainerdGRPCNotFoundError(err), "leaked snapshot should be removed")
+	for _, key := range []string{"image-layer", "store-container", "store-sandbox", "containerd-container"} {
+		_, err = fakeSnapshotter.Stat(context.Background(), key)
+		assert.NoError(t, err, "snapshot %q should be kept", key)
+	}
+}
+
+func TestGCSnapshotsKeepReferencedCandidate(t *testing.T) {
+	c := newTestCRIContainerdService()
+	fakeSnapshotter := c.snapshotService.(*servertesting.FakeSnapshotter)
+	fakeSnapshotter.SetFakeSnapshots([]snapshot.Info{{Name: "test-id", Kind: snapshot.KindActive}})
+	// The container is created after the last collection.
+	cntr, err := containerstore.NewContainer(containerstore.Metadata{
+		ID:     "test-id",
+		Config: &runtime.ContainerConfig{},
+	}, containerstore.Status{})
+	require.NoError(t, err)
+	require.NoError(t, c.containerStore.Add(cntr))
+	candidates, err := c.gcSnapshots(context.Background(), map[string]struct{}{"test-id": {}})
+	assert.NoError(t, err)
+	assert.Empty(t, candidates)
+	assert.NotContains(t, fakeSnapshotter.GetCalledNames(), "remove")
+}
+
+func TestGCSnapshotsRemoveError(t *testing.T) {
+	c := newTestCRIContainerdService()
+	fakeSnapshotter := c.snapshotService.(*servertesting.FakeSnapshotter)
+	fakeSnapshotter.SetFakeSnapshots([]snapshot.Info{{Name: "leaked", Kind: snapshot.KindActive}})
+	fakeSnapshotter.InjectError("remove", errors.New("random error"))
+	candidates, err := c.gcSnapshots(context.Background(), map[string]struct{}{"leaked": {}})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]struct{}{"leaked": {}}, candidates, "failed removal should be retried")
+}
+
+func TestGCSnapshotsListError(t *testing.T) {
+	c := newTestCRIContainerdService()
+	fakeSnapshotter := c.snapshotService.(*servertesting.FakeSnapshotter)
+	fakeSnapshotter.InjectError("walk", errors.New("random error"))
+	candidates := map[string]struct{}{"leaked": {}}
+	got, err := c.gcSnapshots(context.Background(), candidates)
+	assert.Error(t, err)
+	assert.Equal(t, candidates, got)
+}
+
+func TestCreateContainerRemoveSnapshotOnFailure(t *testing.T) {
+	c := newTestCRIContainerdService()
+	fakeSnapshotter := c.snapshotService.(*servertesting.FakeSnapshotter)
+	fakeContainerService := c.containerService.(*servertesting.FakeContainerService)
+	imageID := "sha256:c75bebcdd211f41b3a460c7bf82970ed6c75acaab9cd4c9a4e125b03ca113799"
+	c.imageStore.Add(imagestore.Image{
+		ID:      imageID,
+		ChainID: "test-chain-id",
+		Config:  &imagespec.ImageConfig{Entrypoint: []string{"/bin/sh"}},
+	})
+	sandboxConfig := &runtime.PodSandboxConfig{
+		Metadata: &runtime.PodSandboxMetadata{
+			Name:      "test-sandbox-name",
+			Namespace: "test-sandbox-ns",
+			Uid:       "test-sandbox-uid",
+		},
+	}
+	require.NoError(t, c.sandboxStore.Add(sandboxstore.Sandbox{
+		Metadata: sandboxstore.Metadata{
+			ID:     "test-sandbox-id",
+			Config: sandboxConfig,
+		},
+	}))
+	fakeContainerService.InjectError("create", errors.New("random error"))
+	_, err := c.CreateContainer(context.Background(), &runtime.CreateContainerRequest{
+		PodSandboxId: "test-sandbox-id",
+		Config: &runtime.ContainerConfig{
+			Metadata: &runtime.ContainerMetadata{Name: "test-name"},
+			Image:    &runtime.ImageSpec{Image: imageID},
+		},
+		SandboxConfig: sandboxConfig,
+	})
+	assert.Error(t, err)
+	assert.Contains(t, fakeSnapshotter.GetCalledNames(), "prepare")
+	assert.Contains(t, fakeSnapshotter.GetCalledNames(), "remove", "prepared snapshot should be removed")
+}
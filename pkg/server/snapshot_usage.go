@@ -0,0 +1,112 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/snapshot"
+	"golang.org/x/net/context"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+)
+
+// snapshotUsageCacheTTL is how long a snapshot usage is cached. Snapshot usage
+// is expensive to calculate, and stats are usually requested periodically for
+// all containers.
+const snapshotUsageCacheTTL = 5 * time.Second
+
+// cachedUsage is a snapshot usage with the time it's measured.
+type cachedUsage struct {
+	usage     snapshot.Usage
+	timestamp time.Time
+}
+
+// snapshotUsageCache caches snapshot usages keyed by snapshot key.
+type snapshotUsageCache struct {
+	sync.Mutex
+	clock  clock.Clock
+	ttl    time.Duration
+	usages map[string]cachedUsage
+}
+
+// newSnapshotUsageCache creates a snapshot usage cache with the ttl.
+func newSnapshotUsageCache(c clock.Clock, ttl time.Duration) *snapshotUsageCache {
+	return &snapshotUsageCache{
+		clock:  c,
+		ttl:    ttl,
+		usages: make(map[string]cachedUsage),
+	}
+}
+
+// get returns the cached usage of the snapshot if it's not expired.
+func (s *snapshotUsageCache) get(key string) (cachedUsage, bool) {
+	s.Lock()
+	defer s.Unlock()
+	u, ok := s.usages[key]
+	if !ok || s.clock.Since(u.timestamp) >= s.ttl {
+		return cachedUsage{}, false
+	}
+	return u, true
+}
+
+// set caches the usage of the snapshot, and evicts expired usages.
+func (s *snapshotUsageCache) set(key string, usage snapshot.Usage) cachedUsage {
+	s.Lock()
+	defer s.Unlock()
+	for k, u := range s.usages {
+		if s.clock.Since(u.timestamp) >= s.ttl {
+			delete(s.usages, k)
+		}
+	}
+	u := cachedUsage{usage: usage, timestamp: s.clock.Now()}
+	s.usages[key] = u
+	return u
+}
+
+// remove removes the cached usage of the snapshot.
+func (s *snapshotUsageCache) remove(key string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.usages, key)
+}
+
+// getWritableLayerUsage returns the filesystem usage of the active snapshot of
+// a container. The usage may be cached for a short while.
+func (c *criContainerdService) getWritableLayerUsage(ctx context.Context, key string) (*runtime.FilesystemUsage, error) {
+	u, ok := c.snapshotUsageCache.get(key)
+	if !ok {
+		usage, err := c.snapshotService.Usage(ctx, key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get usage of snapshot %q: %v", key, err)
+		}
+		u = c.snapshotUsageCache.set(key, usage)
+	}
+	// Container writable layers are stored on the image filesystem.
+	mountPoint, err := c.os.MountPoint(c.imageFSPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get mount point of image filesystem %q: %v", c.imageFSPath, err)
+	}
+	return &runtime.FilesystemUsage{
+		Timestamp:  u.timestamp.UnixNano(),
+		StorageId:  &runtime.StorageIdentifier{Uuid: mountPoint},
+		UsedBytes:  &runtime.UInt64Value{Value: uint64(u.usage.Size)},
+		InodesUsed: &runtime.UInt64Value{Value: uint64(u.usage.Inodes)},
+	}, nil
+}
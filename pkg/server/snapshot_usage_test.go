@@ -0,0 +1,72 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/snapshot"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"k8s.io/apimachinery/pkg/util/clock"
+
+	servertesting "github.com/kubernetes-incubator/cri-containerd/pkg/server/testing"
+)
+
+func TestGetWritableLayerUsage(t *testing.T) {
+	testKey := "test-key"
+	c := newTestCRIContainerdService()
+	fakeClock := clock.NewFakeClock(time.Now())
+	c.snapshotUsageCache = newSnapshotUsageCache(fakeClock, snapshotUsageCacheTTL)
+	fakeSnapshotter := c.snapshotService.(*servertesting.FakeSnapshotter)
+	fakeSnapshotter.SetFakeSnapshots([]snapshot.Info{{Name: testKey, Kind: snapshot.KindActive}})
+	fakeSnapshotter.SetFakeUsage(testKey, snapshot.Usage{Size: 100, Inodes: 10})
+
+	usage, err := c.getWritableLayerUsage(context.Background(), testKey)
+	require.NoError(t, err)
+	assert.EqualValues(t, 100, usage.GetUsedBytes().GetValue())
+	assert.EqualValues(t, 10, usage.GetInodesUsed().GetValue())
+	assert.Equal(t, fakeClock.Now().UnixNano(), usage.GetTimestamp())
+
+	t.Logf("should return cached usage before ttl expires")
+	fakeSnapshotter.SetFakeUsage(testKey, snapshot.Usage{Size: 200, Inodes: 20})
+	fakeClock.Step(snapshotUsageCacheTTL / 2)
+	usage, err = c.getWritableLayerUsage(context.Background(), testKey)
+	require.NoError(t, err)
+	assert.EqualValues(t, 100, usage.GetUsedBytes().GetValue())
+	assert.Equal(t, []string{"usage"}, fakeSnapshotter.GetCalledNames())
+
+	t.Logf("should refresh usage after ttl expires")
+	fakeClock.Step(snapshotUsageCacheTTL)
+	usage, err = c.getWritableLayerUsage(context.Background(), testKey)
+	require.NoError(t, err)
+	assert.EqualValues(t, 200, usage.GetUsedBytes().GetValue())
+	assert.EqualValues(t, 20, usage.GetInodesUsed().GetValue())
+
+	t.Logf("should refresh usage after cache is removed")
+	fakeSnapshotter.SetFakeUsage(testKey, snapshot.Usage{Size: 300, Inodes: 30})
+	c.snapshotUsageCache.remove(testKey)
+	usage, err = c.getWritableLayerUsage(context.Background(), testKey)
+	require.NoError(t, err)
+	assert.EqualValues(t, 300, usage.GetUsedBytes().GetValue())
+
+	t.Logf("should return error if snapshot doesn't exist")
+	_, err = c.getWritableLayerUsage(context.Background(), "non-exist")
+	assert.Error(t, err)
+}
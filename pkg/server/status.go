@@ -19,6 +19,7 @@ package server
 import (
 	"fmt"
 
+	"github.com/golang/protobuf/ptypes/empty"
 	"golang.org/x/net/context"
 	healthapi "google.golang.org/grpc/health/grpc_health_v1"
 
@@ -38,9 +39,14 @@ func (c *criContainerdService) Status(ctx context.Context, r *runtime.StatusRequ
 		Type:   runtime.RuntimeReady,
 		Status: true,
 	}
-	// Use containerd grpc server healthcheck service to check its readiness.
-	resp, err := c.healthService.Check(ctx, &healthapi.HealthCheckRequest{})
-	if err != nil || resp.Status != healthapi.HealthCheckResponse_SERVING {
+	// Use containerd version service to check its connectivity, and grpc server
+	// healthcheck service to check its readiness.
+	if _, err := c.versionService.Version(ctx, &empty.Empty{}); err != nil {
+		runtimeCondition.Status = false
+		runtimeCondition.Reason = runtimeNotReadyReason
+		runtimeCondition.Message = fmt.Sprintf("Failed to connect to containerd: %v", err)
+	} else if resp, err := c.healthService.Check(ctx, &healthapi.HealthCheckRequest{}); err != nil ||
+		resp.Status != healthapi.HealthCheckResponse_SERVING {
 		runtimeCondition.Status = false
 		runtimeCondition.Reason = runtimeNotReadyReason
 		if err != nil {
@@ -54,6 +60,8 @@ func (c *criContainerdService) Status(ctx context.Context, r *runtime.StatusRequ
 		Type:   runtime.NetworkReady,
 		Status: true,
 	}
+	// The network plugin is ready once its config is loaded and the default
+	// network is found.
 	if err := c.netPlugin.Status(); err != nil {
 		networkCondition.Status = false
 		networkCondition.Reason = networkNotReadyReason
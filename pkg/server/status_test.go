@@ -20,7 +20,9 @@ import (
 	"errors"
 	"testing"
 
+	versionapi "github.com/containerd/containerd/api/services/version/v1"
 	"github.com/golang/mock/gomock"
+	"github.com/golang/protobuf/ptypes/empty"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/net/context"
@@ -34,13 +36,18 @@ func TestStatus(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 	for desc, test := range map[string]struct {
-		containerdCheckRes *healthapi.HealthCheckResponse
-		containerdCheckErr error
-		networkStatusErr   error
+		containerdVersionErr error
+		containerdCheckRes   *healthapi.HealthCheckResponse
+		containerdCheckErr   error
+		networkStatusErr     error
 
 		expectRuntimeNotReady bool
 		expectNetworkNotReady bool
 	}{
+		"runtime should not be ready when containerd is not connected": {
+			containerdVersionErr:  errors.New("connection error"),
+			expectRuntimeNotReady: true,
+		},
 		"runtime should not be ready when containerd is not serving": {
 			containerdCheckRes: &healthapi.HealthCheckResponse{
 				Status: healthapi.HealthCheckResponse_NOT_SERVING,
@@ -67,9 +74,15 @@ func TestStatus(t *testing.T) {
 		t.Logf("TestCase %q", desc)
 		c := newTestCRIContainerdService()
 		ctx := context.Background()
+		versionMock := servertesting.NewMockVersionClient(ctrl)
+		versionMock.EXPECT().Version(ctx, &empty.Empty{}).Return(
+			&versionapi.VersionResponse{Version: "1.1.1"}, test.containerdVersionErr)
+		c.versionService = versionMock
 		mock := servertesting.NewMockHealthClient(ctrl)
-		mock.EXPECT().Check(ctx, &healthapi.HealthCheckRequest{}).Return(
-			test.containerdCheckRes, test.containerdCheckErr)
+		if test.containerdVersionErr == nil {
+			mock.EXPECT().Check(ctx, &healthapi.HealthCheckRequest{}).Return(
+				test.containerdCheckRes, test.containerdCheckErr)
+		}
 		c.healthService = mock
 		if test.networkStatusErr != nil {
 			c.netPlugin.(*servertesting.FakeCNIPlugin).InjectError(
@@ -20,7 +20,9 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net"
+	"net/http"
 
 	"golang.org/x/net/context"
 	k8snet "k8s.io/apimachinery/pkg/util/net"
@@ -42,7 +44,37 @@ func newStreamServer(c *criContainerdService, addr, port string) (streaming.Serv
 	config := streaming.DefaultConfig
 	config.Addr = net.JoinHostPort(addr, port)
 	runtime := newStreamRuntime(c)
-	return streaming.NewServer(config, runtime)
+	s, err := streaming.NewServer(config, runtime)
+	if err != nil {
+		return nil, err
+	}
+	return &stoppableStreamServer{
+		Server: s,
+		server: &http.Server{Addr: config.Addr, Handler: s},
+	}, nil
+}
+
+// stoppableStreamServer is a streaming server which could be stopped on
+// shutdown. The upstream streaming server doesn't implement Stop yet.
+type stoppableStreamServer struct {
+	streaming.Server
+	server *http.Server
+}
+
+// Start starts serving streaming requests until Stop is called.
+func (s *stoppableStreamServer) Start(stayUp bool) error {
+	if !stayUp {
+		return errors.New("stayUp=false is not yet implemented")
+	}
+	if err := s.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// Stop stops the streaming server and closes all active connections.
+func (s *stoppableStreamServer) Stop() error {
+	return s.server.Close()
 }
 
 type streamRuntime struct {
@@ -77,13 +109,18 @@ func (s *streamRuntime) Exec(containerID string, cmd []string, stdin io.Reader,
 	}
 }
 
+// Attach attaches to the stdio of the container main process.
 func (s *streamRuntime) Attach(containerID string, in io.Reader, out, err io.WriteCloser, tty bool,
 	resize <-chan remotecommand.TerminalSize) error {
-	return errors.New("not implemented")
+	return s.c.attachContainer(context.Background(), containerID, in, out, err, tty, resize)
 }
 
+// PortForward forwards the stream to the port inside the sandbox.
 func (s *streamRuntime) PortForward(podSandboxID string, port int32, stream io.ReadWriteCloser) error {
-	return errors.New("not implemented")
+	if port <= 0 || port > math.MaxUint16 {
+		return fmt.Errorf("invalid port %d", port)
+	}
+	return s.c.portForward(podSandboxID, port, stream)
 }
 
 // handleResizing spawns a goroutine that processes the resize channel, calling resizeFunc for each
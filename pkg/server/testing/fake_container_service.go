@@ -0,0 +1,167 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package testing
+
+import (
+	"context"
+	"sync"
+
+	"github.com/containerd/containerd/containers"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// FakeContainerService is a fake containerd container service used for test.
+// Containers are kept in memory.
+type FakeContainerService struct {
+	sync.Mutex
+	called     []CalledDetail
+	errors     map[string]error
+	containers map[string]containers.Container
+}
+
+var _ containers.Store = &FakeContainerService{}
+
+// NewFakeContainerService creates a FakeContainerService.
+func NewFakeContainerService() *FakeContainerService {
+	return &FakeContainerService{
+		errors:     make(map[string]error),
+		containers: make(map[string]containers.Container),
+	}
+}
+
+// getError get error for call
+func (f *FakeContainerService) getError(op string) error {
+	err, ok := f.errors[op]
+	if ok {
+		delete(f.errors, op)
+		return err
+	}
+	return nil
+}
+
+// InjectError inject error for call
+func (f *FakeContainerService) InjectError(fn string, err error) {
+	f.Lock()
+	defer f.Unlock()
+	f.errors[fn] = err
+}
+
+func (f *FakeContainerService) appendCalled(name string, argument interface{}) {
+	call := CalledDetail{Name: name, Argument: argument}
+	f.called = append(f.called, call)
+}
+
+// GetCalledNames get names of call
+func (f *FakeContainerService) GetCalledNames() []string {
+	f.Lock()
+	defer f.Unlock()
+	names := []string{}
+	for _, detail := range f.called {
+		names = append(names, detail.Name)
+	}
+	return names
+}
+
+// SetFakeContainers injects fake containers.
+func (f *FakeContainerService) SetFakeContainers(cs []containers.Container) {
+	f.Lock()
+	defer f.Unlock()
+	for _, c := range cs {
+		f.containers[c.ID] = c
+	}
+}
+
+func (f *FakeContainerService) notFound(id string) error {
+	return grpc.Errorf(codes.NotFound, "container %q not found", id)
+}
+
+// Get is a test implementation of containers.Get.
+func (f *FakeContainerService) Get(ctx context.Context, id string) (containers.Container, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.appendCalled("get", id)
+	if err := f.getError("get"); err != nil {
+		return containers.Container{}, err
+	}
+	c, ok := f.containers[id]
+	if !ok {
+		return containers.Container{}, f.notFound(id)
+	}
+	return c, nil
+}
+
+// List is a test implementation of containers.List. Filters are ignored.
+func (f *FakeContainerService) List(ctx context.Context, filters ...string) ([]containers.Container, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.appendCalled("list", filters)
+	if err := f.getError("list"); err != nil {
+		return nil, err
+	}
+	var cs []containers.Container
+	for _, c := range f.containers {
+		cs = append(cs, c)
+	}
+	return cs, nil
+}
+
+// Create is a test implementation of containers.Create.
+func (f *FakeContainerService) Create(ctx context.Context, container containers.Container) (containers.Container, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.appendCalled("create", container)
+	if err := f.getError("create"); err != nil {
+		return containers.Container{}, err
+	}
+	if _, ok := f.containers[container.ID]; ok {
+		return containers.Container{}, grpc.Errorf(codes.AlreadyExists, "container %q already exists", container.ID)
+	}
+	f.containers[container.ID] = container
+	return container, nil
+}
+
+// Update is a test implementation of containers.Update. Field paths are ignored,
+// the whole container is replaced.
+func (f *FakeContainerService) Update(ctx context.Context, container containers.Container, fieldpaths ...string) (containers.Container, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.appendCalled("update", container)
+	if err := f.getError("update"); err != nil {
+		return containers.Container{}, err
+	}
+	if _, ok := f.containers[container.ID]; !ok {
+		return containers.Container{}, f.notFound(container.ID)
+	}
+	f.containers[container.ID] = container
+	return container, nil
+}
+
+// Delete is a test implementation of containers.Delete.
+func (f *FakeContainerService) Delete(ctx context.Context, id string) error {
+	f.Lock()
+	defer f.Unlock()
+	f.appendCalled("delete", id)
+	if err := f.getError("delete"); err != nil {
+		return err
+	}
+	if _, ok := f.containers[id]; !ok {
+		return f.notFound(id)
+	}
+	delete(f.containers, id)
+	return nil
+}
@@ -0,0 +1,216 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package testing
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// FakeContentStore is a fake containerd content store used for test. Only
+// ingest management and blob reading are implemented, active ingests and
+// blobs are kept in memory.
+type FakeContentStore struct {
+	sync.Mutex
+	called   []CalledDetail
+	errors   map[string]error
+	statuses map[string]content.Status
+	blobs    map[digest.Digest][]byte
+}
+
+var _ content.Store = &FakeContentStore{}
+
+// NewFakeContentStore creates a FakeContentStore.
+func NewFakeContentStore() *FakeContentStore {
+	return &FakeContentStore{
+		errors:   make(map[string]error),
+		statuses: make(map[string]content.Status),
+		blobs:    make(map[digest.Digest][]byte),
+	}
+}
+
+// getError get error for call
+func (f *FakeContentStore) getError(op string) error {
+	err, ok := f.errors[op]
+	if ok {
+		delete(f.errors, op)
+		return err
+	}
+	return nil
+}
+
+// InjectError inject error for call
+func (f *FakeContentStore) InjectError(fn string, err error) {
+	f.Lock()
+	defer f.Unlock()
+	f.errors[fn] = err
+}
+
+func (f *FakeContentStore) appendCalled(name string, argument interface{}) {
+	call := CalledDetail{Name: name, Argument: argument}
+	f.called = append(f.called, call)
+}
+
+// GetCalledDetails get detail of each call.
+func (f *FakeContentStore) GetCalledDetails() []CalledDetail {
+	f.Lock()
+	defer f.Unlock()
+	// Copy the list and return.
+	return append([]CalledDetail{}, f.called...)
+}
+
+// SetFakeStatuses injects fake active ingests.
+func (f *FakeContentStore) SetFakeStatuses(statuses []content.Status) {
+	f.Lock()
+	defer f.Unlock()
+	for _, status := range statuses {
+		f.statuses[status.Ref] = status
+	}
+}
+
+// SetFakeBlobs injects fake blobs.
+func (f *FakeContentStore) SetFakeBlobs(blobs map[digest.Digest][]byte) {
+	f.Lock()
+	defer f.Unlock()
+	for dgst, blob := range blobs {
+		f.blobs[dgst] = blob
+	}
+}
+
+// RemoveFakeStatus removes an active ingest, as if it is finished.
+func (f *FakeContentStore) RemoveFakeStatus(ref string) {
+	f.Lock()
+	defer f.Unlock()
+	delete(f.statuses, ref)
+}
+
+func (f *FakeContentStore) notFound(ref string) error {
+	return errors.Wrapf(errdefs.ErrNotFound, "ingest %q", ref)
+}
+
+func (f *FakeContentStore) unimplemented(op string) error {
+	return errors.Errorf("%s is not implemented", op)
+}
+
+// Status is a test implementation of content.Store.Status.
+func (f *FakeContentStore) Status(ctx context.Context, ref string) (content.Status, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.appendCalled("status", ref)
+	if err := f.getError("status"); err != nil {
+		return content.Status{}, err
+	}
+	status, ok := f.statuses[ref]
+	if !ok {
+		return content.Status{}, f.notFound(ref)
+	}
+	return status, nil
+}
+
+// ListStatuses is a test implementation of content.Store.ListStatuses. Filters
+// are ignored.
+func (f *FakeContentStore) ListStatuses(ctx context.Context, filters ...string) ([]content.Status, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.appendCalled("liststatuses", filters)
+	if err := f.getError("liststatuses"); err != nil {
+		return nil, err
+	}
+	var statuses []content.Status
+	for _, status := range f.statuses {
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// Abort is a test implementation of content.Store.Abort.
+func (f *FakeContentStore) Abort(ctx context.Context, ref string) error {
+	f.Lock()
+	defer f.Unlock()
+	f.appendCalled("abort", ref)
+	if err := f.getError("abort"); err != nil {
+		return err
+	}
+	if _, ok := f.statuses[ref]; !ok {
+		return f.notFound(ref)
+	}
+	delete(f.statuses, ref)
+	return nil
+}
+
+// Info is a test implementation of content.Store.Info.
+func (f *FakeContentStore) Info(ctx context.Context, dgst digest.Digest) (content.Info, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.appendCalled("info", dgst)
+	if err := f.getError("info"); err != nil {
+		return content.Info{}, err
+	}
+	blob, ok := f.blobs[dgst]
+	if !ok {
+		return content.Info{}, errors.Wrapf(errdefs.ErrNotFound, "content %v", dgst)
+	}
+	return content.Info{Digest: dgst, Size: int64(len(blob))}, nil
+}
+
+// Update is not implemented in FakeContentStore.
+func (f *FakeContentStore) Update(ctx context.Context, info content.Info, fieldpaths ...string) (content.Info, error) {
+	return content.Info{}, f.unimplemented("update")
+}
+
+// Walk is not implemented in FakeContentStore.
+func (f *FakeContentStore) Walk(ctx context.Context, fn content.WalkFunc, filters ...string) error {
+	return f.unimplemented("walk")
+}
+
+// Delete is not implemented in FakeContentStore.
+func (f *FakeContentStore) Delete(ctx context.Context, dgst digest.Digest) error {
+	return f.unimplemented("delete")
+}
+
+// Reader is a test implementation of content.Store.Reader.
+func (f *FakeContentStore) Reader(ctx context.Context, dgst digest.Digest) (io.ReadCloser, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.appendCalled("reader", dgst)
+	if err := f.getError("reader"); err != nil {
+		return nil, err
+	}
+	blob, ok := f.blobs[dgst]
+	if !ok {
+		return nil, errors.Wrapf(errdefs.ErrNotFound, "content %v", dgst)
+	}
+	return ioutil.NopCloser(bytes.NewReader(blob)), nil
+}
+
+// ReaderAt is not implemented in FakeContentStore.
+func (f *FakeContentStore) ReaderAt(ctx context.Context, dgst digest.Digest) (io.ReaderAt, error) {
+	return nil, f.unimplemented("readerat")
+}
+
+// Writer is not implemented in FakeContentStore.
+func (f *FakeContentStore) Writer(ctx context.Context, ref string, size int64, expected digest.Digest) (content.Writer, error) {
+	return nil, f.unimplemented("writer")
+}
@@ -0,0 +1,94 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package testing
+
+import (
+	"sync"
+
+	"github.com/containerd/containerd/api/services/events/v1"
+	"github.com/golang/protobuf/ptypes/empty"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+// FakeEventsClient is a fake containerd events client used for test.
+// Subscribed streams never receive events, and return error once the
+// subscription context is done.
+type FakeEventsClient struct {
+	sync.Mutex
+	errors map[string]error
+}
+
+var _ events.EventsClient = &FakeEventsClient{}
+
+// NewFakeEventsClient creates a FakeEventsClient.
+func NewFakeEventsClient() *FakeEventsClient {
+	return &FakeEventsClient{errors: make(map[string]error)}
+}
+
+// getError get error for call
+func (f *FakeEventsClient) getError(op string) error {
+	f.Lock()
+	defer f.Unlock()
+	err, ok := f.errors[op]
+	if ok {
+		delete(f.errors, op)
+		return err
+	}
+	return nil
+}
+
+// InjectError inject error for call
+func (f *FakeEventsClient) InjectError(fn string, err error) {
+	f.Lock()
+	defer f.Unlock()
+	f.errors[fn] = err
+}
+
+// Publish is a test implementation of events.Publish.
+func (f *FakeEventsClient) Publish(ctx context.Context, req *events.PublishRequest, opts ...grpc.CallOption) (*empty.Empty, error) {
+	if err := f.getError("publish"); err != nil {
+		return nil, err
+	}
+	return &empty.Empty{}, nil
+}
+
+// Subscribe is a test implementation of events.Subscribe.
+func (f *FakeEventsClient) Subscribe(ctx context.Context, req *events.SubscribeRequest, opts ...grpc.CallOption) (events.Events_SubscribeClient, error) {
+	if err := f.getError("subscribe"); err != nil {
+		return nil, err
+	}
+	return &fakeEventStream{ctx: ctx}, nil
+}
+
+// fakeEventStream is a fake event stream which blocks until its context
+// is done.
+type fakeEventStream struct {
+	grpc.ClientStream
+	ctx context.Context
+}
+
+// Recv blocks until the stream context is done.
+func (s *fakeEventStream) Recv() (*events.Envelope, error) {
+	<-s.ctx.Done()
+	return nil, s.ctx.Err()
+}
+
+// Context returns the stream context.
+func (s *fakeEventStream) Context() context.Context {
+	return s.ctx
+}
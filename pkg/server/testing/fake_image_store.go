@@ -0,0 +1,163 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package testing
+
+import (
+	"context"
+	"sync"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/pkg/errors"
+)
+
+// FakeImageStore is a fake containerd image store used for test. Images are
+// kept in memory.
+type FakeImageStore struct {
+	sync.Mutex
+	called []CalledDetail
+	errors map[string]error
+	images map[string]images.Image
+}
+
+var _ images.Store = &FakeImageStore{}
+
+// NewFakeImageStore creates a FakeImageStore.
+func NewFakeImageStore() *FakeImageStore {
+	return &FakeImageStore{
+		errors: make(map[string]error),
+		images: make(map[string]images.Image),
+	}
+}
+
+// getError get error for call
+func (f *FakeImageStore) getError(op string) error {
+	err, ok := f.errors[op]
+	if ok {
+		delete(f.errors, op)
+		return err
+	}
+	return nil
+}
+
+// InjectError inject error for call
+func (f *FakeImageStore) InjectError(fn string, err error) {
+	f.Lock()
+	defer f.Unlock()
+	f.errors[fn] = err
+}
+
+func (f *FakeImageStore) appendCalled(name string, argument interface{}) {
+	call := CalledDetail{Name: name, Argument: argument}
+	f.called = append(f.called, call)
+}
+
+// GetCalledNames get names of call
+func (f *FakeImageStore) GetCalledNames() []string {
+	f.Lock()
+	defer f.Unlock()
+	names := []string{}
+	for _, detail := range f.called {
+		names = append(names, detail.Name)
+	}
+	return names
+}
+
+// SetFakeImages injects fake images.
+func (f *FakeImageStore) SetFakeImages(imgs []images.Image) {
+	f.Lock()
+	defer f.Unlock()
+	for _, img := range imgs {
+		f.images[img.Name] = img
+	}
+}
+
+// Get is a test implementation of images.Store.Get.
+func (f *FakeImageStore) Get(ctx context.Context, name string) (images.Image, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.appendCalled("get", name)
+	if err := f.getError("get"); err != nil {
+		return images.Image{}, err
+	}
+	img, ok := f.images[name]
+	if !ok {
+		return images.Image{}, errors.Wrapf(errdefs.ErrNotFound, "image %q", name)
+	}
+	return img, nil
+}
+
+// List is a test implementation of images.Store.List. Filters are ignored.
+func (f *FakeImageStore) List(ctx context.Context, filters ...string) ([]images.Image, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.appendCalled("list", filters)
+	if err := f.getError("list"); err != nil {
+		return nil, err
+	}
+	var imgs []images.Image
+	for _, img := range f.images {
+		imgs = append(imgs, img)
+	}
+	return imgs, nil
+}
+
+// Create is a test implementation of images.Store.Create.
+func (f *FakeImageStore) Create(ctx context.Context, image images.Image) (images.Image, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.appendCalled("create", image)
+	if err := f.getError("create"); err != nil {
+		return images.Image{}, err
+	}
+	if _, ok := f.images[image.Name]; ok {
+		return images.Image{}, errors.Wrapf(errdefs.ErrAlreadyExists, "image %q", image.Name)
+	}
+	f.images[image.Name] = image
+	return image, nil
+}
+
+// Update is a test implementation of images.Store.Update. Fieldpaths are
+// ignored, the whole image is replaced.
+func (f *FakeImageStore) Update(ctx context.Context, image images.Image, fieldpaths ...string) (images.Image, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.appendCalled("update", image)
+	if err := f.getError("update"); err != nil {
+		return images.Image{}, err
+	}
+	if _, ok := f.images[image.Name]; !ok {
+		return images.Image{}, errors.Wrapf(errdefs.ErrNotFound, "image %q", image.Name)
+	}
+	f.images[image.Name] = image
+	return image, nil
+}
+
+// Delete is a test implementation of images.Store.Delete.
+func (f *FakeImageStore) Delete(ctx context.Context, name string) error {
+	f.Lock()
+	defer f.Unlock()
+	f.appendCalled("delete", name)
+	if err := f.getError("delete"); err != nil {
+		return err
+	}
+	if _, ok := f.images[name]; !ok {
+		return errors.Wrapf(errdefs.ErrNotFound, "image %q", name)
+	}
+	delete(f.images, name)
+	return nil
+}
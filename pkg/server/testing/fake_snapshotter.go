@@ -0,0 +1,223 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package testing
+
+import (
+	"context"
+	"sync"
+
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/snapshot"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// FakeSnapshotter is a fake containerd snapshotter used for test. Snapshots
+// are kept in memory.
+type FakeSnapshotter struct {
+	sync.Mutex
+	called    []CalledDetail
+	errors    map[string]error
+	snapshots map[string]snapshot.Info
+	usages    map[string]snapshot.Usage
+}
+
+var _ snapshot.Snapshotter = &FakeSnapshotter{}
+
+// NewFakeSnapshotter creates a FakeSnapshotter.
+func NewFakeSnapshotter() *FakeSnapshotter {
+	return &FakeSnapshotter{
+		errors:    make(map[string]error),
+		snapshots: make(map[string]snapshot.Info),
+		usages:    make(map[string]snapshot.Usage),
+	}
+}
+
+// getError get error for call
+func (f *FakeSnapshotter) getError(op string) error {
+	err, ok := f.errors[op]
+	if ok {
+		delete(f.errors, op)
+		return err
+	}
+	return nil
+}
+
+// InjectError inject error for call
+func (f *FakeSnapshotter) InjectError(fn string, err error) {
+	f.Lock()
+	defer f.Unlock()
+	f.errors[fn] = err
+}
+
+func (f *FakeSnapshotter) appendCalled(name string, argument interface{}) {
+	call := CalledDetail{Name: name, Argument: argument}
+	f.called = append(f.called, call)
+}
+
+// GetCalledNames get names of call
+func (f *FakeSnapshotter) GetCalledNames() []string {
+	f.Lock()
+	defer f.Unlock()
+	names := []string{}
+	for _, detail := range f.called {
+		names = append(names, detail.Name)
+	}
+	return names
+}
+
+// SetFakeSnapshots injects fake snapshots.
+func (f *FakeSnapshotter) SetFakeSnapshots(infos []snapshot.Info) {
+	f.Lock()
+	defer f.Unlock()
+	for _, info := range infos {
+		f.snapshots[info.Name] = info
+	}
+}
+
+// SetFakeUsage injects fake usage of a snapshot.
+func (f *FakeSnapshotter) SetFakeUsage(key string, usage snapshot.Usage) {
+	f.Lock()
+	defer f.Unlock()
+	f.usages[key] = usage
+}
+
+func (f *FakeSnapshotter) notFound(key string) error {
+	return grpc.Errorf(codes.NotFound, "snapshot %q not found", key)
+}
+
+// Stat is a test implementation of snapshotter.Stat.
+func (f *FakeSnapshotter) Stat(ctx context.Context, key string) (snapshot.Info, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.appendCalled("stat", key)
+	if err := f.getError("stat"); err != nil {
+		return snapshot.Info{}, err
+	}
+	info, ok := f.snapshots[key]
+	if !ok {
+		return snapshot.Info{}, f.notFound(key)
+	}
+	return info, nil
+}
+
+// Usage is a test implementation of snapshotter.Usage.
+func (f *FakeSnapshotter) Usage(ctx context.Context, key string) (snapshot.Usage, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.appendCalled("usage", key)
+	if err := f.getError("usage"); err != nil {
+		return snapshot.Usage{}, err
+	}
+	if _, ok := f.snapshots[key]; !ok {
+		return snapshot.Usage{}, f.notFound(key)
+	}
+	return f.usages[key], nil
+}
+
+// Mounts is a test implementation of snapshotter.Mounts.
+func (f *FakeSnapshotter) Mounts(ctx context.Context, key string) ([]mount.Mount, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.appendCalled("mounts", key)
+	if err := f.getError("mounts"); err != nil {
+		return nil, err
+	}
+	if _, ok := f.snapshots[key]; !ok {
+		return nil, f.notFound(key)
+	}
+	return nil, nil
+}
+
+// Prepare is a test implementation of snapshotter.Prepare.
+func (f *FakeSnapshotter) Prepare(ctx context.Context, key, parent string) ([]mount.Mount, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.appendCalled("prepare", key)
+	if err := f.getError("prepare"); err != nil {
+		return nil, err
+	}
+	return nil, f.create(key, parent, snapshot.KindActive)
+}
+
+// View is a test implementation of snapshotter.View.
+func (f *FakeSnapshotter) View(ctx context.Context, key, parent string) ([]mount.Mount, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.appendCalled("view", key)
+	if err := f.getError("view"); err != nil {
+		return nil, err
+	}
+	return nil, f.create(key, parent, snapshot.KindView)
+}
+
+func (f *FakeSnapshotter) create(key, parent string, kind snapshot.Kind) error {
+	if _, ok := f.snapshots[key]; ok {
+		return grpc.Errorf(codes.AlreadyExists, "snapshot %q already exists", key)
+	}
+	f.snapshots[key] = snapshot.Info{Kind: kind, Name: key, Parent: parent}
+	return nil
+}
+
+// Commit is a test implementation of snapshotter.Commit.
+func (f *FakeSnapshotter) Commit(ctx context.Context, name, key string) error {
+	f.Lock()
+	defer f.Unlock()
+	f.appendCalled("commit", name)
+	if err := f.getError("commit"); err != nil {
+		return err
+	}
+	info, ok := f.snapshots[key]
+	if !ok {
+		return f.notFound(key)
+	}
+	delete(f.snapshots, key)
+	f.snapshots[name] = snapshot.Info{Kind: snapshot.KindCommitted, Name: name, Parent: info.Parent}
+	return nil
+}
+
+// Remove is a test implementation of snapshotter.Remove.
+func (f *FakeSnapshotter) Remove(ctx context.Context, key string) error {
+	f.Lock()
+	defer f.Unlock()
+	f.appendCalled("remove", key)
+	if err := f.getError("remove"); err != nil {
+		return err
+	}
+	if _, ok := f.snapshots[key]; !ok {
+		return f.notFound(key)
+	}
+	delete(f.snapshots, key)
+	delete(f.usages, key)
+	return nil
+}
+
+// Walk is a test implementation of snapshotter.Walk.
+func (f *FakeSnapshotter) Walk(ctx context.Context, fn func(context.Context, snapshot.Info) error) error {
+	f.Lock()
+	defer f.Unlock()
+	f.appendCalled("walk", nil)
+	if err := f.getError("walk"); err != nil {
+		return err
+	}
+	for _, info := range f.snapshots {
+		if err := fn(ctx, info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,328 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package testing
+
+import (
+	"sync"
+
+	"github.com/containerd/containerd/api/services/tasks/v1"
+	"github.com/containerd/containerd/api/types/task"
+	"github.com/golang/protobuf/ptypes/empty"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// FakeTaskService is a fake containerd task service used for test. Tasks
+// are kept in memory, and only the basic task lifecycle is simulated.
+type FakeTaskService struct {
+	sync.Mutex
+	called []CalledDetail
+	errors map[string]error
+	tasks  map[string]*task.Task
+	pid    uint32
+}
+
+var _ tasks.TasksClient = &FakeTaskService{}
+
+// NewFakeTaskService creates a FakeTaskService.
+func NewFakeTaskService() *FakeTaskService {
+	return &FakeTaskService{
+		errors: make(map[string]error),
+		tasks:  make(map[string]*task.Task),
+	}
+}
+
+// getError get error for call
+func (f *FakeTaskService) getError(op string) error {
+	err, ok := f.errors[op]
+	if ok {
+		delete(f.errors, op)
+		return err
+	}
+	return nil
+}
+
+// InjectError inject error for call
+func (f *FakeTaskService) InjectError(fn string, err error) {
+	f.Lock()
+	defer f.Unlock()
+	f.errors[fn] = err
+}
+
+// ClearErrors clear errors for call
+func (f *FakeTaskService) ClearErrors() {
+	f.Lock()
+	defer f.Unlock()
+	f.errors = make(map[string]error)
+}
+
+func (f *FakeTaskService) appendCalled(name string, argument interface{}) {
+	call := CalledDetail{Name: name, Argument: argument}
+	f.called = append(f.called, call)
+}
+
+// GetCalledNames get names of call
+func (f *FakeTaskService) GetCalledNames() []string {
+	f.Lock()
+	defer f.Unlock()
+	names := []string{}
+	for _, detail := range f.called {
+		names = append(names, detail.Name)
+	}
+	return names
+}
+
+// GetCalledDetails get detail of each call.
+func (f *FakeTaskService) GetCalledDetails() []CalledDetail {
+	f.Lock()
+	defer f.Unlock()
+	// Copy the list and return.
+	return append([]CalledDetail{}, f.called...)
+}
+
+// SetFakeTasks injects fake tasks.
+func (f *FakeTaskService) SetFakeTasks(tasks []task.Task) {
+	f.Lock()
+	defer f.Unlock()
+	for i := range tasks {
+		t := tasks[i]
+		f.tasks[t.ID] = &t
+	}
+}
+
+func (f *FakeTaskService) notFound(id string) error {
+	return grpc.Errorf(codes.NotFound, "task %q not found", id)
+}
+
+// Create is a test implementation of tasks.Create.
+func (f *FakeTaskService) Create(ctx context.Context, req *tasks.CreateTaskRequest, opts ...grpc.CallOption) (*tasks.CreateTaskResponse, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.appendCalled("create", req)
+	if err := f.getError("create"); err != nil {
+		return nil, err
+	}
+	if _, ok := f.tasks[req.ContainerID]; ok {
+		return nil, grpc.Errorf(codes.AlreadyExists, "task %q already exists", req.ContainerID)
+	}
+	f.pid++
+	f.tasks[req.ContainerID] = &task.Task{
+		ID:       req.ContainerID,
+		Pid:      f.pid,
+		Status:   task.StatusCreated,
+		Stdin:    req.Stdin,
+		Stdout:   req.Stdout,
+		Stderr:   req.Stderr,
+		Terminal: req.Terminal,
+	}
+	return &tasks.CreateTaskResponse{ContainerID: req.ContainerID, Pid: f.pid}, nil
+}
+
+// Start is a test implementation of tasks.Start.
+func (f *FakeTaskService) Start(ctx context.Context, req *tasks.StartTaskRequest, opts ...grpc.CallOption) (*empty.Empty, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.appendCalled("start", req)
+	if err := f.getError("start"); err != nil {
+		return nil, err
+	}
+	t, ok := f.tasks[req.ContainerID]
+	if !ok {
+		return nil, f.notFound(req.ContainerID)
+	}
+	t.Status = task.StatusRunning
+	return &empty.Empty{}, nil
+}
+
+// Delete is a test implementation of tasks.Delete.
+func (f *FakeTaskService) Delete(ctx context.Context, req *tasks.DeleteTaskRequest, opts ...grpc.CallOption) (*tasks.DeleteResponse, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.appendCalled("delete", req)
+	if err := f.getError("delete"); err != nil {
+		return nil, err
+	}
+	t, ok := f.tasks[req.ContainerID]
+	if !ok {
+		return nil, f.notFound(req.ContainerID)
+	}
+	delete(f.tasks, req.ContainerID)
+	return &tasks.DeleteResponse{ID: t.ID, Pid: t.Pid}, nil
+}
+
+// DeleteProcess is a test implementation of tasks.DeleteProcess.
+func (f *FakeTaskService) DeleteProcess(ctx context.Context, req *tasks.DeleteProcessRequest, opts ...grpc.CallOption) (*tasks.DeleteResponse, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.appendCalled("deleteprocess", req)
+	if err := f.getError("deleteprocess"); err != nil {
+		return nil, err
+	}
+	return &tasks.DeleteResponse{}, nil
+}
+
+// Get is a test implementation of tasks.Get.
+func (f *FakeTaskService) Get(ctx context.Context, req *tasks.GetTaskRequest, opts ...grpc.CallOption) (*tasks.GetTaskResponse, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.appendCalled("get", req)
+	if err := f.getError("get"); err != nil {
+		return nil, err
+	}
+	t, ok := f.tasks[req.ContainerID]
+	if !ok {
+		return nil, f.notFound(req.ContainerID)
+	}
+	copied := *t
+	return &tasks.GetTaskResponse{Task: &copied}, nil
+}
+
+// List is a test implementation of tasks.List.
+func (f *FakeTaskService) List(ctx context.Context, req *tasks.ListTasksRequest, opts ...grpc.CallOption) (*tasks.ListTasksResponse, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.appendCalled("list", req)
+	if err := f.getError("list"); err != nil {
+		return nil, err
+	}
+	resp := &tasks.ListTasksResponse{}
+	for _, t := range f.tasks {
+		copied := *t
+		resp.Tasks = append(resp.Tasks, &copied)
+	}
+	return resp, nil
+}
+
+// Kill is a test implementation of tasks.Kill. The task is stopped on any
+// signal.
+func (f *FakeTaskService) Kill(ctx context.Context, req *tasks.KillRequest, opts ...grpc.CallOption) (*empty.Empty, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.appendCalled("kill", req)
+	if err := f.getError("kill"); err != nil {
+		return nil, err
+	}
+	t, ok := f.tasks[req.ContainerID]
+	if !ok {
+		return nil, f.notFound(req.ContainerID)
+	}
+	t.Status = task.StatusStopped
+	return &empty.Empty{}, nil
+}
+
+// Exec is a test implementation of tasks.Exec.
+func (f *FakeTaskService) Exec(ctx context.Context, req *tasks.ExecProcessRequest, opts ...grpc.CallOption) (*tasks.ExecProcessResponse, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.appendCalled("exec", req)
+	if err := f.getError("exec"); err != nil {
+		return nil, err
+	}
+	return &tasks.ExecProcessResponse{}, nil
+}
+
+// ResizePty is a test implementation of tasks.ResizePty.
+func (f *FakeTaskService) ResizePty(ctx context.Context, req *tasks.ResizePtyRequest, opts ...grpc.CallOption) (*empty.Empty, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.appendCalled("resizepty", req)
+	if err := f.getError("resizepty"); err != nil {
+		return nil, err
+	}
+	return &empty.Empty{}, nil
+}
+
+// CloseIO is a test implementation of tasks.CloseIO.
+func (f *FakeTaskService) CloseIO(ctx context.Context, req *tasks.CloseIORequest, opts ...grpc.CallOption) (*empty.Empty, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.appendCalled("closeio", req)
+	if err := f.getError("closeio"); err != nil {
+		return nil, err
+	}
+	return &empty.Empty{}, nil
+}
+
+// Pause is a test implementation of tasks.Pause.
+func (f *FakeTaskService) Pause(ctx context.Context, req *tasks.PauseTaskRequest, opts ...grpc.CallOption) (*empty.Empty, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.appendCalled("pause", req)
+	if err := f.getError("pause"); err != nil {
+		return nil, err
+	}
+	t, ok := f.tasks[req.ContainerID]
+	if !ok {
+		return nil, f.notFound(req.ContainerID)
+	}
+	t.Status = task.StatusPaused
+	return &empty.Empty{}, nil
+}
+
+// Resume is a test implementation of tasks.Resume.
+func (f *FakeTaskService) Resume(ctx context.Context, req *tasks.ResumeTaskRequest, opts ...grpc.CallOption) (*empty.Empty, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.appendCalled("resume", req)
+	if err := f.getError("resume"); err != nil {
+		return nil, err
+	}
+	t, ok := f.tasks[req.ContainerID]
+	if !ok {
+		return nil, f.notFound(req.ContainerID)
+	}
+	t.Status = task.StatusRunning
+	return &empty.Empty{}, nil
+}
+
+// ListPids is a test implementation of tasks.ListPids.
+func (f *FakeTaskService) ListPids(ctx context.Context, req *tasks.ListPidsRequest, opts ...grpc.CallOption) (*tasks.ListPidsResponse, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.appendCalled("listpids", req)
+	if err := f.getError("listpids"); err != nil {
+		return nil, err
+	}
+	t, ok := f.tasks[req.ContainerID]
+	if !ok {
+		return nil, f.notFound(req.ContainerID)
+	}
+	return &tasks.ListPidsResponse{Pids: []uint32{t.Pid}}, nil
+}
+
+// Checkpoint is a test implementation of tasks.Checkpoint.
+func (f *FakeTaskService) Checkpoint(ctx context.Context, req *tasks.CheckpointTaskRequest, opts ...grpc.CallOption) (*tasks.CheckpointTaskResponse, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.appendCalled("checkpoint", req)
+	if err := f.getError("checkpoint"); err != nil {
+		return nil, err
+	}
+	return &tasks.CheckpointTaskResponse{}, nil
+}
+
+// Update is a test implementation of tasks.Update.
+func (f *FakeTaskService) Update(ctx context.Context, req *tasks.UpdateTaskRequest, opts ...grpc.CallOption) (*empty.Empty, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.appendCalled("update", req)
+	if err := f.getError("update"); err != nil {
+		return nil, err
+	}
+	return &empty.Empty{}, nil
+}
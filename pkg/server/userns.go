@@ -0,0 +1,223 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/containerd/containerd/mount"
+	runtimespec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/opencontainers/runtime-tools/generate"
+	"golang.org/x/net/context"
+	"golang.org/x/sys/unix"
+
+	"github.com/kubernetes-incubator/cri-containerd/pkg/log"
+)
+
+// remappedSnapshotKeyFormat is the key format of the remapped snapshot of an
+// image, keyed by image chain id and host uid/gid.
+const remappedSnapshotKeyFormat = "%s-userns-%d-%d"
+
+// remapSupportedMountTypes are the mount types whose ownership can be shifted.
+var remapSupportedMountTypes = map[string]bool{
+	"bind":    true,
+	"overlay": true,
+	"btrfs":   true,
+}
+
+// parseIDMapping parses an id mapping in the format of
+// "<container id>:<host id>:<size>".
+func parseIDMapping(s string) (*runtimespec.LinuxIDMapping, error) {
+	fields := strings.Split(s, ":")
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("invalid id mapping %q, expected <container id>:<host id>:<size>", s)
+	}
+	var ids [3]uint32
+	for i, f := range fields {
+		id, err := strconv.ParseUint(f, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid id %q in id mapping %q: %v", f, s, err)
+		}
+		ids[i] = uint32(id)
+	}
+	if ids[2] == 0 {
+		return nil, fmt.Errorf("invalid id mapping %q, size must be positive", s)
+	}
+	if ids[1] < ids[0] {
+		return nil, fmt.Errorf("invalid id mapping %q, host id must not be less than container id", s)
+	}
+	return &runtimespec.LinuxIDMapping{ContainerID: ids[0], HostID: ids[1], Size: ids[2]}, nil
+}
+
+// initUserNamespaceMappings parses the configured uid and gid mappings. Both or
+// neither of them should be configured.
+func (c *criContainerdService) initUserNamespaceMappings(uidMap, gidMap string) error {
+	if uidMap == "" && gidMap == "" {
+		return nil
+	}
+	if uidMap == "" || gidMap == "" {
+		return fmt.Errorf("both uid and gid mappings must be specified to enable user namespace")
+	}
+	var err error
+	if c.uidMapping, err = parseIDMapping(uidMap); err != nil {
+		return fmt.Errorf("failed to parse uid mapping: %v", err)
+	}
+	if c.gidMapping, err = parseIDMapping(gidMap); err != nil {
+		return fmt.Errorf("failed to parse gid mapping: %v", err)
+	}
+	return nil
+}
+
+// userNamespaceEnabled returns whether containers run in remapped user namespace.
+func (c *criContainerdService) userNamespaceEnabled() bool {
+	return c.uidMapping != nil && c.gidMapping != nil
+}
+
+// setOCIUserNamespace sets user namespace with the configured id mappings. An
+// empty path creates a new user namespace.
+func (c *criContainerdService) setOCIUserNamespace(g *generate.Generator, path string) {
+	if !c.userNamespaceEnabled() {
+		return
+	}
+	g.AddOrReplaceLinuxNamespace(string(runtimespec.UserNamespace), path) // nolint: errcheck
+	g.AddLinuxUIDMapping(c.uidMapping.HostID, c.uidMapping.ContainerID, c.uidMapping.Size)
+	g.AddLinuxGIDMapping(c.gidMapping.HostID, c.gidMapping.ContainerID, c.gidMapping.Size)
+}
+
+// getRootfsParent returns the parent snapshot of a container rootfs. When user
+// namespace is enabled, it's a snapshot of the image with ownership shifted
+// by the id mappings, which is created if it doesn't exist yet.
+func (c *criContainerdService) getRootfsParent(ctx context.Context, chainID string) (string, error) {
+	if !c.userNamespaceEnabled() {
+		return chainID, nil
+	}
+	key := fmt.Sprintf(remappedSnapshotKeyFormat, chainID, c.uidMapping.HostID, c.gidMapping.HostID)
+
+	c.remapLock.Lock()
+	defer c.remapLock.Unlock()
+	if _, err := c.snapshotService.Stat(ctx, key); err == nil {
+		return key, nil
+	}
+	activeKey := key + "-remap"
+	mounts, err := c.snapshotService.Prepare(ctx, activeKey, chainID)
+	if err != nil {
+		return "", fmt.Errorf("failed to prepare remapped snapshot %q: %v", activeKey, err)
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			if err := c.snapshotService.Remove(ctx, activeKey); err != nil {
+				log.G(ctx).Errorf("Failed to remove remapped snapshot %q: %v", activeKey, err)
+			}
+		}
+	}()
+	if err := c.remapRootfs(ctx, mounts); err != nil {
+		return "", fmt.Errorf("failed to shift ownership of snapshot %q: %v", activeKey, err)
+	}
+	if err := c.snapshotService.Commit(ctx, key, activeKey); err != nil {
+		return "", fmt.Errorf("failed to commit remapped snapshot %q: %v", key, err)
+	}
+	committed = true
+	return key, nil
+}
+
+// remapRootfs mounts the rootfs and shifts the ownership of all files in it
+// by the id mappings.
+func (c *criContainerdService) remapRootfs(ctx context.Context, mounts []mount.Mount) (retErr error) {
+	for _, m := range mounts {
+		if !remapSupportedMountTypes[m.Type] {
+			return fmt.Errorf("snapshotter does not support id-shifted mounts: unsupported mount type %q", m.Type)
+		}
+	}
+	root, err := ioutil.TempDir("", "cri-containerd-remap")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary mount point: %v", err)
+	}
+	defer func() {
+		// Only remove the mount point if it is empty, in case the unmount failed.
+		if err := os.Remove(root); err != nil {
+			log.G(ctx).Errorf("Failed to remove temporary mount point %q: %v", root, err)
+		}
+	}()
+	if err := c.os.MountAll(mounts, root); err != nil {
+		return fmt.Errorf("failed to mount rootfs: %v", err)
+	}
+	defer func() {
+		if err := c.os.Unmount(root, 0); err != nil {
+			if retErr == nil {
+				retErr = fmt.Errorf("failed to unmount rootfs %q: %v", root, err)
+			} else {
+				log.G(ctx).Errorf("Failed to unmount rootfs %q: %v", root, err)
+			}
+		}
+	}()
+	return shiftOwnership(root, c.uidMapping, c.gidMapping)
+}
+
+// shiftOwnership shifts the ownership of all files under root from container
+// ids to host ids by the id mappings. The setuid and setgid bits cleared by
+// chown are restored. Files owned by ids out of the mappings are rejected,
+// because they can't be mapped into the user namespace.
+func shiftOwnership(root string, uidMapping, gidMapping *runtimespec.LinuxIDMapping) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return fmt.Errorf("failed to get ownership of %q", path)
+		}
+		uid, err := shiftID(stat.Uid, uidMapping)
+		if err != nil {
+			return fmt.Errorf("failed to shift uid of %q: %v", path, err)
+		}
+		gid, err := shiftID(stat.Gid, gidMapping)
+		if err != nil {
+			return fmt.Errorf("failed to shift gid of %q: %v", path, err)
+		}
+		if err := os.Lchown(path, int(uid), int(gid)); err != nil {
+			if perr, ok := err.(*os.PathError); ok && (perr.Err == unix.EPERM || perr.Err == unix.EROFS ||
+				perr.Err == unix.EOPNOTSUPP) {
+				return fmt.Errorf("snapshotter does not support id-shifted mounts: %v", err)
+			}
+			return err
+		}
+		// Chown clears the setuid and setgid bits of non-directories, restore them. Mode
+		// of symlinks can't be changed.
+		if info.Mode()&os.ModeSymlink == 0 && info.Mode()&(os.ModeSetuid|os.ModeSetgid) != 0 {
+			if err := os.Chmod(path, info.Mode()); err != nil {
+				return fmt.Errorf("failed to restore mode of %q: %v", path, err)
+			}
+		}
+		return nil
+	})
+}
+
+// shiftID returns the host id of the container id in the id mapping.
+func shiftID(id uint32, mapping *runtimespec.LinuxIDMapping) (uint32, error) {
+	if id < mapping.ContainerID || id-mapping.ContainerID >= mapping.Size {
+		return 0, fmt.Errorf("id %d is out of the mapping %d:%d:%d", id,
+			mapping.ContainerID, mapping.HostID, mapping.Size)
+	}
+	return id - mapping.ContainerID + mapping.HostID, nil
+}
@@ -0,0 +1,221 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/containerd/containerd/mount"
+	runtimespec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	ostesting "github.com/kubernetes-incubator/cri-containerd/pkg/os/testing"
+)
+
+func TestParseIDMapping(t *testing.T) {
+	for desc, test := range map[string]struct {
+		mapping   string
+		expected  *runtimespec.LinuxIDMapping
+		expectErr bool
+	}{
+		"should parse valid mapping": {
+			mapping:  "0:100000:65536",
+			expected: &runtimespec.LinuxIDMapping{ContainerID: 0, HostID: 100000, Size: 65536},
+		},
+		"should return error for wrong number of fields": {
+			mapping:   "100000:65536",
+			expectErr: true,
+		},
+		"should return error for non-numeric id": {
+			mapping:   "0:invalid:65536",
+			expectErr: true,
+		},
+		"should return error for zero size": {
+			mapping:   "0:100000:0",
+			expectErr: true,
+		},
+		"should return error if host id is less than container id": {
+			mapping:   "1000:0:65536",
+			expectErr: true,
+		},
+	} {
+		mapping, err := parseIDMapping(test.mapping)
+		assert.Equal(t, test.expectErr, err != nil, desc)
+		assert.Equal(t, test.expected, mapping, desc)
+	}
+}
+
+func TestInitUserNamespaceMappings(t *testing.T) {
+	for desc, test := range map[string]struct {
+		uidMap        string
+		gidMap        string
+		expectErr     bool
+		expectEnabled bool
+	}{
+		"should disable user namespace if no mapping is specified": {},
+		"should enable user namespace if both mappings are specified": {
+			uidMap:        "0:100000:65536",
+			gidMap:        "0:200000:65536",
+			expectEnabled: true,
+		},
+		"should return error if only uid mapping is specified": {
+			uidMap:    "0:100000:65536",
+			expectErr: true,
+		},
+		"should return error if gid mapping is invalid": {
+			uidMap:    "0:100000:65536",
+			gidMap:    "invalid",
+			expectErr: true,
+		},
+	} {
+		c := newTestCRIContainerdService()
+		err := c.initUserNamespaceMappings(test.uidMap, test.gidMap)
+		assert.Equal(t, test.expectErr, err != nil, desc)
+		if err == nil {
+			assert.Equal(t, test.expectEnabled, c.userNamespaceEnabled(), desc)
+		}
+	}
+}
+
+func TestUserNamespaceSpec(t *testing.T) {
+	testID := "test-id"
+	testPid := uint32(1234)
+	c := newTestCRIContainerdService()
+	require.NoError(t, c.initUserNamespaceMappings("0:100000:65536", "0:200000:65536"))
+	expectedUIDMappings := []runtimespec.LinuxIDMapping{{ContainerID: 0, HostID: 100000, Size: 65536}}
+	expectedGIDMappings := []runtimespec.LinuxIDMapping{{ContainerID: 0, HostID: 200000, Size: 65536}}
+
+	t.Logf("sandbox should create a new user namespace")
+	config, imageConfig, _ := getRunPodSandboxTestData()
+	spec, err := c.generateSandboxContainerSpec(testID, config, imageConfig, "", "")
+	require.NoError(t, err)
+	assert.Contains(t, spec.Linux.Namespaces, runtimespec.LinuxNamespace{Type: runtimespec.UserNamespace})
+	assert.Equal(t, expectedUIDMappings, spec.Linux.UIDMappings)
+	assert.Equal(t, expectedGIDMappings, spec.Linux.GIDMappings)
+
+	t.Logf("container should join the sandbox user namespace with the same mappings")
+	containerConfig, sandboxConfig, containerImageConfig, _ := getCreateContainerTestData()
+	spec, err = c.generateContainerSpec(testID, testPid, containerConfig, sandboxConfig, containerImageConfig, nil, "", "")
+	require.NoError(t, err)
+	assert.Contains(t, spec.Linux.Namespaces, runtimespec.LinuxNamespace{
+		Type: runtimespec.UserNamespace,
+		Path: getUserNamespace(testPid),
+	})
+	assert.Equal(t, expectedUIDMappings, spec.Linux.UIDMappings)
+	assert.Equal(t, expectedGIDMappings, spec.Linux.GIDMappings)
+}
+
+func TestRemapRootfs(t *testing.T) {
+	c := newTestCRIContainerdService()
+	c.uidMapping = &runtimespec.LinuxIDMapping{ContainerID: 0, HostID: 100000, Size: 65536}
+	c.gidMapping = &runtimespec.LinuxIDMapping{ContainerID: 0, HostID: 100000, Size: 65536}
+	fakeOS := c.os.(*ostesting.FakeOS)
+
+	t.Logf("should return error for unsupported mount type")
+	err := c.remapRootfs(context.Background(), []mount.Mount{{Type: "unsupported", Source: "/test-source"}})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "snapshotter does not support id-shifted mounts")
+
+	t.Logf("should return error and not remove the mount point if failed to unmount")
+	var root string
+	fakeOS.MountAllFn = func(mounts []mount.Mount, target string) error {
+		root = target
+		// Simulate a file in the mounted snapshot.
+		return ioutil.WriteFile(filepath.Join(target, "file"), []byte("content"), 0644)
+	}
+	fakeOS.UnmountFn = func(target string, flags int) error {
+		return errors.New("random error")
+	}
+	err = c.remapRootfs(context.Background(), []mount.Mount{{Type: "bind", Source: "/test-source"}})
+	assert.Error(t, err)
+	require.NotEmpty(t, root)
+	defer os.RemoveAll(root)
+	_, err = os.Stat(filepath.Join(root, "file"))
+	assert.NoError(t, err, "content of the mounted snapshot should not be removed")
+}
+
+func TestShiftID(t *testing.T) {
+	mapping := &runtimespec.LinuxIDMapping{ContainerID: 0, HostID: 100000, Size: 65536}
+	for desc, test := range map[string]struct {
+		id        uint32
+		expected  uint32
+		expectErr bool
+	}{
+		"should shift root": {
+			id:       0,
+			expected: 100000,
+		},
+		"should shift the last id in the mapping": {
+			id:       65535,
+			expected: 165535,
+		},
+		"should return error for id out of the mapping": {
+			id:        65536,
+			expectErr: true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		id, err := shiftID(test.id, mapping)
+		assert.Equal(t, test.expectErr, err != nil)
+		assert.Equal(t, test.expected, id)
+	}
+}
+
+func TestShiftOwnership(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Skipping test that requires root")
+	}
+	mapping := &runtimespec.LinuxIDMapping{ContainerID: 0, HostID: 100000, Size: 65536}
+	root, err := ioutil.TempDir("", "shift-ownership-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+	setuidFile := filepath.Join(root, "setuid")
+	require.NoError(t, ioutil.WriteFile(setuidFile, []byte{}, 0755))
+	require.NoError(t, os.Chmod(setuidFile, 0755|os.ModeSetuid|os.ModeSetgid))
+	userFile := filepath.Join(root, "user")
+	require.NoError(t, ioutil.WriteFile(userFile, []byte{}, 0644))
+	require.NoError(t, os.Lchown(userFile, 1000, 1000))
+	require.NoError(t, os.Symlink("user", filepath.Join(root, "symlink")))
+
+	require.NoError(t, shiftOwnership(root, mapping, mapping))
+	for path, expected := range map[string]uint32{
+		root:                           100000,
+		setuidFile:                     100000,
+		userFile:                       101000,
+		filepath.Join(root, "symlink"): 100000,
+	} {
+		info, err := os.Lstat(path)
+		require.NoError(t, err)
+		stat := info.Sys().(*syscall.Stat_t)
+		assert.Equal(t, expected, stat.Uid, "uid of %q", path)
+		assert.Equal(t, expected, stat.Gid, "gid of %q", path)
+	}
+	info, err := os.Stat(setuidFile)
+	require.NoError(t, err)
+	assert.Equal(t, 0755|os.ModeSetuid|os.ModeSetgid, info.Mode(), "setuid and setgid bits should be kept")
+
+	t.Logf("should return error for files owned by ids out of the mapping")
+	require.NoError(t, os.Lchown(userFile, 70000, 0))
+	assert.Error(t, shiftOwnership(root, mapping, mapping))
+}
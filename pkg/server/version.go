@@ -23,26 +23,29 @@ import (
 	"golang.org/x/net/context"
 
 	"k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+
+	"github.com/kubernetes-incubator/cri-containerd/pkg/version"
 )
 
 const (
-	containerName        = "containerd"
-	containerdAPIVersion = "0.0.0"
-	// kubeAPIVersion is the api version of kubernetes.
+	// runtimeName is the name of the runtime reported to kubelet.
+	runtimeName = "cri-containerd"
+	// kubeAPIVersion is the version of the kubelet runtime api.
 	kubeAPIVersion = "0.1.0"
 )
 
-// Version returns the runtime name, runtime version and runtime API version.
+// Version returns the kubelet runtime api version, the runtime name and version,
+// and the version of the containerd daemon the runtime talks to, which is the
+// api cri-containerd drives containers with.
 func (c *criContainerdService) Version(ctx context.Context, r *runtime.VersionRequest) (*runtime.VersionResponse, error) {
 	resp, err := c.versionService.Version(ctx, &empty.Empty{})
 	if err != nil {
 		return nil, fmt.Errorf("failed to get containerd version: %v", err)
 	}
 	return &runtime.VersionResponse{
-		Version:        kubeAPIVersion,
-		RuntimeName:    containerName,
-		RuntimeVersion: resp.Version,
-		// Containerd doesn't have an api version now.
-		RuntimeApiVersion: containerdAPIVersion,
+		Version:           kubeAPIVersion,
+		RuntimeName:       runtimeName,
+		RuntimeVersion:    version.CRIContainerdVersion(),
+		RuntimeApiVersion: resp.Version,
 	}, nil
 }
@@ -28,6 +28,7 @@ import (
 	"k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
 
 	servertesting "github.com/kubernetes-incubator/cri-containerd/pkg/server/testing"
+	"github.com/kubernetes-incubator/cri-containerd/pkg/version"
 )
 
 func TestVersion(t *testing.T) {
@@ -58,7 +59,10 @@ func TestVersion(t *testing.T) {
 		if test.expectErr {
 			assert.Equal(t, test.expectErr, err != nil)
 		} else {
-			assert.Equal(t, test.versionRes.Version, v.RuntimeVersion)
+			assert.Equal(t, kubeAPIVersion, v.Version)
+			assert.Equal(t, runtimeName, v.RuntimeName)
+			assert.Equal(t, version.CRIContainerdVersion(), v.RuntimeVersion)
+			assert.Equal(t, test.versionRes.Version, v.RuntimeApiVersion)
 		}
 	}
 }
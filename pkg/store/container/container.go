@@ -19,6 +19,7 @@ package container
 import (
 	"sync"
 
+	cio "github.com/kubernetes-incubator/cri-containerd/pkg/server/io"
 	"github.com/kubernetes-incubator/cri-containerd/pkg/store"
 )
 
@@ -29,20 +30,44 @@ type Container struct {
 	Metadata
 	// Status stores the status of the container.
 	Status StatusStorage
+	// IO stores the stdio of the container, it's nil if not available.
+	IO *cio.ContainerIO
 	// TODO(random-liu): Add containerd container client.
-	// TODO(random-liu): Add stop channel to get rid of stop poll waiting.
+
+	// statusRoot is the directory to checkpoint the status into.
+	statusRoot string
+}
+
+// Opts sets specific information to newly created Container.
+type Opts func(*Container)
+
+// WithContainerIO adds IO into the container.
+func WithContainerIO(io *cio.ContainerIO) Opts {
+	return func(c *Container) {
+		c.IO = io
+	}
+}
+
+// WithStatusCheckpoint checkpoints the container status under the root
+// directory, so that the status survives a restart.
+func WithStatusCheckpoint(root string) Opts {
+	return func(c *Container) {
+		c.statusRoot = root
+	}
 }
 
 // NewContainer creates an internally used container type.
-func NewContainer(metadata Metadata, status Status) (Container, error) {
-	s, err := StoreStatus(metadata.ID, status)
+func NewContainer(metadata Metadata, status Status, opts ...Opts) (Container, error) {
+	c := Container{Metadata: metadata}
+	for _, o := range opts {
+		o(&c)
+	}
+	s, err := StoreStatus(c.statusRoot, metadata.ID, status)
 	if err != nil {
 		return Container{}, err
 	}
-	return Container{
-		Metadata: metadata,
-		Status:   s,
-	}, nil
+	c.Status = s
+	return c, nil
 }
 
 // Delete deletes checkpoint for the container.
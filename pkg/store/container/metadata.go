@@ -50,6 +50,15 @@ type Metadata struct {
 	Config *runtime.ContainerConfig
 	// ImageRef is the reference of image used by the container.
 	ImageRef string
+	// RestartCount is the number of times the container with the same name
+	// has been recreated in the sandbox.
+	RestartCount uint32
+	// StopSignal is the signal to stop the container gracefully, it is from
+	// the image config. SIGTERM is used if it's empty.
+	StopSignal string
+	// LogPath is the container log path on the host. It is empty if the
+	// container log path is not specified.
+	LogPath string
 }
 
 // Encode encodes Metadata into bytes in json format.
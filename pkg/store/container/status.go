@@ -17,16 +17,22 @@ limitations under the License.
 package container
 
 import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"sync"
 
 	"k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
 )
 
-// TODO(random-liu): Handle versioning.
-// TODO(random-liu): Add checkpoint support.
-
-// version is current version of container status.
-const version = "v1" // nolint
+const (
+	// version is current version of container status.
+	version = "v1" // nolint
+	// statusFile is the name of the container status checkpoint file.
+	statusFile = "status"
+)
 
 // versionedStatus is the internal used versioned container status.
 // nolint
@@ -56,7 +62,7 @@ type Status struct {
 	// Removing indicates that the container is in removing state.
 	// This field doesn't need to be checkpointed.
 	// TODO(random-liu): Reset this field to false during state recoverry.
-	Removing bool
+	Removing bool `json:"-"`
 }
 
 // State returns current state of the container based on the container status.
@@ -73,6 +79,29 @@ func (c Status) State() runtime.ContainerState {
 	return runtime.ContainerState_CONTAINER_UNKNOWN
 }
 
+// Encode encodes Status into bytes in json format.
+func (c *Status) Encode() ([]byte, error) {
+	return json.Marshal(&versionedStatus{
+		Version: version,
+		Status:  *c,
+	})
+}
+
+// Decode decodes Status from bytes.
+func (c *Status) Decode(data []byte) error {
+	versioned := &versionedStatus{}
+	if err := json.Unmarshal(data, versioned); err != nil {
+		return err
+	}
+	// Handle old version after upgrade.
+	switch versioned.Version {
+	case version:
+		*c = versioned.Status
+		return nil
+	}
+	return fmt.Errorf("unsupported version")
+}
+
 // UpdateFunc is function used to update the container status. If there
 // is an error, the update will be rolled back.
 type UpdateFunc func(Status) (Status, error)
@@ -92,27 +121,93 @@ type StatusStorage interface {
 	// * Delete should be idempotent.
 	// * The status must be deleted in one trasaction.
 	Delete() error
+	// Stopped returns a channel which is closed when the container is
+	// stopped, i.e. the container is in exited state.
+	Stopped() <-chan struct{}
 }
 
-// TODO(random-liu): Add factory function and configure checkpoint path.
-
 // StoreStatus creates the storage containing the passed in container status with the
-// specified id.
+// specified id. The status is checkpointed under the root directory, or only kept in
+// memory if the root directory is empty.
 // The status MUST be created in one transaction.
-func StoreStatus(id string, status Status) (StatusStorage, error) {
-	return &statusStorage{status: status}, nil
-	// TODO(random-liu): Create the data on disk atomically.
+func StoreStatus(root, id string, status Status) (StatusStorage, error) {
+	s := newStatusStorage("", status)
+	if root == "" {
+		return s, nil
+	}
+	s.path = filepath.Join(root, statusFile)
+	if err := s.checkpoint(status); err != nil {
+		return nil, fmt.Errorf("failed to checkpoint status of container %q: %v", id, err)
+	}
+	return s, nil
 }
 
-// LoadStatus loads container status from checkpoint.
-func LoadStatus(id string) (StatusStorage, error) {
-	// TODO(random-liu): Load container status from disk.
-	return nil, nil
+// LoadStatus loads container status from checkpoint under the root directory.
+// Temporary files left by an interrupted checkpoint are removed.
+func LoadStatus(root, id string) (StatusStorage, error) {
+	path := filepath.Join(root, statusFile)
+	tmps, err := filepath.Glob(filepath.Join(root, "."+statusFile+"*"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to find temporary status files of container %q: %v", id, err)
+	}
+	for _, tmp := range tmps {
+		if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to remove temporary status file %q: %v", tmp, err)
+		}
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read status checkpoint of container %q: %v", id, err)
+	}
+	var status Status
+	if err := status.Decode(data); err != nil {
+		return nil, fmt.Errorf("failed to decode status checkpoint of container %q: %v", id, err)
+	}
+	return newStatusStorage(path, status), nil
 }
 
 type statusStorage struct {
 	sync.RWMutex
+	// path is the path of the status checkpoint file, it is empty if the
+	// status is not checkpointed.
+	path   string
 	status Status
+	// stopCh is closed when the container is stopped.
+	stopCh  chan struct{}
+	stopped bool
+}
+
+// newStatusStorage creates a status storage with the status.
+func newStatusStorage(path string, status Status) *statusStorage {
+	s := &statusStorage{
+		path:   path,
+		status: status,
+		stopCh: make(chan struct{}),
+	}
+	s.notifyStopped()
+	return s
+}
+
+// notifyStopped closes the stop channel if the container is stopped. Must be
+// called with the lock held or before the storage is shared.
+func (m *statusStorage) notifyStopped() {
+	if m.stopped || m.status.State() != runtime.ContainerState_CONTAINER_EXITED {
+		return
+	}
+	close(m.stopCh)
+	m.stopped = true
+}
+
+// checkpoint writes the status into the checkpoint file atomically.
+func (m *statusStorage) checkpoint(status Status) error {
+	if m.path == "" {
+		return nil
+	}
+	data, err := status.Encode()
+	if err != nil {
+		return fmt.Errorf("failed to encode status: %v", err)
+	}
+	return atomicWriteFile(m.path, data, 0600)
 }
 
 // Get a copy of container status.
@@ -130,17 +225,64 @@ func (m *statusStorage) Update(u UpdateFunc) error {
 	if err != nil {
 		return err
 	}
-	// TODO(random-liu) *Update* existing status on disk atomically,
-	// return error if checkpoint failed.
+	if err := m.checkpoint(newStatus); err != nil {
+		return fmt.Errorf("failed to checkpoint status: %v", err)
+	}
 	m.status = newStatus
+	m.notifyStopped()
 	return nil
 }
 
+// Stopped returns a channel which is closed when the container is stopped.
+func (m *statusStorage) Stopped() <-chan struct{} {
+	return m.stopCh
+}
+
 // Delete deletes the container status from disk atomically.
+// No lock is needed because file removal is atomic.
 func (m *statusStorage) Delete() error {
-	// TODO(random-liu): Rename the data on the disk, returns error
-	// if fails. No lock is needed because file rename is atomic.
-	// TODO(random-liu): Cleanup temporary files generated, do not
-	// return error.
+	if m.path == "" {
+		return nil
+	}
+	if err := os.Remove(m.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
 	return nil
 }
+
+// atomicWriteFile writes data into a temporary file in the same directory, and
+// renames it to the target path, so that the file is either fully written or
+// not changed.
+func atomicWriteFile(path string, data []byte, perm os.FileMode) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp) // nolint: errcheck
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	// Sync the directory to make sure the rename is durable.
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
@@ -18,10 +18,14 @@ package container
 
 import (
 	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
 	assertlib "github.com/stretchr/testify/assert"
+	requirelib "github.com/stretchr/testify/require"
 	"k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
 )
 
@@ -73,7 +77,7 @@ func TestStatus(t *testing.T) {
 	assert := assertlib.New(t)
 
 	t.Logf("simple store and get")
-	s, err := StoreStatus(testID, testStatus)
+	s, err := StoreStatus("", testID, testStatus)
 	assert.NoError(err)
 	old := s.Get()
 	assert.Equal(testStatus, old)
@@ -96,6 +100,120 @@ func TestStatus(t *testing.T) {
 
 	t.Logf("successful update should not affect existing snapshot")
 	assert.Equal(testStatus, old)
+}
+
+func TestStatusStopped(t *testing.T) {
+	assert := assertlib.New(t)
+	isStopped := func(s StatusStorage) bool {
+		select {
+		case <-s.Stopped():
+			return true
+		default:
+			return false
+		}
+	}
+
+	t.Logf("stopped channel should be closed for exited container")
+	s, err := StoreStatus("", "test-id", Status{
+		CreatedAt:  time.Now().UnixNano(),
+		StartedAt:  time.Now().UnixNano(),
+		FinishedAt: time.Now().UnixNano(),
+	})
+	assert.NoError(err)
+	assert.True(isStopped(s))
+
+	t.Logf("stopped channel should not be closed for running container")
+	s, err = StoreStatus("", "test-id", Status{
+		CreatedAt: time.Now().UnixNano(),
+		StartedAt: time.Now().UnixNano(),
+	})
+	assert.NoError(err)
+	assert.False(isStopped(s))
+
+	t.Logf("stopped channel should be closed after container exits")
+	update := func(o Status) (Status, error) {
+		o.FinishedAt = time.Now().UnixNano()
+		return o, nil
+	}
+	assert.NoError(s.Update(update))
+	assert.True(isStopped(s))
+
+	t.Logf("update after container exits should not close the channel again")
+	assert.NoError(s.Update(update))
+	assert.True(isStopped(s))
+}
+
+func TestStatusCheckpoint(t *testing.T) {
+	testID := "test-id"
+	testStatus := Status{
+		CreatedAt: time.Now().UnixNano(),
+	}
+	updateStatus := Status{
+		CreatedAt:  time.Now().UnixNano(),
+		StartedAt:  time.Now().UnixNano(),
+		FinishedAt: time.Now().UnixNano(),
+		ExitCode:   137,
+		Reason:     "OOMKilled",
+	}
+	updateErr := errors.New("update error")
+	assert := assertlib.New(t)
+	require := requirelib.New(t)
+	tempDir, err := ioutil.TempDir(os.TempDir(), "status-checkpoint")
+	require.NoError(err)
+	defer os.RemoveAll(tempDir)
+	statusFile := filepath.Join(tempDir, "status")
+
+	t.Logf("store should checkpoint status")
+	s, err := StoreStatus(tempDir, testID, testStatus)
+	require.NoError(err)
+	loaded, err := LoadStatus(tempDir, testID)
+	require.NoError(err)
+	assert.Equal(testStatus, loaded.Get())
+
+	t.Logf("load should remove temporary files of interrupted checkpoint")
+	tmpFile := filepath.Join(tempDir, ".status123")
+	require.NoError(ioutil.WriteFile(tmpFile, []byte("corrupted"), 0600))
+	loaded, err = LoadStatus(tempDir, testID)
+	require.NoError(err)
+	assert.Equal(testStatus, loaded.Get())
+	_, err = os.Stat(tmpFile)
+	assert.True(os.IsNotExist(err))
+
+	t.Logf("failed update should not be checkpointed")
+	err = s.Update(func(o Status) (Status, error) {
+		return updateStatus, updateErr
+	})
+	assert.Equal(updateErr, err)
+	loaded, err = LoadStatus(tempDir, testID)
+	require.NoError(err)
+	assert.Equal(testStatus, loaded.Get())
+
+	t.Logf("successful update should be checkpointed")
+	err = s.Update(func(o Status) (Status, error) {
+		return updateStatus, nil
+	})
+	assert.NoError(err)
+	loaded, err = LoadStatus(tempDir, testID)
+	require.NoError(err)
+	assert.Equal(updateStatus, loaded.Get())
+
+	t.Logf("removing state should not be checkpointed")
+	err = s.Update(func(o Status) (Status, error) {
+		o.Removing = true
+		return o, nil
+	})
+	assert.NoError(err)
+	loaded, err = LoadStatus(tempDir, testID)
+	require.NoError(err)
+	assert.False(loaded.Get().Removing)
+
+	t.Logf("delete should remove the checkpoint")
+	assert.NoError(s.Delete())
+	_, err = os.Stat(statusFile)
+	assert.True(os.IsNotExist(err))
+	_, err = LoadStatus(tempDir, testID)
+	assert.Error(err)
 
-	// TODO(random-liu): Test Load and Delete after disc checkpoint is added.
+	t.Logf("delete should be idempotent")
+	assert.NoError(s.Delete())
 }
@@ -37,7 +37,10 @@ type Image struct {
 	ChainID string
 	// Size is the compressed size of the image.
 	Size int64
-	// Config is the oci image config of the image.
+	// Config is the oci image config of the image. It's decoded from the config
+	// blob once when the image is pulled or loaded on restart, and dropped with
+	// the image when the image is removed. It's shared by all containers created
+	// from the image, so it MUST not be mutated.
 	Config *imagespec.ImageConfig
 	// TODO(random-liu): Add containerd image client.
 }
@@ -103,6 +106,33 @@ func (s *Store) Delete(id string) {
 	delete(s.images, id)
 }
 
+// DeleteReference deletes a repo tag or repo digest of the image with specified id,
+// and returns the updated image. Returns store.ErrNotExist if the image doesn't exist.
+func (s *Store) DeleteReference(id, ref string) (Image, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	i, ok := s.images[id]
+	if !ok {
+		return Image{}, store.ErrNotExist
+	}
+	// Create new slices, because the image could be shared by callers of Get.
+	i.RepoTags = removeString(i.RepoTags, ref)
+	i.RepoDigests = removeString(i.RepoDigests, ref)
+	s.images[id] = i
+	return i, nil
+}
+
+// removeString returns a new string slice without the element.
+func removeString(ss []string, e string) []string {
+	var res []string
+	for _, s := range ss {
+		if s != e {
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
 // mergeStringSlices merges 2 string slices into one and remove duplicated elements.
 func mergeStringSlices(a []string, b []string) []string {
 	set := map[string]struct{}{}
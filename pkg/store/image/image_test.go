@@ -94,6 +94,23 @@ func TestImageStore(t *testing.T) {
 	assert.Len(got.RepoDigests, 2)
 	assert.Contains(got.RepoDigests, "digest-2", "digest-new")
 
+	t.Logf("should be able to delete repo tag/digest")
+	got, err = s.DeleteReference(testID, "tag-new")
+	assert.NoError(err)
+	assert.Equal([]string{"tag-2"}, got.RepoTags)
+	assert.Len(got.RepoDigests, 2)
+	got, err = s.DeleteReference(testID, "digest-2")
+	assert.NoError(err)
+	assert.Equal([]string{"tag-2"}, got.RepoTags)
+	assert.Equal([]string{"digest-new"}, got.RepoDigests)
+	stored, err := s.Get(testID)
+	assert.NoError(err)
+	assert.Equal(got, stored)
+
+	t.Logf("should not be able to delete repo tag/digest of non-exist image")
+	_, err = s.DeleteReference("non-exist", "tag-2")
+	assert.Equal(store.ErrNotExist, err)
+
 	t.Logf("should be able to delete image")
 	s.Delete(testID)
 	imgs = s.List()
@@ -53,6 +53,23 @@ type Metadata struct {
 	Pid uint32
 	// NetNS is the network namespace used by the sandbox.
 	NetNS string
+	// NetworkConfigured indicates whether the network of the sandbox is set up
+	// by the network plugin.
+	NetworkConfigured bool
+	// IP is the primary ip address of the sandbox. It is the address of the
+	// configured primary ip family when the sandbox has one.
+	IP string
+	// AdditionalIPs are the other ip addresses of the sandbox, e.g. the ipv6
+	// addresses of a dual-stack sandbox.
+	AdditionalIPs []string
+	// ProcessLabel is the selinux process label of the sandbox, which is shared
+	// by all containers in the sandbox.
+	ProcessLabel string
+	// MountLabel is the selinux mount label of the sandbox.
+	MountLabel string
+	// RuntimeHandler is the runtime handler the sandbox runs with. All
+	// containers in the sandbox use the same runtime handler.
+	RuntimeHandler string
 }
 
 // Encode encodes Metadata into bytes in json format.
@@ -22,8 +22,15 @@ import (
 	"github.com/blang/semver"
 )
 
+// criContainerdVersion is the release version of cri-containerd, which is
+// injected at build time with ldflags.
 var criContainerdVersion = "UNKNOWN"
 
+// CRIContainerdVersion returns the release version of cri-containerd.
+func CRIContainerdVersion() string {
+	return criContainerdVersion
+}
+
 func validateSemver(sv string) error {
 	_, err := semver.Parse(sv)
 	if err != nil {